@@ -6,5 +6,5 @@ import (
 
 func main() {
 	proxy := mixed.NewProxy()
-	_ = proxy.ListenAndServe()
+	_ = proxy.RunUntilSignal()
 }
@@ -41,7 +41,7 @@ func main() {
 	fmt.Printf("Bind address: %s:%d\n", bindIP, bindPort)
 
 	// Create UDP connection
-	udpConn, err := net.Dial("udp", fmt.Sprintf("%s:%d", bindIP, bindPort))
+	udpConn, err := net.Dial("udp", net.JoinHostPort(bindIP.String(), strconv.Itoa(int(bindPort))))
 	if err != nil {
 		panic(err)
 	}
@@ -1,3 +1,7 @@
 module github.com/bepass-org/proxy
 
 go 1.21.1
+
+require golang.org/x/net v0.35.0
+
+require golang.org/x/text v0.22.0 // indirect
@@ -0,0 +1,214 @@
+package http
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardHTTP writes req to target, reads the response and relays it to conn.
+// The response is sent with Connection: close, since the client connection is
+// not kept alive after it. It returns the response status and the number of
+// body bytes relayed.
+func (s *Server) forwardHTTP(conn net.Conn, target net.Conn, req *http.Request) (int, int64, error) {
+	if err := req.Write(target); err != nil {
+		return http.StatusBadGateway, -1, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(target), req)
+	if err != nil {
+		return http.StatusBadGateway, -1, err
+	}
+	defer resp.Body.Close()
+
+	size, _, err := s.relayResponse(conn, req, resp, false)
+	return resp.StatusCode, size, err
+}
+
+// relayResponse writes resp to conn, applying the response transformations
+// configured on the server. keepAlive tells the client whether the connection
+// stays open. It returns the number of body bytes relayed and whether the
+// client connection must be closed to delimit the response.
+func (s *Server) relayResponse(conn net.Conn, req *http.Request, resp *http.Response, keepAlive bool) (int64, bool, error) {
+	if s.ResponseCompression && shouldCompress(req, resp) {
+		gzipResponse(resp)
+		defer resp.Body.Close()
+	}
+
+	removeHopHeaders(resp.Header)
+	s.injectResponseHeaders(resp.Header)
+
+	// a body without length or chunked framing is delimited by closing the connection
+	mustClose := !keepAlive ||
+		(resp.ContentLength < 0 && !isChunked(resp.TransferEncoding) && bodyAllowed(req, resp))
+
+	body := &countingBody{ReadCloser: resp.Body}
+	resp.Body = body
+	resp.Close = mustClose
+	err := resp.Write(conn)
+	return body.n, mustClose, err
+}
+
+// injectResponseHeaders sets ResponseHeaders on header, replacing the values
+// of the same names.
+func (s *Server) injectResponseHeaders(header http.Header) {
+	for name, values := range s.ResponseHeaders {
+		header.Del(name)
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
+
+// hopHeaders are the hop-by-hop headers that apply to a single connection and
+// must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers, including those listed in Connection.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// acceptsTrailers reports whether the TE header of a request accepts
+// trailers in the response.
+func acceptsTrailers(header http.Header) bool {
+	for _, value := range header.Values("TE") {
+		for _, token := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(token, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientKeepAlive reports whether the client connection stays open after
+// req. Proxy-Connection, which older clients send to proxies instead of
+// Connection, is honored the same way; close in either header wins.
+func clientKeepAlive(req *http.Request) bool {
+	keepAlive := !req.Close
+	for _, name := range []string{"Connection", "Proxy-Connection"} {
+		for _, value := range req.Header.Values(name) {
+			for _, token := range strings.Split(value, ",") {
+				switch strings.ToLower(strings.TrimSpace(token)) {
+				case "close":
+					return false
+				case "keep-alive":
+					keepAlive = true
+				}
+			}
+		}
+	}
+	return keepAlive
+}
+
+// countingBody counts the bytes read from a response body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read reads from the body and counts the bytes read.
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// isChunked reports whether the transfer encodings end with chunked.
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[len(te)-1] == "chunked"
+}
+
+// bodyAllowed reports whether resp may carry a body.
+func bodyAllowed(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+	status := resp.StatusCode
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// shouldCompress reports whether resp is an uncompressed, compressible
+// response to a client that accepts gzip.
+func shouldCompress(req *http.Request, resp *http.Response) bool {
+	if !bodyAllowed(req, resp) || !acceptsGzip(req.Header) {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.ContentLength == 0 {
+		return false
+	}
+	return isCompressible(resp.Header.Get("Content-Type"))
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(header http.Header) bool {
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// isCompressible reports whether a body of the given content type is worth compressing.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// gzipResponse replaces the body of resp with its gzip-compressed form.
+func gzipResponse(resp *http.Response) {
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, body)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+}
@@ -0,0 +1,368 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+	"golang.org/x/net/http2"
+)
+
+// h2cPreface is the HTTP/2 client connection preface.
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// IsH2CPreface reports whether the buffered data in r starts with the HTTP/2
+// connection preface. It only peeks as far as the data keeps matching, so it
+// doesn't block on short HTTP/1 requests.
+func IsH2CPreface(r *bufio.Reader) bool {
+	for i := 1; i <= len(h2cPreface); i++ {
+		b, err := r.Peek(i)
+		if err != nil || b[i-1] != h2cPreface[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrH2CDisabled is returned when a client sends the HTTP/2 connection
+// preface to a server that doesn't have H2C enabled.
+var ErrH2CDisabled = errors.New("http/2 connection preface received but h2c is disabled")
+
+// h2cRefusal is an empty SETTINGS frame followed by a GOAWAY frame carrying
+// HTTP_1_1_REQUIRED, telling the client to retry over HTTP/1.1.
+var h2cRefusal = []byte{
+	0, 0, 0, 0x4, 0, 0, 0, 0, 0,
+	0, 0, 8, 0x7, 0, 0, 0, 0, 0,
+	0, 0, 0, 0,
+	0, 0, 0, 0xd,
+}
+
+// rejectH2C refuses an h2c connection with a GOAWAY and closes it.
+func rejectH2C(conn net.Conn) error {
+	_, _ = conn.Write(h2cRefusal)
+	_ = conn.Close()
+	return ErrH2CDisabled
+}
+
+// ServeH2CConn handles an incoming connection starting with the HTTP/2
+// connection preface like ServeConn does, refusing it unless H2C is set.
+func (s *Server) ServeH2CConn(conn net.Conn) error {
+	stop := statute.LimitLifetime(conn, s.MaxConnLifetime)
+	defer stop()
+
+	if s.ConnLog == nil && s.Stats == nil && s.Events == nil {
+		return s.serveH2CConn(conn, nil)
+	}
+
+	tracker := s.Stats.Track(conn, statute.ProtocolH2C)
+	tracker.Notify(s.Events)
+	tracker.ReverseLookup(s.ReverseDNS)
+	err := s.serveH2CConn(tracker.Conn(), tracker)
+	tracker.Done(err, s.ConnLog)
+	return err
+}
+
+// serveH2CConn serves an h2c connection, recording its streams in tracker,
+// or refuses it if H2C isn't set.
+func (s *Server) serveH2CConn(conn net.Conn, tracker *statute.ConnTracker) error {
+	if !s.H2C {
+		return rejectH2C(conn)
+	}
+	// streams are multiplexed over the connection once it's h2c
+	statute.EndHandshake(conn)
+	return s.serveH2C(conn, tracker)
+}
+
+// ServeH2C serves a prior-knowledge HTTP/2 (h2c) connection. CONNECT streams
+// are tunneled to their authority and other requests are forwarded.
+func (s *Server) ServeH2C(conn net.Conn) error {
+	return s.serveH2C(conn, nil)
+}
+
+// serveH2C serves an h2c connection until it's closed or the server's
+// context ends, recording the destination of its streams in tracker.
+func (s *Server) serveH2C(conn net.Conn, tracker *statute.ConnTracker) error {
+	// ServeConn doesn't watch its context, so the connection is closed for it
+	stop := context.AfterFunc(s.Context, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	srv := &http2.Server{}
+	srv.ServeConn(conn, &http2.ServeConnOpts{
+		Context: s.Context,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.handleH2CRequest(w, req, tracker)
+		}),
+	})
+	return nil
+}
+
+// handleH2CRequest handles a single HTTP/2 stream, recording its destination in tracker.
+func (s *Server) handleH2CRequest(w http.ResponseWriter, req *http.Request, tracker *statute.ConnTracker) {
+	if s.CLFLog != nil {
+		start := time.Now()
+		lw := &loggedResponseWriter{ResponseWriter: w}
+		w = lw
+		defer func() {
+			s.logCLF(req.RemoteAddr, req, start, lw.statusCode(), lw.size)
+		}()
+	}
+
+	if req.URL.Host == "" {
+		req.URL.Host = req.Host
+	}
+	isConnectMethod := req.Method == http.MethodConnect
+	if s.draining.Load() {
+		w.Header().Set("Retry-After", drainRetryAfter)
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.matchHost(req, req.Header.Get("Host"), isConnectMethod); err != nil {
+		http.Error(w, "Host header does not match the request target", http.StatusBadRequest)
+		s.Logger.Debug(err)
+		return
+	}
+	if !s.methodAllowed(req.Method, isConnectMethod) {
+		w.Header().Set("Allow", strings.Join(s.AllowedMethods, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := s.applyInterceptors(nil, req, isConnectMethod)
+	if err == nil {
+		err = s.checkConnectPort(req, isConnectMethod)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		s.Logger.Error(err)
+		return
+	}
+	tracker.SetDestination(s.targetAddress(req, isConnectMethod))
+	tracker.SetUserHandler(s.UserConnectHandle != nil)
+
+	if !isConnectMethod {
+		s.forwardH2CRequest(w, req)
+		return
+	}
+
+	stream := newH2Stream(w, req)
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.UserConnectHandle != nil {
+		w.WriteHeader(http.StatusOK)
+		_ = http.NewResponseController(w).Flush()
+
+		port, err := net.LookupPort("tcp", portStr)
+		if err != nil {
+			s.Logger.Error(err)
+			return
+		}
+		proxyReq := &statute.ProxyRequest{
+			Conn:        stream,
+			Reader:      io.Reader(stream),
+			Writer:      io.Writer(stream),
+			Network:     "tcp",
+			Destination: req.Host,
+			DestHost:    host,
+			DestPort:    int32(port),
+			Protocol:    statute.ProtocolHTTPConnect,
+			HTTPRequest: req,
+		}
+		cancel := statute.WatchTeardown(req.Context(), proxyReq)
+		defer cancel()
+		if err := statute.WrapHandlerError(s.UserConnectHandle(proxyReq)); err != nil {
+			statute.LogConnError(s.Logger, err, s.HandlerErrorFilter)
+		}
+		return
+	}
+
+	target, err := s.dialTarget(tracker, req, req.Host)
+	if err != nil {
+		http.Error(w, err.Error(), dialErrorStatus(err))
+		s.Logger.Error(err)
+		return
+	}
+	defer target.Close()
+
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		s.Logger.Error(err)
+		return
+	}
+
+	if _, err := s.tunnel(stream, target, req.Host, true); err != nil {
+		s.Logger.Error(err)
+	}
+}
+
+// forwardH2CRequest forwards a non-CONNECT HTTP/2 request to its origin.
+func (s *Server) forwardH2CRequest(w http.ResponseWriter, req *http.Request) {
+	// the transport dials within the context of the request
+	outReq := req.Clone(statute.ContextWithHTTPHeaders(req.Context(), req.Header))
+	outReq.RequestURI = ""
+	if outReq.URL.Host == "" {
+		outReq.URL.Host = req.Host
+	}
+	if outReq.URL.Scheme == "" {
+		outReq.URL.Scheme = "http"
+	}
+	removeHopHeaders(outReq.Header)
+	if acceptsTrailers(req.Header) {
+		outReq.Header.Set("TE", "trailers")
+	}
+
+	resp, err := s.forwardTransport().RoundTrip(outReq)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, statute.ErrBlockedDestination) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		s.Logger.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if s.ResponseCompression && shouldCompress(req, resp) {
+		gzipResponse(resp)
+		defer resp.Body.Close()
+	}
+	removeHopHeaders(resp.Header)
+	s.injectResponseHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		s.Logger.Error(err)
+	}
+}
+
+// forwardTransport returns the transport HTTP/2 requests are forwarded with.
+// Its connections are only reused when the upstream pool is on and the dial
+// doesn't route on the request headers, as on the HTTP/1 path.
+func (s *Server) forwardTransport() *http.Transport {
+	s.h2cTransportOnce.Do(func() {
+		s.h2cTransport = &http.Transport{
+			DialContext:        s.proxyDial(),
+			DisableCompression: true,
+			DisableKeepAlives:  s.upstreamPool == nil || s.UpstreamPoolKey != nil,
+		}
+		if s.upstreamPool != nil {
+			s.h2cTransport.MaxIdleConnsPerHost = s.upstreamPool.maxIdlePerHost
+			s.h2cTransport.IdleConnTimeout = s.upstreamPool.idleTimeout
+		}
+	})
+	return s.h2cTransport
+}
+
+// loggedResponseWriter records the status and body size of a response for
+// the access log.
+type loggedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+// WriteHeader records the status and sends the header.
+func (w *loggedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the body bytes written.
+func (w *loggedResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (w *loggedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode returns the status sent, 200 if the header was sent implicitly.
+func (w *loggedResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// h2Stream adapts an HTTP/2 CONNECT stream to a net.Conn.
+type h2Stream struct {
+	w          http.ResponseWriter
+	body       io.ReadCloser
+	rc         *http.ResponseController
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// newH2Stream creates an h2Stream reading from the request body and writing to the response.
+func newH2Stream(w http.ResponseWriter, req *http.Request) *h2Stream {
+	stream := &h2Stream{
+		w:          w,
+		body:       req.Body,
+		rc:         http.NewResponseController(w),
+		remoteAddr: &net.TCPAddr{},
+		localAddr:  &net.TCPAddr{},
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		stream.remoteAddr = addr
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		stream.localAddr = addr
+	}
+	return stream
+}
+
+// Read reads data sent by the client on the stream.
+func (st *h2Stream) Read(p []byte) (int, error) {
+	return st.body.Read(p)
+}
+
+// Write writes data to the client and flushes it immediately.
+func (st *h2Stream) Write(p []byte) (int, error) {
+	n, err := st.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, st.rc.Flush()
+}
+
+// Close closes the request body, ending the client side of the stream.
+func (st *h2Stream) Close() error {
+	return st.body.Close()
+}
+
+func (st *h2Stream) LocalAddr() net.Addr  { return st.localAddr }
+func (st *h2Stream) RemoteAddr() net.Addr { return st.remoteAddr }
+
+func (st *h2Stream) SetDeadline(t time.Time) error {
+	if err := st.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return st.rc.SetWriteDeadline(t)
+}
+
+func (st *h2Stream) SetReadDeadline(t time.Time) error  { return st.rc.SetReadDeadline(t) }
+func (st *h2Stream) SetWriteDeadline(t time.Time) error { return st.rc.SetWriteDeadline(t) }
@@ -0,0 +1,264 @@
+package http
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineWriter hands every line written to it to the test reading the channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+// echo runs a TCP server writing back whatever it reads until the test ends,
+// returning its address.
+func echo(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestH2CForward(t *testing.T) {
+	body := strings.Repeat("hello h2c ", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	target := srv.Listener.Addr().String()
+
+	log := make(lineWriter, 1)
+	// the origin only lists X-Hop in Connection on kept-alive connections
+	_, proxy := serve(t, WithH2C(true), WithResponseCompression(true), WithCLFLog(log), WithUpstreamPool(2, time.Minute))
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// set explicitly, the transport leaves the body compressed
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := h2cClient(t, proxy).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got %s, want HTTP/2", resp.Proto)
+	}
+	if resp.Header.Get("X-Hop") != "" {
+		t.Error("hop-by-hop header of the origin was forwarded")
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", encoding)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("got body %q", got)
+	}
+
+	select {
+	case line := <-log:
+		if !strings.Contains(line, `"GET / HTTP/2.0" 200 `) {
+			t.Errorf("log line %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no log line")
+	}
+}
+
+func TestH2CConnect(t *testing.T) {
+	target := echo(t)
+	_, proxy := serve(t, WithH2C(true))
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, "http://"+target, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h2cClient(t, proxy).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+
+	if _, err := io.WriteString(pw, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echoed %q", buf)
+	}
+	_ = pw.Close()
+}
+
+// countMetrics adds up the counts recorded per name.
+type countMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (m *countMetrics) ObserveDuration(string, time.Duration, ...string) {}
+
+func (m *countMetrics) AddCount(name string, delta int64, _ ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int64)
+	}
+	m.counts[name] += delta
+}
+
+func (m *countMetrics) count(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[name]
+}
+
+func TestH2CConnectTunnel(t *testing.T) {
+	target := echo(t)
+	metrics := &countMetrics{}
+	first := make(chan string, 1)
+	_, proxy := serve(t, WithH2C(true), WithMetrics(metrics), WithMuxHint(func(b []byte) bool {
+		first <- string(b)
+		return false
+	}))
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, "http://"+target, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h2cClient(t, proxy).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.WriteString(pw, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	_ = pw.Close()
+
+	// the stream goes through the tunnel of HTTP/1 CONNECT requests
+	select {
+	case got := <-first:
+		if got != "ping" {
+			t.Errorf("mux hint saw %q, want the first bytes of the stream", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mux hint not consulted")
+	}
+	for start := time.Now(); metrics.count("bytes_down") < 4; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d bytes down recorded, want 4", metrics.count("bytes_down"))
+		}
+	}
+	if up := metrics.count("bytes_up"); up != 4 {
+		t.Errorf("%d bytes up recorded, want 4", up)
+	}
+}
+
+func TestH2CDraining(t *testing.T) {
+	target := origin(t)
+	s, proxy := serve(t, WithH2C(true))
+	s.SetDraining(true)
+
+	if status := h2cRoundTrip(t, proxy, http.MethodGet, target); status != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestH2CStrictHostMatch(t *testing.T) {
+	s := NewServer(WithLogger(quietLogger{}), WithStrictHostMatch(true))
+
+	// a Host field may accompany :authority, which the request target comes from
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com:80"
+	req.Header.Set("Host", "other.example:80")
+	rec := httptest.NewRecorder()
+	s.handleH2CRequest(rec, req, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServeH2CContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServer(WithLogger(quietLogger{}), WithContext(ctx), WithH2C(true))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeH2C(conn)
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ServeH2C: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeH2C still serving after the context ended")
+	}
+}
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// errHeaderTooLarge is returned when the request header does not fit in the
+// read buffer, so its Host header cannot be inspected.
+var errHeaderTooLarge = errors.New("request header too large")
+
+// readRequest reads the next request of conn from reader. With StrictHostMatch
+// it also returns the raw Host header, which http.ReadRequest discards in
+// favour of the request target. A header too large to be inspected is
+// answered with 431 and conn is closed.
+func (s *Server) readRequest(conn net.Conn, reader *bufio.Reader) (*http.Request, string, error) {
+	if !s.StrictHostMatch {
+		req, err := http.ReadRequest(reader)
+		return req, "", err
+	}
+
+	header, err := peekHeader(reader)
+	if errors.Is(err, errHeaderTooLarge) {
+		http.Error(NewHTTPResponseWriter(conn), err.Error(), http.StatusRequestHeaderFieldsTooLarge)
+		_ = statute.DrainAndClose(conn)
+		return nil, "", fmt.Errorf("request from %v: %w", conn.RemoteAddr(), err)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	hostHeader := hostFromHeader(header)
+
+	req, err := http.ReadRequest(reader)
+	return req, hostHeader, err
+}
+
+// stripUserinfo removes the userinfo from the request target of req, so it
+// reaches neither the origin nor the handlers, setting it as Basic
+// Authorization of non-CONNECT requests with UserinfoAuthorization.
+func (s *Server) stripUserinfo(req *http.Request) {
+	user := req.URL.User
+	if user == nil {
+		return
+	}
+	req.URL.User = nil
+	if req.Method == http.MethodConnect {
+		req.RequestURI = req.URL.Host
+		return
+	}
+	req.RequestURI = req.URL.String()
+
+	if s.UserinfoAuthorization && req.Header.Get("Authorization") == "" {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+}
+
+// peekHeader returns the request line and header block at the head of reader
+// without consuming them.
+func peekHeader(reader *bufio.Reader) ([]byte, error) {
+	for n := 1; ; n = reader.Buffered() + 1 {
+		if n > reader.Size() {
+			return nil, errHeaderTooLarge
+		}
+		if _, err := reader.Peek(n); err != nil {
+			return nil, err
+		}
+		head, _ := reader.Peek(reader.Buffered())
+		if i := bytes.Index(head, []byte("\r\n\r\n")); i >= 0 {
+			return head[:i+4], nil
+		}
+	}
+}
+
+// hostFromHeader returns the value of the Host field in a raw header block.
+func hostFromHeader(header []byte) string {
+	lines := strings.Split(string(header), "\r\n")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Host") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// checkHost enforces StrictHostMatch on an HTTP/1 request whose raw Host
+// header is hostHeader. A mismatching request is answered with 400 and conn
+// is closed.
+func (s *Server) checkHost(conn net.Conn, req *http.Request, hostHeader string, isConnectMethod bool) error {
+	err := s.matchHost(req, hostHeader, isConnectMethod)
+	if err != nil {
+		http.Error(NewHTTPResponseWriter(conn), "Host header does not match the request target", http.StatusBadRequest)
+		_ = conn.Close()
+	}
+	return err
+}
+
+// matchHost reports, with StrictHostMatch, whether hostHeader disagrees with
+// the request target of req.
+func (s *Server) matchHost(req *http.Request, hostHeader string, isConnectMethod bool) error {
+	if !s.StrictHostMatch || hostHeader == "" || req.URL.Host == "" {
+		return nil
+	}
+
+	host := hostHeader
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), s.getPortForScheme(req.URL.Scheme, isConnectMethod))
+	}
+	target := s.targetAddress(req, isConnectMethod)
+	if strings.EqualFold(host, target) {
+		return nil
+	}
+	return fmt.Errorf("host %q does not match request target %q", hostHeader, target)
+}
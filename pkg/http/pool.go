@@ -0,0 +1,245 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// upstreamPool keeps idle keep-alive connections to origins, keyed by host:port
+// and routing identity, for reuse by the forward path.
+type upstreamPool struct {
+	maxIdlePerHost int
+	idleTimeout    time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*pooledConn
+}
+
+// pooledConn is an upstream connection along with the reader its responses are parsed from.
+type pooledConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	idleSince time.Time
+}
+
+// newUpstreamPool creates a new upstreamPool.
+func newUpstreamPool(maxIdlePerHost int, idleTimeout time.Duration) *upstreamPool {
+	return &upstreamPool{
+		maxIdlePerHost: maxIdlePerHost,
+		idleTimeout:    idleTimeout,
+		idle:           make(map[string][]*pooledConn),
+	}
+}
+
+// get returns a healthy idle connection to key, or nil when there is none.
+// Expired and broken connections found on the way are closed.
+func (p *upstreamPool) get(key string) *pooledConn {
+	for {
+		pc := p.pop(key)
+		if pc == nil {
+			return nil
+		}
+		if time.Since(pc.idleSince) < p.idleTimeout && pc.healthy() {
+			return pc
+		}
+		_ = pc.Close()
+	}
+}
+
+// pop removes the most recently used idle connection to key.
+func (p *upstreamPool) pop(key string) *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	pc := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = conns[:len(conns)-1]
+	}
+	return pc
+}
+
+// put returns a connection to the pool, closing it when the pool for key is full.
+func (p *upstreamPool) put(key string, pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// drop connections that idled out while nobody asked for them
+	conns := p.idle[key][:0]
+	for _, idle := range p.idle[key] {
+		if time.Since(idle.idleSince) < p.idleTimeout {
+			conns = append(conns, idle)
+		} else {
+			_ = idle.Close()
+		}
+	}
+
+	if len(conns) >= p.maxIdlePerHost {
+		p.idle[key] = conns
+		_ = pc.Close()
+		return
+	}
+	pc.idleSince = time.Now()
+	p.idle[key] = append(conns, pc)
+}
+
+// healthy reports whether an idle connection is still usable: the origin must
+// neither have closed it nor sent anything unsolicited.
+func (pc *pooledConn) healthy() bool {
+	if pc.reader.Buffered() > 0 {
+		return false
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := pc.reader.Peek(1)
+	_ = pc.SetReadDeadline(time.Time{})
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// serveForward serves plain forward requests on a kept-alive client connection,
+// reusing pooled upstream connections across requests. A CONNECT request on
+// the same connection is handed over to the regular handler.
+func (s *Server) serveForward(conn net.Conn, reader *bufio.Reader, req *http.Request) error {
+	defer conn.Close()
+
+	for {
+		keepAlive, err := s.forwardPooled(conn, req)
+		if err != nil || !keepAlive {
+			return err
+		}
+
+		if err := s.checkRequestLine(conn, reader); err != nil {
+			return err
+		}
+		session := req.Context()
+		var hostHeader string
+		req, hostHeader, err = s.readRequest(conn, reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		req = req.WithContext(session)
+		s.stripUserinfo(req)
+
+		if s.isSelfRequest(req) {
+			return s.serveSelf(conn, req)
+		}
+		isConnectMethod := req.Method == http.MethodConnect
+		if err := s.checkDraining(conn); err != nil {
+			return err
+		}
+		if err := s.checkHost(conn, req, hostHeader, isConnectMethod); err != nil {
+			return err
+		}
+		if err := s.checkMethod(conn, req, isConnectMethod); err != nil {
+			return err
+		}
+		if err := s.intercept(conn, req, isConnectMethod); err != nil {
+			return err
+		}
+		if isConnectMethod {
+			return s.handleHTTP(statute.NewBufferedConn(conn, reader), req, true)
+		}
+	}
+}
+
+// forwardPooled forwards a single request over a pooled or newly dialed
+// upstream connection. It reports whether the client connection can be used
+// for another request.
+func (s *Server) forwardPooled(conn net.Conn, req *http.Request) (bool, error) {
+	status, size := http.StatusOK, int64(-1)
+	if s.CLFLog != nil {
+		start := time.Now()
+		defer func() {
+			s.logCLF(conn.RemoteAddr().String(), req, start, status, size)
+		}()
+	}
+
+	targetAddr := s.targetAddress(req, false)
+	key := targetAddr
+	if s.UpstreamPoolKey != nil {
+		key += "\x00" + s.UpstreamPoolKey(req)
+	}
+	keepAlive := clientKeepAlive(req)
+
+	// the upstream connection is kept alive independently of the client's
+	outReq := req.Clone(req.Context())
+	removeHopHeaders(outReq.Header)
+	outReq.Close = false
+	// TE is hop-by-hop, but trailers are relayed end to end, so origins like
+	// gRPC servers that require TE: trailers still see it
+	if acceptsTrailers(req.Header) {
+		outReq.Header.Set("TE", "trailers")
+	}
+	// the trailers of a chunked body are only filled in once the body has been
+	// read, so share the map rather than the copy Clone made while still empty
+	outReq.Trailer = req.Trailer
+
+	pc := s.upstreamPool.get(key)
+	reused := pc != nil
+	var resp *http.Response
+	for {
+		if pc == nil {
+			target, err := s.dialTarget(statute.ConnTrackerOf(conn), req, targetAddr)
+			if err != nil {
+				status = dialErrorStatus(err)
+				http.Error(NewHTTPResponseWriter(conn), err.Error(), status)
+				return false, err
+			}
+			pc = &pooledConn{Conn: target, reader: bufio.NewReader(target)}
+		}
+
+		var err error
+		if err = outReq.Write(pc); err == nil {
+			resp, err = http.ReadResponse(pc.reader, outReq)
+		}
+		if err == nil {
+			break
+		}
+		_ = pc.Close()
+		// the origin may have closed the idle connection as it was reused
+		if reused && retryable(req) {
+			pc, reused = nil, false
+			continue
+		}
+		status = http.StatusBadGateway
+		http.Error(NewHTTPResponseWriter(conn), err.Error(), status)
+		return false, err
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+	upstreamClose := resp.Close
+
+	size, mustClose, err := s.relayResponse(conn, req, resp, keepAlive)
+	if err != nil || upstreamClose {
+		_ = pc.Close()
+	} else {
+		s.upstreamPool.put(key, pc)
+	}
+	return err == nil && !mustClose, err
+}
+
+// retryable reports whether req can be sent again after a pooled connection
+// failed: it must be idempotent and have no body to replay.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
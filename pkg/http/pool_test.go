@@ -0,0 +1,154 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// forward sends a GET for target through the server at proxy on a new client
+// connection, with the extra header lines given, returning the response body.
+func forward(t *testing.T, proxy, target string, header ...string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := fmt.Sprintf("GET http://%s/ HTTP/1.1\r\nHost: %s\r\n", target, target)
+	for _, line := range header {
+		request += line + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d: %s", resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+// peerOrigin runs an HTTP server answering every request with the address of
+// the connection it came on, returning its address.
+func peerOrigin(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.RemoteAddr)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestUpstreamPoolReuse(t *testing.T) {
+	target := peerOrigin(t)
+	_, proxy := serve(t, WithUpstreamPool(2, time.Minute))
+
+	first := forward(t, proxy, target)
+	if second := forward(t, proxy, target); second != first {
+		t.Errorf("second request came from %s, want the pooled %s", second, first)
+	}
+}
+
+func TestUpstreamPoolKey(t *testing.T) {
+	target := peerOrigin(t)
+	_, proxy := serve(t, WithUpstreamPool(2, time.Minute), WithUpstreamPoolKey(func(req *http.Request) string {
+		return req.Header.Get("X-Route")
+	}))
+
+	a := forward(t, proxy, target, "X-Route: a")
+	if b := forward(t, proxy, target, "X-Route: b"); b == a {
+		t.Errorf("route b reused the connection of route a (%s)", a)
+	}
+	if again := forward(t, proxy, target, "X-Route: a"); again != a {
+		t.Errorf("route a came from %s, want the pooled %s", again, a)
+	}
+}
+
+// staleOrigin runs a server answering the first request of each connection
+// and closing the connection on the next one, as an origin timing out an idle
+// connection just as it is reused does. It returns its address and the number
+// of connections accepted so far.
+func staleOrigin(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, req.Body)
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				_, _ = http.ReadRequest(reader)
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestUpstreamPoolStaleRetry(t *testing.T) {
+	target, accepted := staleOrigin(t)
+	_, proxy := serve(t, WithUpstreamPool(2, time.Minute))
+
+	for i := 0; i < 3; i++ {
+		if body := forward(t, proxy, target); body != "ok" {
+			t.Fatalf("request %d: got %q", i, body)
+		}
+	}
+	if n := accepted.Load(); n != 3 {
+		t.Errorf("origin accepted %d connections, want 3", n)
+	}
+
+	// a request with a body can't be replayed
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	body := "data"
+	if _, err := fmt.Fprintf(conn, "POST http://%s/ HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s", target, target, len(body), body); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodPost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("POST on a stale connection: got %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,97 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// healthPath is the path answered with 200 OK on the proxy's own host.
+const healthPath = "/__health"
+
+// statsPath is the path answered with a plain text summary of the Stats
+// snapshot on the proxy's own host.
+const statsPath = "/__stats"
+
+// pacContentType is the media type browsers expect for proxy auto-config files.
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// isSelfRequest reports whether req is addressed to the proxy itself rather
+// than to a destination to be forwarded to.
+func (s *Server) isSelfRequest(req *http.Request) bool {
+	if req.Method == http.MethodConnect {
+		return false
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.SelfHost != "" && strings.EqualFold(host, s.SelfHost) {
+		return true
+	}
+	// origin-form requests are sent to the proxy directly rather than through it
+	return s.PACPath != "" && req.URL.Host == "" && req.URL.Path == s.PACPath
+}
+
+// serveSelf answers a request addressed to the proxy itself and closes conn.
+func (s *Server) serveSelf(conn net.Conn, req *http.Request) error {
+	defer conn.Close()
+
+	status, contentType, body := http.StatusNotFound, "text/plain; charset=utf-8", "not found\n"
+	switch {
+	case s.PACPath != "" && req.URL.Path == s.PACPath:
+		status, contentType, body = http.StatusOK, pacContentType, s.PACFile
+	case req.URL.Path == healthPath:
+		status, body = http.StatusOK, "OK\n"
+	case req.URL.Path == statsPath && s.Stats != nil:
+		status, body = http.StatusOK, formatStats(s.Stats.Snapshot())
+	}
+
+	if s.CLFLog != nil {
+		start := time.Now()
+		defer func() {
+			s.logCLF(conn.RemoteAddr().String(), req, start, status, int64(len(body)))
+		}()
+	}
+
+	return writeSelfResponse(conn, req, status, contentType, body)
+}
+
+// formatStats renders stats as a plain text page, one value per line.
+func formatStats(stats statute.Stats) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "active connections: %d\n", stats.ActiveConns)
+	fmt.Fprintf(&b, "total connections: %d\n", stats.TotalConns)
+	fmt.Fprintf(&b, "bytes up: %d\n", stats.BytesUp)
+	fmt.Fprintf(&b, "bytes down: %d\n", stats.BytesDown)
+
+	protocols := make([]string, 0, len(stats.Protocols))
+	for protocol := range stats.Protocols {
+		protocols = append(protocols, string(protocol))
+	}
+	sort.Strings(protocols)
+	for _, protocol := range protocols {
+		fmt.Fprintf(&b, "%s connections: %d\n", protocol, stats.Protocols[statute.Protocol(protocol)])
+	}
+	return b.String()
+}
+
+// writeSelfResponse writes a complete response generated by the proxy.
+func writeSelfResponse(conn net.Conn, req *http.Request, status int, contentType, body string) error {
+	rw := NewHTTPResponseWriter(conn)
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.Header().Set("Connection", "close")
+	rw.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err := rw.Write([]byte(body))
+	return err
+}
@@ -0,0 +1,855 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+	"golang.org/x/net/http2"
+)
+
+type quietLogger struct{}
+
+func (quietLogger) Debug(...interface{}) {}
+func (quietLogger) Error(...interface{}) {}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// serve runs a server built with options on a loopback address until the
+// test ends, returning it and its address.
+func serve(t *testing.T, options ...ServerOption) (*Server, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	options = append([]ServerOption{WithLogger(quietLogger{}), WithBind(addr), WithContext(ctx)}, options...)
+	s := NewServer(options...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return s, addr
+		}
+	}
+	t.Fatalf("server on %s didn't start", addr)
+	return nil, ""
+}
+
+// origin runs an HTTP server answering every request with "ok" until the
+// test ends, returning its address.
+func origin(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// roundTrip writes the HTTP/1.1 request line and host header of method for
+// target to the server at proxy, returning the response status.
+func roundTrip(t *testing.T, proxy, method, target, host string) int {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", method, target, host); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// h2cClient returns a client speaking prior-knowledge HTTP/2 to the server
+// at proxy, whatever the request URL.
+func h2cClient(t *testing.T, proxy string) *http.Client {
+	t.Helper()
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, proxy)
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+// h2cRoundTrip sends a request with method for target over an h2c
+// connection to the server at proxy, returning the response status.
+func h2cRoundTrip(t *testing.T, proxy, method, target string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+target+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h2cClient(t, proxy).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestBlockPrivateRanges(t *testing.T) {
+	target := origin(t)
+	_, port, _ := net.SplitHostPort(target)
+	_, open := serve(t, WithH2C(true))
+	_, proxy := serve(t, WithH2C(true), WithBlockPrivateRanges(true))
+
+	requests := map[string]func(proxy, target string) int{
+		"CONNECT": func(proxy, target string) int {
+			return roundTrip(t, proxy, http.MethodConnect, target, target)
+		},
+		"forward": func(proxy, target string) int {
+			return roundTrip(t, proxy, http.MethodGet, "http://"+target+"/", target)
+		},
+		"h2c CONNECT": func(proxy, target string) int {
+			return h2cRoundTrip(t, proxy, http.MethodConnect, target)
+		},
+		"h2c forward": func(proxy, target string) int {
+			return h2cRoundTrip(t, proxy, http.MethodGet, target)
+		},
+	}
+	// the name is only found private once resolved
+	for _, dest := range []string{target, net.JoinHostPort("localhost", port)} {
+		for name, request := range requests {
+			if status := request(open, dest); status != http.StatusOK {
+				t.Fatalf("%s %s without the guard: %d", name, dest, status)
+			}
+			if status := request(proxy, dest); status != http.StatusForbidden {
+				t.Errorf("%s %s: got %d, want %d", name, dest, status, http.StatusForbidden)
+			}
+		}
+	}
+}
+
+func TestStrictHostMatch(t *testing.T) {
+	target := origin(t)
+	_, proxy := serve(t, WithStrictHostMatch(true))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		host   string
+		want   int
+	}{
+		{"CONNECT", http.MethodConnect, target, target, http.StatusOK},
+		{"CONNECT mismatch", http.MethodConnect, target, "example.com:443", http.StatusBadRequest},
+		{"absolute URI", http.MethodGet, "http://" + target + "/", target, http.StatusOK},
+		{"absolute URI mismatch", http.MethodGet, "http://" + target + "/", "example.com", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roundTrip(t, proxy, tt.method, tt.target, tt.host); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("header too large", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		padding := strings.Repeat("a", 2*defaultReaderSize)
+		if _, err := fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\nX-Padding: %s\r\n\r\n", target, target, padding); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("got %d, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+		}
+	})
+}
+
+func TestUserinfo(t *testing.T) {
+	type seen struct{ uri, auth string }
+	requests := make(chan seen, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{r.RequestURI, r.Header.Get("Authorization")}
+	}))
+	t.Cleanup(srv.Close)
+	target := srv.Listener.Addr().String()
+
+	for _, authorize := range []bool{false, true} {
+		t.Run(fmt.Sprintf("authorization %v", authorize), func(t *testing.T) {
+			_, proxy := serve(t, WithUserinfoAuthorization(authorize))
+			if status := roundTrip(t, proxy, http.MethodGet, "http://user:pass@"+target+"/", target); status != http.StatusOK {
+				t.Fatalf("got %d, want %d", status, http.StatusOK)
+			}
+			got := <-requests
+			if strings.Contains(got.uri, "user") {
+				t.Errorf("origin saw userinfo in %q", got.uri)
+			}
+			want := ""
+			if authorize {
+				want = "Basic dXNlcjpwYXNz"
+			}
+			if got.auth != want {
+				t.Errorf("Authorization %q, want %q", got.auth, want)
+			}
+		})
+	}
+}
+
+func TestUserHandlerRequest(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	_, proxy := serve(t, WithConnectHandle(func(req *statute.ProxyRequest) error {
+		requests <- req.HTTPRequest
+		if req.HTTPRequest.Method == http.MethodConnect {
+			return nil
+		}
+		_, err := io.WriteString(req.Conn, "HTTP/1.1 204 No Content\r\n\r\n")
+		return err
+	}))
+
+	tests := []struct {
+		method, target, host, wantHost string
+		want                           int
+	}{
+		{http.MethodConnect, "example.com:443", "example.com:443", "example.com:443", http.StatusOK},
+		{http.MethodGet, "http://example.com/path?q=1", "example.com", "example.com", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if status := roundTrip(t, proxy, tt.method, tt.target, tt.host); status != tt.want {
+				t.Fatalf("got %d, want %d", status, tt.want)
+			}
+			req := <-requests
+			if req == nil {
+				t.Fatal("handler received no request")
+			}
+			if req.Method != tt.method || req.URL.Host != tt.wantHost {
+				t.Errorf("handler received %s %s, want %s %s", req.Method, req.URL.Host, tt.method, tt.wantHost)
+			}
+			if tt.method == http.MethodGet && req.URL.RawQuery != "q=1" {
+				t.Errorf("query %q, want %q", req.URL.RawQuery, "q=1")
+			}
+		})
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	text := strings.Repeat("compressible text ", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		_, _ = io.WriteString(w, text)
+	}))
+	t.Cleanup(srv.Close)
+	_, proxy := serve(t, WithResponseCompression(true))
+
+	proxyURL, _ := url.Parse("http://" + proxy)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true},
+		Timeout:   5 * time.Second,
+	}
+	get := func(contentType string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/?type="+url.QueryEscape(contentType), nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("text/plain")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("text response not gzipped, Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	if len(body) >= len(text) {
+		t.Errorf("gzipped body of %d bytes, original %d", len(body), len(text))
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(gz); err != nil || string(plain) != text {
+		t.Errorf("gunzipped body differs, err %v", err)
+	}
+
+	resp, body = get("image/png")
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != text {
+		t.Errorf("image response altered, Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestCLFLog(t *testing.T) {
+	target := origin(t)
+	lines := make(lineWriter, 1)
+	_, proxy := serve(t, WithCLFLog(lines))
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "GET http://%s/page HTTP/1.1\r\nHost: %s\r\nReferer: http://example.com/\r\nUser-Agent: test-agent\r\n\r\n", target, target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	var line string
+	select {
+	case line = <-lines:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no log line")
+	}
+	clf := regexp.MustCompile(`^(\S+) - - \[([^\]]+)\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-) "([^"]*)" "([^"]*)"\n$`)
+	m := clf.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("line %q is not in Combined Log Format", line)
+	}
+	if _, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[2]); err != nil {
+		t.Errorf("timestamp: %v", err)
+	}
+	want := []string{"127.0.0.1", "GET", "http://" + target + "/page", "HTTP/1.1", "200", "2", "http://example.com/", "test-agent"}
+	got := append([]string{m[1]}, m[3:]...)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("field %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// get sends a GET request for target with host to the server at proxy,
+// returning the response and its body.
+func get(t *testing.T, proxy, target, host string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, host); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestSelfURL(t *testing.T) {
+	_, proxy := serve(t, WithSelfURL("proxy.test"))
+
+	resp, body := get(t, proxy, "http://proxy.test:8080/__health", "proxy.test:8080")
+	if resp.StatusCode != http.StatusOK || body != "OK\n" {
+		t.Errorf("health: %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "OK\n")
+	}
+	if resp, _ := get(t, proxy, "http://proxy.test/elsewhere", "proxy.test"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	// other hosts are still forwarded
+	target := origin(t)
+	if resp, body := get(t, proxy, "http://"+target+"/__health", target); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("forwarded: %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "ok")
+	}
+}
+
+func TestPACFile(t *testing.T) {
+	const pac = `function FindProxyForURL(url, host) { return "PROXY 127.0.0.1:8080"; }`
+	_, proxy := serve(t, WithPACFile(pac, "/proxy.pac"))
+
+	resp, body := get(t, proxy, "/proxy.pac", "127.0.0.1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != pacContentType {
+		t.Errorf("Content-Type %q, want %q", got, pacContentType)
+	}
+	if body != pac {
+		t.Errorf("body %q, want %q", body, pac)
+	}
+}
+
+func TestContextCancelStopsServing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := freeAddr(t)
+	s := NewServer(WithLogger(quietLogger{}), WithBind(addr), WithContext(ctx))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("server on %s didn't start", addr)
+		}
+	}
+
+	// Accept is blocked with no client connecting
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe still running after the context was cancelled")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		_ = conn.Close()
+		t.Error("listener still open")
+	}
+}
+
+func TestConnectPorts(t *testing.T) {
+	target := origin(t)
+	dialed := make(chan string, 2)
+	// every destination is served by the origin, whatever its port
+	redirect := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}
+	_, proxy := serve(t, WithConnectPorts(443), WithProxyDial(redirect))
+
+	if status := roundTrip(t, proxy, http.MethodConnect, "example.com:22", "example.com:22"); status != http.StatusForbidden {
+		t.Errorf("CONNECT to port 22: status %d, want %d", status, http.StatusForbidden)
+	}
+	if status := roundTrip(t, proxy, http.MethodConnect, "example.com:443", "example.com:443"); status != http.StatusOK {
+		t.Errorf("CONNECT to port 443: status %d, want %d", status, http.StatusOK)
+	}
+
+	// the refused request never reached the dial
+	if address := <-dialed; address != "example.com:443" {
+		t.Errorf("dialed %s, want example.com:443", address)
+	}
+	select {
+	case address := <-dialed:
+		t.Errorf("unexpected dial to %s", address)
+	default:
+	}
+}
+
+func TestDefaultPorts(t *testing.T) {
+	target := origin(t)
+	dialed := make(chan string, 2)
+	redirect := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}
+	_, proxy := serve(t, WithDefaultPorts(8080, 8443), WithProxyDial(redirect))
+
+	if resp, body := get(t, proxy, "http://example.com/", "example.com"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("portless GET: %d %q", resp.StatusCode, body)
+	}
+	if address := <-dialed; address != "example.com:8080" {
+		t.Errorf("portless GET dialed %s, want example.com:8080", address)
+	}
+
+	if status := roundTrip(t, proxy, http.MethodConnect, "example.com", "example.com"); status != http.StatusOK {
+		t.Fatalf("portless CONNECT: status %d", status)
+	}
+	if address := <-dialed; address != "example.com:8443" {
+		t.Errorf("portless CONNECT dialed %s, want example.com:8443", address)
+	}
+}
+
+// bufferedWriteConn holds writes until it is flushed.
+type bufferedWriteConn struct {
+	net.Conn
+	writer *bufio.Writer
+}
+
+func (c *bufferedWriteConn) Write(p []byte) (int, error) { return c.writer.Write(p) }
+
+func (c *bufferedWriteConn) Flush() error { return c.writer.Flush() }
+
+func TestConnectFlushesBufferedConn(t *testing.T) {
+	target := origin(t)
+	_, proxy := serve(t, WithConnMiddleware(func(conn net.Conn) net.Conn {
+		return &bufferedWriteConn{Conn: conn, writer: bufio.NewWriter(conn)}
+	}))
+
+	// the 200 is far smaller than the buffer, so only a flush sends it
+	if status := roundTrip(t, proxy, http.MethodConnect, target, target); status != http.StatusOK {
+		t.Fatalf("CONNECT: status %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	target := origin(t)
+	_, proxy := serve(t, WithAllowedMethods(http.MethodGet))
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "POST http://%s/ HTTP/1.1\r\nHost: %s\r\nContent-Length: 4\r\n\r\nbody", target, target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodGet {
+		t.Errorf("POST: %d with Allow %q, want %d with Allow %q",
+			resp.StatusCode, resp.Header.Get("Allow"), http.StatusMethodNotAllowed, http.MethodGet)
+	}
+
+	if resp, body := get(t, proxy, "http://"+target+"/", target); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("GET: %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "ok")
+	}
+	// CONNECT is not a forwarded method
+	if status := roundTrip(t, proxy, http.MethodConnect, target, target); status != http.StatusOK {
+		t.Errorf("CONNECT: status %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestProxyConnectionKeepAlive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "proxy-connection=%q", r.Header.Get("Proxy-Connection"))
+	}))
+	t.Cleanup(srv.Close)
+	target := srv.Listener.Addr().String()
+	_, proxy := serve(t, WithUpstreamPool(2, time.Minute))
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// HTTP/1.0 closes by default, Proxy-Connection asks to keep the connection
+	for i := 0; i < 2; i++ {
+		if _, err := fmt.Fprintf(conn, "GET http://%s/ HTTP/1.0\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", target, target); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `proxy-connection=""` {
+			t.Errorf("request %d: origin saw %s", i+1, body)
+		}
+	}
+}
+
+func TestChunkedRequestBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%v %s %s", r.TransferEncoding, body, r.Trailer.Get("Checksum"))
+	}))
+	t.Cleanup(srv.Close)
+	target := srv.Listener.Addr().String()
+	_, proxy := serve(t, WithUpstreamPool(2, time.Minute))
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "POST http://%s/ HTTP/1.1\r\nHost: %s\r\nTransfer-Encoding: chunked\r\nTrailer: Checksum\r\n\r\n"+
+		"5\r\nhello\r\n6\r\n world\r\n0\r\nChecksum: abc\r\n\r\n", target, target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[chunked] hello world abc"; string(body) != want {
+		t.Errorf("origin received %q, want %q", body, want)
+	}
+}
+
+func TestResponseTrailer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// like gRPC servers, only send trailers to clients that accept them
+		if r.Header.Get("TE") != "trailers" {
+			http.Error(w, "trailers not accepted", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write([]byte("ok"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	t.Cleanup(srv.Close)
+	target := srv.Listener.Addr().String()
+	_, proxy := serve(t, WithUpstreamPool(2, time.Minute))
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\nTE: trailers\r\n\r\n", target, target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("response %d %q", resp.StatusCode, body)
+	}
+	// trailers are only known once the body has been read
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("trailer Grpc-Status = %q, want %q", status, "0")
+	}
+}
+
+func TestMaxRequestLineBytes(t *testing.T) {
+	target := origin(t)
+	_, proxy := serve(t, WithMaxRequestLineBytes(256))
+
+	long := "http://" + target + "/" + strings.Repeat("a", 300)
+	if status := roundTrip(t, proxy, http.MethodGet, long, target); status != http.StatusRequestURITooLong {
+		t.Errorf("oversized URL: status %d, want %d", status, http.StatusRequestURITooLong)
+	}
+	if status := roundTrip(t, proxy, http.MethodGet, "http://"+target+"/short", target); status != http.StatusOK {
+		t.Errorf("short URL: status %d, want %d", status, http.StatusOK)
+	}
+}
+
+// rotatingResolver answers each lookup with the next of its addresses, as DNS
+// records changing between requests.
+type rotatingResolver struct {
+	mu  sync.Mutex
+	ips []string
+}
+
+func (r *rotatingResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ip := r.ips[0]
+	r.ips = append(r.ips[1:], ip)
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+func TestPinnedResolution(t *testing.T) {
+	// the origin closes its connections, so every request dials again
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Connection", "close")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	target := net.JoinHostPort("origin.test", port)
+
+	dialed := make(chan string, 4)
+	var d net.Dialer
+	_, proxy := serve(t,
+		WithUpstreamPool(2, time.Minute),
+		WithPinnedResolution(true),
+		WithResolver(&rotatingResolver{ips: []string{"127.0.0.1", "127.0.0.2"}}),
+		WithProxyDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			return d.DialContext(ctx, network, address)
+		}),
+	)
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if _, err := fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+
+	// the second lookup would have moved to 127.0.0.2
+	want := net.JoinHostPort("127.0.0.1", port)
+	for i := 0; i < 2; i++ {
+		if address := <-dialed; address != want {
+			t.Errorf("dial %d to %s, want %s", i+1, address, want)
+		}
+	}
+}
+
+func TestStatsPage(t *testing.T) {
+	target := origin(t)
+	stats := statute.NewStatsCollector()
+	_, proxy := serve(t, WithSelfURL("proxy.test"), WithStats(stats))
+	// wait for serve's probe connection to be done
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if stats.Snapshot().ActiveConns == 0 {
+			break
+		}
+	}
+
+	tunnel, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	_ = tunnel.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(tunnel, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tunnel), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+
+	// the open tunnel and the page request itself are active
+	resp, body := get(t, proxy, "http://proxy.test/__stats", "proxy.test")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stats page: status %d", resp.StatusCode)
+	}
+	for _, want := range []string{"active connections: 2\n", "total connections: 3\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("stats page %q, want %q", body, want)
+		}
+	}
+}
+
+func TestDialContextHeaders(t *testing.T) {
+	target := origin(t)
+	routes := make(chan string, 2)
+	_, proxy := serve(t, WithProxyDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+		header, ok := statute.HTTPHeadersFromContext(ctx)
+		if !ok {
+			return nil, fmt.Errorf("no headers for %s", address)
+		}
+		routes <- header.Get("X-Route")
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}))
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-Route: egress-b\r\n\r\n", target, target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: status %d", resp.StatusCode)
+	}
+	if route := <-routes; route != "egress-b" {
+		t.Errorf("dial saw X-Route %q, want %q", route, "egress-b")
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Proxy-Id", "origin")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	target := srv.Listener.Addr().String()
+	_, proxy := serve(t, WithResponseHeaders(http.Header{"X-Proxy-Id": {"edge-1"}}))
+
+	// the injected value replaces the origin's
+	resp, body := get(t, proxy, "http://"+target+"/", target)
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("response %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Values("X-Proxy-Id"); len(got) != 1 || got[0] != "edge-1" {
+		t.Errorf("X-Proxy-Id %q, want %q", got, "edge-1")
+	}
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Validate checks the assembled configuration of the server without serving,
+// returning every problem found joined in one error, or nil.
+func (s *Server) Validate() error {
+	c := statute.NewConfigCheck("http")
+	c.CheckAddr("Bind", s.Bind)
+	c.Check(s.ProxyDial != nil, "ProxyDial is nil")
+	c.Check(s.Logger != nil, "Logger is nil")
+	c.Check(s.Metrics != nil, "Metrics is nil")
+	c.Check(s.Context != nil, "Context is nil")
+	c.CheckDSCP(s.DSCP)
+
+	// zero falls back to the default port of the scheme
+	c.Check(s.DefaultHTTPPort == 0 || validPort(s.DefaultHTTPPort), "DefaultHTTPPort %d is not a valid port", s.DefaultHTTPPort)
+	c.Check(s.DefaultHTTPSPort == 0 || validPort(s.DefaultHTTPSPort), "DefaultHTTPSPort %d is not a valid port", s.DefaultHTTPSPort)
+	for _, port := range s.ConnectPorts {
+		c.Check(validPort(port), "ConnectPorts: %d is not a valid port", port)
+	}
+	for _, method := range s.AllowedMethods {
+		c.Check(method != "", "AllowedMethods contains an empty method")
+		c.Check(!strings.EqualFold(method, http.MethodConnect), "AllowedMethods doesn't apply to CONNECT, restrict it with ConnectPorts")
+	}
+	c.Check(s.MaxRequestLineBytes >= 0, "MaxRequestLineBytes is negative")
+	if s.PACPath != "" {
+		c.Check(strings.HasPrefix(s.PACPath, "/"), "PACPath %q doesn't start with /", s.PACPath)
+	}
+	c.Check(s.PACFile == "" || s.PACPath != "", "PACFile is set without a PACPath to serve it at")
+
+	c.Check(s.ReadBufferSize >= 0, "ReadBufferSize is negative")
+	c.Check(s.WriteBufferSize >= 0, "WriteBufferSize is negative")
+	c.Check(s.SocketRecvBuffer >= 0, "SocketRecvBuffer is negative")
+	c.Check(s.SocketSendBuffer >= 0, "SocketSendBuffer is negative")
+	c.Check(s.TunnelKeepalive >= 0, "TunnelKeepalive is negative")
+	c.Check(s.MaxConnLifetime >= 0, "MaxConnLifetime is negative")
+	c.Check(s.ConnectTimeout >= 0, "ConnectTimeout is negative")
+	return c.Err()
+}
+
+// validPort reports whether port can be dialed.
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
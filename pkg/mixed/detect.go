@@ -0,0 +1,46 @@
+package mixed
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/bepass-org/proxy/pkg/http"
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// ProtocolDetector picks the protocol of a new connection from its first
+// bytes. It must only peek at reader and never consume from it, as the
+// chosen server reads the connection from the start.
+type ProtocolDetector func(reader *bufio.Reader) (statute.Protocol, error)
+
+// ProtocolHandler serves a connection whose protocol was picked by the
+// ProtocolDetector. Reads from conn start at the first byte the client sent.
+type ProtocolHandler func(conn net.Conn) error
+
+// DetectProtocol is the default ProtocolDetector. It tells the protocols
+// apart by the first byte: the SOCKS version, a TLS handshake record, or
+// anything else as HTTP, unless it starts the HTTP/2 connection preface.
+func DetectProtocol(reader *bufio.Reader) (statute.Protocol, error) {
+	head, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	switch head[0] {
+	case 5:
+		return statute.ProtocolSOCKS5, nil
+	case 4:
+		return statute.ProtocolSOCKS4, nil
+	case 0x16:
+		return statute.ProtocolTLS, nil
+	case 'P':
+		// the preface ("PRI * HTTP/2.0...") is only peeked while it matches,
+		// so POST and PUT requests aren't held back
+		if http.IsH2CPreface(reader) {
+			return statute.ProtocolH2C, nil
+		}
+		return statute.ProtocolHTTP, nil
+	default:
+		return statute.ProtocolHTTP, nil
+	}
+}
@@ -0,0 +1,160 @@
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+	"golang.org/x/net/http2"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		head string
+		want statute.Protocol
+	}{
+		{"\x05\x01\x00", statute.ProtocolSOCKS5},
+		{"\x04\x01\x00\x50", statute.ProtocolSOCKS4},
+		{"\x16\x03\x01", statute.ProtocolTLS},
+		{"GET http://example.com/ HTTP/1.1\r\n\r\n", statute.ProtocolHTTP},
+		{"CONNECT example.com:443 HTTP/1.1\r\n\r\n", statute.ProtocolHTTP},
+		{"POST http://example.com/ HTTP/1.1\r\n\r\n", statute.ProtocolHTTP},
+		{"PUT http://example.com/ HTTP/1.1\r\n\r\n", statute.ProtocolHTTP},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", statute.ProtocolH2C},
+	}
+	for _, tt := range tests {
+		got, err := DetectProtocol(bufio.NewReader(strings.NewReader(tt.head)))
+		if err != nil {
+			t.Errorf("DetectProtocol(%q): %v", tt.head, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("DetectProtocol(%q) = %s, want %s", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestH2CRouted(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	defer origin.Close()
+
+	_, proxy := serve(t, WithH2C(true))
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, proxy)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: 5 * time.Second, Transport: transport}
+
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("response %s over %s, want 200 over HTTP/2", resp.Status, resp.Proto)
+	}
+}
+
+func TestH2CProtocolHandler(t *testing.T) {
+	served := make(chan string, 1)
+	_, proxy := serve(t, WithProtocolHandler(statute.ProtocolH2C, func(conn net.Conn) error {
+		defer conn.Close()
+		preface := make([]byte, 3)
+		_, err := io.ReadFull(conn, preface)
+		served <- string(preface)
+		return err
+	}))
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-served:
+		if got != "PRI" {
+			t.Fatalf("handler read %q, want the preface", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("h2c connection not routed to its handler")
+	}
+}
+
+func TestCustomProtocolDetector(t *testing.T) {
+	const bepass statute.Protocol = "bepass"
+	detector := func(reader *bufio.Reader) (statute.Protocol, error) {
+		// only wait for the whole prefix once the first byte matches, as other
+		// clients may send less and wait for an answer
+		if head, err := reader.Peek(1); err != nil || head[0] != 'B' {
+			return DetectProtocol(reader)
+		}
+		prefix, err := reader.Peek(len("BEPASS"))
+		if err != nil {
+			return "", err
+		}
+		if string(prefix) == "BEPASS" {
+			return bepass, nil
+		}
+		return DetectProtocol(reader)
+	}
+
+	echo := echoServer(t)
+	_, proxy := serve(t,
+		WithProtocolDetector(detector),
+		WithProtocolHandler(bepass, func(conn net.Conn) error {
+			defer conn.Close()
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(conn, "handled "+line)
+			return err
+		}),
+	)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, "BEPASS hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	// the handler reads the connection from the start, prefix included
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "handled BEPASS hello\n" {
+		t.Fatalf("handler answered %q", got)
+	}
+
+	// other protocols still reach the built-in servers
+	tunnel := socks5Connect(t, proxy, echo)
+	if _, err := io.WriteString(tunnel, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = tunnel.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("socks5 echo = %q, %v", buf, err)
+	}
+}
@@ -2,17 +2,18 @@ package mixed
 
 import (
 	"context"
+	"net"
+	nethttp "net/http"
+	"time"
 
+	"github.com/bepass-org/proxy/pkg/socks5"
 	"github.com/bepass-org/proxy/pkg/statute"
 )
 
 // WithBinAddress sets the bind address for the proxy.
 func WithBinAddress(binAddress string) Option {
 	return func(p *Proxy) {
-		p.bind = binAddress
-		p.socks5Proxy.Bind = binAddress
-		p.socks4Proxy.Bind = binAddress
-		p.httpProxy.Bind = binAddress
+		p.setBind(binAddress)
 	}
 }
 
@@ -23,6 +24,204 @@ func WithLogger(logger statute.Logger) Option {
 		p.socks5Proxy.Logger = logger
 		p.socks4Proxy.Logger = logger
 		p.httpProxy.Logger = logger
+		p.transparent.Logger = logger
+	}
+}
+
+// WithMetrics sets the metrics sink for the proxy.
+func WithMetrics(metrics statute.Metrics) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.Metrics = metrics
+		p.socks4Proxy.Metrics = metrics
+		p.httpProxy.Metrics = metrics
+		p.transparent.Metrics = metrics
+	}
+}
+
+// WithBlockPrivateRanges rejects destinations that resolve to private addresses.
+func WithBlockPrivateRanges(block bool) Option {
+	return func(p *Proxy) {
+		p.blockPrivate = block
+		p.socks5Proxy.BlockPrivateRanges = block
+		p.socks4Proxy.BlockPrivateRanges = block
+		p.httpProxy.BlockPrivateRanges = block
+		p.transparent.BlockPrivateRanges = block
+	}
+}
+
+// WithResolver sets the resolver used to resolve destination names before dialing.
+func WithResolver(resolver statute.Resolver) Option {
+	return func(p *Proxy) {
+		p.resolver = resolver
+		p.socks5Proxy.Resolver = resolver
+		p.socks4Proxy.Resolver = resolver
+		p.httpProxy.Resolver = resolver
+		p.transparent.Resolver = resolver
+	}
+}
+
+// WithDSCP marks outbound and accepted sockets with the given DSCP value.
+func WithDSCP(value int) Option {
+	return func(p *Proxy) {
+		p.dscp = value
+		p.socks5Proxy.DSCP = value
+		p.socks4Proxy.DSCP = value
+		p.httpProxy.DSCP = value
+		p.transparent.DSCP = value
+	}
+}
+
+// WithConnMiddleware adds middleware wrapping every accepted connection, for
+// example statute.DeadlineMiddleware to bound each read and write.
+func WithConnMiddleware(middleware ...statute.ConnMiddleware) Option {
+	return func(p *Proxy) {
+		p.connMiddleware = append(p.connMiddleware, middleware...)
+	}
+}
+
+// WithAllowedSourceCIDRs drops connections from clients outside the given
+// networks before any protocol parsing. It panics if a network can't be parsed.
+func WithAllowedSourceCIDRs(cidrs ...string) Option {
+	return func(p *Proxy) {
+		p.allowedSources = append(p.allowedSources, statute.MustParseCIDRs(cidrs...)...)
+	}
+}
+
+// WithRejectWithRST makes connections rejected by the source allowlist close
+// with an RST instead of a FIN.
+func WithRejectWithRST(reset bool) Option {
+	return func(p *Proxy) {
+		p.rejectWithRST = reset
+	}
+}
+
+// WithPerIPByteQuota refuses new connections from client IPs that transferred
+// more than bytes within the sliding window.
+func WithPerIPByteQuota(bytes int64, window time.Duration) Option {
+	return func(p *Proxy) {
+		p.byteQuota = statute.NewByteQuota(bytes, window)
+	}
+}
+
+// WithHandlerErrorFilter leaves errors returned by user handlers out of the
+// logs when filter reports them as expected.
+func WithHandlerErrorFilter(filter statute.HandlerErrorFilter) Option {
+	return func(p *Proxy) {
+		p.handlerErrFilter = filter
+		p.socks5Proxy.HandlerErrorFilter = filter
+		p.socks4Proxy.HandlerErrorFilter = filter
+		p.httpProxy.HandlerErrorFilter = filter
+		p.transparent.HandlerErrorFilter = filter
+	}
+}
+
+// WithEventChannel publishes connection open, close and error events of every
+// protocol on ch. Events are dropped rather than blocking when ch is full, see
+// DroppedEvents.
+func WithEventChannel(ch chan<- statute.Event) Option {
+	return func(p *Proxy) {
+		p.events = statute.NewEventSink(ch)
+		p.socks5Proxy.Events = p.events
+		p.socks4Proxy.Events = p.events
+		p.httpProxy.Events = p.events
+		p.transparent.Events = p.events
+	}
+}
+
+// WithReverseDNS records the reverse DNS name of client IPs in connection log summaries, see statute.ReverseDNS.
+func WithReverseDNS(enable bool) Option {
+	return func(p *Proxy) {
+		p.reverseDNS = nil
+		if enable {
+			p.reverseDNS = statute.NewReverseDNS(nil)
+		}
+		p.socks5Proxy.ReverseDNS = p.reverseDNS
+		p.socks4Proxy.ReverseDNS = p.reverseDNS
+		p.httpProxy.ReverseDNS = p.reverseDNS
+		p.transparent.ReverseDNS = p.reverseDNS
+	}
+}
+
+// WithConnLog sets the callback receiving a summary of every connection
+// served, whatever its protocol.
+func WithConnLog(connLog statute.ConnLogFunc) Option {
+	return func(p *Proxy) {
+		p.connLog = connLog
+		p.socks5Proxy.ConnLog = connLog
+		p.socks4Proxy.ConnLog = connLog
+		p.httpProxy.ConnLog = connLog
+		p.transparent.ConnLog = connLog
+	}
+}
+
+// WithRequestInterceptors adds interceptors run on requests of every protocol
+// after parsing and before the destination is dialed.
+func WithRequestInterceptors(interceptors ...statute.RequestInterceptor) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.RequestInterceptors = append(p.socks5Proxy.RequestInterceptors, interceptors...)
+		p.socks4Proxy.RequestInterceptors = append(p.socks4Proxy.RequestInterceptors, interceptors...)
+		p.httpProxy.RequestInterceptors = append(p.httpProxy.RequestInterceptors, interceptors...)
+		p.transparent.RequestInterceptors = append(p.transparent.RequestInterceptors, interceptors...)
+	}
+}
+
+// WithStrictHostMatch makes the HTTP proxy reject requests whose Host header
+// disagrees with the request target.
+func WithStrictHostMatch(strict bool) Option {
+	return func(p *Proxy) {
+		p.httpProxy.StrictHostMatch = strict
+	}
+}
+
+// WithSelfURL makes the HTTP proxy answer requests addressed to host itself,
+// including a /__stats page summarizing the connections of every protocol.
+func WithSelfURL(host string) Option {
+	return func(p *Proxy) {
+		p.httpProxy.SelfHost = host
+	}
+}
+
+// WithPACFile makes the HTTP proxy serve content as a proxy auto-config file at path.
+func WithPACFile(content string, path string) Option {
+	return func(p *Proxy) {
+		p.httpProxy.PACFile = content
+		p.httpProxy.PACPath = path
+	}
+}
+
+// WithH2C enables serving prior-knowledge HTTP/2 (h2c) connections. When
+// disabled, clients sending the HTTP/2 preface are refused with a GOAWAY.
+func WithH2C(enable bool) Option {
+	return func(p *Proxy) {
+		p.httpProxy.H2C = enable
+	}
+}
+
+// WithTransparentMode makes the proxy treat every accepted connection as
+// redirected by the kernel (iptables REDIRECT) and tunnel it to its original
+// destination instead of parsing a SOCKS or HTTP request. Linux only.
+func WithTransparentMode(enable bool) Option {
+	return func(p *Proxy) {
+		p.transparentOn = enable
+	}
+}
+
+// WithTLSPassthrough makes the proxy accept raw TLS connections and tunnel
+// them to port 443 of the host named by the client's SNI.
+func WithTLSPassthrough(enable bool) Option {
+	return func(p *Proxy) {
+		p.tlsPassthrough = enable
+	}
+}
+
+// WithTLSRoutes terminates TLS connections at the proxy. The SNI of the
+// client selects the route, keyed by server name, whose certificate is
+// presented and whose handler serves the decrypted connection. The route
+// keyed "" serves clients with no or an unknown SNI, without it they are
+// refused. TLS routes take precedence over TLS passthrough.
+func WithTLSRoutes(routes map[string]TLSRoute) Option {
+	return func(p *Proxy) {
+		p.tlsRouter = newTLSRouter(routes)
 	}
 }
 
@@ -34,6 +233,7 @@ func WithUserHandler(handler userHandler) Option {
 		p.socks5Proxy.UserAssociateHandle = statute.UserAssociateHandler(handler)
 		p.socks4Proxy.UserConnectHandle = statute.UserConnectHandler(handler)
 		p.httpProxy.UserConnectHandle = statute.UserConnectHandler(handler)
+		p.transparent.UserConnectHandle = statute.UserConnectHandler(handler)
 	}
 }
 
@@ -44,6 +244,7 @@ func WithUserTCPHandler(handler userHandler) Option {
 		p.socks5Proxy.UserConnectHandle = statute.UserConnectHandler(handler)
 		p.socks4Proxy.UserConnectHandle = statute.UserConnectHandler(handler)
 		p.httpProxy.UserConnectHandle = statute.UserConnectHandler(handler)
+		p.transparent.UserConnectHandle = statute.UserConnectHandler(handler)
 	}
 }
 
@@ -55,6 +256,47 @@ func WithUserUDPHandler(handler userHandler) Option {
 	}
 }
 
+// WithAllowBind accepts SOCKS4 BIND requests, for protocols such as FTP in
+// active mode.
+func WithAllowBind(allow bool) Option {
+	return func(p *Proxy) {
+		p.socks4Proxy.AllowBind = allow
+	}
+}
+
+// WithUserBindHandler sets the handler opening the listener of SOCKS4 BIND
+// requests, which enables them.
+func WithUserBindHandler(handler statute.UserBindHandler) Option {
+	return func(p *Proxy) {
+		p.socks4Proxy.UserBindHandle = handler
+	}
+}
+
+// WithExtendedReplies follows SOCKS5 failure replies with the error message
+// for clients offering the private method 0xfe. Other clients are unaffected.
+func WithExtendedReplies(extended bool) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ExtendedReplies = extended
+	}
+}
+
+// WithTunnelCompression compresses SOCKS5 CONNECT tunnels with algo for
+// clients negotiating it, such as socks5.Dialer with the same Compression.
+// Other clients are unaffected.
+func WithTunnelCompression(algo statute.Compression) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.TunnelCompression = algo
+	}
+}
+
+// WithStrictProtocol makes the SOCKS5 server reject malformed requests, such
+// as a non-zero reserved byte, rather than parsing them best effort.
+func WithStrictProtocol(strict bool) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.StrictProtocol = strict
+	}
+}
+
 // WithUserDialFunc sets the user-defined dial function for the proxy.
 func WithUserDialFunc(proxyDial statute.ProxyDialFunc) Option {
 	return func(p *Proxy) {
@@ -62,6 +304,7 @@ func WithUserDialFunc(proxyDial statute.ProxyDialFunc) Option {
 		p.socks5Proxy.ProxyDial = proxyDial
 		p.socks4Proxy.ProxyDial = proxyDial
 		p.httpProxy.ProxyDial = proxyDial
+		p.transparent.ProxyDial = proxyDial
 	}
 }
 
@@ -72,6 +315,22 @@ func WithUserListenPacketFunc(proxyListenPacket statute.ProxyListenPacket) Optio
 	}
 }
 
+// WithTargetListenPacketFunc sets the function opening the egress socket for
+// each SOCKS5 UDP target.
+func WithTargetListenPacketFunc(targetListenPacket statute.TargetListenPacket) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.TargetListenPacket = targetListenPacket
+	}
+}
+
+// WithDatagramHandler sets the function inspecting, rewriting or dropping
+// each datagram of SOCKS5 UDP associate sessions before it is relayed.
+func WithDatagramHandler(handler statute.DatagramHandler) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.DatagramHandler = handler
+	}
+}
+
 // WithUserForwardAddressFunc sets the user-defined forward address function for the proxy.
 func WithUserForwardAddressFunc(packetForwardAddress statute.PacketForwardAddress) Option {
 	return func(p *Proxy) {
@@ -86,14 +345,296 @@ func WithContext(ctx context.Context) Option {
 		p.socks5Proxy.Context = ctx
 		p.socks4Proxy.Context = ctx
 		p.httpProxy.Context = ctx
+		p.transparent.Context = ctx
+	}
+}
+
+// WithProtocolDetector replaces DetectProtocol for choosing the protocol of
+// accepted connections. Protocols without a handler registered by
+// WithProtocolHandler that are not built in are served as HTTP.
+func WithProtocolDetector(detector ProtocolDetector) Option {
+	return func(p *Proxy) {
+		p.detector = detector
+	}
+}
+
+// WithProtocolHandler serves connections detected as protocol with handler,
+// taking precedence over the built-in server for that protocol.
+func WithProtocolHandler(protocol statute.Protocol, handler ProtocolHandler) Option {
+	return func(p *Proxy) {
+		if p.protocolHandlers == nil {
+			p.protocolHandlers = make(map[statute.Protocol]ProtocolHandler)
+		}
+		p.protocolHandlers[protocol] = handler
+	}
+}
+
+// WithDefaultPorts sets the ports the HTTP proxy uses for http and https
+// requests that don't name one.
+func WithDefaultPorts(httpPort, httpsPort int) Option {
+	return func(p *Proxy) {
+		p.httpProxy.DefaultHTTPPort = httpPort
+		p.httpProxy.DefaultHTTPSPort = httpsPort
+	}
+}
+
+// WithAllowedMethods restricts requests forwarded by the HTTP proxy to the
+// given methods.
+func WithAllowedMethods(methods ...string) Option {
+	return func(p *Proxy) {
+		p.httpProxy.AllowedMethods = methods
+	}
+}
+
+// WithMaxRequestLineBytes answers HTTP requests whose request line is longer
+// than n bytes with 414 URI Too Long.
+func WithMaxRequestLineBytes(n int) Option {
+	return func(p *Proxy) {
+		p.httpProxy.MaxRequestLineBytes = n
+	}
+}
+
+// WithPinnedResolution pins each HTTP destination to the first address it
+// connected to for the life of the client connection.
+func WithPinnedResolution(pinned bool) Option {
+	return func(p *Proxy) {
+		p.httpProxy.PinnedResolution = pinned
+	}
+}
+
+// WithConnectPorts restricts HTTP CONNECT requests to the given destination ports.
+func WithConnectPorts(ports ...int) Option {
+	return func(p *Proxy) {
+		p.httpProxy.ConnectPorts = ports
+	}
+}
+
+// WithResponseHeaders sets header on responses forwarded by the HTTP proxy,
+// replacing the values the origin sent for the same names.
+func WithResponseHeaders(header nethttp.Header) Option {
+	return func(p *Proxy) {
+		p.httpProxy.ResponseHeaders = header.Clone()
+	}
+}
+
+// WithMuxHint detects tunnels of every protocol carrying a multiplexed
+// session from the first bytes the client sends and tunes them with larger
+// socket buffers and no idle deadline.
+func WithMuxHint(detector statute.MuxDetector) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.MuxHint = detector
+		p.socks4Proxy.MuxHint = detector
+		p.httpProxy.MuxHint = detector
+		p.transparent.MuxHint = detector
+	}
+}
+
+// WithCloseGrace lets tunnels of every protocol flush in-flight data for up
+// to grace when the proxy's context is cancelled, half-closing them and
+// waiting for their peers to close before closing them.
+func WithCloseGrace(grace time.Duration) Option {
+	return func(p *Proxy) {
+		p.closeGrace = grace
+		p.socks5Proxy.CloseGrace = grace
+		p.socks4Proxy.CloseGrace = grace
+		p.httpProxy.CloseGrace = grace
+		p.transparent.CloseGrace = grace
+	}
+}
+
+// WithMaxConcurrentHandshakes bounds how many connections of every protocol
+// are in their handshake phase at once, from detecting their protocol until
+// the tunnel starts or the connection is rejected. Connections beyond the
+// limit wait for a slot. Zero or less doesn't limit them.
+func WithMaxConcurrentHandshakes(n int) Option {
+	return func(p *Proxy) {
+		p.handshakes = statute.NewHandshakeLimiter(n)
+	}
+}
+
+// WithAcceptRateLimit paces accepted connections to perSec per second, in
+// bursts of up to burst.
+func WithAcceptRateLimit(perSec int, burst int) Option {
+	return func(p *Proxy) {
+		p.acceptRate = perSec
+		p.acceptBurst = burst
+	}
+}
+
+// WithRejectOverAcceptRate closes connections over the rate set by
+// WithAcceptRateLimit at once rather than making them wait.
+func WithRejectOverAcceptRate(reject bool) Option {
+	return func(p *Proxy) {
+		p.rejectOverRate = reject
+	}
+}
+
+// WithAddressResolver connects SOCKS5 CONNECT destinations with resolver,
+// given their parsed address, so names and IPs can take different paths.
+// It replaces the dial function for them, along with the resolver and socket
+// options it applies, but connections reaching the proxy itself or, with
+// WithBlockPrivateRanges, a private address are still refused.
+func WithAddressResolver(resolver socks5.AddressResolverFunc) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.AddressResolver = resolver
+	}
+}
+
+// WithUserinfoAuthorization sends the userinfo of absolute HTTP request URIs
+// to the origin as Basic Authorization, unless the request has one already.
+func WithUserinfoAuthorization(enabled bool) Option {
+	return func(p *Proxy) {
+		p.httpProxy.UserinfoAuthorization = enabled
+	}
+}
+
+// WithSessionTTLExtension lets SOCKS5 clients offering the private method 0xfb
+// send the maximum lifetime of uncompressed CONNECT tunnels once the reply
+// accepts it, four bytes big-endian in seconds, after which the tunnel is
+// closed.
+func WithSessionTTLExtension(enabled bool) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.SessionTTLExtension = enabled
+	}
+}
+
+// WithAddressType handles SOCKS5 requests addressed with the custom address
+// type addrType, reading and writing its body with reader and writer.
+func WithAddressType(addrType byte, reader socks5.AddressReaderFunc, writer socks5.AddressWriterFunc) Option {
+	return func(p *Proxy) {
+		if p.socks5Proxy.AddressTypes == nil {
+			p.socks5Proxy.AddressTypes = make(map[byte]socks5.AddressType)
+		}
+		p.socks5Proxy.AddressTypes[addrType] = socks5.AddressType{Read: reader, Write: writer}
+	}
+}
+
+// WithMaxConnLifetime closes connections of every protocol lifetime after
+// they were accepted, even while they are actively transferring data.
+func WithMaxConnLifetime(lifetime time.Duration) Option {
+	return func(p *Proxy) {
+		p.maxConnLifetime = lifetime
+	}
+}
+
+// WithSocketBuffers sets the receive and send socket buffer sizes of client
+// and destination connections of every protocol. Zero leaves the OS default.
+func WithSocketBuffers(recv, send int) Option {
+	return func(p *Proxy) {
+		p.socketRecvBuffer = recv
+		p.socketSendBuffer = send
+		p.socks5Proxy.SocketRecvBuffer = recv
+		p.socks5Proxy.SocketSendBuffer = send
+		p.socks4Proxy.SocketRecvBuffer = recv
+		p.socks4Proxy.SocketSendBuffer = send
+		p.httpProxy.SocketRecvBuffer = recv
+		p.httpProxy.SocketSendBuffer = send
+		p.transparent.SocketRecvBuffer = recv
+		p.transparent.SocketSendBuffer = send
+	}
+}
+
+// WithTunnelKeepalive enables TCP keepalive probes at the given interval on tunnels, see statute.KeepAliveDial.
+func WithTunnelKeepalive(interval time.Duration) Option {
+	return func(p *Proxy) {
+		p.tunnelKeepalive = interval
+		p.socks5Proxy.TunnelKeepalive = interval
+		p.socks4Proxy.TunnelKeepalive = interval
+		p.httpProxy.TunnelKeepalive = interval
+		p.transparent.TunnelKeepalive = interval
+	}
+}
+
+// WithFirstByteTimeout closes connections whose client sends nothing within
+// timeout of connecting, before the protocol is detected. Once data arrives
+// the timeout no longer applies.
+func WithFirstByteTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.firstByteTimeout = timeout
+	}
+}
+
+// WithWorkerPool serves connections with a fixed set of size workers instead
+// of a goroutine per connection. Accepted connections wait in a queue of the
+// same size; once it is full, accepting blocks until a worker is free.
+func WithWorkerPool(size int) Option {
+	return func(p *Proxy) {
+		p.workerPool = size
+	}
+}
+
+// WithBindReplyAddr advertises ip instead of the proxy's local address in
+// SOCKS success replies.
+func WithBindReplyAddr(ip net.IP) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.BindReplyIP = ip
+		p.socks4Proxy.BindReplyIP = ip
+	}
+}
+
+// WithConnectTimeout bounds how long establishing a connection to a
+// destination may take on every protocol.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.connectTimeout = timeout
+		p.socks5Proxy.ConnectTimeout = timeout
+		p.socks4Proxy.ConnectTimeout = timeout
+		p.httpProxy.ConnectTimeout = timeout
+		p.transparent.ConnectTimeout = timeout
+	}
+}
+
+// WithNetns dials destinations from within the Linux network namespace at
+// path on every protocol.
+func WithNetns(path string) Option {
+	return func(p *Proxy) {
+		p.netns = path
+		p.socks5Proxy.Netns = path
+		p.socks4Proxy.Netns = path
+		p.httpProxy.Netns = path
+		p.transparent.Netns = path
+	}
+}
+
+// WithVerboseReplies logs a diagnostic of every failed SOCKS5 CONNECT, listing
+// the resolved addresses tried and the error of each.
+func WithVerboseReplies(verbose bool) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.VerboseReplies = verbose
+	}
+}
+
+// WithDestinationClassifier labels connection metrics of every protocol with
+// the class classify maps their destination host to.
+func WithDestinationClassifier(classify statute.DestinationClassifier) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.DestinationClassifier = classify
+		p.socks4Proxy.DestinationClassifier = classify
+		p.httpProxy.DestinationClassifier = classify
+		p.transparent.DestinationClassifier = classify
+	}
+}
+
+// WithBuffers sets the sizes of the buffers for data read from clients
+// (upload) and written to them (download) on every protocol.
+func WithBuffers(readSize, writeSize int) Option {
+	return func(p *Proxy) {
+		p.readBufferSize = readSize
+		p.writeBufferSize = writeSize
+		p.socks5Proxy.ReadBufferSize, p.socks5Proxy.WriteBufferSize = readSize, writeSize
+		p.socks4Proxy.ReadBufferSize, p.socks4Proxy.WriteBufferSize = readSize, writeSize
+		p.httpProxy.ReadBufferSize, p.httpProxy.WriteBufferSize = readSize, writeSize
+		p.transparent.ReadBufferSize, p.transparent.WriteBufferSize = readSize, writeSize
 	}
 }
 
 // WithBytesPool sets the byte pool for the proxy.
 func WithBytesPool(bytesPool statute.BytesPool) Option {
 	return func(p *Proxy) {
+		p.bytesPool = bytesPool
 		p.socks5Proxy.BytesPool = bytesPool
 		p.socks4Proxy.BytesPool = bytesPool
 		p.httpProxy.BytesPool = bytesPool
+		p.transparent.BytesPool = bytesPool
 	}
 }
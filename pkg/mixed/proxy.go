@@ -3,12 +3,17 @@ package mixed
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/bepass-org/proxy/pkg/http"
 	"github.com/bepass-org/proxy/pkg/socks4"
 	"github.com/bepass-org/proxy/pkg/socks5"
 	"github.com/bepass-org/proxy/pkg/statute"
+	"github.com/bepass-org/proxy/pkg/transparent"
 )
 
 // userHandler is a function type for handling proxy requests.
@@ -16,40 +21,122 @@ type userHandler func(request *statute.ProxyRequest) error
 
 // Proxy is a multiprotocol proxy server.
 type Proxy struct {
-	bind           string                // Address to listen on
-	socks5Proxy    *socks5.Server        // SOCKS5 server with TCP and UDP support
-	socks4Proxy    *socks4.Server        // SOCKS4 server with TCP support
-	httpProxy      *http.Server          // HTTP proxy server with HTTP and HTTP-connect support
-	userHandler    userHandler           // General handler for TCP and UDP requests
-	userTCPHandler userHandler           // User-defined handler for TCP requests
-	userUDPHandler userHandler           // User-defined handler for UDP requests
-	userDialFunc   statute.ProxyDialFunc // User-defined dial function
-	logger         statute.Logger        // Logger for error logs
-	ctx            context.Context       // Default context
+	bind             string                               // Address to listen on
+	socks5Proxy      *socks5.Server                       // SOCKS5 server with TCP and UDP support
+	socks4Proxy      *socks4.Server                       // SOCKS4 server with TCP support
+	httpProxy        *http.Server                         // HTTP proxy server with HTTP and HTTP-connect support
+	userHandler      userHandler                          // General handler for TCP and UDP requests
+	userTCPHandler   userHandler                          // User-defined handler for TCP requests
+	userUDPHandler   userHandler                          // User-defined handler for UDP requests
+	userDialFunc     statute.ProxyDialFunc                // User-defined dial function
+	logger           statute.Logger                       // Logger for error logs
+	ctx              context.Context                      // Default context
+	dscp             int                                  // DSCP value for accepted sockets and TLS passthrough destinations
+	blockPrivate     bool                                 // Refuse TLS passthrough destinations in private ranges
+	resolver         statute.Resolver                     // Resolves TLS passthrough destinations, nil leaves it to the dial function
+	bytesPool        statute.BytesPool                    // Buffers of TLS passthrough tunnels, nil to allocate them
+	tlsPassthrough   bool                                 // Tunnel raw TLS connections to their SNI host
+	tlsRouter        *tlsRouter                           // Terminates TLS connections by their SNI, nil for none
+	connMiddleware   []statute.ConnMiddleware             // Wrappers applied to accepted connections
+	detector         ProtocolDetector                     // Picks the protocol of accepted connections
+	protocolHandlers map[statute.Protocol]ProtocolHandler // Serve protocols picked by the detector, overriding the built-in servers
+	readBufferSize   int                                  // Buffer size for data read from TLS passthrough clients, zero for the default
+	writeBufferSize  int                                  // Buffer size for data written to TLS passthrough clients, zero for the default
+	tunnelKeepalive  time.Duration                        // TCP keepalive interval of client and TLS passthrough connections, zero for the default
+	socketRecvBuffer int                                  // SO_RCVBUF size of client and TLS passthrough connections, zero for the default
+	socketSendBuffer int                                  // SO_SNDBUF size of client and TLS passthrough connections, zero for the default
+	firstByteTimeout time.Duration                        // Closes connections sending nothing for this long, zero for none
+	connectTimeout   time.Duration                        // Bounds dialing TLS passthrough destinations, zero for none
+	transparent      *transparent.Server                  // Server for kernel-redirected connections
+	transparentOn    bool                                 // Serve every connection in transparent mode
+	allowedSources   []*net.IPNet                         // Client networks accepted, empty allows all
+	stats            *statute.StatsCollector              // Counts the connections served by every protocol
+	connLog          statute.ConnLogFunc                  // Receives a summary of every connection
+	rejectWithRST    bool                                 // Reset rather than close rejected connections
+	byteQuota        *statute.ByteQuota                   // Per client IP byte quota, nil for none
+	workerPool       int                                  // Number of workers serving connections, zero for a goroutine per connection
+	handlerErrFilter statute.HandlerErrorFilter           // Reports user handler errors to leave out of the logs
+	netns            string                               // Network namespace TLS passthrough destinations are dialed from
+	events           *statute.EventSink                   // Receives the connection events of every protocol, nil for none
+	reverseDNS       *statute.ReverseDNS                  // Looks up the names of client IPs for connLog, nil for none
+	maxConnLifetime  time.Duration                        // Closes connections this long after they were accepted, zero for no limit
+	handshakes       *statute.HandshakeLimiter            // Bounds the connections negotiating at once, nil for no limit
+	listenAddrs      *statute.ListenAddrs                 // Addresses the proxy listens on, refused as destinations
+	closeGrace       time.Duration                        // Bounds flushing TLS passthrough tunnels once ctx is cancelled, zero for none
+	acceptRate       int                                  // Connections accepted per second, zero for no limit
+	acceptBurst      int                                  // Connections accepted at once within acceptRate
+	rejectOverRate   bool                                 // Close connections over acceptRate rather than holding them back
+
+	mu       sync.Mutex
+	listener net.Listener          // Listener of the running ListenAndServe
+	conns    map[net.Conn]struct{} // Active connections
+	active   int                   // Number of active connections, including refused ones
+	idle     chan struct{}         // Closed when active drops to zero during Shutdown
+	closed   bool                  // Set once Shutdown has been called
 }
 
 // NewProxy creates a new multiprotocol proxy server with options.
 func NewProxy(options ...Option) *Proxy {
+	stats := statute.NewStatsCollector()
+	listenAddrs := statute.NewListenAddrs()
 	p := &Proxy{
 		bind:         statute.DefaultBindAddress,
-		socks5Proxy:  socks5.NewServer(),
-		socks4Proxy:  socks4.NewServer(),
-		httpProxy:    http.NewServer(),
+		socks5Proxy:  socks5.NewServer(socks5.WithStats(stats)),
+		socks4Proxy:  socks4.NewServer(socks4.WithStats(stats)),
+		httpProxy:    http.NewServer(http.WithStats(stats)),
+		transparent:  transparent.NewServer(transparent.WithStats(stats)),
+		stats:        stats,
+		listenAddrs:  listenAddrs,
 		userDialFunc: statute.DefaultProxyDial(),
 		logger:       statute.DefaultLogger{},
 		ctx:          statute.DefaultContext(),
+		detector:     DetectProtocol,
 	}
 
 	for _, option := range options {
 		option(p)
 	}
 
+	// connections are accepted by the proxy, so its listeners are the ones
+	// every protocol must not dial back into
+	p.socks5Proxy.ListenAddrs = listenAddrs
+	p.socks4Proxy.ListenAddrs = listenAddrs
+	p.httpProxy.ListenAddrs = listenAddrs
+	p.transparent.ListenAddrs = listenAddrs
+
+	if p.socks5Proxy.OpenProxy() {
+		statute.Warn(p.logger, "proxy on "+p.bind+" accepts SOCKS5 clients without authentication")
+	}
+
 	return p
 }
 
 // Option is a function type for configuring the Proxy.
 type Option func(*Proxy)
 
+// Stats returns a snapshot of the connections served on every protocol.
+func (p *Proxy) Stats() statute.Stats {
+	return p.stats.Snapshot()
+}
+
+// ActiveConnections returns the connections being served on every protocol,
+// oldest first.
+func (p *Proxy) ActiveConnections() []statute.ConnInfo {
+	return p.stats.Connections()
+}
+
+// DroppedEvents returns the number of events dropped because the channel
+// set by WithEventChannel was full.
+func (p *Proxy) DroppedEvents() int64 {
+	return p.events.Dropped()
+}
+
+// Handshakes returns the number of connections in their handshake phase and
+// of those waiting for a slot set by WithMaxConcurrentHandshakes.
+func (p *Proxy) Handshakes() (active, waiting int) {
+	return p.handshakes.Active(), p.handshakes.Waiting()
+}
+
 // SwitchConn wraps a net.Conn and a bufio.Reader.
 type SwitchConn struct {
 	net.Conn
@@ -69,65 +156,302 @@ func (c *SwitchConn) Read(p []byte) (n int, err error) {
 	return c.reader.Read(p)
 }
 
+// NetConn returns the wrapped net.Conn.
+func (c *SwitchConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 // ListenAndServe starts the proxy server and begins listening for incoming connections.
+// It returns an error wrapping statute.ErrBindFailed if it can't listen, or
+// statute.ErrShutdown once the proxy's context is cancelled or it is shut down.
 func (p *Proxy) ListenAndServe() error {
 	p.logger.Debug("Serving on " + p.bind + " ...")
-	ln, err := net.Listen("tcp", p.bind)
+	ln, err := statute.Listen("tcp", p.bind)
 	if err != nil {
 		p.logger.Error("Error listening on " + p.bind + ", " + err.Error())
-		return err
+		return statute.BindError(err)
 	}
-	defer func() {
+	if !p.serveListener(ln) {
 		_ = ln.Close()
+		return ErrProxyClosed
+	}
+	p.listenAddrs.Add(ln.Addr())
+	// Reload may have swapped the listener by the time serving stops
+	defer func() {
+		current := p.currentListener()
+		_ = current.Close()
+		p.listenAddrs.Remove(current.Addr())
 	}()
 
 	ctx, cancel := context.WithCancel(p.ctx)
 	defer cancel()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := ln.Accept()
-			if err != nil {
-				p.logger.Error(err)
-				continue
-			}
+	// close the listener on cancellation so a blocked Accept returns
+	go func() {
+		<-ctx.Done()
+		_ = p.currentListener().Close()
+	}()
 
+	var queue chan net.Conn
+	if p.workerPool > 0 {
+		queue = make(chan net.Conn, p.workerPool)
+		// workers drain the connections still queued once accepting stops
+		defer close(queue)
+		for i := 0; i < p.workerPool; i++ {
 			go func() {
-				err := p.handleConnection(conn)
-				if err != nil {
-					p.logger.Error(err)
+				for conn := range queue {
+					p.serveTracked(conn)
 				}
 			}()
 		}
 	}
+
+	acceptRate := statute.NewAcceptRateLimiter(p.acceptRate, p.acceptBurst, p.rejectOverRate)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return statute.ShutdownError(ctx)
+			}
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			if next := p.currentListener(); next != ln {
+				// replaced by Reload
+				ln = next
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return statute.AcceptError(err)
+			}
+			p.logger.Error(err)
+			continue
+		}
+		if !acceptRate.Admit(ctx) {
+			p.logger.Debug("accept rate exceeded, rejected connection from " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, p.rejectWithRST)
+			continue
+		}
+		if !statute.SourceAllowed(conn.RemoteAddr(), p.allowedSources) {
+			p.logger.Debug("rejected connection from " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, p.rejectWithRST)
+			continue
+		}
+		if p.byteQuota != nil && !p.byteQuota.Allow(statute.RemoteIP(conn.RemoteAddr())) {
+			p.logger.Debug("byte quota exceeded for " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, p.rejectWithRST)
+			continue
+		}
+		if !p.trackConn(conn) {
+			go p.rejectDraining(conn)
+			continue
+		}
+		if p.dscp != 0 {
+			if err := statute.SetDSCP(conn, p.dscp); err != nil {
+				p.logger.Debug(err)
+			}
+		}
+		if p.tunnelKeepalive > 0 {
+			if err := statute.SetKeepAlive(conn, p.tunnelKeepalive); err != nil {
+				p.logger.Debug(err)
+			}
+		}
+		if p.socketRecvBuffer > 0 || p.socketSendBuffer > 0 {
+			if err := statute.SetSocketBuffers(conn, p.socketRecvBuffer, p.socketSendBuffer); err != nil {
+				p.logger.Debug(err)
+			}
+		}
+
+		if queue == nil {
+			go p.serveTracked(conn)
+			continue
+		}
+		// block accepting while every worker is busy and the queue is full
+		select {
+		case queue <- conn:
+		case <-ctx.Done():
+			_ = conn.Close()
+			p.untrackConn(conn)
+			return statute.ShutdownError(ctx)
+		}
+	}
+}
+
+// serveTracked handles a connection registered with trackConn and
+// unregisters it once served.
+func (p *Proxy) serveTracked(conn net.Conn) {
+	defer p.untrackConn(conn)
+	stop := statute.LimitLifetime(conn, p.maxConnLifetime)
+	defer stop()
+	err := p.handleConnection(conn)
+	if err != nil {
+		statute.LogConnError(p.logger, err, p.handlerErrFilter)
+	}
 }
 
 // handleConnection handles incoming connections and routes them based on the detected protocol.
 func (p *Proxy) handleConnection(conn net.Conn) error {
-	switchConn := NewSwitchConn(conn)
-	buf := make([]byte, 1)
+	if p.transparentOn {
+		// the original destination is read from the socket before any
+		// middleware hides it
+		dest, err := transparent.OriginalDestination(conn)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		conn, err = p.beginHandshake(conn)
+		if err != nil {
+			return err
+		}
+		defer statute.EndHandshake(conn)
+		return p.transparent.ServeRedirected(p.wrapConn(conn), dest)
+	}
 
-	_, err := switchConn.Read(buf)
+	conn, err := p.beginHandshake(conn)
 	if err != nil {
 		return err
 	}
+	defer statute.EndHandshake(conn)
+	return p.serveDetected(p.wrapConn(conn), false)
+}
+
+// beginHandshake waits for a handshake slot for conn, closing it if the
+// proxy's context ends first.
+func (p *Proxy) beginHandshake(conn net.Conn) (net.Conn, error) {
+	limited, err := p.handshakes.Begin(p.ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return limited, nil
+}
+
+// serveDetected serves conn with the server of the protocol detected from
+// its first bytes. Connections decrypted by a TLS route can't be TLS again.
+func (p *Proxy) serveDetected(conn net.Conn, decrypted bool) error {
+	switchConn := NewSwitchConn(conn)
 
-	err = switchConn.reader.UnreadByte()
+	// a timer rather than a read deadline, so deadlines set by middleware
+	// are left alone
+	var timer *time.Timer
+	if p.firstByteTimeout > 0 {
+		timer = time.AfterFunc(p.firstByteTimeout, func() {
+			_ = conn.Close()
+		})
+	}
+	protocol, err := p.detector(switchConn.reader)
+	if timer != nil && !timer.Stop() {
+		return fmt.Errorf("no data from %v within %v", conn.RemoteAddr(), p.firstByteTimeout)
+	}
 	if err != nil {
 		return err
 	}
 
 	switch {
-	case buf[0] == 5:
-		err = p.socks5Proxy.ServeConn(switchConn)
-	case buf[0] == 4:
-		err = p.socks4Proxy.ServeConn(switchConn)
+	case p.protocolHandlers[protocol] != nil:
+		statute.EndHandshake(switchConn)
+		err = p.protocolHandlers[protocol](switchConn)
+	case protocol == statute.ProtocolSOCKS5:
+		err = p.socks5Proxy.ServeConnReader(switchConn.Conn, switchConn.reader)
+	case protocol == statute.ProtocolSOCKS4:
+		err = p.socks4Proxy.ServeConnReader(switchConn.Conn, switchConn.reader)
+	case protocol == statute.ProtocolH2C:
+		err = p.httpProxy.ServeH2CConn(switchConn)
+	case protocol == statute.ProtocolTLS && decrypted:
+		_ = conn.Close()
+		err = fmt.Errorf("nested TLS from %v", conn.RemoteAddr())
+	case protocol == statute.ProtocolTLS && p.tlsRouter != nil:
+		err = p.handleTLSTermination(switchConn)
+	case protocol == statute.ProtocolTLS && p.tlsPassthrough:
+		err = p.handleTLSPassthrough(switchConn)
 	default:
 		err = p.httpProxy.ServeConn(switchConn)
 	}
 
 	return err
 }
+
+// wrapConn applies the byte quota accounting and the middleware to an accepted connection.
+func (p *Proxy) wrapConn(conn net.Conn) net.Conn {
+	if p.byteQuota != nil {
+		conn = p.byteQuota.Conn(conn)
+	}
+	return statute.ApplyConnMiddleware(conn, p.connMiddleware)
+}
+
+// handleTLSPassthrough tunnels a raw TLS connection to port 443 of the host
+// named in its ClientHello. The parsed hello is passed to the dial function
+// through the context, see statute.ClientHelloFromContext.
+func (p *Proxy) handleTLSPassthrough(conn *SwitchConn) error {
+	// the reader must hold the largest hello to parse it
+	conn.reader = bufio.NewReaderSize(conn.reader, statute.ClientHelloMaxSize)
+	tracker := p.stats.Track(conn, statute.ProtocolTLS)
+	tracker.Notify(p.events)
+	tracker.ReverseLookup(p.reverseDNS)
+	err := p.tunnelTLS(tracker.Conn(), conn.reader, tracker)
+	tracker.Done(err, p.connLog)
+	return err
+}
+
+// tunnelTLS peeks the ClientHello from reader, which buffers conn, and tunnels
+// conn to the server it names.
+func (p *Proxy) tunnelTLS(conn net.Conn, reader *bufio.Reader, tracker *statute.ConnTracker) error {
+	hello, err := statute.PeekClientHello(reader)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if hello.ServerName == "" {
+		_ = conn.Close()
+		return errors.New("tls passthrough: client hello has no server name")
+	}
+
+	destination := net.JoinHostPort(hello.ServerName, "443")
+	tracker.SetDestination(destination)
+
+	ctx := statute.ContextWithClientHello(p.ctx, hello)
+	target, err := p.passthroughDial()(ctx, "tcp", destination)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	// conn is the source here, so its first buffer carries data to the client
+	buf1, buf2, release := statute.TunnelBuffers(p.bytesPool, p.writeBufferSize, p.readBufferSize)
+	defer release()
+	return statute.Tunnel(statute.ContextWithCloseGrace(p.ctx, p.closeGrace), conn, target, buf1, buf2)
+}
+
+// passthroughDial returns the dial function of TLS passthrough destinations,
+// applying the same guards and socket options as the servers of the other
+// protocols.
+func (p *Proxy) passthroughDial() statute.ProxyDialFunc {
+	dial := statute.SelfDialGuard(p.userDialFunc, p.listenAddrs)
+	if p.netns != "" {
+		dial = statute.NetnsDial(dial, p.netns)
+	}
+	if p.dscp != 0 {
+		dial = statute.DSCPDial(dial, p.dscp)
+	}
+	if p.tunnelKeepalive > 0 {
+		dial = statute.KeepAliveDial(dial, p.tunnelKeepalive)
+	}
+	if p.socketRecvBuffer > 0 || p.socketSendBuffer > 0 {
+		dial = statute.SocketBuffersDial(dial, p.socketRecvBuffer, p.socketSendBuffer)
+	}
+
+	resolver := p.resolver
+	if p.blockPrivate {
+		if resolver == nil {
+			resolver = statute.DefaultResolver()
+		}
+		dial = statute.BlockPrivateDial(resolver, dial)
+	} else if resolver != nil {
+		dial = statute.ResolveDial(resolver, dial)
+	}
+
+	if p.connectTimeout > 0 {
+		dial = statute.TimeoutDial(dial, p.connectTimeout)
+	}
+	return dial
+}
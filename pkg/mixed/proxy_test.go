@@ -0,0 +1,577 @@
+package mixed
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+type quietLogger struct{}
+
+func (quietLogger) Debug(...interface{}) {}
+func (quietLogger) Error(...interface{}) {}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// serve runs a proxy built with options on a loopback address until the
+// test ends, returning it and its address.
+func serve(t testing.TB, options ...Option) (*Proxy, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	options = append([]Option{WithLogger(quietLogger{}), WithBinAddress(addr), WithContext(ctx)}, options...)
+	p := NewProxy(options...)
+
+	go func() {
+		_ = p.ListenAndServe()
+	}()
+	t.Cleanup(cancel)
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return p, addr
+		}
+	}
+	t.Fatalf("proxy on %s didn't start", addr)
+	return nil, ""
+}
+
+// echoServer runs a TCP server echoing what it reads until the test ends,
+// returning its address.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// sendClientHello starts a TLS handshake with config over a connection to
+// proxy, and gives up on it after a second, returning how it failed.
+func sendClientHello(proxy string, config *tls.Config) error {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	return tls.Client(conn, config).Handshake()
+}
+
+func TestTLSPassthroughClientHello(t *testing.T) {
+	echo := echoServer(t)
+	hellos := make(chan *statute.ClientHello, 2)
+	dests := make(chan string, 2)
+	_, proxy := serve(t, WithTLSPassthrough(true), WithUserDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		hello, _ := statute.ClientHelloFromContext(ctx)
+		hellos <- hello
+		dests <- address
+		var d net.Dialer
+		return d.DialContext(ctx, network, echo)
+	}))
+
+	// ALPN protocols push the hello past the default reader size
+	var protos []string
+	for i := 0; i < 40; i++ {
+		protos = append(protos, strings.Repeat(string(rune('a'+i%26)), 200))
+	}
+	config := &tls.Config{ServerName: "service.example", NextProtos: protos, InsecureSkipVerify: true}
+
+	var ja3 string
+	for i := 0; i < 2; i++ {
+		go sendClientHello(proxy, config)
+		select {
+		case hello := <-hellos:
+			if hello == nil {
+				t.Fatal("no ClientHello in the dial context")
+			}
+			if hello.ServerName != "service.example" {
+				t.Errorf("ServerName = %q", hello.ServerName)
+			}
+			if len(hello.ALPNProtocols) != len(protos) {
+				t.Errorf("got %d ALPN protocols, want %d", len(hello.ALPNProtocols), len(protos))
+			}
+			if i == 0 {
+				ja3 = hello.JA3()
+			} else if hello.JA3() != ja3 {
+				t.Errorf("JA3 changed from %q to %q", ja3, hello.JA3())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("passthrough didn't dial")
+		}
+		if dest := <-dests; dest != "service.example:443" {
+			t.Errorf("dialed %q", dest)
+		}
+	}
+	if ja3 == "" || strings.Count(ja3, ",") != 4 {
+		t.Errorf("malformed JA3 %q", ja3)
+	}
+}
+
+func TestTLSPassthroughBlockPrivateRanges(t *testing.T) {
+	dialed := make(chan string, 1)
+	_, proxy := serve(t, WithTLSPassthrough(true), WithBlockPrivateRanges(true),
+		WithUserDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			return nil, io.EOF
+		}))
+
+	// the proxy closes the connection once it refused the destination
+	err := sendClientHello(proxy, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("handshake through the proxy: got %v, want the connection closed", err)
+	}
+	select {
+	case address := <-dialed:
+		t.Fatalf("dialed %s, a private address", address)
+	default:
+	}
+}
+
+// warnLogger records the warnings logged.
+type warnLogger struct {
+	quietLogger
+	warnings []string
+}
+
+func (l *warnLogger) Warn(v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprint(v...))
+}
+
+func TestOpenProxyWarning(t *testing.T) {
+	for bind, warn := range map[string]bool{"0.0.0.0:1080": true, "127.0.0.1:1080": false} {
+		logger := &warnLogger{}
+		NewProxy(WithLogger(logger), WithBinAddress(bind))
+		if warned := len(logger.warnings) > 0; warned != warn {
+			t.Errorf("%s: warned %v (%q), want %v", bind, warned, logger.warnings, warn)
+		}
+	}
+}
+
+func TestListenAndServeErrors(t *testing.T) {
+	t.Run("bind", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		p := NewProxy(WithLogger(quietLogger{}), WithBinAddress(ln.Addr().String()))
+		if err := p.ListenAndServe(); !errors.Is(err, statute.ErrBindFailed) {
+			t.Errorf("got %v, want ErrBindFailed", err)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		p := NewProxy(WithLogger(quietLogger{}), WithBinAddress(freeAddr(t)), WithContext(ctx))
+		done := make(chan error, 1)
+		go func() {
+			done <- p.ListenAndServe()
+		}()
+		cancel()
+		select {
+		case err := <-done:
+			if !errors.Is(err, statute.ErrShutdown) {
+				t.Errorf("got %v, want ErrShutdown", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("ListenAndServe didn't return")
+		}
+	})
+}
+
+func TestProxyRequestProtocol(t *testing.T) {
+	protocols := make(chan statute.Protocol, 1)
+	_, addr := serve(t, WithUserHandler(func(req *statute.ProxyRequest) error {
+		protocols <- req.Protocol
+		return nil
+	}))
+	send := func(request string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _ = io.Copy(io.Discard, conn)
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		want    statute.Protocol
+	}{
+		{"socks5", "\x05\x01\x00\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x50", statute.ProtocolSOCKS5},
+		{"socks4", "\x04\x01\x00\x50\x7f\x00\x00\x01\x00", statute.ProtocolSOCKS4},
+		{"http", "GET http://127.0.0.1/ HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n", statute.ProtocolHTTP},
+		{"http connect", "CONNECT 127.0.0.1:443 HTTP/1.1\r\nHost: 127.0.0.1:443\r\n\r\n", statute.ProtocolHTTPConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send(tt.request)
+			select {
+			case got := <-protocols:
+				if got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("handler not called")
+			}
+		})
+	}
+}
+
+func TestConnLogSummaries(t *testing.T) {
+	echo := echoServer(t)
+	summaries := make(chan statute.ConnSummary, 1)
+	_, addr := serve(t, WithConnLog(func(s statute.ConnSummary) {
+		// skip the probe connection of serve
+		if s.Destination != "" {
+			summaries <- s
+		}
+	}))
+	echoAddr, _ := net.ResolveTCPAddr("tcp", echo)
+	port := []byte{byte(echoAddr.Port >> 8), byte(echoAddr.Port)}
+
+	tests := []struct {
+		name     string
+		request  string
+		reply    int
+		protocol statute.Protocol
+	}{
+		{"socks5", "\x05\x01\x00\x05\x01\x00\x01\x7f\x00\x00\x01" + string(port), 2 + 10, statute.ProtocolSOCKS5},
+		{"socks4", "\x04\x01" + string(port) + "\x7f\x00\x00\x01\x00", 8, statute.ProtocolSOCKS4},
+		{"http connect", "CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\n", len("HTTP/1.1 200 Connection established\r\n\r\n"), statute.ProtocolHTTPConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, make([]byte, tt.reply)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(conn, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+
+			var s statute.ConnSummary
+			select {
+			case s = <-summaries:
+			case <-time.After(2 * time.Second):
+				t.Fatal("no connection summary")
+			}
+			if s.Protocol != tt.protocol {
+				t.Errorf("Protocol = %q, want %q", s.Protocol, tt.protocol)
+			}
+			if s.Destination != echo {
+				t.Errorf("Destination = %q, want %q", s.Destination, echo)
+			}
+			if s.ClientAddr != conn.LocalAddr().String() {
+				t.Errorf("ClientAddr = %q, want %q", s.ClientAddr, conn.LocalAddr())
+			}
+			if s.BytesUp != int64(len(tt.request)+4) || s.BytesDown != int64(tt.reply+4) {
+				t.Errorf("bytes up/down = %d/%d, want %d/%d", s.BytesUp, s.BytesDown, len(tt.request)+4, tt.reply+4)
+			}
+			if s.Start.IsZero() || s.Duration <= 0 {
+				t.Errorf("Start %v, Duration %v", s.Start, s.Duration)
+			}
+		})
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	echo := echoServer(t)
+	_, proxy := serve(t, WithFirstByteTimeout(timeout))
+
+	// a client sending nothing is closed once the timeout passes
+	idle, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	start := time.Now()
+	_ = idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("idle connection read %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed > timeout+500*time.Millisecond {
+		t.Errorf("idle connection closed after %v", elapsed)
+	}
+
+	// once data arrived the timeout no longer applies
+	conn := socks5Connect(t, proxy, echo)
+	time.Sleep(2 * timeout)
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo after the timeout = %q, %v", buf, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	echo := echoServer(t)
+	p, proxy := serve(t)
+	before := p.Stats()
+
+	conn := socks5Connect(t, proxy, echo)
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if active := p.Stats().ActiveConns - before.ActiveConns; active != 1 {
+		t.Errorf("%d active connections during the tunnel, want 1", active)
+	}
+	_ = conn.Close()
+
+	var stats statute.Stats
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if stats = p.Stats(); stats.ActiveConns == before.ActiveConns {
+			break
+		}
+	}
+	if stats.ActiveConns != before.ActiveConns {
+		t.Fatalf("%d active connections after close, want %d", stats.ActiveConns, before.ActiveConns)
+	}
+	if total := stats.TotalConns - before.TotalConns; total != 1 {
+		t.Errorf("%d connections counted, want 1", total)
+	}
+	if n := stats.Protocols[statute.ProtocolSOCKS5] - before.Protocols[statute.ProtocolSOCKS5]; n != 1 {
+		t.Errorf("%d socks5 connections counted, want 1", n)
+	}
+	if up := stats.BytesUp - before.BytesUp; up < 4 {
+		t.Errorf("%d bytes up, want at least 4", up)
+	}
+	if down := stats.BytesDown - before.BytesDown; down < 4 {
+		t.Errorf("%d bytes down, want at least 4", down)
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	echo := echoServer(t)
+	p, proxy := serve(t)
+
+	start := time.Now()
+	conn := socks5Connect(t, proxy, echo)
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	active := p.ActiveConnections()
+	if len(active) != 1 {
+		t.Fatalf("active connections %+v, want the tunnel", active)
+	}
+	info := active[0]
+	if info.Protocol != statute.ProtocolSOCKS5 || info.ClientAddr != conn.LocalAddr().String() || info.Destination != echo {
+		t.Errorf("active %s connection from %s to %s, want socks5 from %s to %s",
+			info.Protocol, info.ClientAddr, info.Destination, conn.LocalAddr(), echo)
+	}
+	if info.Start.Before(start.Add(-time.Second)) || info.Start.After(time.Now()) {
+		t.Errorf("connection started at %v, want about %v", info.Start, start)
+	}
+	// the byte counts are live, the echo has gone both ways
+	if info.BytesUp < 4 || info.BytesDown < 4 {
+		t.Errorf("connection moved %d bytes up and %d down, want at least 4 each", info.BytesUp, info.BytesDown)
+	}
+
+	_ = conn.Close()
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if len(p.ActiveConnections()) == 0 {
+			return
+		}
+	}
+	t.Errorf("active connections %+v after close, want none", p.ActiveConnections())
+}
+
+// tracked returns the number of connections p has accepted and not yet
+// finished serving, queued ones included.
+func tracked(p *Proxy) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// waitTracked waits until p tracks n connections.
+func waitTracked(t *testing.T, p *Proxy, n int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if tracked(p) == n {
+			return
+		}
+	}
+	t.Fatalf("%d connections tracked, want %d", tracked(p), n)
+}
+
+// greet sends a SOCKS5 greeting offering no authentication over a new
+// connection to proxy.
+func greet(t *testing.T, proxy string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// greeted reports whether conn receives the method reply within timeout.
+func greeted(conn net.Conn, timeout time.Duration) bool {
+	reply := make([]byte, 2)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.ReadFull(conn, reply)
+	return err == nil && reply[0] == 5 && reply[1] == 0
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	echo := echoServer(t)
+	p, proxy := serve(t, WithWorkerPool(1))
+	waitTracked(t, p, 0)
+
+	busy := socks5Connect(t, proxy, echo)
+	waitTracked(t, p, 1)
+
+	// one connection waits in the queue and one is held by the accept loop,
+	// the rest are left unaccepted
+	queued := greet(t, proxy)
+	for i := 0; i < 3; i++ {
+		greet(t, proxy)
+	}
+	waitTracked(t, p, 3)
+	time.Sleep(100 * time.Millisecond)
+	if n := tracked(p); n != 3 {
+		t.Fatalf("%d connections accepted while the worker is busy, want 3", n)
+	}
+	if greeted(queued, 100*time.Millisecond) {
+		t.Fatal("queued connection served while the worker is busy")
+	}
+
+	_ = busy.Close()
+	if !greeted(queued, 2*time.Second) {
+		t.Fatal("queued connection not served once the worker is free")
+	}
+}
+
+func TestWorkerPoolDrainsQueue(t *testing.T) {
+	echo := echoServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, proxy := serve(t, WithWorkerPool(1), WithContext(ctx))
+	waitTracked(t, p, 0)
+
+	busy := socks5Connect(t, proxy, echo)
+	queued := greet(t, proxy)
+	waitTracked(t, p, 2)
+
+	cancel()
+	stopped := false
+	for start := time.Now(); !stopped && time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", proxy)
+		if stopped = err != nil; !stopped {
+			_ = conn.Close()
+		}
+	}
+	if !stopped {
+		t.Fatal("proxy still accepting after cancellation")
+	}
+
+	_ = busy.Close()
+	if !greeted(queued, 2*time.Second) {
+		t.Fatal("queued connection not served after cancellation")
+	}
+}
+
+// benchmarkChurn opens and closes connections to a proxy built with options
+// as fast as possible, each negotiating a SOCKS5 greeting.
+func benchmarkChurn(b *testing.B, options ...Option) {
+	_, proxy := serve(b, options...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		reply := make([]byte, 2)
+		for pb.Next() {
+			conn, err := net.Dial("tcp", proxy)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := conn.Write([]byte{5, 1, 0}); err == nil {
+				_, err = io.ReadFull(conn, reply)
+			}
+			_ = conn.Close()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkGoroutinePerConn(b *testing.B) {
+	benchmarkChurn(b)
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	benchmarkChurn(b, WithWorkerPool(64))
+}
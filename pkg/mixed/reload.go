@@ -0,0 +1,53 @@
+package mixed
+
+import (
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Reload moves the proxy to newBind without dropping active connections: it
+// listens on newBind, swaps the new listener in for the one being served and
+// closes the old one, so that new connections are only accepted on newBind.
+// If the proxy isn't serving yet, ListenAndServe will listen on newBind.
+func (p *Proxy) Reload(newBind string) error {
+	p.mu.Lock()
+	if p.listener == nil {
+		defer p.mu.Unlock()
+		if p.closed {
+			return ErrProxyClosed
+		}
+		p.setBind(newBind)
+		return nil
+	}
+	p.mu.Unlock()
+
+	ln, err := statute.Listen("tcp", newBind)
+	if err != nil {
+		return statute.BindError(err)
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		_ = ln.Close()
+		return ErrProxyClosed
+	}
+	old := p.listener
+	p.listener = ln
+	p.setBind(newBind)
+	p.mu.Unlock()
+	p.listenAddrs.Add(ln.Addr())
+	p.listenAddrs.Remove(old.Addr())
+
+	p.logger.Debug("Serving on " + newBind + " ...")
+	// the accept loop picks up the new listener once the old one is closed
+	return old.Close()
+}
+
+// setBind records bind as the address of the proxy and of its sub-servers.
+func (p *Proxy) setBind(bind string) {
+	p.bind = bind
+	p.socks5Proxy.Bind = bind
+	p.socks4Proxy.Bind = bind
+	p.httpProxy.Bind = bind
+	p.transparent.Bind = bind
+}
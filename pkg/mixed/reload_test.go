@@ -0,0 +1,74 @@
+package mixed
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// connectThrough sends an HTTP CONNECT for target to the proxy at proxy,
+// returning the response status.
+func connectThrough(proxy, target string) (int, error) {
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+// assertBind fails the test unless the proxy and every sub-server are bound to bind.
+func assertBind(t *testing.T, p *Proxy, bind string) {
+	t.Helper()
+	for name, got := range map[string]string{
+		"proxy":       p.bind,
+		"socks5":      p.socks5Proxy.Bind,
+		"socks4":      p.socks4Proxy.Bind,
+		"http":        p.httpProxy.Bind,
+		"transparent": p.transparent.Bind,
+	} {
+		if got != bind {
+			t.Errorf("%s bound to %s, want %s", name, got, bind)
+		}
+	}
+}
+
+func TestReloadServing(t *testing.T) {
+	target := echoServer(t)
+	p, oldAddr := serve(t)
+
+	newAddr := freeAddr(t)
+	if err := p.Reload(newAddr); err != nil {
+		t.Fatal(err)
+	}
+	assertBind(t, p, newAddr)
+
+	if status, err := connectThrough(newAddr, target); err != nil || status != http.StatusOK {
+		t.Errorf("CONNECT on the new address: %d, %v", status, err)
+	}
+	if conn, err := net.DialTimeout("tcp", oldAddr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Error("the old address still accepts connections")
+	}
+}
+
+func TestReloadNotServing(t *testing.T) {
+	p := NewProxy(WithLogger(quietLogger{}), WithBinAddress(freeAddr(t)))
+	newAddr := freeAddr(t)
+	if err := p.Reload(newAddr); err != nil {
+		t.Fatal(err)
+	}
+	assertBind(t, p, newAddr)
+}
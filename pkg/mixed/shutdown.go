@@ -0,0 +1,201 @@
+package mixed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// ErrProxyClosed is returned by ListenAndServe after Shutdown has been called.
+// It wraps statute.ErrShutdown.
+var ErrProxyClosed = fmt.Errorf("mixed: proxy closed: %w", statute.ErrShutdown)
+
+// DefaultShutdownGracePeriod is how long RunUntilSignal lets active
+// connections finish before closing them.
+const DefaultShutdownGracePeriod = 10 * time.Second
+
+// drainRejectTimeout bounds how long a connection accepted during Shutdown
+// may take to send the request it is refused.
+const drainRejectTimeout = 5 * time.Second
+
+// serveListener records ln as the proxy's listener. It reports false if the
+// proxy has already been shut down.
+func (p *Proxy) serveListener(ln net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.listener = ln
+	return true
+}
+
+// currentListener returns the listener being served, which Reload may replace.
+func (p *Proxy) currentListener() net.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listener
+}
+
+// isClosed reports whether Shutdown has been called.
+func (p *Proxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// trackConn adds conn to the set of active connections. It reports false if
+// the proxy is shutting down, in which case conn is still tracked until
+// rejectDraining has refused it.
+func (p *Proxy) trackConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]struct{})
+	}
+	p.conns[conn] = struct{}{}
+	p.active++
+	return !p.closed
+}
+
+// untrackConn removes conn from the set of active connections.
+func (p *Proxy) untrackConn(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+	p.active--
+	if p.active == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// Shutdown drains the proxy and waits for the active connections to finish.
+// While draining, new connections are still accepted but refused with the
+// failure reply of their protocol: 503 with Retry-After for HTTP, a server
+// failure for SOCKS. Once the active connections finish the listener is
+// closed. If ctx ends first, the remaining connections are closed and the
+// context's error is returned.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	ln := p.listener
+	done := p.idle
+	if done == nil {
+		done = make(chan struct{})
+		if p.active == 0 {
+			close(done)
+		} else {
+			p.idle = done
+		}
+	}
+	p.mu.Unlock()
+
+	p.socks5Proxy.SetDraining(true)
+	p.socks4Proxy.SetDraining(true)
+	p.httpProxy.SetDraining(true)
+	p.transparent.SetDraining(true)
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.CloseAllConns()
+		err = ctx.Err()
+	}
+
+	if ln != nil {
+		// a cancelled context may have closed it already
+		if closeErr := ln.Close(); err == nil && !errors.Is(closeErr, net.ErrClosed) {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// CloseAllConns immediately closes every active connection while the proxy
+// keeps accepting new ones, for instance after rotating upstream credentials.
+func (p *Proxy) CloseAllConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+}
+
+// rejectDraining refuses a connection accepted during Shutdown with the
+// failure reply of its protocol. Connections of other protocols are closed.
+func (p *Proxy) rejectDraining(conn net.Conn) {
+	defer p.untrackConn(conn)
+	defer func() {
+		_ = conn.Close()
+	}()
+	if p.transparentOn {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(drainRejectTimeout))
+
+	switchConn := NewSwitchConn(conn)
+	protocol, err := p.detector(switchConn.reader)
+	if err != nil {
+		return
+	}
+
+	switch protocol {
+	case statute.ProtocolSOCKS5:
+		err = p.socks5Proxy.ServeConnReader(switchConn.Conn, switchConn.reader)
+	case statute.ProtocolSOCKS4:
+		err = p.socks4Proxy.ServeConnReader(switchConn.Conn, switchConn.reader)
+	case statute.ProtocolHTTP:
+		err = p.httpProxy.ServeConn(switchConn)
+	case statute.ProtocolH2C:
+		err = p.httpProxy.ServeH2CConn(switchConn)
+	}
+	if err != nil && !errors.Is(err, statute.ErrDraining) {
+		p.logger.Debug(err)
+	}
+}
+
+// RunUntilSignal serves the proxy until one of sigs is received, SIGINT or
+// SIGTERM by default, or the proxy's context ends, then shuts it down with
+// DefaultShutdownGracePeriod. It returns the serve or the shutdown error.
+func (p *Proxy) RunUntilSignal(sigs ...os.Signal) error {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ctx, stop := signal.NotifyContext(p.ctx, sigs...)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- p.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// the proxy's context ending stops ListenAndServe too, drain anyway
+		if ctx.Err() == nil {
+			return err
+		}
+		serveErr <- err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownGracePeriod)
+	defer cancel()
+	if err := p.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-serveErr; err != nil && !errors.Is(err, statute.ErrShutdown) {
+		return err
+	}
+	return nil
+}
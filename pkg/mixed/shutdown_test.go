@@ -0,0 +1,195 @@
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socks5Connect opens a SOCKS5 tunnel through proxy to the IPv4 address dest.
+func socks5Connect(t *testing.T, proxy, dest string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	addr, err := net.ResolveTCPAddr("tcp", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{5, 1, 0, 5, 1, 0, 1}
+	req = append(req, addr.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(addr.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0 {
+		t.Fatalf("connect reply = %d, want success", reply[3])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn
+}
+
+// runUntilSignal runs a proxy with RunUntilSignal on SIGUSR1 until it is
+// listening, returning its address and the channel RunUntilSignal's result
+// is sent on.
+func runUntilSignal(t *testing.T, ctx context.Context) (string, <-chan error) {
+	t.Helper()
+	addr := freeAddr(t)
+	p := NewProxy(WithLogger(quietLogger{}), WithBinAddress(addr), WithContext(ctx))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.RunUntilSignal(syscall.SIGUSR1)
+	}()
+	for start := time.Now(); p.currentListener() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("proxy on %s didn't start", addr)
+		}
+	}
+	return addr, done
+}
+
+// waitStopped waits for RunUntilSignal to return nil and checks that the
+// proxy no longer accepts connections on addr.
+func waitStopped(t *testing.T, addr string, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RunUntilSignal = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunUntilSignal didn't return")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		_ = conn.Close()
+		t.Fatal("proxy still accepts connections after shutdown")
+	}
+}
+
+func TestRunUntilSignalDrains(t *testing.T) {
+	addr, done := runUntilSignal(t, context.Background())
+	tunnel := socks5Connect(t, addr, echoServer(t))
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the open tunnel holds the shutdown back and keeps working
+	select {
+	case err := <-done:
+		t.Fatalf("RunUntilSignal returned %v with a tunnel open", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := tunnel.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	_ = tunnel.Close()
+	waitStopped(t, addr, done)
+}
+
+func TestRunUntilSignalContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, done := runUntilSignal(t, ctx)
+	tunnel := socks5Connect(t, addr, echoServer(t))
+	cancel()
+
+	// cancelling the proxy's context tears the tunnel down
+	_ = tunnel.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var netErr net.Error
+	if _, err := tunnel.Read(make([]byte, 1)); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("tunnel still open after the context was cancelled")
+	}
+	waitStopped(t, addr, done)
+}
+
+func TestCloseAllConns(t *testing.T) {
+	echo := echoServer(t)
+	p, addr := serve(t)
+	var tunnels []net.Conn
+	for i := 0; i < 3; i++ {
+		tunnels = append(tunnels, socks5Connect(t, addr, echo))
+	}
+
+	p.CloseAllConns()
+	for i, tunnel := range tunnels {
+		_ = tunnel.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := tunnel.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Errorf("tunnel %d: read = %v, want EOF", i, err)
+		}
+	}
+
+	// the proxy still serves new connections
+	tunnel := socks5Connect(t, addr, echo)
+	if _, err := tunnel.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestShutdownRefusesHTTP(t *testing.T) {
+	echo := echoServer(t)
+	p, addr := serve(t)
+	// the open tunnel keeps the proxy draining
+	tunnel := socks5Connect(t, addr, echo)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Shutdown(ctx)
+	}()
+	for start := time.Now(); !p.isClosed(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("proxy not shutting down")
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", echo, echo); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+
+	_ = tunnel.Close()
+	cancel()
+	<-done
+}
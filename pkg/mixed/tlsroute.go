@@ -0,0 +1,91 @@
+package mixed
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of terminated connections.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// errUnknownServerName is returned to clients whose SNI matches no TLS route.
+var errUnknownServerName = errors.New("mixed: no TLS route for server name")
+
+// TLSRoute terminates TLS for the clients naming one server name in their
+// SNI.
+type TLSRoute struct {
+	// Certificate is presented to the clients of the route.
+	Certificate tls.Certificate
+	// Handler serves the decrypted connection. When nil its protocol is
+	// detected and it is served like any other connection, for instance as
+	// SOCKS5 or HTTP proxy requests over TLS.
+	Handler ProtocolHandler
+}
+
+// tlsRouter selects the TLS route of a connection by its SNI.
+type tlsRouter struct {
+	routes  map[string]TLSRoute
+	configs map[string]*tls.Config
+	config  *tls.Config
+}
+
+// newTLSRouter creates a tlsRouter for routes, keyed by server name.
+func newTLSRouter(routes map[string]TLSRoute) *tlsRouter {
+	r := &tlsRouter{
+		routes:  make(map[string]TLSRoute, len(routes)),
+		configs: make(map[string]*tls.Config, len(routes)),
+	}
+	for name, route := range routes {
+		name = strings.ToLower(name)
+		r.routes[name] = route
+		r.configs[name] = &tls.Config{Certificates: []tls.Certificate{route.Certificate}}
+	}
+	r.config = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name, ok := r.match(hello.ServerName)
+			if !ok {
+				return nil, fmt.Errorf("%w %q", errUnknownServerName, hello.ServerName)
+			}
+			return r.configs[name], nil
+		},
+	}
+	return r
+}
+
+// match returns the route name serving serverName: serverName itself or ""
+// for the default route.
+func (r *tlsRouter) match(serverName string) (string, bool) {
+	serverName = strings.ToLower(serverName)
+	if _, ok := r.routes[serverName]; ok {
+		return serverName, true
+	}
+	_, ok := r.routes[""]
+	return "", ok
+}
+
+// handleTLSTermination completes the TLS handshake of conn with the
+// certificate of its route and serves the decrypted connection with the
+// route's handler, or as any other connection if it has none.
+func (p *Proxy) handleTLSTermination(conn *SwitchConn) error {
+	tlsConn := tls.Server(conn, p.tlsRouter.config)
+	ctx, cancel := context.WithTimeout(p.ctx, tlsHandshakeTimeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("tls handshake with %v: %w", conn.RemoteAddr(), err)
+	}
+
+	name, _ := p.tlsRouter.match(tlsConn.ConnectionState().ServerName)
+	if handler := p.tlsRouter.routes[name].Handler; handler != nil {
+		statute.EndHandshake(tlsConn)
+		return handler(tlsConn)
+	}
+	return p.serveDetected(tlsConn, true)
+}
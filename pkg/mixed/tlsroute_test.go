@@ -0,0 +1,93 @@
+package mixed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate for name, along with a pool
+// trusting it.
+func selfSigned(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// backend returns a ProtocolHandler answering every connection with name.
+func backend(name string) ProtocolHandler {
+	return func(conn net.Conn) error {
+		defer conn.Close()
+		_, err := io.WriteString(conn, name)
+		return err
+	}
+}
+
+func TestTLSRoutes(t *testing.T) {
+	certA, poolA := selfSigned(t, "a.test")
+	certB, poolB := selfSigned(t, "b.test")
+	_, proxy := serve(t, WithTLSRoutes(map[string]TLSRoute{
+		"a.test": {Certificate: certA, Handler: backend("backend a")},
+		"b.test": {Certificate: certB, Handler: backend("backend b")},
+	}))
+
+	for _, tt := range []struct {
+		serverName string
+		roots      *x509.CertPool
+		want       string
+	}{
+		{"a.test", poolA, "backend a"},
+		{"b.test", poolB, "backend b"},
+	} {
+		// the handshake only succeeds if the route's own certificate is presented
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", proxy,
+			&tls.Config{ServerName: tt.serverName, RootCAs: tt.roots})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.serverName, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(conn)
+		_ = conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.serverName, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: served by %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+
+	// without a default route an unknown name is refused
+	if err := sendClientHello(proxy, &tls.Config{ServerName: "c.test", InsecureSkipVerify: true}); err == nil {
+		t.Error("handshake for an unknown server name succeeded")
+	}
+}
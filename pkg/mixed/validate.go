@@ -0,0 +1,34 @@
+package mixed
+
+import (
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Validate checks the assembled configuration of the proxy and of the
+// servers it delegates to without serving, returning every problem found
+// joined in one error, or nil.
+func (p *Proxy) Validate() error {
+	c := statute.NewConfigCheck("mixed")
+	c.CheckAddr("bind address", p.bind)
+	c.Check(p.userDialFunc != nil, "dial function is nil")
+	c.Check(p.logger != nil, "logger is nil")
+	c.Check(p.ctx != nil, "context is nil")
+	c.Check(p.detector != nil, "protocol detector is nil")
+	c.CheckDSCP(p.dscp)
+	c.Check(!(p.transparentOn && p.tlsPassthrough), "TLS passthrough has no effect in transparent mode")
+	c.Check(!(p.transparentOn && p.tlsRouter != nil), "TLS routes have no effect in transparent mode")
+	if p.tlsRouter != nil {
+		for name, route := range p.tlsRouter.routes {
+			c.Check(len(route.Certificate.Certificate) > 0, "TLS route %q has no certificate", name)
+		}
+	}
+	c.Check(!(p.transparentOn && len(p.protocolHandlers) > 0), "protocol handlers have no effect in transparent mode")
+	c.Check(p.workerPool >= 0, "worker pool size is negative")
+	c.Check(p.firstByteTimeout >= 0, "first byte timeout is negative")
+
+	c.Add(p.socks5Proxy.Validate())
+	c.Add(p.socks4Proxy.Validate())
+	c.Add(p.httpProxy.Validate())
+	c.Add(p.transparent.Validate())
+	return c.Err()
+}
@@ -0,0 +1,137 @@
+package socks4
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// bindAcceptTimeout bounds the wait for the inbound connection of a BIND
+// request, as the SOCKS4 protocol recommends. Tests shorten it.
+var bindAcceptTimeout = 2 * time.Minute
+
+// errBindPeerMismatch reports an inbound BIND connection from another host
+// than the one named in the request.
+var errBindPeerMismatch = errors.New("inbound connection from unexpected host")
+
+// handleBind handles the SOCKS4 BIND command, used by protocols such as FTP
+// in active mode: the server listens, tells the client where in a first
+// reply, accepts one connection from the requested destination, reports it
+// in a second reply and tunnels it to the client.
+func (s *Server) handleBind(req *request) error {
+	defer func() {
+		_ = req.Conn.Close()
+	}()
+
+	ln, err := s.bindListener(req)
+	if err != nil {
+		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("bind for %v failed: %w", req.DestinationAddr, err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	bind := listenerAddress(ln, req.Conn)
+	if s.BindReplyIP != nil {
+		bind.IP = s.BindReplyIP
+	}
+	if err := sendReply(req.Conn, grantedReply, &bind); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	// waiting for the peer is no handshake of the client
+	statute.EndHandshake(req.Conn)
+
+	// closing the listener unblocks Accept once the wait is over
+	timer := time.AfterFunc(bindAcceptTimeout, func() {
+		_ = ln.Close()
+	})
+	inbound, err := ln.Accept()
+	timer.Stop()
+	if err != nil {
+		_ = sendReply(req.Conn, rejectedReply, nil)
+		return fmt.Errorf("bind for %v failed: %w", req.DestinationAddr, err)
+	}
+	defer func() {
+		_ = inbound.Close()
+	}()
+
+	peer, _ := inbound.RemoteAddr().(*net.TCPAddr)
+	if peer == nil || !s.bindPeerAllowed(req.DestinationAddr, peer.IP) {
+		_ = sendReply(req.Conn, rejectedReply, nil)
+		return fmt.Errorf("bind for %v: %w %v", req.DestinationAddr, errBindPeerMismatch, inbound.RemoteAddr())
+	}
+	if err := sendReply(req.Conn, grantedReply, &address{IP: peer.IP, Port: peer.Port}); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	buf1, buf2, release := statute.TunnelBuffers(s.BytesPool, s.ReadBufferSize, s.WriteBufferSize)
+	defer release()
+
+	labels := statute.MetricLabels("socks4", req.DestinationAddr.String(), s.DestinationClassifier)
+	client := statute.NewCountingConn(req.Conn)
+	defer func() {
+		s.Metrics.AddCount("bytes_up", client.BytesRead(), labels...)
+		s.Metrics.AddCount("bytes_down", client.BytesWritten(), labels...)
+		statute.HintBytesPool(s.BytesPool, max(client.BytesRead(), client.BytesWritten()))
+	}()
+	return statute.Tunnel(statute.ContextWithCloseGrace(s.Context, s.CloseGrace), inbound, client, buf1, buf2)
+}
+
+// bindListener opens the listener of a BIND request with UserBindHandle or,
+// by default, on an ephemeral port of the address the client connected to.
+func (s *Server) bindListener(req *request) (net.Listener, error) {
+	if s.UserBindHandle == nil {
+		host := ""
+		if local, ok := req.Conn.LocalAddr().(*net.TCPAddr); ok {
+			host = local.IP.String()
+		}
+		return statute.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+
+	host := req.DestinationAddr.IP.String()
+	if req.DestinationAddr.Name != "" {
+		host = req.DestinationAddr.Name
+	}
+	ln, err := s.UserBindHandle(&statute.ProxyRequest{
+		Conn:        req.Conn,
+		Reader:      req.Conn,
+		Writer:      req.Conn,
+		Network:     "tcp",
+		Destination: req.DestinationAddr.String(),
+		DestHost:    host,
+		DestPort:    int32(req.DestinationAddr.Port),
+		Protocol:    statute.ProtocolSOCKS4,
+	})
+	return ln, statute.WrapHandlerError(err)
+}
+
+// bindPeerAllowed reports whether an inbound BIND connection from ip comes
+// from dest, the host named in the request. SOCKS4a names and the unspecified
+// address can't be checked and allow any host.
+func (s *Server) bindPeerAllowed(dest *address, ip net.IP) bool {
+	if dest.Name != "" || dest.IP.IsUnspecified() {
+		return true
+	}
+	return dest.IP.Equal(ip)
+}
+
+// listenerAddress returns the address advertised for ln, replacing an
+// unspecified IP with the one the client connected to.
+func listenerAddress(ln net.Listener, client net.Conn) address {
+	var bind address
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		bind = address{IP: tcp.IP, Port: tcp.Port}
+	}
+	if bind.IP == nil || bind.IP.IsUnspecified() {
+		if local, ok := client.LocalAddr().(*net.TCPAddr); ok {
+			bind.IP = local.IP
+		}
+	}
+	return bind
+}
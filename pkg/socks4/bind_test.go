@@ -0,0 +1,99 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readReply reads the second reply of a BIND request from conn.
+func readReply(t *testing.T, conn net.Conn) (reply, *address) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return reply(resp[1]), &address{IP: net.IP(resp[4:8]), Port: int(binary.BigEndian.Uint16(resp[2:4]))}
+}
+
+// dialBind connects to the address of a BIND reply, as the peer would.
+func dialBind(t *testing.T, bind *address) net.Conn {
+	t.Helper()
+	peer, err := net.DialTimeout("tcp", bind.String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = peer.Close() })
+	return peer
+}
+
+func TestBind(t *testing.T) {
+	_, closed := serve(t)
+	if _, resp, _ := sendRequest(t, closed, BindCommand, "127.0.0.1:21"); resp != rejectedReply {
+		t.Fatalf("BIND without AllowBind: got %v, want %v", resp, rejectedReply)
+	}
+	_, proxy := serve(t, WithAllowBind(true))
+
+	conn, resp, bind := sendRequest(t, proxy, BindCommand, "127.0.0.1:21")
+	if resp != grantedReply {
+		t.Fatalf("first reply: %v", resp)
+	}
+	peer := dialBind(t, bind)
+	resp, from := readReply(t, conn)
+	if resp != grantedReply {
+		t.Fatalf("second reply: %v", resp)
+	}
+	if local := peer.LocalAddr().(*net.TCPAddr); !from.IP.Equal(local.IP) || from.Port != local.Port {
+		t.Errorf("second reply names %v, want the peer %v", from, local)
+	}
+
+	// the inbound connection is tunneled to the client both ways
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	for _, pair := range [][2]net.Conn{{peer, conn}, {conn, peer}} {
+		if _, err := pair[0].Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(pair[1], buf); err != nil || string(buf) != "data" {
+			t.Fatalf("relayed %q, %v", buf, err)
+		}
+	}
+}
+
+func TestBindUnexpectedPeer(t *testing.T) {
+	_, proxy := serve(t, WithAllowBind(true))
+
+	// the peer connects from loopback rather than the host requested
+	conn, resp, bind := sendRequest(t, proxy, BindCommand, "192.0.2.1:21")
+	if resp != grantedReply {
+		t.Fatalf("first reply: %v", resp)
+	}
+	dialBind(t, bind)
+	if resp, _ := readReply(t, conn); resp != rejectedReply {
+		t.Errorf("second reply: got %v, want %v", resp, rejectedReply)
+	}
+}
+
+func TestBindAcceptTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { bindAcceptTimeout = timeout }(bindAcceptTimeout)
+	bindAcceptTimeout = 100 * time.Millisecond
+	_, proxy := serve(t, WithAllowBind(true))
+
+	conn, resp, bind := sendRequest(t, proxy, BindCommand, "127.0.0.1:21")
+	if resp != grantedReply {
+		t.Fatalf("first reply: %v", resp)
+	}
+	if resp, _ := readReply(t, conn); resp != rejectedReply {
+		t.Errorf("second reply: got %v, want %v", resp, rejectedReply)
+	}
+	// the listener is gone once the wait is over
+	if peer, err := net.DialTimeout("tcp", bind.String(), time.Second); err == nil {
+		_ = peer.Close()
+		t.Error("the BIND address still accepts connections")
+	}
+}
@@ -1,242 +1,203 @@
 package socks4
 
 import (
-	"context"
-	"fmt"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
-
-	"github.com/bepass-org/proxy/pkg/statute"
+	"strconv"
 )
 
-// Server is accepting connections and handling the details of the SOCKS4 protocol
-type Server struct {
-	// bind is the address to listen on
-	Bind string
-	// ProxyDial specifies the optional proxyDial function for
-	// establishing the transport connection.
-	ProxyDial statute.ProxyDialFunc
-	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
-	UserConnectHandle statute.UserConnectHandler
-	// Logger error log
-	Logger statute.Logger
-	// Context is default context
-	Context context.Context
-	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
-	BytesPool statute.BytesPool
-}
+var (
+	errStringTooLong = errors.New("string too long")
+	// ErrIdentFailed reports that the client's ident service could not be reached.
+	ErrIdentFailed = errors.New("cannot connect to identd on the client")
+	// ErrUserIDMismatch reports that identd returned a different user id than the request.
+	ErrUserIDMismatch = errors.New("client program and identd report different user-ids")
+)
 
-func NewServer(options ...ServerOption) *Server {
-	s := &Server{
-		ProxyDial: statute.DefaultProxyDial(),
-		Logger:    statute.DefaultLogger{},
-		Context:   statute.DefaultContext(),
-	}
+const (
+	// maxStringLen bounds the null-terminated user id and host name fields
+	maxStringLen = 255
+)
 
-	for _, option := range options {
-		option(s)
-	}
+const (
+	socks4Version = 0x04
+)
 
-	return s
-}
+const (
+	ConnectCommand Command = 0x01
+	BindCommand    Command = 0x02
+)
 
-type ServerOption func(*Server)
+// Command is a SOCKS Command.
+type Command byte
 
-func (s *Server) ListenAndServe() error {
-	s.Logger.Debug("Serving on " + s.Bind + " ...")
-	// Create a new listener
-	ln, err := net.Listen("tcp", s.Bind)
-	if err != nil {
-		s.Logger.Error("Error listening on " + s.Bind + ", " + err.Error())
-		return err // Return error if binding was unsuccessful
+func (cmd Command) String() string {
+	switch cmd {
+	case ConnectCommand:
+		return "socks connect"
+	case BindCommand:
+		return "socks bind"
+	default:
+		return "socks " + strconv.Itoa(int(cmd))
 	}
+}
 
-	// ensure listener will be closed
-	defer func() {
-		_ = ln.Close()
-	}()
-
-	// Create a cancelable context based on s.Context
-	ctx, cancel := context.WithCancel(s.Context)
-	defer cancel() // Ensure resources are cleaned up
+const (
+	grantedReply        reply = 0x5a
+	rejectedReply       reply = 0x5b
+	identFailedReply    reply = 0x5c
+	userIDMismatchReply reply = 0x5d
+)
 
-	// Start to accept connections and serve them
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := ln.Accept()
-			if err != nil {
-				s.Logger.Error(err)
-				continue
-			}
-
-			// Start a new goroutine to handle each connection
-			// This way, the server can handle multiple connections concurrently
-			go func() {
-				err := s.ServeConn(conn)
-				if err != nil {
-					s.Logger.Error(err) // Log errors from ServeConn
-				}
-			}()
-		}
+// errToReply maps a failure to the matching SOCKS4 reject code.
+func errToReply(err error) reply {
+	switch {
+	case err == nil:
+		return grantedReply
+	case errors.Is(err, ErrIdentFailed):
+		return identFailedReply
+	case errors.Is(err, ErrUserIDMismatch):
+		return userIDMismatchReply
+	default:
+		return rejectedReply
 	}
 }
 
-func WithLogger(logger statute.Logger) ServerOption {
-	return func(s *Server) {
-		s.Logger = logger
+// reply is a SOCKS Command reply code.
+type reply byte
+
+func (code reply) String() string {
+	switch code {
+	case grantedReply:
+		return "request granted"
+	case rejectedReply:
+		return "request rejected or failed"
+	case identFailedReply:
+		return "request rejected, cannot connect to identd"
+	case userIDMismatchReply:
+		return "request rejected, user-id mismatch"
+	default:
+		return "unknown code: " + strconv.Itoa(int(code))
 	}
 }
 
-func WithBind(bindAddress string) ServerOption {
-	return func(s *Server) {
-		s.Bind = bindAddress
-	}
+// address is a SOCKS-specific address.
+// Name is only set for SOCKS4a requests, in which case IP is a placeholder.
+type address struct {
+	Name string // fully-qualified domain name
+	IP   net.IP
+	Port int
 }
 
-func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
-	return func(s *Server) {
-		s.UserConnectHandle = handler
+// hostPortAddress returns the address of host, an IP literal or a name, and port.
+func hostPortAddress(host string, port int) *address {
+	if ip := net.ParseIP(host); ip != nil {
+		return &address{IP: ip, Port: port}
 	}
+	return &address{Name: host, Port: port}
 }
 
-func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
-	return func(s *Server) {
-		s.ProxyDial = proxyDial
-	}
-}
+func (a *address) Network() string { return "socks4" }
 
-func WithContext(ctx context.Context) ServerOption {
-	return func(s *Server) {
-		s.Context = ctx
+func (a *address) String() string {
+	if a == nil {
+		return "<nil>"
 	}
+	return a.Address()
 }
 
-func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
-	return func(s *Server) {
-		s.BytesPool = bytesPool
+// Address returns a string suitable to dial; prefer returning the SOCKS4a
+// Name, fallback to IP
+func (a address) Address() string {
+	port := strconv.Itoa(a.Port)
+	if a.Name != "" {
+		return net.JoinHostPort(a.Name, port)
 	}
+	return net.JoinHostPort(a.IP.String(), port)
 }
 
-func (s *Server) ServeConn(conn net.Conn) error {
-	version, err := readByte(conn)
-	if err != nil {
-		return err
-	}
-	if version != socks4Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version)
-	}
-	req := &request{
-		Version: socks4Version,
-		Conn:    conn,
-	}
-
-	cmd, err := readByte(conn)
-	if err != nil {
-		return err
-	}
-	req.Command = Command(cmd)
+// addrAndUser is the destination and user id of a SOCKS4 request.
+type addrAndUser struct {
+	address
+	Username string
+}
 
-	addr, err := readAddrAndUser(conn)
+func readByte(r io.Reader) (byte, error) {
+	var buf [1]byte
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
-		}
-		return err
+		return 0, err
 	}
-	req.DestinationAddr = &addr.address
-	req.Username = addr.Username
-	return s.handle(req)
+	return buf[0], nil
 }
 
-func (s *Server) handle(req *request) error {
-	switch req.Command {
-	case ConnectCommand:
-		return s.handleConnect(req)
-	default:
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return err
+// readString reads a null-terminated string.
+func readString(r io.Reader) (string, error) {
+	var buf []byte
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= maxStringLen {
+			return "", errStringTooLong
 		}
-		return fmt.Errorf("unsupported Command: %v", req.Command)
+		buf = append(buf, b)
 	}
 }
 
-func (s *Server) handleConnect(req *request) error {
-	if s.UserConnectHandle == nil {
-		return s.embedHandleConnect(req)
+// readAddrAndUser reads DSTPORT, DSTIP and USERID, followed by the host name
+// for SOCKS4a requests.
+func readAddrAndUser(r io.Reader) (*addrAndUser, error) {
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
 	}
 
-	if err := sendReply(req.Conn, grantedReply, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
-	}
-	host := req.DestinationAddr.IP.String()
-	if req.DestinationAddr.Name != "" {
-		host = req.DestinationAddr.Name
+	ip := make(net.IP, net.IPv4len)
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return nil, err
 	}
 
-	proxyReq := &statute.ProxyRequest{
-		Conn:        req.Conn,
-		Reader:      io.Reader(req.Conn),
-		Writer:      io.Writer(req.Conn),
-		Network:     "tcp",
-		Destination: req.DestinationAddr.String(),
-		DestHost:    host,
-		DestPort:    int32(req.DestinationAddr.Port),
+	username, err := readString(r)
+	if err != nil {
+		return nil, err
 	}
 
-	return s.UserConnectHandle(proxyReq)
-}
+	addr := &addrAndUser{
+		address: address{
+			IP:   ip,
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		},
+		Username: username,
+	}
 
-func (s *Server) embedHandleConnect(req *request) error {
-	defer func() {
-		_ = req.Conn.Close()
-	}()
-	target, err := s.ProxyDial(s.Context, "tcp", req.DestinationAddr.Address())
-	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+	// SOCKS4a marks a trailing host name with a 0.0.0.x destination, x != 0
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
-	}
-	defer func() {
-		_ = target.Close()
-	}()
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, grantedReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+		addr.Name = name
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
-		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
-	}
-	return statute.Tunnel(s.Context, target, req.Conn, buf1, buf2)
+	return addr, nil
 }
 
-func sendReply(w io.Writer, resp reply, addr *address) error {
-	_, err := w.Write([]byte{0, byte(resp)})
-	if err != nil {
-		return err
+// writeAddr writes the DSTPORT and DSTIP fields of a reply.
+func writeAddr(w io.Writer, addr *address) error {
+	var buf [6]byte
+	if addr != nil {
+		binary.BigEndian.PutUint16(buf[:2], uint16(addr.Port))
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(buf[2:], ip4)
+		}
 	}
-	err = writeAddr(w, addr)
+	_, err := w.Write(buf[:])
 	return err
 }
-
-type request struct {
-	Version         uint8
-	Command         Command
-	DestinationAddr *address
-	Username        string
-	Conn            net.Conn
-}
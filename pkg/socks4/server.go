@@ -1,10 +1,14 @@
 package socks4
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/bepass-org/proxy/pkg/statute"
 )
@@ -15,15 +19,85 @@ type Server struct {
 	ProxyDial         statute.ProxyDialFunc
 	UserConnectHandle statute.UserConnectHandler
 	Logger            statute.Logger
+	Metrics           statute.Metrics
 	Context           context.Context
 	BytesPool         statute.BytesPool
+	// BlockPrivateRanges rejects destinations resolving to private addresses.
+	BlockPrivateRanges bool
+	// Resolver resolves destination names before dialing, nil passes names to ProxyDial.
+	Resolver statute.Resolver
+	// DSCP marks proxied traffic with the given DSCP value, zero leaves it unmarked.
+	DSCP int
+	// ConnMiddleware wraps accepted connections before they are served.
+	ConnMiddleware []statute.ConnMiddleware
+	// RequestInterceptors run on requests before the destination is dialed.
+	RequestInterceptors []statute.RequestInterceptor
+	// AllowedSources limits the client networks accepted by ListenAndServe, empty allows all.
+	AllowedSources []*net.IPNet
+	// ConnLog receives a summary of every connection served.
+	ConnLog statute.ConnLogFunc
+	// HandlerErrorFilter reports user handler errors to leave out of the logs.
+	HandlerErrorFilter statute.HandlerErrorFilter
+	// Events receives connection open, close and error events, nil for none.
+	Events *statute.EventSink
+	// Stats counts the connections served, nil disables counting.
+	Stats *statute.StatsCollector
+	// RejectWithRST resets connections rejected by AllowedSources instead of closing them normally.
+	RejectWithRST bool
+	// ByteQuota limits the bytes each client IP may transfer within a window.
+	ByteQuota *statute.ByteQuota
+	// ReadBufferSize and WriteBufferSize size the buffers for data read from and
+	// written to the client, zero takes them from BytesPool.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// TunnelKeepalive is the TCP keepalive interval of client and destination connections, zero leaves the default.
+	TunnelKeepalive time.Duration
+	// SocketRecvBuffer and SocketSendBuffer are the SO_RCVBUF and SO_SNDBUF
+	// sizes of client and destination connections, zero leaves the OS default.
+	SocketRecvBuffer int
+	SocketSendBuffer int
+	// MaxConnLifetime closes client connections this long after they were accepted, zero for no limit.
+	MaxConnLifetime time.Duration
+	// MuxHint detects multiplexed sessions from the first bytes of tunnels, to tune them, see statute.WatchMux.
+	MuxHint statute.MuxDetector
+	// CloseGrace bounds flushing tunnels once Context is cancelled before they are closed, zero closes them at once.
+	CloseGrace time.Duration
+	// AcceptRate and AcceptBurst pace the connections accepted by ListenAndServe to AcceptRate per
+	// second, in bursts of up to AcceptBurst, zero for no limit.
+	AcceptRate  int
+	AcceptBurst int
+	// RejectOverAcceptRate closes connections over AcceptRate rather than holding them back.
+	RejectOverAcceptRate bool
+	// Handshakes bounds the connections accepted by ListenAndServe that are negotiating at once, nil doesn't limit them.
+	Handshakes *statute.HandshakeLimiter
+	// ListenAddrs holds the addresses the server listens on, destinations reaching them are refused.
+	ListenAddrs *statute.ListenAddrs
+	// ReverseDNS looks up the names of client IPs for ConnLog, nil disables lookups.
+	ReverseDNS *statute.ReverseDNS
+	// ConnectTimeout bounds establishing connections to destinations, zero leaves them to the context.
+	ConnectTimeout time.Duration
+	// Netns is the path of the network namespace destinations are dialed from, empty for the current one.
+	Netns string
+	// DestinationClassifier labels metrics with the class of their destination.
+	DestinationClassifier statute.DestinationClassifier
+	// BindReplyIP replaces the IPv4 address advertised in granted replies, for proxies behind NAT.
+	BindReplyIP net.IP
+	// AllowBind accepts BIND requests, which make the server listen for an
+	// inbound connection. Setting UserBindHandle accepts them as well.
+	AllowBind bool
+	// UserBindHandle opens the listener of BIND requests instead of the server.
+	UserBindHandle statute.UserBindHandler
+
+	draining atomic.Bool
 }
 
 func NewServer(options ...ServerOption) *Server {
 	s := &Server{
-		ProxyDial: statute.DefaultProxyDial(),
-		Logger:    statute.DefaultLogger{},
-		Context:   statute.DefaultContext(),
+		ProxyDial:   statute.DefaultProxyDial(),
+		Logger:      statute.DefaultLogger{},
+		Metrics:     statute.DefaultMetrics{},
+		Context:     statute.DefaultContext(),
+		ListenAddrs: statute.NewListenAddrs(),
 	}
 
 	for _, option := range options {
@@ -37,44 +111,131 @@ func NewServer(options ...ServerOption) *Server {
 type ServerOption func(*Server)
 
 // ListenAndServe starts accepting connections on the specified address.
+// It returns an error wrapping statute.ErrBindFailed if it can't listen, or
+// statute.ErrShutdown once the server's context is cancelled.
 func (s *Server) ListenAndServe() error {
 	s.Logger.Debug("Serving on " + s.Bind + " ...")
 
-	ln, err := net.Listen("tcp", s.Bind)
+	ln, err := statute.Listen("tcp", s.Bind)
 	if err != nil {
 		s.Logger.Error("Error listening on " + s.Bind + ", " + err.Error())
-		return err
+		return statute.BindError(err)
 	}
 	defer func() {
 		_ = ln.Close()
 	}()
+	s.ListenAddrs.Add(ln.Addr())
+	defer s.ListenAddrs.Remove(ln.Addr())
 
 	ctx, cancel := context.WithCancel(s.Context)
 	defer cancel()
 
+	// close the listener on cancellation so a blocked Accept returns
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	acceptRate := statute.NewAcceptRateLimiter(s.AcceptRate, s.AcceptBurst, s.RejectOverAcceptRate)
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := ln.Accept()
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return statute.ShutdownError(ctx)
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return statute.AcceptError(err)
+			}
+			s.Logger.Error(err)
+			continue
+		}
+		if !acceptRate.Admit(ctx) {
+			s.Logger.Debug("accept rate exceeded, rejected connection from " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, s.RejectWithRST)
+			continue
+		}
+		if !statute.SourceAllowed(conn.RemoteAddr(), s.AllowedSources) {
+			s.Logger.Debug("rejected connection from " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, s.RejectWithRST)
+			continue
+		}
+		if s.ByteQuota != nil && !s.ByteQuota.Allow(statute.RemoteIP(conn.RemoteAddr())) {
+			s.Logger.Debug("byte quota exceeded for " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, s.RejectWithRST)
+			continue
+		}
+		if s.DSCP != 0 {
+			if err := statute.SetDSCP(conn, s.DSCP); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.TunnelKeepalive > 0 {
+			if err := statute.SetKeepAlive(conn, s.TunnelKeepalive); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.SocketRecvBuffer > 0 || s.SocketSendBuffer > 0 {
+			if err := statute.SetSocketBuffers(conn, s.SocketRecvBuffer, s.SocketSendBuffer); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.ByteQuota != nil {
+			conn = s.ByteQuota.Conn(conn)
+		}
+		conn = statute.ApplyConnMiddleware(conn, s.ConnMiddleware)
+
+		go func() {
+			limited, err := s.Handshakes.Begin(s.Context, conn)
 			if err != nil {
-				s.Logger.Error(err)
-				continue
+				_ = conn.Close()
+				return
 			}
+			defer statute.EndHandshake(limited)
 
-			go func() {
-				err := s.ServeConn(conn)
-				if err != nil {
-					s.Logger.Error(err)
-				}
-			}()
-		}
+			err = s.ServeConn(limited)
+			if err != nil {
+				statute.LogConnError(s.Logger, err, s.HandlerErrorFilter)
+			}
+		}()
 	}
 }
 
+// ServeConnReader serves conn whose first bytes may already be buffered in
+// reader, as when the protocol was detected by peeking at the connection.
+func (s *Server) ServeConnReader(conn net.Conn, reader *bufio.Reader) error {
+	return s.ServeConn(statute.NewBufferedConn(conn, reader))
+}
+
 // ServeConn handles the SOCKS4 protocol for a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
+	stop := statute.LimitLifetime(conn, s.MaxConnLifetime)
+	defer stop()
+
+	if s.ConnLog == nil && s.Stats == nil && s.Events == nil {
+		return s.serveConn(conn, nil)
+	}
+
+	tracker := s.Stats.Track(conn, statute.ProtocolSOCKS4)
+	tracker.Notify(s.Events)
+	tracker.ReverseLookup(s.ReverseDNS)
+	err := s.serveConn(tracker.Conn(), tracker)
+	tracker.Done(err, s.ConnLog)
+	return err
+}
+
+// ActiveConnections returns the connections being served, as tracked by
+// Stats, or none if Stats is nil.
+func (s *Server) ActiveConnections() []statute.ConnInfo {
+	return s.Stats.Connections()
+}
+
+// SetDraining makes the server reject new requests while it shuts down.
+func (s *Server) SetDraining(draining bool) {
+	s.draining.Store(draining)
+}
+
+// serveConn handles the SOCKS4 protocol, recording the request in tracker.
+func (s *Server) serveConn(conn net.Conn, tracker *statute.ConnTracker) error {
 	version, err := readByte(conn)
 	if err != nil {
 		return err
@@ -96,14 +257,25 @@ func (s *Server) ServeConn(conn net.Conn) error {
 
 	addr, err := readAddrAndUser(conn)
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return err
 	}
 	req.DestinationAddr = &addr.address
 	req.Username = addr.Username
-	return s.handle(req)
+	if s.draining.Load() {
+		if err := sendReply(conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return statute.ErrDraining
+	}
+	tracker.SetUserHandler(req.Command == ConnectCommand && s.UserConnectHandle != nil)
+	tracker.SetDestination(req.DestinationAddr.String())
+	err = s.handle(req)
+	// interceptors may have rewritten the destination
+	tracker.SetDestination(req.DestinationAddr.String())
+	return err
 }
 
 // ServerOption functions for configuring the Server.
@@ -115,6 +287,13 @@ func WithLogger(logger statute.Logger) ServerOption {
 	}
 }
 
+// WithMetrics sets the metrics sink for the Server.
+func WithMetrics(metrics statute.Metrics) ServerOption {
+	return func(s *Server) {
+		s.Metrics = metrics
+	}
+}
+
 // WithBind sets the address to listen on for the Server.
 func WithBind(bindAddress string) ServerOption {
 	return func(s *Server) {
@@ -129,6 +308,22 @@ func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	}
 }
 
+// WithAllowBind accepts BIND requests, listening for the inbound connection
+// on an ephemeral port of the address the client connected to.
+func WithAllowBind(allow bool) ServerOption {
+	return func(s *Server) {
+		s.AllowBind = allow
+	}
+}
+
+// WithBindHandle sets the user handler opening the listener of BIND
+// requests, which enables them.
+func WithBindHandle(handler statute.UserBindHandler) ServerOption {
+	return func(s *Server) {
+		s.UserBindHandle = handler
+	}
+}
+
 // WithProxyDial sets the proxyDial function for establishing transport connections.
 func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
 	return func(s *Server) {
@@ -150,11 +345,234 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+// WithBlockPrivateRanges rejects destinations that resolve to loopback,
+// link-local, private or unique-local addresses.
+func WithBlockPrivateRanges(block bool) ServerOption {
+	return func(s *Server) {
+		s.BlockPrivateRanges = block
+	}
+}
+
+// WithResolver sets the resolver used to resolve destination names before dialing.
+func WithResolver(resolver statute.Resolver) ServerOption {
+	return func(s *Server) {
+		s.Resolver = resolver
+	}
+}
+
+// WithDSCP marks outbound and accepted sockets with the given DSCP value.
+func WithDSCP(value int) ServerOption {
+	return func(s *Server) {
+		s.DSCP = value
+	}
+}
+
+// WithConnMiddleware adds middleware wrapping every accepted connection.
+func WithConnMiddleware(middleware ...statute.ConnMiddleware) ServerOption {
+	return func(s *Server) {
+		s.ConnMiddleware = append(s.ConnMiddleware, middleware...)
+	}
+}
+
+// WithRequestInterceptors adds interceptors run on requests before the destination is dialed.
+func WithRequestInterceptors(interceptors ...statute.RequestInterceptor) ServerOption {
+	return func(s *Server) {
+		s.RequestInterceptors = append(s.RequestInterceptors, interceptors...)
+	}
+}
+
+// WithAllowedSourceCIDRs limits accepted clients to the given networks in CIDR
+// notation or bare IPs. It panics if a network can't be parsed.
+func WithAllowedSourceCIDRs(cidrs ...string) ServerOption {
+	return func(s *Server) {
+		s.AllowedSources = append(s.AllowedSources, statute.MustParseCIDRs(cidrs...)...)
+	}
+}
+
+// WithStats counts the connections served in stats, which may be shared
+// with other servers.
+func WithStats(stats *statute.StatsCollector) ServerOption {
+	return func(s *Server) {
+		s.Stats = stats
+	}
+}
+
+// WithEventChannel publishes connection open, close and error events on ch.
+// Events are dropped rather than blocking when ch is full.
+func WithEventChannel(ch chan<- statute.Event) ServerOption {
+	return func(s *Server) {
+		s.Events = statute.NewEventSink(ch)
+	}
+}
+
+// WithHandlerErrorFilter leaves errors returned by the user handler out of
+// the logs when filter reports them as expected.
+func WithHandlerErrorFilter(filter statute.HandlerErrorFilter) ServerOption {
+	return func(s *Server) {
+		s.HandlerErrorFilter = filter
+	}
+}
+
+// WithConnLog sets the callback receiving a summary of every connection served.
+func WithConnLog(connLog statute.ConnLogFunc) ServerOption {
+	return func(s *Server) {
+		s.ConnLog = connLog
+	}
+}
+
+// WithRejectWithRST makes rejected connections close with an RST instead of a FIN.
+func WithRejectWithRST(reset bool) ServerOption {
+	return func(s *Server) {
+		s.RejectWithRST = reset
+	}
+}
+
+// WithReverseDNS records the reverse DNS name of client IPs in ConnLog summaries, see statute.ReverseDNS.
+func WithReverseDNS(enable bool) ServerOption {
+	return func(s *Server) {
+		s.ReverseDNS = nil
+		if enable {
+			s.ReverseDNS = statute.NewReverseDNS(nil)
+		}
+	}
+}
+
+// WithMuxHint detects tunnels carrying a multiplexed session, such as yamux
+// or smux, from the first bytes the client sends and tunes them with larger
+// socket buffers and no idle deadline, see statute.WatchMux.
+func WithMuxHint(detector statute.MuxDetector) ServerOption {
+	return func(s *Server) {
+		s.MuxHint = detector
+	}
+}
+
+// WithCloseGrace lets tunnels flush in-flight data for up to grace when the
+// server's context is cancelled: both ends are half-closed, so peers see EOF
+// after the data already relayed, and only closed once their peers have
+// closed too or after grace. Zero closes them at once.
+func WithCloseGrace(grace time.Duration) ServerOption {
+	return func(s *Server) {
+		s.CloseGrace = grace
+	}
+}
+
+// WithAcceptRateLimit paces accepted connections to perSec per second, in
+// bursts of up to burst.
+func WithAcceptRateLimit(perSec int, burst int) ServerOption {
+	return func(s *Server) {
+		s.AcceptRate = perSec
+		s.AcceptBurst = burst
+	}
+}
+
+// WithRejectOverAcceptRate closes connections over the rate set by
+// WithAcceptRateLimit at once rather than making them wait.
+func WithRejectOverAcceptRate(reject bool) ServerOption {
+	return func(s *Server) {
+		s.RejectOverAcceptRate = reject
+	}
+}
+
+// WithMaxConcurrentHandshakes bounds how many accepted connections are in
+// their handshake phase at once, from parsing the first bytes until the
+// tunnel starts or the connection is rejected. Connections beyond the limit
+// wait for a slot, protecting the server against handshake floods. Zero or
+// less doesn't limit them.
+func WithMaxConcurrentHandshakes(n int) ServerOption {
+	return func(s *Server) {
+		s.Handshakes = statute.NewHandshakeLimiter(n)
+	}
+}
+
+// WithMaxConnLifetime closes client connections lifetime after they were
+// accepted, even while they are actively transferring data.
+func WithMaxConnLifetime(lifetime time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxConnLifetime = lifetime
+	}
+}
+
+// WithSocketBuffers sets the receive and send socket buffer sizes of client
+// and destination connections. Zero leaves the OS default.
+func WithSocketBuffers(recv, send int) ServerOption {
+	return func(s *Server) {
+		s.SocketRecvBuffer = recv
+		s.SocketSendBuffer = send
+	}
+}
+
+// WithTunnelKeepalive enables TCP keepalive probes at the given interval on tunnels, see statute.KeepAliveDial.
+func WithTunnelKeepalive(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.TunnelKeepalive = interval
+	}
+}
+
+// WithBindReplyAddr advertises ip instead of the proxy's local address in
+// granted replies, keeping the real port. It must be an IPv4 address.
+func WithBindReplyAddr(ip net.IP) ServerOption {
+	return func(s *Server) {
+		s.BindReplyIP = ip
+	}
+}
+
+// WithNetns dials destinations from within the Linux network namespace at
+// path, such as /var/run/netns/egress, so proxied traffic exits through it
+// rather than the listener's namespace.
+func WithNetns(path string) ServerOption {
+	return func(s *Server) {
+		s.Netns = path
+	}
+}
+
+// WithDestinationClassifier labels connection metrics with the class
+// classify maps their destination host to. Without it metrics carry no
+// destination label.
+func WithDestinationClassifier(classify statute.DestinationClassifier) ServerOption {
+	return func(s *Server) {
+		s.DestinationClassifier = classify
+	}
+}
+
+// WithConnectTimeout bounds how long establishing a connection to a
+// destination may take, regardless of the deadline of the server context.
+func WithConnectTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ConnectTimeout = timeout
+	}
+}
+
+// WithBuffers sets the sizes of the buffers for data read from the client
+// (upload) and written to it (download), overriding BytesPool for that
+// direction. Zero keeps the default for a direction.
+func WithBuffers(readSize, writeSize int) ServerOption {
+	return func(s *Server) {
+		s.ReadBufferSize = readSize
+		s.WriteBufferSize = writeSize
+	}
+}
+
+// WithPerIPByteQuota refuses new connections from client IPs that transferred
+// more than bytes within the sliding window.
+func WithPerIPByteQuota(bytes int64, window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ByteQuota = statute.NewByteQuota(bytes, window)
+	}
+}
+
 // handle processes the SOCKS4 request based on the command type.
 func (s *Server) handle(req *request) error {
 	switch req.Command {
 	case ConnectCommand:
 		return s.handleConnect(req)
+	case BindCommand:
+		if !s.AllowBind && s.UserBindHandle == nil {
+			if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+				return err
+			}
+			return fmt.Errorf("disallowed Command: %v", req.Command)
+		}
+		return s.handleBind(req)
 	default:
 		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
 			return err
@@ -165,13 +583,6 @@ func (s *Server) handle(req *request) error {
 
 // handleConnect handles the SOCKS4 CONNECT command.
 func (s *Server) handleConnect(req *request) error {
-	if s.UserConnectHandle == nil {
-		return s.embedHandleConnect(req)
-	}
-
-	if err := sendReply(req.Conn, grantedReply, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
-	}
 	host := req.DestinationAddr.IP.String()
 	if req.DestinationAddr.Name != "" {
 		host = req.DestinationAddr.Name
@@ -185,9 +596,35 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+		Protocol:    statute.ProtocolSOCKS4,
+	}
+
+	if len(s.RequestInterceptors) > 0 {
+		if err := statute.ApplyInterceptors(proxyReq, s.RequestInterceptors); err != nil {
+			if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("request to %v rejected: %w", req.DestinationAddr, err)
+		}
+		req.DestinationAddr = hostPortAddress(proxyReq.DestHost, int(proxyReq.DestPort))
+	}
+
+	if s.UserConnectHandle == nil {
+		return s.embedHandleConnect(req)
 	}
 
-	return s.UserConnectHandle(proxyReq)
+	// the handler may return without closing the client connection
+	defer func() {
+		_ = req.Conn.Close()
+	}()
+	if err := sendReply(req.Conn, grantedReply, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	statute.EndHandshake(proxyReq.Conn)
+	cancel := statute.WatchTeardown(s.Context, proxyReq)
+	defer cancel()
+	return statute.WrapHandlerError(s.UserConnectHandle(proxyReq))
 }
 
 // embedHandleConnect is the default handler for SOCKS4 CONNECT if UserConnectHandle is not set.
@@ -195,9 +632,10 @@ func (s *Server) embedHandleConnect(req *request) error {
 	defer func() {
 		_ = req.Conn.Close()
 	}()
-	target, err := s.ProxyDial(s.Context, "tcp", req.DestinationAddr.Address())
+	dialStart := time.Now()
+	target, err := s.proxyDial()(s.Context, "tcp", req.DestinationAddr.Address())
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
@@ -205,25 +643,73 @@ func (s *Server) embedHandleConnect(req *request) error {
 	defer func() {
 		_ = target.Close()
 	}()
+
+	destination := req.DestinationAddr.String()
+	dialLatency := time.Since(dialStart)
+	labels := statute.MetricLabels("socks4", destination, s.DestinationClassifier)
+	s.Logger.Debug("dial", "protocol", "socks4", "destination", destination, "latency", dialLatency)
+	s.Metrics.ObserveDuration("dial_latency", dialLatency, labels...)
+	tracker := statute.ConnTrackerOf(req.Conn)
+	tracker.SetDialLatency(dialLatency)
+	target = statute.NewFirstByteConn(target, func(ttfb time.Duration) {
+		s.Logger.Debug("first byte", "protocol", "socks4", "destination", destination, "ttfb", ttfb)
+		s.Metrics.ObserveDuration("ttfb", ttfb, labels...)
+		tracker.SetTTFB(ttfb)
+	})
 	local := target.LocalAddr().(*net.TCPAddr)
 	bind := address{IP: local.IP, Port: local.Port}
+	if s.BindReplyIP != nil {
+		bind.IP = s.BindReplyIP
+	}
 	if err := sendReply(req.Conn, grantedReply, &bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
-		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+	buf1, buf2, release := statute.TunnelBuffers(s.BytesPool, s.ReadBufferSize, s.WriteBufferSize)
+	defer release()
+
+	clientConn := statute.WatchMux(req.Conn, target, s.MuxHint, func() {
+		s.Logger.Debug("mux session detected", "protocol", "socks4", "destination", destination)
+	})
+	client := statute.NewCountingConn(clientConn)
+	defer func() {
+		s.Metrics.AddCount("bytes_up", client.BytesRead(), labels...)
+		s.Metrics.AddCount("bytes_down", client.BytesWritten(), labels...)
+		statute.HintBytesPool(s.BytesPool, max(client.BytesRead(), client.BytesWritten()))
+	}()
+	return statute.Tunnel(statute.ContextWithCloseGrace(s.Context, s.CloseGrace), target, client, buf1, buf2)
+}
+
+// proxyDial returns the dial function used by the embedded handler.
+func (s *Server) proxyDial() statute.ProxyDialFunc {
+	dial := statute.SelfDialGuard(s.ProxyDial, s.ListenAddrs)
+	if s.Netns != "" {
+		dial = statute.NetnsDial(dial, s.Netns)
+	}
+	if s.DSCP != 0 {
+		dial = statute.DSCPDial(dial, s.DSCP)
+	}
+	if s.TunnelKeepalive > 0 {
+		dial = statute.KeepAliveDial(dial, s.TunnelKeepalive)
+	}
+	if s.SocketRecvBuffer > 0 || s.SocketSendBuffer > 0 {
+		dial = statute.SocketBuffersDial(dial, s.SocketRecvBuffer, s.SocketSendBuffer)
+	}
+
+	resolver := s.Resolver
+	if s.BlockPrivateRanges {
+		if resolver == nil {
+			resolver = statute.DefaultResolver()
+		}
+		dial = statute.BlockPrivateDial(resolver, dial)
+	} else if resolver != nil {
+		dial = statute.ResolveDial(resolver, dial)
+	}
+
+	if s.ConnectTimeout > 0 {
+		dial = statute.TimeoutDial(dial, s.ConnectTimeout)
 	}
-	return statute.Tunnel(s.Context, target, req.Conn, buf1, buf2)
+	return dial
 }
 
 // sendReply sends the SOCKS4 reply to the client.
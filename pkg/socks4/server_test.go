@@ -0,0 +1,212 @@
+package socks4
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type quietLogger struct{}
+
+func (quietLogger) Debug(...interface{}) {}
+func (quietLogger) Error(...interface{}) {}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// serve runs a server built with options on a loopback address until the
+// test ends, returning it and its address.
+func serve(t *testing.T, options ...ServerOption) (*Server, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	options = append([]ServerOption{WithLogger(quietLogger{}), WithBind(addr), WithContext(ctx)}, options...)
+	s := NewServer(options...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return s, addr
+		}
+	}
+	t.Fatalf("server on %s didn't start", addr)
+	return nil, ""
+}
+
+// echoServer runs a TCP server echoing what it reads until the test ends,
+// returning its address.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// sendRequest sends a SOCKS4 request with command for dest to the server at
+// proxy, as SOCKS4a if the host isn't an IPv4 address, returning the
+// connection, the reply and the address it carries.
+func sendRequest(t *testing.T, proxy string, command Command, dest string) (net.Conn, reply, *address) {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := []byte{socks4Version, byte(command)}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	req = append(req, ip...)
+	req = append(req, 0)
+	if net.ParseIP(host) == nil {
+		req = append(append(req, host...), 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	bind := &address{IP: net.IP(resp[4:8]), Port: int(binary.BigEndian.Uint16(resp[2:4]))}
+	return conn, reply(resp[1]), bind
+}
+
+func TestBlockPrivateRanges(t *testing.T) {
+	echo := echoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	_, open := serve(t)
+	_, proxy := serve(t, WithBlockPrivateRanges(true))
+
+	// the SOCKS4a name is only found private once resolved
+	for _, target := range []string{echo, net.JoinHostPort("localhost", port)} {
+		if _, resp, _ := sendRequest(t, open, ConnectCommand, target); resp != grantedReply {
+			t.Fatalf("CONNECT %s without the guard: %v", target, resp)
+		}
+		if _, resp, _ := sendRequest(t, proxy, ConnectCommand, target); resp != rejectedReply {
+			t.Errorf("CONNECT %s: got %v, want %v", target, resp, rejectedReply)
+		}
+	}
+}
+
+func TestRejectReplies(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want reply
+	}{
+		{"ident failed", fmt.Errorf("ident: %w", ErrIdentFailed), identFailedReply},
+		{"user id mismatch", fmt.Errorf("ident: %w", ErrUserIDMismatch), userIDMismatchReply},
+		{"other", errors.New("connection refused"), rejectedReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, proxy := serve(t, WithProxyDial(func(context.Context, string, string) (net.Conn, error) {
+				return nil, tt.err
+			}))
+			if _, got, _ := sendRequest(t, proxy, ConnectCommand, "127.0.0.1:80"); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContextCancelStopsServing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	addr := freeAddr(t)
+	s := NewServer(WithLogger(quietLogger{}), WithBind(addr), WithContext(ctx))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("server on %s didn't start", addr)
+		}
+	}
+
+	// Accept is blocked with no client connecting
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe still running after the context was cancelled")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		_ = conn.Close()
+		t.Error("listener still open")
+	}
+}
+
+func TestBindReplyAddr(t *testing.T) {
+	echo := echoServer(t)
+	public := net.IPv4(203, 0, 113, 7).To4()
+	_, proxy := serve(t, WithBindReplyAddr(public))
+
+	_, got, bind := sendRequest(t, proxy, ConnectCommand, echo)
+	if got != grantedReply {
+		t.Fatalf("got %v, want %v", got, grantedReply)
+	}
+	// the address is replaced, the real port is kept
+	if !bind.IP.Equal(public) || bind.Port == 0 {
+		t.Errorf("reply advertises %v:%d, want %v and the local port", bind.IP, bind.Port, public)
+	}
+}
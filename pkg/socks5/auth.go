@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+)
+
+// Authenticator authenticates a client with a single SOCKS5 method
+type Authenticator interface {
+	// Method is the method code advertised during negotiation
+	Method() byte
+	// Authenticate runs the method's sub-negotiation after it was selected
+	Authenticate(conn net.Conn) error
+}
+
+// NoAuthAuthenticator accepts clients without authentication
+type NoAuthAuthenticator struct{}
+
+func (NoAuthAuthenticator) Method() byte { return byte(noAuth) }
+
+func (NoAuthAuthenticator) Authenticate(net.Conn) error { return nil }
+
+// OpenProxy reports whether the server accepts clients without
+// authentication on an address reachable from other hosts.
+func (s *Server) OpenProxy() bool {
+	if !s.acceptsNoAuth() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(s.Bind)
+	if err != nil {
+		host = s.Bind
+	}
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+func (s *Server) acceptsNoAuth() bool {
+	for _, a := range s.Authenticators {
+		if a.Method() == byte(noAuth) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateAuth reads the client's method selection message, replies with the
+// first configured method the client offers and runs its sub-negotiation. If
+// there is none, it replies with noAcceptable and closes the connection as
+// RFC 1928 requires. The methods offered are returned as well.
+func (s *Server) negotiateAuth(conn net.Conn) (Authenticator, []byte, error) {
+	methods, err := readBytes(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, a := range s.Authenticators {
+		if bytes.IndexByte(methods, a.Method()) != -1 {
+			if _, err := conn.Write([]byte{socks5Version, a.Method()}); err != nil {
+				return nil, methods, err
+			}
+			return a, methods, a.Authenticate(conn)
+		}
+	}
+
+	_, _ = conn.Write([]byte{socks5Version, byte(noAcceptable)})
+	_ = conn.Close()
+	return nil, methods, errNoSupportedAuth
+}
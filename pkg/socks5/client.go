@@ -0,0 +1,125 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Dialer connects to destinations through a SOCKS5 server with CONNECT
+// requests, without authentication. Its Dial method is a
+// statute.ProxyDialFunc, so it can be chained with the other dialers.
+type Dialer struct {
+	// ProxyAddress is the address of the SOCKS5 server
+	ProxyAddress string
+	// ProxyDial connects to the server, nil uses statute.DefaultProxyDial
+	ProxyDial statute.ProxyDialFunc
+	// Compression is offered to the server and used for tunnels it accepts
+	// them for, which only a Server with the same TunnelCompression does
+	Compression statute.Compression
+	// SessionTTL is offered to the server as the maximum lifetime of the
+	// tunnel and sent once a Server with SessionTTLExtension accepts it, in
+	// which case the tunnel is left uncompressed; zero offers none
+	SessionTTL time.Duration
+}
+
+// Dial connects to address through the SOCKS5 server. Only TCP networks are
+// supported.
+func (d *Dialer) Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("socks5 dial: unsupported network %q", network)
+	}
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := d.ProxyDial
+	if dial == nil {
+		dial = statute.DefaultProxyDial()
+	}
+	conn, err := dial(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// a cancelled context interrupts the handshake
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	compression, err := d.connectHandshake(conn, hostPortAddress(host, port))
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks5 dial %v via %v: %w", address, d.ProxyAddress, err)
+	}
+	return statute.CompressConn(conn, compression), nil
+}
+
+// connectHandshake negotiates no-auth, offering compression and the session
+// TTL if set, and sends a CONNECT request for dest over conn, returning the
+// compression the server accepted. The session TTL follows the reply if the
+// server accepted it.
+func (d *Dialer) connectHandshake(conn net.Conn, dest *Address) (statute.Compression, error) {
+	methods := []byte{byte(noAuth)}
+	offered := compressionMethod(d.Compression)
+	if offered != noAuth {
+		methods = append(methods, byte(offered))
+	}
+	if d.SessionTTL > 0 {
+		methods = append(methods, byte(sessionTTL))
+	}
+	hello := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(hello); err != nil {
+		return statute.CompressionNone, err
+	}
+
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		return statute.CompressionNone, err
+	}
+	if method[0] != socks5Version {
+		return statute.CompressionNone, fmt.Errorf("unsupported SOCKS version: %d", method[0])
+	}
+	if authMethod(method[1]) != noAuth {
+		return statute.CompressionNone, errNoSupportedAuth
+	}
+
+	var request bytes.Buffer
+	request.Write([]byte{socks5Version, byte(ConnectCommand), 0})
+	if err := writeAddr(&request, dest, nil); err != nil {
+		return statute.CompressionNone, err
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return statute.CompressionNone, err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return statute.CompressionNone, err
+	}
+	if reply(header[1]) != successReply {
+		return statute.CompressionNone, fmt.Errorf("connect failed: %v", reply(header[1]))
+	}
+	if _, err := readAddr(conn, nil); err != nil {
+		return statute.CompressionNone, err
+	}
+
+	if offered != noAuth && header[2] == byte(offered) {
+		return d.Compression, nil
+	}
+	if d.SessionTTL > 0 && header[2] == byte(sessionTTL) {
+		if err := writeSessionTTL(conn, d.SessionTTL); err != nil {
+			return statute.CompressionNone, err
+		}
+	}
+	return statute.CompressionNone, nil
+}
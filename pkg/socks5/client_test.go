@@ -0,0 +1,143 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+func TestDialerSessionTTL(t *testing.T) {
+	echo := echoServer(t)
+
+	t.Run("accepted", func(t *testing.T) {
+		_, proxy := serve(t, WithSessionTTLExtension(true))
+		d := &Dialer{ProxyAddress: proxy, SessionTTL: time.Second}
+		conn, err := d.Dial(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+
+		assertExpires(t, conn)
+	})
+
+	t.Run("with compression", func(t *testing.T) {
+		_, proxy := serve(t, WithSessionTTLExtension(true), WithTunnelCompression(statute.CompressionGzip))
+		d := &Dialer{ProxyAddress: proxy, SessionTTL: time.Second, Compression: statute.CompressionGzip}
+		conn, err := d.Dial(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// both ends agree on leaving the tunnel uncompressed, and the TTL is kept
+		assertEcho(t, conn)
+		assertExpires(t, conn)
+	})
+
+	t.Run("not supported", func(t *testing.T) {
+		_, proxy := serve(t)
+		d := &Dialer{ProxyAddress: proxy, SessionTTL: time.Second}
+		conn, err := d.Dial(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// no TTL is sent into the tunnel, which outlives it
+		time.Sleep(1500 * time.Millisecond)
+		assertEcho(t, conn)
+	})
+}
+
+// assertExpires checks that the server closes conn about when its session
+// TTL of a second expires.
+func assertExpires(t *testing.T, conn net.Conn) {
+	t.Helper()
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded on an expired session")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("session closed after %v, want about the 1s TTL", elapsed)
+	}
+}
+
+// compressionRoundTrip dials the echo server at target through proxy with a
+// Dialer offering algo, sends a compressible payload and checks it comes
+// back, returning the bytes the client received from the proxy.
+func compressionRoundTrip(t *testing.T, proxy, target string, algo statute.Compression) int64 {
+	t.Helper()
+	var raw *statute.CountingConn
+	d := &Dialer{
+		ProxyAddress: proxy,
+		Compression:  algo,
+		ProxyDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := statute.DefaultProxyDial()(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			raw = statute.NewCountingConn(conn)
+			return raw, nil
+		},
+	}
+	conn, err := d.Dial(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	payload := bytes.Repeat([]byte("compressible "), 4096)
+	before := raw.BytesRead()
+	go func() {
+		_, _ = conn.Write(payload)
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload corrupted through the tunnel")
+	}
+	return raw.BytesRead() - before
+}
+
+func TestDialerCompression(t *testing.T) {
+	echo := echoServer(t)
+	size := int64(len("compressible ") * 4096)
+
+	for _, algo := range []statute.Compression{statute.CompressionGzip, statute.CompressionDeflate} {
+		t.Run(algo.String(), func(t *testing.T) {
+			_, proxy := serve(t, WithTunnelCompression(algo))
+			if n := compressionRoundTrip(t, proxy, echo, algo); n >= size/10 {
+				t.Errorf("received %d bytes for a %d byte payload, want it compressed", n, size)
+			}
+		})
+	}
+}
+
+func TestDialerCompressionFallback(t *testing.T) {
+	echo := echoServer(t)
+	size := int64(len("compressible ") * 4096)
+
+	// servers that don't echo the method offered leave the tunnel uncompressed
+	for name, options := range map[string][]ServerOption{
+		"not supported":   nil,
+		"other algorithm": {WithTunnelCompression(statute.CompressionDeflate)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, proxy := serve(t, options...)
+			if n := compressionRoundTrip(t, proxy, echo, statute.CompressionGzip); n < size {
+				t.Errorf("received %d bytes for a %d byte payload, want it uncompressed", n, size)
+			}
+		})
+	}
+}
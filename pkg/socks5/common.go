@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,16 +12,31 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
 )
 
 var (
 	errStringTooLong        = errors.New("string too long")
 	errNoSupportedAuth      = errors.New("no supported authentication mechanism")
 	errUnrecognizedAddrType = errors.New("unrecognized address type")
+	errTooManyUDPSessions   = errors.New("too many UDP associate sessions")
+	errMalformedRequest     = errors.New("malformed request")
 )
 
 const (
 	maxUdpPacket = math.MaxUint16 - 28
+	minUdpPacket = 512
+	// maxUdpHeader is the longest SOCKS UDP request header: RSV, FRAG, ATYP,
+	// a length-prefixed FQDN and the port
+	maxUdpHeader = 3 + 1 + 1 + 255 + 2
+)
+
+const (
+	udpResolveTTL         = time.Minute
+	udpResolveNegativeTTL = 5 * time.Second
+	udpResolveCacheSize   = 1024
 )
 
 const (
@@ -62,6 +78,9 @@ func errToReply(err error) reply {
 	if err == nil {
 		return successReply
 	}
+	if errors.Is(err, statute.ErrBlockedDestination) {
+		return ruleFailure
+	}
 	msg := err.Error()
 	resp := hostUnreachable
 	if strings.Contains(msg, "refused") {
@@ -106,17 +125,44 @@ const (
 	ipv6Address = 0x04
 )
 
-// address is a SOCKS-specific address.
+// Address is a SOCKS-specific address.
 // Either Name or IP is used exclusively.
-type address struct {
+type Address struct {
 	Name string // fully-qualified domain name
 	IP   net.IP
 	Port int
+	Type byte // custom address type, zero for the standard ones
+}
+
+// AddressReaderFunc reads the body of a custom address type, following the
+// type byte and preceding the port, into Name or IP.
+type AddressReaderFunc func(r io.Reader) (*Address, error)
+
+// AddressWriterFunc writes the body of a custom address type, following the
+// type byte and preceding the port.
+type AddressWriterFunc func(w io.Writer, addr *Address) error
+
+// AddressType reads and writes a custom address type.
+type AddressType struct {
+	Read  AddressReaderFunc
+	Write AddressWriterFunc
+}
+
+// AddressResolverFunc connects to the destination of a CONNECT request from
+// its address as parsed, a name or an IP.
+type AddressResolverFunc func(ctx context.Context, addr *Address) (net.Conn, error)
+
+// hostPortAddress returns the address of host, an IP literal or a name, and port.
+func hostPortAddress(host string, port int) *Address {
+	if ip := net.ParseIP(host); ip != nil {
+		return &Address{IP: ip, Port: port}
+	}
+	return &Address{Name: host, Port: port}
 }
 
-func (a *address) Network() string { return "socks5" }
+func (a *Address) Network() string { return "socks5" }
 
-func (a *address) String() string {
+func (a *Address) String() string {
 	if a == nil {
 		return "<nil>"
 	}
@@ -125,7 +171,7 @@ func (a *address) String() string {
 
 // Address returns a string suitable to dial; prefer returning IP-based
 // address, fallback to Name
-func (a address) Address() string {
+func (a Address) Address() string {
 	port := strconv.Itoa(a.Port)
 	if 0 != len(a.IP) {
 		return net.JoinHostPort(a.IP.String(), port)
@@ -138,50 +184,123 @@ type authMethod byte
 
 const (
 	noAuth       authMethod = 0x00 // no authentication required
+	gssapiAuth   authMethod = 0x01 // GSSAPI
+	userPassAuth authMethod = 0x02 // username/password
 	noAcceptable authMethod = 0xff // no acceptable authentication methods
+
+	// extendedReplies is a private method never selected, offered by clients
+	// that accept an error message after failure replies
+	extendedReplies authMethod = 0xfe
+	// gzipTunnel and deflateTunnel are private methods never selected,
+	// offered by clients that can compress CONNECT tunnels; the server
+	// accepts by echoing the method in the reserved byte of the reply
+	gzipTunnel    authMethod = 0xfd
+	deflateTunnel authMethod = 0xfc
+	// sessionTTL is a private method never selected, offered by clients that
+	// can limit the lifetime of the session; the server accepts by echoing
+	// the method in the reserved byte of the reply, which the client follows
+	// with the lifetime
+	sessionTTL authMethod = 0xfb
 )
 
+// compressionMethod returns the private method negotiating algo, or noAuth
+// if there is none.
+func compressionMethod(algo statute.Compression) authMethod {
+	switch algo {
+	case statute.CompressionGzip:
+		return gzipTunnel
+	case statute.CompressionDeflate:
+		return deflateTunnel
+	default:
+		return noAuth
+	}
+}
+
+func (m authMethod) String() string {
+	switch m {
+	case noAuth:
+		return "no-auth"
+	case gssapiAuth:
+		return "gssapi"
+	case userPassAuth:
+		return "user/pass"
+	default:
+		return "method " + strconv.Itoa(int(m))
+	}
+}
+
+// readSessionTTL reads the session TTL following a reply, in seconds as
+// four bytes big-endian, zero for none.
+func readSessionTTL(r io.Reader) (time.Duration, error) {
+	var ttl [4]byte
+	if _, err := io.ReadFull(r, ttl[:]); err != nil {
+		return 0, fmt.Errorf("truncated session TTL: %w", err)
+	}
+	return time.Duration(binary.BigEndian.Uint32(ttl[:])) * time.Second, nil
+}
+
+// writeSessionTTL writes ttl following a reply, rounded up to seconds.
+func writeSessionTTL(w io.Writer, ttl time.Duration) error {
+	seconds := math.Ceil(ttl.Seconds())
+	if seconds > math.MaxUint32 {
+		seconds = math.MaxUint32
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(seconds))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// readBytes reads a length-prefixed field, tolerating the length and the data
+// arriving across multiple reads.
 func readBytes(r io.Reader) ([]byte, error) {
-	var buf [1]byte
-	_, err := r.Read(buf[:])
+	length, err := readByte(r)
 	if err != nil {
 		return nil, err
 	}
-	bytes := make([]byte, buf[0])
+	bytes := make([]byte, length)
 	_, err = io.ReadFull(r, bytes)
 	if err != nil {
-		return nil, err
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("truncated %d byte field: %w", length, err)
 	}
 	return bytes, nil
 }
 
+// writeBytes writes a length-prefixed field in a single write.
 func writeBytes(w io.Writer, b []byte) error {
-	_, err := w.Write([]byte{byte(len(b))})
-	if err != nil {
-		return err
+	if len(b) > 255 {
+		return errStringTooLong
 	}
-	_, err = w.Write(b)
+	buf := make([]byte, 0, 1+len(b))
+	buf = append(buf, byte(len(b)))
+	buf = append(buf, b...)
+	_, err := w.Write(buf)
 	return err
 }
 
 func readByte(r io.Reader) (byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return 0, err
 	}
 	return buf[0], nil
 }
 
-func readAddr(r io.Reader) (*address, error) {
-	address := &address{}
+// readAddr reads an address of a standard type, or of a custom one found in
+// types.
+func readAddr(r io.Reader, types map[byte]AddressType) (*Address, error) {
+	address := &Address{}
 
-	var addrType [1]byte
-	if _, err := r.Read(addrType[:]); err != nil {
+	addrType, err := readByte(r)
+	if err != nil {
 		return nil, err
 	}
 
-	switch addrType[0] {
+	switch addrType {
 	case ipv4Address:
 		addr := make(net.IP, net.IPv4len)
 		if _, err := io.ReadFull(r, addr); err != nil {
@@ -195,17 +314,24 @@ func readAddr(r io.Reader) (*address, error) {
 		}
 		address.IP = addr
 	case fqdnAddress:
-		if _, err := r.Read(addrType[:]); err != nil {
-			return nil, err
-		}
-		addrLen := int(addrType[0])
-		fqdn := make([]byte, addrLen)
-		if _, err := io.ReadFull(r, fqdn); err != nil {
+		fqdn, err := readBytes(r)
+		if err != nil {
 			return nil, err
 		}
 		address.Name = string(fqdn)
 	default:
-		return nil, errUnrecognizedAddrType
+		custom, ok := types[addrType]
+		if !ok || custom.Read == nil {
+			return nil, errUnrecognizedAddrType
+		}
+		address, err = custom.Read(r)
+		if err != nil {
+			return nil, fmt.Errorf("address type %#x: %w", addrType, err)
+		}
+		if address == nil {
+			return nil, fmt.Errorf("address type %#x: no address read", addrType)
+		}
+		address.Type = addrType
 	}
 	var port [2]byte
 	if _, err := io.ReadFull(r, port[:]); err != nil {
@@ -215,7 +341,9 @@ func readAddr(r io.Reader) (*address, error) {
 	return address, nil
 }
 
-func writeAddr(w io.Writer, addr *address) error {
+// writeAddr writes addr, through its writer in types if it is of a custom
+// type.
+func writeAddr(w io.Writer, addr *Address, types map[byte]AddressType) error {
 	if addr == nil {
 		_, err := w.Write([]byte{ipv4Address, 0, 0, 0, 0, 0, 0})
 		if err != nil {
@@ -223,7 +351,18 @@ func writeAddr(w io.Writer, addr *address) error {
 		}
 		return nil
 	}
-	if addr.IP != nil {
+	if addr.Type != 0 {
+		custom, ok := types[addr.Type]
+		if !ok || custom.Write == nil {
+			return errUnrecognizedAddrType
+		}
+		if _, err := w.Write([]byte{addr.Type}); err != nil {
+			return err
+		}
+		if err := custom.Write(w, addr); err != nil {
+			return fmt.Errorf("address type %#x: %w", addr.Type, err)
+		}
+	} else if addr.IP != nil {
 		if ip4 := addr.IP.To4(); ip4 != nil {
 			_, err := w.Write([]byte{ipv4Address})
 			if err != nil {
@@ -278,9 +417,9 @@ func writeAddrWithStr(w io.Writer, addr string) error {
 		return err
 	}
 	if ip := net.ParseIP(host); ip != nil {
-		return writeAddr(w, &address{IP: ip, Port: port})
+		return writeAddr(w, &Address{IP: ip, Port: port}, nil)
 	}
-	return writeAddr(w, &address{Name: host, Port: port})
+	return writeAddr(w, &Address{Name: host, Port: port}, nil)
 }
 
 func splitHostPort(address string) (string, int, error) {
@@ -298,6 +437,20 @@ func splitHostPort(address string) (string, int, error) {
 	return host, portnum, nil
 }
 
+// declaredSource reports whether a datagram from addr can come from the client
+// that declared declared in its ASSOCIATE request. RFC 1928 lets clients leave
+// the address or port zero when they do not know them yet, which matches any.
+func declaredSource(declared *Address, addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || declared == nil {
+		return true
+	}
+	if declared.Name == "" && len(declared.IP) > 0 && !declared.IP.IsUnspecified() && !declared.IP.Equal(udpAddr.IP) {
+		return false
+	}
+	return declared.Port == 0 || declared.Port == udpAddr.Port
+}
+
 type readStruct struct {
 	data []byte
 	err  error
@@ -309,10 +462,18 @@ type udpCustomConn struct {
 	lock         sync.Mutex
 	sourceAddr   net.Addr
 	targetAddr   net.Addr
+	wantTarget   string
 	replyPrefix  []byte
 	firstRead    sync.Once
-	frc          chan bool
+	frc          chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
 	packetQueue  chan *readStruct
+	maxPacket    int
+	resolve      func(*Address) (*net.UDPAddr, error)
+	stats        *udpStats
+	declared     *Address
+	filter       statute.DatagramHandler
 }
 
 func (cc *udpCustomConn) RemoteAddr() net.Addr {
@@ -322,94 +483,143 @@ func (cc *udpCustomConn) RemoteAddr() net.Addr {
 func (cc *udpCustomConn) asyncReadPackets() {
 	go func() {
 		for {
-			tempBuf := make([]byte, maxUdpPacket)
+			tempBuf := make([]byte, cc.maxPacket)
 			n, addr, err := cc.ReadFrom(tempBuf)
 			if err != nil {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
-				break
+				cc.deliver(&readStruct{err: err})
+				return
 			}
 			if cc.sourceAddr == nil {
+				if !declaredSource(cc.declared, addr) {
+					continue
+				}
 				cc.sourceAddr = addr
+			} else if addr.String() != cc.sourceAddr.String() {
+				// drop datagrams spoofing or injected by other hosts
+				continue
 			}
 			packetData := tempBuf[:n]
 			if len(packetData) < 3 {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
-				break
+				cc.deliver(&readStruct{err: err})
+				return
 			}
 			reader := bytes.NewBuffer(packetData[3:])
-			targetAddr, err := readAddr(reader)
+			targetAddr, err := readAddr(reader, nil)
 
 			if err != nil {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
-				break
+				cc.deliver(&readStruct{err: err})
+				return
 			}
 			if cc.targetAddr == nil {
-				cc.targetAddr = &net.UDPAddr{
-					IP:   targetAddr.IP,
-					Port: targetAddr.Port,
+				resolved, err := cc.resolve(targetAddr)
+				if err != nil {
+					cc.deliver(&readStruct{err: err})
+					return
 				}
+				cc.targetAddr = resolved
+				cc.wantTarget = targetAddr.String()
 			}
-			if targetAddr.String() != cc.targetAddr.String() {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  fmt.Errorf("ignore non-target addresses %s", targetAddr.String()),
-				}
-				break
+			if targetAddr.String() != cc.wantTarget {
+				cc.deliver(&readStruct{err: fmt.Errorf("ignore non-target addresses %s", targetAddr.String())})
+				return
 			}
 			cc.firstRead.Do(func() {
 				// ok we have source and destination address now user can handle new ProxyReq
-				cc.frc <- true
+				close(cc.frc)
 			})
-			cc.packetQueue <- &readStruct{
-				data: reader.Bytes(),
-				err:  nil,
+			payload := reader.Bytes()
+			if cc.filter != nil {
+				var ok bool
+				if payload, ok = cc.filter(cc.sourceAddr, cc.targetAddr, payload); !ok {
+					continue
+				}
+			}
+			if !cc.deliver(&readStruct{data: payload}) {
+				return
 			}
 		}
 	}()
 }
 
+// deliver hands a read result to Read, giving up once the session is closed.
+func (cc *udpCustomConn) deliver(read *readStruct) bool {
+	select {
+	case cc.packetQueue <- read:
+		return true
+	case <-cc.done:
+		return false
+	}
+}
+
+// watchControl closes the session once the associated TCP connection goes away.
+func (cc *udpCustomConn) watchControl() {
+	var buf [1]byte
+	for {
+		if _, err := cc.assocTCPConn.Read(buf[:]); err != nil {
+			_ = cc.Close()
+			return
+		}
+	}
+}
+
 func (cc *udpCustomConn) Read(b []byte) (int, error) {
 	// wait for packet data
-	read := <-cc.packetQueue
+	var read *readStruct
+	select {
+	case read = <-cc.packetQueue:
+	case <-cc.done:
+		return 0, net.ErrClosed
+	}
 	if read.err != nil {
 		return 0, read.err
 	}
-	copy(b, read.data)
-	return len(read.data), nil
+	n := copy(b, read.data)
+	cc.stats.up(n)
+	return n, nil
 }
 
 func (cc *udpCustomConn) Write(b []byte) (int, error) {
+	payload := b
+	if cc.filter != nil {
+		var ok bool
+		if payload, ok = cc.filter(cc.targetAddr, cc.sourceAddr, b); !ok {
+			// dropped datagrams count as written, like datagrams lost in transit
+			return len(b), nil
+		}
+	}
+
 	cc.lock.Lock()
 	defer cc.lock.Unlock()
 	if cc.replyPrefix == nil {
 		prefix := bytes.NewBuffer(make([]byte, 3, 16))
-		err := writeAddrWithStr(prefix, cc.targetAddr.String())
+		// echo the address in the form the client sent, which may be a name
+		err := writeAddrWithStr(prefix, cc.wantTarget)
 		if err != nil {
 			return 0, err
 		}
 		cc.replyPrefix = prefix.Bytes()
 	}
-	buff := append(cc.replyPrefix, b...)
-	_, err := cc.WriteTo(buff[:len(cc.replyPrefix)+len(b)], cc.sourceAddr)
-	return len(b), err
+	buff := append(cc.replyPrefix, payload...)
+	_, err := cc.WriteTo(buff[:len(cc.replyPrefix)+len(payload)], cc.sourceAddr)
+	if err != nil {
+		return 0, err
+	}
+	cc.stats.down(len(payload))
+	return len(b), nil
 }
 
+// Close ends the session, closing the PacketConn to unblock the pending
+// ReadFrom of asyncReadPackets.
 func (cc *udpCustomConn) Close() error {
-	cc.lock.Lock()
-	defer cc.lock.Unlock()
-	udpErr := cc.Close()
-	tcpErr := cc.assocTCPConn.Close()
-	if udpErr != nil {
-		return udpErr
-	}
-	return tcpErr
+	err := net.ErrClosed
+	cc.closeOnce.Do(func() {
+		close(cc.done)
+		udpErr := cc.PacketConn.Close()
+		tcpErr := cc.assocTCPConn.Close()
+		err = udpErr
+		if err == nil {
+			err = tcpErr
+		}
+	})
+	return err
 }
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUDPCustomConnControlClose(t *testing.T) {
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, control := net.Pipe()
+	defer client.Close()
+
+	baseline := runtime.NumGoroutine()
+	cc := &udpCustomConn{
+		PacketConn:   packet,
+		assocTCPConn: control,
+		frc:          make(chan struct{}),
+		done:         make(chan struct{}),
+		packetQueue:  make(chan *readStruct),
+		maxPacket:    1500,
+		stats:        &udpStats{},
+	}
+	cc.asyncReadPackets()
+	go cc.watchControl()
+
+	// a handler waiting for a datagram
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := cc.Read(make([]byte, 1500))
+		readErr <- err
+	}()
+
+	_ = client.Close()
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Read = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read still blocked after the control connection closed")
+	}
+
+	// asyncReadPackets and watchControl exit with the session
+	for start := time.Now(); runtime.NumGoroutine() > baseline; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("%d goroutines still running, want %d", runtime.NumGoroutine(), baseline)
+		}
+	}
+}
+
+func TestDeclaredSource(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	tests := []struct {
+		declared *Address
+		want     bool
+	}{
+		{nil, true},
+		{&Address{IP: net.IPv4zero, Port: 0}, true},
+		{&Address{IP: net.IPv4(192, 0, 2, 1), Port: 0}, true},
+		{&Address{IP: net.IPv4zero, Port: 5000}, true},
+		{&Address{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, true},
+		{&Address{IP: net.IPv4(192, 0, 2, 2), Port: 5000}, false},
+		{&Address{IP: net.IPv4(192, 0, 2, 1), Port: 5001}, false},
+		{&Address{Name: "client.example", Port: 5000}, true},
+	}
+	for _, tt := range tests {
+		if got := declaredSource(tt.declared, source); got != tt.want {
+			t.Errorf("declaredSource(%v, %v) = %v, want %v", tt.declared, source, got, tt.want)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package socks5
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bepass-org/proxy/pkg/statute"
 )
@@ -20,6 +25,13 @@ type Server struct {
 	// ProxyListenPacket specifies the optional proxyListenPacket function for
 	// establishing the transport connection.
 	ProxyListenPacket statute.ProxyListenPacket
+	// TargetListenPacket opens the egress socket for each UDP target instead of
+	// sending through the relay socket
+	TargetListenPacket statute.TargetListenPacket
+	// DatagramHandler inspects, rewrites or drops each datagram of UDP
+	// associate sessions before it is relayed, in either direction. Sessions
+	// relayed through UpstreamAssociate are not inspected
+	DatagramHandler statute.DatagramHandler
 	// PacketForwardAddress specifies the packet forwarding address
 	PacketForwardAddress statute.PacketForwardAddress
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
@@ -28,10 +40,136 @@ type Server struct {
 	UserAssociateHandle statute.UserAssociateHandler
 	// Logger error log
 	Logger statute.Logger
+	// Metrics receives connection measurements
+	Metrics statute.Metrics
 	// Context is default context
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// AllowedCommands lists the SOCKS commands the server accepts
+	AllowedCommands []Command
+	// BlockPrivateRanges rejects destinations resolving to loopback, link-local,
+	// private or unique-local addresses
+	BlockPrivateRanges bool
+	// Resolver resolves destination names on the proxy before dialing,
+	// when nil names are passed to ProxyDial as-is
+	Resolver statute.Resolver
+	// DSCP marks proxied traffic with the given DSCP value, zero leaves it unmarked
+	DSCP int
+	// MaxUDPPacketSize is the largest UDP datagram relayed for ASSOCIATE sessions
+	MaxUDPPacketSize int
+	// UpstreamAssociate is the address of an upstream SOCKS5 proxy that
+	// UDP ASSOCIATE sessions are relayed through
+	UpstreamAssociate string
+	// ConnMiddleware wraps accepted connections before they are served
+	ConnMiddleware []statute.ConnMiddleware
+	// RequestInterceptors run on CONNECT requests before the destination is dialed
+	RequestInterceptors []statute.RequestInterceptor
+	// AllowedSources limits the client networks accepted by ListenAndServe,
+	// empty allows all
+	AllowedSources []*net.IPNet
+	// ConnLog receives a summary of every connection served
+	ConnLog statute.ConnLogFunc
+	// HandlerErrorFilter reports user handler errors to leave out of the logs
+	HandlerErrorFilter statute.HandlerErrorFilter
+	// Events receives connection open, close and error events, nil for none
+	Events *statute.EventSink
+	// Stats counts the connections served, nil disables counting
+	Stats *statute.StatsCollector
+	// RejectWithRST resets connections rejected by AllowedSources instead of
+	// closing them normally
+	RejectWithRST bool
+	// ByteQuota limits the bytes each client IP may transfer within a window
+	ByteQuota *statute.ByteQuota
+	// UDPLogInterval is how often the packet and byte counts of UDP ASSOCIATE
+	// sessions are logged, zero logs them only when a session ends
+	UDPLogInterval time.Duration
+	// MaxUDPSessions caps the concurrent UDP ASSOCIATE sessions, zero is unlimited
+	MaxUDPSessions int
+	// Authenticators lists the accepted authentication methods in order of
+	// preference, leaving out NoAuthAuthenticator requires clients to authenticate
+	Authenticators []Authenticator
+	// ReadBufferSize and WriteBufferSize size the buffers for data read from
+	// and written to the client, zero takes them from BytesPool
+	ReadBufferSize  int
+	WriteBufferSize int
+	// TunnelKeepalive is the TCP keepalive interval of client and destination
+	// connections, zero leaves the default
+	TunnelKeepalive time.Duration
+	// SocketRecvBuffer and SocketSendBuffer are the SO_RCVBUF and SO_SNDBUF
+	// sizes of client and destination connections, zero leaves the OS default
+	SocketRecvBuffer int
+	SocketSendBuffer int
+	// MaxConnLifetime closes client connections this long after they were
+	// accepted, zero for no limit
+	MaxConnLifetime time.Duration
+	// MuxHint detects multiplexed sessions from the first bytes of tunnels,
+	// to tune them, see statute.WatchMux
+	MuxHint statute.MuxDetector
+	// TunnelCompression compresses CONNECT tunnels with clients offering it,
+	// which only Dialer does
+	TunnelCompression statute.Compression
+	// StrictProtocol rejects requests with a non-zero reserved byte, a
+	// command or address type outside RFC 1928 or an invalid name rather
+	// than parsing them best effort
+	StrictProtocol bool
+	// CloseGrace bounds flushing tunnels once Context is cancelled before
+	// they are closed, zero closes them at once
+	CloseGrace time.Duration
+	// AcceptRate and AcceptBurst pace the connections accepted by
+	// ListenAndServe to AcceptRate per second, in bursts of up to
+	// AcceptBurst, zero for no limit
+	AcceptRate  int
+	AcceptBurst int
+	// RejectOverAcceptRate closes connections over AcceptRate rather than
+	// holding them back
+	RejectOverAcceptRate bool
+	// Handshakes bounds the connections accepted by ListenAndServe that are
+	// negotiating at once, nil doesn't limit them
+	Handshakes *statute.HandshakeLimiter
+	// ListenAddrs holds the addresses the server listens on, destinations
+	// reaching them are refused so the proxy can't loop into itself
+	ListenAddrs *statute.ListenAddrs
+	// ReverseDNS looks up the names of client IPs for ConnLog, nil disables
+	// lookups
+	ReverseDNS *statute.ReverseDNS
+	// ConnectTimeout bounds establishing connections to destinations, zero
+	// leaves them to the context
+	ConnectTimeout time.Duration
+	// Netns is the path of the network namespace destinations are dialed
+	// from, empty for the current one
+	Netns string
+	// DestinationClassifier labels metrics with the class of their destination
+	DestinationClassifier statute.DestinationClassifier
+	// VerboseReplies logs a diagnostic of every failed CONNECT, listing the
+	// resolved addresses tried and the error of each
+	VerboseReplies bool
+	// ExtendedReplies follows failure replies with the error message for
+	// clients offering the private method 0xfe, which is never selected;
+	// other clients get standard replies
+	ExtendedReplies bool
+	// SessionTTLExtension accepts the session TTL of clients offering the
+	// private method 0xfb for CONNECT tunnels and closes the tunnel once it
+	// expires; clients also offering compression get an uncompressed tunnel
+	SessionTTLExtension bool
+	// BindReplyIP replaces the address advertised in success replies, for
+	// proxies behind NAT, the port is kept
+	BindReplyIP net.IP
+	// AddressResolver connects to CONNECT destinations in place of the dial
+	// chain, given their typed address, nil dials with ProxyDial. Its
+	// connections are refused if they reach the proxy itself or, with
+	// BlockPrivateRanges, a private address, and ConnectTimeout applies;
+	// Resolver, Netns, DSCP, TunnelKeepalive and the socket buffers are left
+	// to it
+	AddressResolver AddressResolverFunc
+	// AddressTypes handles address types beyond IPv4, IPv6 and names in
+	// requests, keyed by their type byte
+	AddressTypes map[byte]AddressType
+
+	udpSessions     atomic.Int64
+	draining        atomic.Bool
+	udpResolverOnce sync.Once
+	udpResolver     *statute.CachingResolver
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -41,13 +179,22 @@ func NewServer(options ...ServerOption) *Server {
 		ProxyListenPacket:    statute.DefaultProxyListenPacket(),
 		PacketForwardAddress: defaultReplyPacketForwardAddress,
 		Logger:               statute.DefaultLogger{},
+		Metrics:              statute.DefaultMetrics{},
 		Context:              statute.DefaultContext(),
+		ListenAddrs:          statute.NewListenAddrs(),
+		AllowedCommands:      []Command{ConnectCommand, AssociateCommand},
+		MaxUDPPacketSize:     maxUdpPacket,
+		Authenticators:       []Authenticator{NoAuthAuthenticator{}},
 	}
 
 	for _, option := range options {
 		option(s)
 	}
 
+	if s.OpenProxy() {
+		statute.Warn(s.Logger, "SOCKS5 server on "+s.Bind+" accepts clients without authentication")
+	}
+
 	return s
 }
 
@@ -56,42 +203,94 @@ type ServerOption func(*Server)
 func (s *Server) ListenAndServe() error {
 	s.Logger.Debug("Serving on " + s.Bind + " ...")
 	// Create a new listener
-	ln, err := net.Listen("tcp", s.Bind)
+	ln, err := statute.Listen("tcp", s.Bind)
 	if err != nil {
 		s.Logger.Error("Error listening on " + s.Bind + ", " + err.Error())
-		return err // Return error if binding was unsuccessful
+		return statute.BindError(err)
 	}
 
 	// ensure listener will be closed
 	defer func() {
 		_ = ln.Close()
 	}()
+	s.ListenAddrs.Add(ln.Addr())
+	defer s.ListenAddrs.Remove(ln.Addr())
 
 	// Create a cancelable context based on s.Context
 	ctx, cancel := context.WithCancel(s.Context)
 	defer cancel() // Ensure resources are cleaned up
 
+	// close the listener on cancellation so a blocked Accept returns
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	acceptRate := statute.NewAcceptRateLimiter(s.AcceptRate, s.AcceptBurst, s.RejectOverAcceptRate)
+
 	// Start to accept connections and serve them
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := ln.Accept()
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return statute.ShutdownError(ctx)
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return statute.AcceptError(err)
+			}
+			s.Logger.Error(err)
+			continue
+		}
+		if !acceptRate.Admit(ctx) {
+			s.Logger.Debug("accept rate exceeded, rejected connection from " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, s.RejectWithRST)
+			continue
+		}
+		if !statute.SourceAllowed(conn.RemoteAddr(), s.AllowedSources) {
+			s.Logger.Debug("rejected connection from " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, s.RejectWithRST)
+			continue
+		}
+		if s.ByteQuota != nil && !s.ByteQuota.Allow(statute.RemoteIP(conn.RemoteAddr())) {
+			s.Logger.Debug("byte quota exceeded for " + conn.RemoteAddr().String())
+			_ = statute.CloseRejected(conn, s.RejectWithRST)
+			continue
+		}
+		if s.DSCP != 0 {
+			if err := statute.SetDSCP(conn, s.DSCP); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.TunnelKeepalive > 0 {
+			if err := statute.SetKeepAlive(conn, s.TunnelKeepalive); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.SocketRecvBuffer > 0 || s.SocketSendBuffer > 0 {
+			if err := statute.SetSocketBuffers(conn, s.SocketRecvBuffer, s.SocketSendBuffer); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.ByteQuota != nil {
+			conn = s.ByteQuota.Conn(conn)
+		}
+		conn = statute.ApplyConnMiddleware(conn, s.ConnMiddleware)
+
+		// Start a new goroutine to handle each connection
+		// This way, the server can handle multiple connections concurrently
+		go func() {
+			limited, err := s.Handshakes.Begin(s.Context, conn)
 			if err != nil {
-				s.Logger.Error(err)
-				continue
+				_ = conn.Close()
+				return
 			}
+			defer statute.EndHandshake(limited)
 
-			// Start a new goroutine to handle each connection
-			// This way, the server can handle multiple connections concurrently
-			go func() {
-				err := s.ServeConn(conn)
-				if err != nil {
-					s.Logger.Error(err) // Log errors from ServeConn
-				}
-			}()
-		}
+			err = s.ServeConn(limited)
+			if err != nil {
+				statute.LogConnError(s.Logger, err, s.HandlerErrorFilter)
+			}
+		}()
 	}
 }
 
@@ -101,6 +300,12 @@ func WithLogger(logger statute.Logger) ServerOption {
 	}
 }
 
+func WithMetrics(metrics statute.Metrics) ServerOption {
+	return func(s *Server) {
+		s.Metrics = metrics
+	}
+}
+
 func WithBind(bindAddress string) ServerOption {
 	return func(s *Server) {
 		s.Bind = bindAddress
@@ -131,6 +336,18 @@ func WithProxyListenPacket(proxyListenPacket statute.ProxyListenPacket) ServerOp
 	}
 }
 
+func WithTargetListenPacket(targetListenPacket statute.TargetListenPacket) ServerOption {
+	return func(s *Server) {
+		s.TargetListenPacket = targetListenPacket
+	}
+}
+
+func WithDatagramHandler(handler statute.DatagramHandler) ServerOption {
+	return func(s *Server) {
+		s.DatagramHandler = handler
+	}
+}
+
 func WithPacketForwardAddress(packetForwardAddress statute.PacketForwardAddress) ServerOption {
 	return func(s *Server) {
 		s.PacketForwardAddress = packetForwardAddress
@@ -149,7 +366,296 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithBlockPrivateRanges(block bool) ServerOption {
+	return func(s *Server) {
+		s.BlockPrivateRanges = block
+	}
+}
+
+func WithResolver(resolver statute.Resolver) ServerOption {
+	return func(s *Server) {
+		s.Resolver = resolver
+	}
+}
+
+func WithDSCP(value int) ServerOption {
+	return func(s *Server) {
+		s.DSCP = value
+	}
+}
+
+func WithConnMiddleware(middleware ...statute.ConnMiddleware) ServerOption {
+	return func(s *Server) {
+		s.ConnMiddleware = append(s.ConnMiddleware, middleware...)
+	}
+}
+
+func WithRequestInterceptors(interceptors ...statute.RequestInterceptor) ServerOption {
+	return func(s *Server) {
+		s.RequestInterceptors = append(s.RequestInterceptors, interceptors...)
+	}
+}
+
+// WithAllowedSourceCIDRs panics if a network can't be parsed
+func WithAllowedSourceCIDRs(cidrs ...string) ServerOption {
+	return func(s *Server) {
+		s.AllowedSources = append(s.AllowedSources, statute.MustParseCIDRs(cidrs...)...)
+	}
+}
+
+func WithStats(stats *statute.StatsCollector) ServerOption {
+	return func(s *Server) {
+		s.Stats = stats
+	}
+}
+
+func WithEventChannel(ch chan<- statute.Event) ServerOption {
+	return func(s *Server) {
+		s.Events = statute.NewEventSink(ch)
+	}
+}
+
+func WithHandlerErrorFilter(filter statute.HandlerErrorFilter) ServerOption {
+	return func(s *Server) {
+		s.HandlerErrorFilter = filter
+	}
+}
+
+func WithConnLog(connLog statute.ConnLogFunc) ServerOption {
+	return func(s *Server) {
+		s.ConnLog = connLog
+	}
+}
+
+func WithRejectWithRST(reset bool) ServerOption {
+	return func(s *Server) {
+		s.RejectWithRST = reset
+	}
+}
+
+func WithPerIPByteQuota(bytes int64, window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ByteQuota = statute.NewByteQuota(bytes, window)
+	}
+}
+
+func WithMaxUDPPacketSize(size int) ServerOption {
+	return func(s *Server) {
+		s.MaxUDPPacketSize = size
+	}
+}
+
+func WithUpstreamAssociate(address string) ServerOption {
+	return func(s *Server) {
+		s.UpstreamAssociate = address
+	}
+}
+
+func WithAuthenticators(authenticators ...Authenticator) ServerOption {
+	return func(s *Server) {
+		s.Authenticators = authenticators
+	}
+}
+
+func WithMaxUDPSessions(n int) ServerOption {
+	return func(s *Server) {
+		s.MaxUDPSessions = n
+	}
+}
+
+func WithUDPLogInterval(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.UDPLogInterval = interval
+	}
+}
+
+func WithBuffers(readSize, writeSize int) ServerOption {
+	return func(s *Server) {
+		s.ReadBufferSize = readSize
+		s.WriteBufferSize = writeSize
+	}
+}
+
+// WithReverseDNS records the reverse DNS name of client IPs in ConnLog summaries, see statute.ReverseDNS.
+func WithReverseDNS(enable bool) ServerOption {
+	return func(s *Server) {
+		s.ReverseDNS = nil
+		if enable {
+			s.ReverseDNS = statute.NewReverseDNS(nil)
+		}
+	}
+}
+
+func WithMuxHint(detector statute.MuxDetector) ServerOption {
+	return func(s *Server) {
+		s.MuxHint = detector
+	}
+}
+
+func WithTunnelCompression(algo statute.Compression) ServerOption {
+	return func(s *Server) {
+		s.TunnelCompression = algo
+	}
+}
+
+func WithStrictProtocol(strict bool) ServerOption {
+	return func(s *Server) {
+		s.StrictProtocol = strict
+	}
+}
+
+func WithCloseGrace(grace time.Duration) ServerOption {
+	return func(s *Server) {
+		s.CloseGrace = grace
+	}
+}
+
+// WithAcceptRateLimit paces accepted connections to perSec per second, in
+// bursts of up to burst.
+func WithAcceptRateLimit(perSec int, burst int) ServerOption {
+	return func(s *Server) {
+		s.AcceptRate = perSec
+		s.AcceptBurst = burst
+	}
+}
+
+// WithRejectOverAcceptRate closes connections over the rate set by
+// WithAcceptRateLimit at once rather than making them wait.
+func WithRejectOverAcceptRate(reject bool) ServerOption {
+	return func(s *Server) {
+		s.RejectOverAcceptRate = reject
+	}
+}
+
+func WithMaxConcurrentHandshakes(n int) ServerOption {
+	return func(s *Server) {
+		s.Handshakes = statute.NewHandshakeLimiter(n)
+	}
+}
+
+func WithAddressResolver(resolver AddressResolverFunc) ServerOption {
+	return func(s *Server) {
+		s.AddressResolver = resolver
+	}
+}
+
+func WithAddressType(addrType byte, reader AddressReaderFunc, writer AddressWriterFunc) ServerOption {
+	return func(s *Server) {
+		if s.AddressTypes == nil {
+			s.AddressTypes = make(map[byte]AddressType)
+		}
+		s.AddressTypes[addrType] = AddressType{Read: reader, Write: writer}
+	}
+}
+
+func WithMaxConnLifetime(lifetime time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxConnLifetime = lifetime
+	}
+}
+
+func WithSocketBuffers(recv, send int) ServerOption {
+	return func(s *Server) {
+		s.SocketRecvBuffer = recv
+		s.SocketSendBuffer = send
+	}
+}
+
+// WithTunnelKeepalive enables TCP keepalive probes at the given interval on tunnels, see statute.KeepAliveDial.
+func WithTunnelKeepalive(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.TunnelKeepalive = interval
+	}
+}
+
+func WithBindReplyAddr(ip net.IP) ServerOption {
+	return func(s *Server) {
+		s.BindReplyIP = ip
+	}
+}
+
+func WithConnectTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ConnectTimeout = timeout
+	}
+}
+
+func WithNetns(path string) ServerOption {
+	return func(s *Server) {
+		s.Netns = path
+	}
+}
+
+func WithExtendedReplies(extended bool) ServerOption {
+	return func(s *Server) {
+		s.ExtendedReplies = extended
+	}
+}
+
+// WithSessionTTLExtension accepts a session TTL from clients offering the
+// private method 0xfb and closes their CONNECT tunnels once it expires. The
+// reply accepts a single extension, so a client offering both the TTL and
+// tunnel compression gets the TTL and an uncompressed tunnel, which it tells
+// from the method echoed in the reply.
+func WithSessionTTLExtension(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.SessionTTLExtension = enabled
+	}
+}
+
+func WithVerboseReplies(verbose bool) ServerOption {
+	return func(s *Server) {
+		s.VerboseReplies = verbose
+	}
+}
+
+func WithDestinationClassifier(classify statute.DestinationClassifier) ServerOption {
+	return func(s *Server) {
+		s.DestinationClassifier = classify
+	}
+}
+
+func WithAllowedCommands(commands ...Command) ServerOption {
+	return func(s *Server) {
+		s.AllowedCommands = commands
+	}
+}
+
+// ServeConnReader serves conn whose first bytes may already be buffered in
+// reader, as when the protocol was detected by peeking at the connection.
+func (s *Server) ServeConnReader(conn net.Conn, reader *bufio.Reader) error {
+	return s.ServeConn(statute.NewBufferedConn(conn, reader))
+}
+
+// ActiveConnections returns the connections being served, as tracked by
+// Stats, or none if Stats is nil.
+func (s *Server) ActiveConnections() []statute.ConnInfo {
+	return s.Stats.Connections()
+}
+
+// SetDraining makes the server answer new requests with a server failure
+// while it shuts down.
+func (s *Server) SetDraining(draining bool) {
+	s.draining.Store(draining)
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
+	stop := statute.LimitLifetime(conn, s.MaxConnLifetime)
+	defer stop()
+
+	if s.ConnLog == nil && s.Stats == nil && s.Events == nil {
+		return s.serveConn(conn, nil)
+	}
+
+	tracker := s.Stats.Track(conn, statute.ProtocolSOCKS5)
+	tracker.Notify(s.Events)
+	tracker.ReverseLookup(s.ReverseDNS)
+	err := s.serveConn(tracker.Conn(), tracker)
+	tracker.Done(err, s.ConnLog)
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn, tracker *statute.ConnTracker) error {
 	version, err := readByte(conn)
 	if err != nil {
 		return err
@@ -163,23 +669,20 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		Conn:    conn,
 	}
 
-	methods, err := readBytes(conn)
+	auth, methods, err := s.negotiateAuth(conn)
 	if err != nil {
 		return err
 	}
-
-	if bytes.IndexByte(methods, byte(noAuth)) != -1 {
-		_, err := conn.Write([]byte{socks5Version, byte(noAuth)})
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
-		if err != nil {
-			return err
-		}
-		return errNoSupportedAuth
+	req.ExtendedReplies = s.ExtendedReplies && bytes.IndexByte(methods, byte(extendedReplies)) != -1
+	req.SessionTTL = s.SessionTTLExtension && bytes.IndexByte(methods, byte(sessionTTL)) != -1
+	// the reply accepts a single extension, and bounding the session is
+	// preferred to compressing it
+	if method := compressionMethod(s.TunnelCompression); !req.SessionTTL && method != noAuth && bytes.IndexByte(methods, byte(method)) != -1 {
+		req.Compression = s.TunnelCompression
 	}
+	method := authMethod(auth.Method()).String()
+	tracker.SetAuthMethod(method)
+	s.Logger.Debug("auth negotiated", "protocol", "socks5", "client", conn.RemoteAddr().String(), "method", method)
 
 	var header [3]byte
 	_, err = io.ReadFull(conn, header[:])
@@ -192,19 +695,44 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 
 	req.Command = Command(header[1])
+	if s.StrictProtocol {
+		if err := checkStrictHeader(req, header); err != nil {
+			return err
+		}
+	}
 
-	dest, err := readAddr(conn)
+	dest, err := readAddr(conn, s.AddressTypes)
 	if err != nil {
 		if err == errUnrecognizedAddrType {
-			err := sendReply(conn, addrTypeNotSupported, nil)
-			if err != nil {
-				return err
+			if replyErr := sendFailure(req, addrTypeNotSupported, err); replyErr != nil {
+				return replyErr
 			}
 		}
 		return err
 	}
 	req.DestinationAddr = dest
+	if s.StrictProtocol && dest.IP == nil && !validName(dest.Name) {
+		err := fmt.Errorf("%w: invalid name %q", errMalformedRequest, dest.Name)
+		if replyErr := sendFailure(req, addrTypeNotSupported, err); replyErr != nil {
+			return replyErr
+		}
+		return err
+	}
+	if s.draining.Load() {
+		if err := sendFailure(req, serverFailure, statute.ErrDraining); err != nil {
+			return err
+		}
+		return statute.ErrDraining
+	}
+	tracker.SetUserHandler(req.Command == ConnectCommand && s.UserConnectHandle != nil ||
+		req.Command == AssociateCommand && s.UserAssociateHandle != nil)
+	tracker.SetDestination(req.DestinationAddr.String())
 	err = s.handle(req)
+	if req.stopSessionTTL != nil {
+		req.stopSessionTTL()
+	}
+	// interceptors may have rewritten the destination
+	tracker.SetDestination(req.DestinationAddr.String())
 	if err != nil {
 		return err
 	}
@@ -212,28 +740,74 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	return nil
 }
 
+// checkStrictHeader rejects a request header whose reserved byte isn't zero
+// or whose command isn't one defined by RFC 1928, with the matching reply.
+func checkStrictHeader(req *request, header [3]byte) error {
+	var (
+		resp reply
+		err  error
+	)
+	switch {
+	case header[2] != 0:
+		resp, err = serverFailure, fmt.Errorf("%w: reserved byte %#x", errMalformedRequest, header[2])
+	case header[1] < 0x01 || header[1] > 0x03:
+		resp, err = commandNotSupported, fmt.Errorf("%w: command %#x", errMalformedRequest, header[1])
+	default:
+		return nil
+	}
+	if replyErr := sendFailure(req, resp, err); replyErr != nil {
+		return replyErr
+	}
+	return err
+}
+
+// validName reports whether name is a plausible domain name: not empty and
+// made of printable ASCII without spaces.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) handle(req *request) error {
+	if !s.isAllowedCommand(req.Command) {
+		err := fmt.Errorf("disallowed Command: %v", req.Command)
+		if replyErr := sendFailure(req, commandNotSupported, err); replyErr != nil {
+			return replyErr
+		}
+		return err
+	}
+
 	switch req.Command {
 	case ConnectCommand:
 		return s.handleConnect(req)
 	case AssociateCommand:
 		return s.handleAssociate(req)
 	default:
-		if err := sendReply(req.Conn, commandNotSupported, nil); err != nil {
-			return err
+		err := fmt.Errorf("unsupported Command: %v", req.Command)
+		if replyErr := sendFailure(req, commandNotSupported, err); replyErr != nil {
+			return replyErr
 		}
-		return fmt.Errorf("unsupported Command: %v", req.Command)
+		return err
 	}
 }
 
-func (s *Server) handleConnect(req *request) error {
-	if s.UserConnectHandle == nil {
-		return s.embedHandleConnect(req)
+func (s *Server) isAllowedCommand(cmd Command) bool {
+	for _, allowed := range s.AllowedCommands {
+		if allowed == cmd {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := sendReply(req.Conn, successReply, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
-	}
+func (s *Server) handleConnect(req *request) error {
 	host := req.DestinationAddr.IP.String()
 	if req.DestinationAddr.Name != "" {
 		host = req.DestinationAddr.Name
@@ -247,9 +821,37 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+		Protocol:    statute.ProtocolSOCKS5,
+	}
+
+	if len(s.RequestInterceptors) > 0 {
+		if err := statute.ApplyInterceptors(proxyReq, s.RequestInterceptors); err != nil {
+			err = fmt.Errorf("request to %v rejected: %w", req.DestinationAddr, err)
+			if replyErr := sendFailure(req, ruleFailure, err); replyErr != nil {
+				return fmt.Errorf("failed to send reply: %v", replyErr)
+			}
+			return err
+		}
+		req.DestinationAddr = hostPortAddress(proxyReq.DestHost, int(proxyReq.DestPort))
+	}
+
+	if s.UserConnectHandle == nil {
+		return s.embedHandleConnect(req)
+	}
+
+	// the handler may return without closing the client connection
+	defer func() {
+		_ = req.Conn.Close()
+	}()
+	if err := sendConnectReply(req, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
 	}
+	proxyReq.Conn, proxyReq.Reader, proxyReq.Writer = req.Conn, req.Conn, req.Conn
 
-	return s.UserConnectHandle(proxyReq)
+	statute.EndHandshake(proxyReq.Conn)
+	cancel := statute.WatchTeardown(s.Context, proxyReq)
+	defer cancel()
+	return statute.WrapHandlerError(s.UserConnectHandle(proxyReq))
 }
 
 func (s *Server) embedHandleConnect(req *request) error {
@@ -257,10 +859,14 @@ func (s *Server) embedHandleConnect(req *request) error {
 		_ = req.Conn.Close()
 	}()
 
-	target, err := s.ProxyDial(s.Context, "tcp", req.DestinationAddr.Address())
+	dialStart := time.Now()
+	target, err := s.dialDestination(req.DestinationAddr)
 	if err != nil {
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if replyErr := sendFailure(req, errToReply(err), err); replyErr != nil {
+			return fmt.Errorf("failed to send reply: %v", replyErr)
+		}
+		if s.VerboseReplies {
+			s.logConnectDiagnostic(req, err)
 		}
 		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
 	}
@@ -268,65 +874,160 @@ func (s *Server) embedHandleConnect(req *request) error {
 		_ = target.Close()
 	}()
 
+	destination := req.DestinationAddr.String()
+	dialLatency := time.Since(dialStart)
+	labels := statute.MetricLabels("socks5", destination, s.DestinationClassifier)
+	s.Logger.Debug("dial", "protocol", "socks5", "destination", destination, "latency", dialLatency)
+	s.Metrics.ObserveDuration("dial_latency", dialLatency, labels...)
+	tracker := statute.ConnTrackerOf(req.Conn)
+	tracker.SetDialLatency(dialLatency)
+	target = statute.NewFirstByteConn(target, func(ttfb time.Duration) {
+		s.Logger.Debug("first byte", "protocol", "socks5", "destination", destination, "ttfb", ttfb)
+		s.Metrics.ObserveDuration("ttfb", ttfb, labels...)
+		tracker.SetTTFB(ttfb)
+	})
+
 	localAddr := target.LocalAddr()
 	local, ok := localAddr.(*net.TCPAddr)
 	if !ok {
 		return fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String())
 	}
-	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, successReply, &bind); err != nil {
+	bind := Address{IP: local.IP, Port: local.Port}
+	if s.BindReplyIP != nil {
+		bind.IP = s.BindReplyIP
+	}
+	if err := sendConnectReply(req, &bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
-		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+	buf1, buf2, release := statute.TunnelBuffers(s.BytesPool, s.ReadBufferSize, s.WriteBufferSize)
+	defer release()
+
+	clientConn := statute.WatchMux(req.Conn, target, s.MuxHint, func() {
+		s.Logger.Debug("mux session detected", "protocol", "socks5", "destination", destination)
+	})
+	client := statute.NewCountingConn(clientConn)
+	defer func() {
+		s.Metrics.AddCount("bytes_up", client.BytesRead(), labels...)
+		s.Metrics.AddCount("bytes_down", client.BytesWritten(), labels...)
+		statute.HintBytesPool(s.BytesPool, max(client.BytesRead(), client.BytesWritten()))
+	}()
+	return statute.Tunnel(statute.ContextWithCloseGrace(s.Context, s.CloseGrace), target, client, buf1, buf2)
+}
+
+// sendConnectReply sends the success reply of a CONNECT request and, if
+// compression was negotiated, accepts it in the reserved byte and wraps
+// req.Conn to compress the tunnel. Otherwise a session TTL offered is
+// accepted in the reserved byte and read from the client; the two are never
+// negotiated together.
+func sendConnectReply(req *request, bind *Address) error {
+	if req.Compression == statute.CompressionNone {
+		if !req.SessionTTL {
+			return sendReply(req.Conn, successReply, bind)
+		}
+		if err := sendReplyReserved(req.Conn, successReply, byte(sessionTTL), bind); err != nil {
+			return err
+		}
+		ttl, err := readSessionTTL(req.Conn)
+		if err != nil {
+			return err
+		}
+		req.stopSessionTTL = statute.LimitLifetime(req.Conn, ttl)
+		return nil
 	}
-	return statute.Tunnel(s.Context, target, req.Conn, buf1, buf2)
+
+	if err := sendReplyReserved(req.Conn, successReply, byte(compressionMethod(req.Compression)), bind); err != nil {
+		return err
+	}
+	req.Conn = statute.CompressConn(req.Conn, req.Compression)
+	return nil
 }
 
 func (s *Server) handleAssociate(req *request) error {
-	destinationAddr := req.DestinationAddr.String()
-	udpConn, err := s.ProxyListenPacket(s.Context, "udp", destinationAddr)
-	if err != nil {
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
+	sessions := s.udpSessions.Add(1)
+	defer s.udpSessions.Add(-1)
+	if s.MaxUDPSessions > 0 && sessions > int64(s.MaxUDPSessions) {
+		if err := sendFailure(req, serverFailure, errTooManyUDPSessions); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return errTooManyUDPSessions
+	}
+
+	var upstream *upstreamRelay
+	if s.UserAssociateHandle == nil && s.UpstreamAssociate != "" {
+		var err error
+		upstream, err = dialUpstreamAssociate(s.Context, s.ProxyDial, s.UpstreamAssociate)
+		if err != nil {
+			err = fmt.Errorf("associate via %v failed: %w", s.UpstreamAssociate, err)
+			if replyErr := sendFailure(req, errToReply(err), err); replyErr != nil {
+				return fmt.Errorf("failed to send reply: %v", replyErr)
+			}
+			return err
+		}
+		defer func() {
+			_ = upstream.Close()
+		}()
+	}
+
+	destinationAddr := req.DestinationAddr.String()
+	// the request declares the client's address, which isn't ours to bind
+	udpConn, err := s.ProxyListenPacket(s.Context, "udp", ":0")
+	if err != nil {
+		return s.rejectAssociate(req, fmt.Errorf("udp relay for %v unavailable: %w", req.DestinationAddr, err))
 	}
 
 	ip, port, err := s.PacketForwardAddress(s.Context, destinationAddr, udpConn, req.Conn)
 	if err != nil {
-		return err
+		_ = udpConn.Close()
+		return s.rejectAssociate(req, err)
+	}
+	bind := Address{IP: ip, Port: port}
+	if s.BindReplyIP != nil {
+		bind.IP = s.BindReplyIP
 	}
-	bind := address{IP: ip, Port: port}
 	if err := sendReply(req.Conn, successReply, &bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
+	// the relay is set up, the control connection only signals its end
+	statute.EndHandshake(req.Conn)
+
+	stats, endSession := s.startUDPSession(req, udpConn.LocalAddr().String())
+	defer endSession()
 
 	if s.UserAssociateHandle == nil {
-		return s.embedHandleAssociate(req, udpConn)
+		if upstream != nil {
+			return s.embedHandleUpstreamAssociate(req, udpConn, upstream, stats)
+		}
+		return s.embedHandleAssociate(req, udpConn, stats)
 	}
 
 	cConn := &udpCustomConn{
 		PacketConn:   udpConn,
 		assocTCPConn: req.Conn,
-		frc:          make(chan bool),
+		frc:          make(chan struct{}),
+		done:         make(chan struct{}),
 		packetQueue:  make(chan *readStruct),
+		maxPacket:    s.udpPacketSize(),
+		resolve:      s.resolveUDPTarget,
+		stats:        stats,
+		declared:     req.DestinationAddr,
+		filter:       s.DatagramHandler,
 	}
 
+	// the session ends with the handler or the control connection, whichever
+	// comes first
+	defer func() {
+		_ = cConn.Close()
+	}()
 	cConn.asyncReadPackets()
+	go cConn.watchControl()
 
 	// wait for first packet so that target sender and receiver get known
-	<-cConn.frc
+	select {
+	case <-cConn.frc:
+	case <-cConn.done:
+		return fmt.Errorf("associate for %v closed before the first packet", req.Conn.RemoteAddr())
+	}
 
 	proxyReq := &statute.ProxyRequest{
 		Conn:        cConn,
@@ -336,12 +1037,28 @@ func (s *Server) handleAssociate(req *request) error {
 		Destination: cConn.targetAddr.String(),
 		DestHost:    cConn.targetAddr.(*net.UDPAddr).IP.String(),
 		DestPort:    int32(cConn.targetAddr.(*net.UDPAddr).Port),
+		Protocol:    statute.ProtocolSOCKS5,
 	}
 
-	return s.UserAssociateHandle(proxyReq)
+	cancel := statute.WatchTeardown(s.Context, proxyReq)
+	defer cancel()
+	return statute.WrapHandlerError(s.UserAssociateHandle(proxyReq))
 }
 
-func (s *Server) embedHandleAssociate(req *request, udpConn net.PacketConn) error {
+// rejectAssociate answers an associate request that can't be relayed, for
+// lack of a UDP relay socket, with a server failure and closes the control
+// connection so the client doesn't wait on it.
+func (s *Server) rejectAssociate(req *request, err error) error {
+	defer func() {
+		_ = req.Conn.Close()
+	}()
+	if replyErr := sendFailure(req, serverFailure, err); replyErr != nil {
+		return fmt.Errorf("failed to send reply: %v", replyErr)
+	}
+	return err
+}
+
+func (s *Server) embedHandleAssociate(req *request, udpConn net.PacketConn, stats *udpStats) error {
 	defer func() {
 		_ = udpConn.Close()
 	}()
@@ -360,19 +1077,28 @@ func (s *Server) embedHandleAssociate(req *request, udpConn net.PacketConn) erro
 	var (
 		sourceAddr  net.Addr
 		wantSource  string
-		targetAddr  net.Addr
+		targetAddr  *net.UDPAddr
 		wantTarget  string
+		wantRequest string
 		replyPrefix []byte
-		buf         [maxUdpPacket]byte
+		egress      net.PacketConn
+		size        = s.udpPacketSize()
+		// leave room to prepend the reply header to a full-sized datagram
+		buf = make([]byte, size+maxUdpHeader)
 	)
+	defer func() {
+		if egress != nil {
+			_ = egress.Close()
+		}
+	}()
 
 	for {
-		n, addr, err := udpConn.ReadFrom(buf[:])
+		n, addr, err := udpConn.ReadFrom(buf[:size])
 		if err != nil {
 			return err
 		}
 
-		if sourceAddr == nil {
+		if sourceAddr == nil && declaredSource(req.DestinationAddr, addr) {
 			sourceAddr = addr
 			wantSource = sourceAddr.String()
 		}
@@ -383,61 +1109,295 @@ func (s *Server) embedHandleAssociate(req *request, udpConn net.PacketConn) erro
 				continue
 			}
 			reader := bytes.NewBuffer(buf[3:n])
-			addr, err := readAddr(reader)
+			addr, err := readAddr(reader, nil)
 			if err != nil {
 				s.Logger.Debug(err)
 				continue
 			}
 			if targetAddr == nil {
-				targetAddr = &net.UDPAddr{
-					IP:   addr.IP,
-					Port: addr.Port,
+				target, err := s.resolveUDPTarget(addr)
+				if err != nil {
+					s.Logger.Debug(err)
+					continue
 				}
+				targetAddr = target
 				wantTarget = targetAddr.String()
+				wantRequest = addr.String()
 			}
-			if addr.String() != wantTarget {
+			if addr.String() != wantRequest {
 				s.Logger.Debug(fmt.Errorf("ignore non-target addresses %s", addr))
 				continue
 			}
-			_, err = udpConn.WriteTo(reader.Bytes(), targetAddr)
+			if s.BlockPrivateRanges && statute.IsPrivateIP(targetAddr.IP) {
+				s.Logger.Debug(fmt.Errorf("ignore blocked address %s", addr))
+				continue
+			}
+			out := udpConn
+			if s.TargetListenPacket != nil {
+				if egress == nil {
+					egress, err = s.TargetListenPacket(s.Context, "udp", wantRequest)
+					if err != nil {
+						return err
+					}
+					go s.relayEgress(egress, udpConn, sourceAddr, wantTarget, wantRequest, stats)
+				}
+				out = egress
+			}
+			payload, ok := s.filterDatagram(sourceAddr, targetAddr, reader.Bytes())
+			if !ok {
+				continue
+			}
+			_, err = out.WriteTo(payload, targetAddr)
 			if err != nil {
 				return err
 			}
-		} else if targetAddr != nil && wantTarget == gotAddr {
+			stats.up(len(payload))
+		} else if targetAddr != nil && wantTarget == gotAddr && sourceAddr != nil {
 			if replyPrefix == nil {
-				b := bytes.NewBuffer(make([]byte, 3, 16))
-				err = writeAddrWithStr(b, wantTarget)
+				replyPrefix, err = udpReplyPrefix(wantRequest)
 				if err != nil {
 					return err
 				}
-				replyPrefix = b.Bytes()
 			}
-			copy(buf[len(replyPrefix):len(replyPrefix)+n], buf[:n])
-			copy(buf[:len(replyPrefix)], replyPrefix)
-			_, err = udpConn.WriteTo(buf[:len(replyPrefix)+n], sourceAddr)
+			payload, ok := s.filterDatagram(addr, sourceAddr, buf[:n])
+			if !ok {
+				continue
+			}
+			_, err = udpConn.WriteTo(replyDatagram(buf, replyPrefix, payload), sourceAddr)
 			if err != nil {
 				return err
 			}
+			stats.down(len(payload))
+		}
+	}
+}
+
+// relayEgress copies the datagrams the target sends to egress back to the
+// client through the relay socket, until either socket fails.
+func (s *Server) relayEgress(egress, udpConn net.PacketConn, sourceAddr net.Addr, wantTarget, wantRequest string, stats *udpStats) {
+	replyPrefix, err := udpReplyPrefix(wantRequest)
+	if err != nil {
+		s.Logger.Debug(err)
+		_ = udpConn.Close()
+		return
+	}
+
+	size := s.udpPacketSize()
+	buf := make([]byte, len(replyPrefix)+size)
+	for {
+		n, addr, err := egress.ReadFrom(buf[len(replyPrefix):])
+		if err != nil {
+			return
+		}
+		if addr.String() != wantTarget {
+			s.Logger.Debug(fmt.Errorf("ignore non-target addresses %s", addr))
+			continue
+		}
+		payload, ok := s.filterDatagram(addr, sourceAddr, buf[len(replyPrefix):len(replyPrefix)+n])
+		if !ok {
+			continue
+		}
+		_, err = udpConn.WriteTo(replyDatagram(buf, replyPrefix, payload), sourceAddr)
+		if err != nil {
+			_ = udpConn.Close()
+			return
+		}
+		stats.down(len(payload))
+	}
+}
+
+// filterDatagram passes a datagram relayed from src to dst through the
+// DatagramHandler, if any.
+func (s *Server) filterDatagram(src, dst net.Addr, payload []byte) ([]byte, bool) {
+	if s.DatagramHandler == nil {
+		return payload, true
+	}
+	return s.DatagramHandler(src, dst, payload)
+}
+
+// replyDatagram returns payload behind the reply header prefix, assembled in
+// buf when it has room. payload may overlap buf.
+func replyDatagram(buf, prefix, payload []byte) []byte {
+	packet := buf
+	if len(prefix)+len(payload) > len(buf) {
+		packet = make([]byte, len(prefix)+len(payload))
+	}
+	copy(packet[len(prefix):], payload)
+	copy(packet, prefix)
+	return packet[:len(prefix)+len(payload)]
+}
+
+// udpReplyPrefix returns the header prepended to datagrams relayed back to
+// the client, echoing the target in the form the client sent, which may be
+// a name.
+func udpReplyPrefix(target string) ([]byte, error) {
+	b := bytes.NewBuffer(make([]byte, 3, 16))
+	if err := writeAddrWithStr(b, target); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// resolveUDPTarget returns the UDP address of a datagram target. Names are
+// resolved with the server's Resolver through a cache shared by all
+// associate sessions, preferring IPv4 addresses.
+func (s *Server) resolveUDPTarget(addr *Address) (*net.UDPAddr, error) {
+	if addr.Name == "" {
+		return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+
+	s.udpResolverOnce.Do(func() {
+		resolver := s.Resolver
+		if resolver == nil {
+			resolver = statute.DefaultResolver()
+		}
+		s.udpResolver = statute.NewCachingResolver(resolver, udpResolveTTL, udpResolveNegativeTTL, udpResolveCacheSize)
+	})
+
+	ips, err := s.udpResolver.LookupIPAddr(s.Context, addr.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", addr.Name)
+	}
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.IP.To4() != nil {
+			ip = candidate
+			break
 		}
 	}
+	return &net.UDPAddr{IP: ip.IP, Port: addr.Port, Zone: ip.Zone}, nil
 }
 
-func sendReply(w io.Writer, resp reply, addr *address) error {
-	_, err := w.Write([]byte{socks5Version, byte(resp), 0})
+// udpPacketSize returns the configured maximum UDP packet size, falling back
+// to the default when it's out of range.
+func (s *Server) udpPacketSize() int {
+	if s.MaxUDPPacketSize < minUdpPacket || s.MaxUDPPacketSize > maxUdpPacket {
+		return maxUdpPacket
+	}
+	return s.MaxUDPPacketSize
+}
+
+// dialDestination connects to the destination of a CONNECT request, through
+// AddressResolver if set.
+func (s *Server) dialDestination(addr *Address) (net.Conn, error) {
+	if s.AddressResolver == nil {
+		return s.proxyDial()(s.Context, "tcp", addr.Address())
+	}
+
+	ctx := s.Context
+	if s.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ConnectTimeout)
+		defer cancel()
+	}
+	conn, err := s.AddressResolver(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return statute.GuardDialedConn(conn, s.BlockPrivateRanges, s.ListenAddrs)
+}
+
+// proxyDial returns the dial function used by the embedded handlers.
+func (s *Server) proxyDial() statute.ProxyDialFunc {
+	dial := statute.SelfDialGuard(s.ProxyDial, s.ListenAddrs)
+	if s.Netns != "" {
+		dial = statute.NetnsDial(dial, s.Netns)
+	}
+	if s.DSCP != 0 {
+		dial = statute.DSCPDial(dial, s.DSCP)
+	}
+	if s.TunnelKeepalive > 0 {
+		dial = statute.KeepAliveDial(dial, s.TunnelKeepalive)
+	}
+	if s.SocketRecvBuffer > 0 || s.SocketSendBuffer > 0 {
+		dial = statute.SocketBuffersDial(dial, s.SocketRecvBuffer, s.SocketSendBuffer)
+	}
+
+	resolver := s.Resolver
+	if s.BlockPrivateRanges {
+		if resolver == nil {
+			resolver = statute.DefaultResolver()
+		}
+		dial = statute.BlockPrivateDial(resolver, dial)
+	} else if resolver != nil || s.VerboseReplies {
+		// resolving here rather than in the dialer records every address tried
+		if resolver == nil {
+			resolver = statute.DefaultResolver()
+		}
+		dial = statute.ResolveDial(resolver, dial)
+	}
+
+	if s.ConnectTimeout > 0 {
+		dial = statute.TimeoutDial(dial, s.ConnectTimeout)
+	}
+	return dial
+}
+
+// logConnectDiagnostic logs why a CONNECT to the destination of req failed,
+// with the error of every resolved address tried.
+func (s *Server) logConnectDiagnostic(req *request, err error) {
+	destination := req.DestinationAddr.String()
+	reply := errToReply(err)
+	var dialErr *statute.DialError
+	if !errors.As(err, &dialErr) {
+		s.Logger.Error("connect failed", "protocol", "socks5", "destination", destination, "reply", reply, "error", err)
+		return
+	}
+	s.Logger.Error("connect failed", "protocol", "socks5", "destination", destination, "reply", reply, "attempts", len(dialErr.Attempts))
+	for _, attempt := range dialErr.Attempts {
+		s.Logger.Error("connect attempt failed", "protocol", "socks5", "destination", destination, "address", attempt.Address, "error", attempt.Err)
+	}
+}
+
+// sendFailure sends the failure reply resp for req. Clients that negotiated
+// extended replies also receive the message of err, as a length-prefixed
+// string of at most 255 bytes.
+func sendFailure(req *request, resp reply, err error) error {
+	if err := sendReply(req.Conn, resp, nil); err != nil {
+		return err
+	}
+	if !req.ExtendedReplies {
+		return nil
+	}
+	msg := err.Error()
+	if len(msg) > 255 {
+		msg = msg[:255]
+	}
+	return writeBytes(req.Conn, []byte(msg))
+}
+
+func sendReply(w io.Writer, resp reply, addr *Address) error {
+	return sendReplyReserved(w, resp, 0, addr)
+}
+
+// sendReplyReserved sends a reply whose reserved byte is rsv.
+func sendReplyReserved(w io.Writer, resp reply, rsv byte, addr *Address) error {
+	_, err := w.Write([]byte{socks5Version, byte(resp), rsv})
 	if err != nil {
 		return err
 	}
-	err = writeAddr(w, addr)
+	err = writeAddr(w, addr, nil)
 	return err
 }
 
 type request struct {
 	Version         uint8
 	Command         Command
-	DestinationAddr *address
+	DestinationAddr *Address
 	Username        string
 	Password        string
 	Conn            net.Conn
+	// ExtendedReplies is set when failure replies are followed by a message
+	ExtendedReplies bool
+	// Compression is the algorithm negotiated for a CONNECT tunnel
+	Compression statute.Compression
+	// SessionTTL is set when the client offered a session TTL the server accepts
+	SessionTTL bool
+
+	stopSessionTTL func()
 }
 
 func defaultReplyPacketForwardAddress(_ context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (net.IP, int, error) {
@@ -0,0 +1,1744 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+type quietLogger struct{}
+
+func (quietLogger) Debug(...interface{}) {}
+func (quietLogger) Error(...interface{}) {}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// serve runs a server built with options on a loopback address until the
+// test ends, returning it and its address.
+func serve(t *testing.T, options ...ServerOption) (*Server, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	options = append([]ServerOption{WithLogger(quietLogger{}), WithBind(addr), WithContext(ctx)}, options...)
+	s := NewServer(options...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return s, addr
+		}
+	}
+	t.Fatalf("server on %s didn't start", addr)
+	return nil, ""
+}
+
+// echoServer runs a TCP server echoing what it reads until the test ends,
+// returning its address.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dial connects to address through the server at proxy with a CONNECT
+// request, returning an error naming the reply if it is refused.
+func dial(t *testing.T, proxy string, address string) (net.Conn, error) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+		return nil, err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{socks5Version, byte(ConnectCommand), 0}); err != nil {
+		return nil, err
+	}
+	if err := writeAddrWithStr(conn, address); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if _, err := readAddr(conn, nil); err != nil {
+		return nil, err
+	}
+	if code := reply(header[1]); code != successReply {
+		return nil, fmt.Errorf("connect to %s: %v", address, code)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// udpEchoServer runs a UDP server echoing the datagrams it receives until
+// the test ends, returning its address.
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, maxUdpPacket)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// associate sends a UDP ASSOCIATE request to the server at proxy, returning
+// a UDP socket for the client and the address of the relay.
+func associate(t *testing.T, proxy string) (*net.UDPConn, *net.UDPAddr) {
+	t.Helper()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	_, code, relay := sendAssociate(t, proxy, "0.0.0.0:0")
+	if code != successReply {
+		t.Fatalf("associate: %v", code)
+	}
+	return client, relay
+}
+
+// sendAssociate sends a UDP ASSOCIATE request declaring the client address
+// declared to the server at proxy, returning the control connection, the
+// reply and the address of the relay.
+func sendAssociate(t *testing.T, proxy, declared string) (net.Conn, reply, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{socks5Version, byte(AssociateCommand), 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAddrWithStr(conn, declared); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	bind, err := readAddr(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	relay := &net.UDPAddr{IP: bind.IP, Port: bind.Port}
+	if relay.IP.IsUnspecified() {
+		relay.IP = net.IPv4(127, 0, 0, 1)
+	}
+	return conn, reply(header[1]), relay
+}
+
+// udpRoundTrip sends payload to address through the relay and reports
+// whether it was echoed back.
+func udpRoundTrip(t *testing.T, client *net.UDPConn, relay *net.UDPAddr, address string, payload []byte) bool {
+	t.Helper()
+	var datagram bytes.Buffer
+	datagram.Write([]byte{0, 0, 0})
+	if err := writeAddrWithStr(&datagram, address); err != nil {
+		t.Fatal(err)
+	}
+	datagram.Write(payload)
+	if _, err := client.WriteTo(datagram.Bytes(), relay); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		return false
+	}
+	return bytes.HasSuffix(buf[:n], payload)
+}
+
+// assertEcho checks that conn carries data to an echo server and back.
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echoed %q, want %q", buf, "ping")
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+}
+
+func TestAddressResolverPaths(t *testing.T) {
+	echo := echoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	paths := make(chan string, 2)
+	_, proxy := serve(t, WithAddressResolver(func(ctx context.Context, addr *Address) (net.Conn, error) {
+		var d net.Dialer
+		if addr.IP == nil {
+			paths <- "name " + addr.Name
+			return d.DialContext(ctx, "tcp", echo)
+		}
+		paths <- "ip " + addr.IP.String()
+		return d.DialContext(ctx, "tcp", addr.Address())
+	}))
+
+	for target, want := range map[string]string{
+		"service.internal:" + port: "name service.internal",
+		"127.0.0.1:" + port:        "ip 127.0.0.1",
+	} {
+		conn, err := dial(t, proxy, target)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		assertEcho(t, conn)
+		if got := <-paths; got != want {
+			t.Errorf("%s took path %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestAddressResolverGuards(t *testing.T) {
+	echo := echoServer(t)
+
+	var self string
+	resolver := func(ctx context.Context, addr *Address) (net.Conn, error) {
+		var d net.Dialer
+		if addr.Name == "self.internal" {
+			return d.DialContext(ctx, "tcp", self)
+		}
+		return d.DialContext(ctx, "tcp", echo)
+	}
+
+	_, self = serve(t, WithAddressResolver(resolver))
+	_, err := dial(t, self, "self.internal:80")
+	if err == nil || !strings.Contains(err.Error(), ruleFailure.String()) {
+		t.Errorf("dial back to the proxy itself: got %v, want %v", err, ruleFailure)
+	}
+
+	_, proxy := serve(t, WithAddressResolver(resolver), WithBlockPrivateRanges(true))
+	_, err = dial(t, proxy, "echo.internal:80")
+	if err == nil || !strings.Contains(err.Error(), ruleFailure.String()) {
+		t.Errorf("dial to a private address: got %v, want %v", err, ruleFailure)
+	}
+}
+
+func TestBlockPrivateRanges(t *testing.T) {
+	echo := echoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	_, proxy := serve(t, WithBlockPrivateRanges(true))
+
+	// the name is only found private once resolved
+	for _, target := range []string{echo, net.JoinHostPort("localhost", port)} {
+		_, err := dial(t, proxy, target)
+		if err == nil || !strings.Contains(err.Error(), ruleFailure.String()) {
+			t.Errorf("CONNECT %s: got %v, want %v", target, err, ruleFailure)
+		}
+	}
+}
+
+func TestBlockPrivateRangesUDP(t *testing.T) {
+	echo := udpEchoServer(t)
+	targets := []string{echo.String(), net.JoinHostPort("localhost", strconv.Itoa(echo.Port))}
+
+	_, open := serve(t)
+	_, proxy := serve(t, WithBlockPrivateRanges(true))
+	for _, target := range targets {
+		// the relay keeps the first target, so each needs its own association
+		client, relay := associate(t, open)
+		if !udpRoundTrip(t, client, relay, target, []byte("ping")) {
+			t.Fatalf("datagram to %s not relayed without the guard", target)
+		}
+		client, relay = associate(t, proxy)
+		if udpRoundTrip(t, client, relay, target, []byte("ping")) {
+			t.Errorf("datagram to %s relayed with private ranges blocked", target)
+		}
+	}
+}
+
+func TestMaxUDPSessions(t *testing.T) {
+	_, proxy := serve(t, WithMaxUDPSessions(2))
+
+	first, code, _ := sendAssociate(t, proxy, "0.0.0.0:0")
+	if code != successReply {
+		t.Fatalf("first associate: %v", code)
+	}
+	if _, code, _ := sendAssociate(t, proxy, "0.0.0.0:0"); code != successReply {
+		t.Fatalf("second associate: %v", code)
+	}
+	if _, code, _ := sendAssociate(t, proxy, "0.0.0.0:0"); code != serverFailure {
+		t.Fatalf("associate over the limit: got %v, want %v", code, serverFailure)
+	}
+
+	// closing a control connection ends its session and frees the slot
+	_ = first.Close()
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		if _, code, _ := sendAssociate(t, proxy, "0.0.0.0:0"); code == successReply {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("slot not freed after closing a session")
+		}
+	}
+}
+
+func TestAssociateDeclaredSource(t *testing.T) {
+	echo := udpEchoServer(t)
+	_, proxy := serve(t)
+
+	var clients [2]*net.UDPConn
+	for i := range clients {
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		clients[i] = client
+	}
+	declared, other := clients[0], clients[1]
+
+	_, code, relay := sendAssociate(t, proxy, declared.LocalAddr().String())
+	if code != successReply {
+		t.Fatalf("associate: %v", code)
+	}
+	if udpRoundTrip(t, other, relay, echo.String(), []byte("ping")) {
+		t.Error("datagram from an undeclared source relayed")
+	}
+	if !udpRoundTrip(t, declared, relay, echo.String(), []byte("ping")) {
+		t.Error("datagram from the declared source not relayed")
+	}
+}
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	echo := echoServer(t)
+	_, proxy := serve(t, WithMaxConcurrentHandshakes(1))
+
+	// a failed handshake gives its slot back
+	bad, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if _, err := bad.Write([]byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(t, proxy, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	// an idle client holds the only slot, so the next handshake waits
+	idle, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	waiting := make(chan result, 1)
+	go func() {
+		conn, err := dial(t, proxy, echo)
+		waiting <- result{conn, err}
+	}()
+	select {
+	case r := <-waiting:
+		t.Fatalf("handshake over the limit finished: %v", r.err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the slot is released once the idle client's tunnel starts
+	if _, err := idle.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(ConnectCommand), 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAddrWithStr(idle, echo); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-waiting:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		assertEcho(t, r.conn)
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting handshake didn't proceed once the slot was released")
+	}
+}
+
+// warnLogger records the warnings logged.
+type warnLogger struct {
+	quietLogger
+	warnings []string
+}
+
+func (l *warnLogger) Warn(v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprint(v...))
+}
+
+// passwordAuthenticator stands for any method requiring credentials.
+type passwordAuthenticator struct{}
+
+func (passwordAuthenticator) Method() byte { return 0x02 }
+
+func (passwordAuthenticator) Authenticate(net.Conn) error { return nil }
+
+func TestOpenProxyWarning(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ServerOption
+		warn    bool
+	}{
+		{"public without auth", []ServerOption{WithBind("0.0.0.0:1080")}, true},
+		{"public name without auth", []ServerOption{WithBind("proxy.example:1080")}, true},
+		{"loopback without auth", []ServerOption{WithBind("127.0.0.1:1080")}, false},
+		{"localhost without auth", []ServerOption{WithBind("localhost:1080")}, false},
+		{"public with auth", []ServerOption{WithBind("0.0.0.0:1080"), WithAuthenticators(passwordAuthenticator{})}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &warnLogger{}
+			NewServer(append([]ServerOption{WithLogger(logger)}, tt.options...)...)
+			if warned := len(logger.warnings) > 0; warned != tt.warn {
+				t.Errorf("warned %v (%q), want %v", warned, logger.warnings, tt.warn)
+			}
+		})
+	}
+}
+
+// failureMessage sends request after negotiating extended replies with the
+// server at proxy, returning the reply and the message following it.
+func failureMessage(t *testing.T, proxy string, request []byte) (reply, string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{socks5Version, 2, byte(noAuth), byte(extendedReplies)}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAddr(conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readBytes(conn)
+	if err != nil {
+		t.Fatalf("reply %v without message: %v", reply(header[1]), err)
+	}
+	return reply(header[1]), string(msg)
+}
+
+func TestFailureMessages(t *testing.T) {
+	connect := []byte{socks5Version, byte(ConnectCommand), 0, 1, 127, 0, 0, 1, 0, 80}
+	associate := []byte{socks5Version, byte(AssociateCommand), 0, 1, 127, 0, 0, 1, 0, 80}
+
+	_, proxy := serve(t, WithExtendedReplies(true), WithAllowedCommands(ConnectCommand))
+	draining, drainingProxy := serve(t, WithExtendedReplies(true))
+	draining.SetDraining(true)
+
+	tests := []struct {
+		name    string
+		proxy   string
+		request []byte
+		want    reply
+	}{
+		{"address type", proxy, []byte{socks5Version, byte(ConnectCommand), 0, 0x09}, addrTypeNotSupported},
+		{"disallowed command", proxy, associate, commandNotSupported},
+		{"unknown command", proxy, []byte{socks5Version, 0x7f, 0, 1, 127, 0, 0, 1, 0, 80}, commandNotSupported},
+		{"draining", drainingProxy, connect, serverFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, msg := failureMessage(t, tt.proxy, tt.request)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if msg == "" {
+				t.Error("empty message")
+			}
+		})
+	}
+}
+
+func TestConnLogTimings(t *testing.T) {
+	echo := echoServer(t)
+	summaries := make(chan statute.ConnSummary, 1)
+	_, proxy := serve(t, WithConnLog(func(s statute.ConnSummary) {
+		// skip the probe connection of serve
+		if s.Destination != "" {
+			summaries <- s
+		}
+	}))
+
+	conn, err := dial(t, proxy, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+
+	select {
+	case s := <-summaries:
+		if s.DialLatency <= 0 {
+			t.Errorf("dial latency %v, want > 0", s.DialLatency)
+		}
+		if s.TTFB <= 0 {
+			t.Errorf("TTFB %v, want > 0", s.TTFB)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no connection summary")
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	echo := echoServer(t)
+	_, proxy := serve(t, WithAllowedCommands(ConnectCommand))
+
+	conn, err := dial(t, proxy, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	for name, cmd := range map[string]byte{"BIND": 0x02, "ASSOCIATE": byte(AssociateCommand)} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+				t.Fatal(err)
+			}
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(conn, method); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write([]byte{socks5Version, cmd, 0, 1, 127, 0, 0, 1, 0, 80}); err != nil {
+				t.Fatal(err)
+			}
+			header := make([]byte, 3)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				t.Fatal(err)
+			}
+			if got := reply(header[1]); got != commandNotSupported {
+				t.Errorf("got %v, want %v", got, commandNotSupported)
+			}
+		})
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	echo := echoServer(t)
+	_, proxy := serve(t, WithMaxConnLifetime(200*time.Millisecond))
+
+	start := time.Now()
+	conn, err := dial(t, proxy, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tunnel is closed while still active
+	for {
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("tunnel still open after its lifetime")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("tunnel closed after %v, before its lifetime", elapsed)
+	}
+}
+
+func TestUpstreamAssociate(t *testing.T) {
+	echo := udpEchoServer(t)
+	stats := statute.NewStatsCollector()
+	_, upstream := serve(t, WithStats(stats))
+	_, proxy := serve(t, WithUpstreamAssociate(upstream))
+
+	client, relay := associate(t, proxy)
+	if !udpRoundTrip(t, client, relay, echo.String(), []byte("ping")) {
+		t.Fatal("datagram not relayed through the upstream proxy")
+	}
+	if conns := stats.Connections(); len(conns) != 1 {
+		t.Fatalf("upstream proxy has %d active connections, want the association", len(conns))
+	}
+}
+
+func TestNoAcceptableMethods(t *testing.T) {
+	_, proxy := serve(t)
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// GSSAPI and a private method, neither configured
+	if _, err := conn.Write([]byte{socks5Version, 2, 0x01, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(method, []byte{socks5Version, byte(noAcceptable)}) {
+		t.Errorf("got %x, want %x", method, []byte{socks5Version, byte(noAcceptable)})
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("read after the reply = %v, want EOF", err)
+	}
+}
+
+// errorLogger records the errors logged.
+type errorLogger struct {
+	quietLogger
+	mu     sync.Mutex
+	errors []string
+}
+
+func (l *errorLogger) Error(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, fmt.Sprint(v...))
+}
+
+func TestUserHandlerReturnsEarly(t *testing.T) {
+	logger := &errorLogger{}
+	returned := make(chan struct{})
+	_, proxy := serve(t, WithLogger(logger), WithConnectHandle(func(*statute.ProxyRequest) error {
+		// neither reads from nor closes the connection
+		close(returned)
+		return nil
+	}))
+	// forget the probe connection of serve
+	time.Sleep(50 * time.Millisecond)
+	logger.mu.Lock()
+	logger.errors = nil
+	logger.mu.Unlock()
+
+	conn, err := dial(t, proxy, "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-returned
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after the handler returned = %v, want EOF", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.errors) != 0 {
+		t.Errorf("logged %q", logger.errors)
+	}
+}
+
+func TestListenAndServeErrors(t *testing.T) {
+	t.Run("bind", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		s := NewServer(WithLogger(quietLogger{}), WithBind(ln.Addr().String()))
+		if err := s.ListenAndServe(); !errors.Is(err, statute.ErrBindFailed) {
+			t.Errorf("got %v, want ErrBindFailed", err)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := NewServer(WithLogger(quietLogger{}), WithBind(freeAddr(t)), WithContext(ctx))
+		done := make(chan error, 1)
+		go func() {
+			done <- s.ListenAndServe()
+		}()
+		cancel()
+		select {
+		case err := <-done:
+			if !errors.Is(err, statute.ErrShutdown) {
+				t.Errorf("got %v, want ErrShutdown", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("ListenAndServe didn't return")
+		}
+	})
+}
+
+func TestMaxUDPPacketSize(t *testing.T) {
+	const size = 2048
+	echo := udpEchoServer(t)
+	_, proxy := serve(t, WithMaxUDPPacketSize(size))
+	client, relay := associate(t, proxy)
+
+	var header bytes.Buffer
+	header.Write([]byte{0, 0, 0})
+	if err := writeAddrWithStr(&header, echo.String()); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip := func(payload []byte) []byte {
+		t.Helper()
+		if _, err := client.WriteTo(append(header.Bytes(), payload...), relay); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2*size)
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[header.Len():n]
+	}
+
+	// a datagram of exactly the maximum size is relayed whole both ways
+	payload := bytes.Repeat([]byte("x"), size-header.Len())
+	if got := roundTrip(payload); !bytes.Equal(got, payload) {
+		t.Errorf("echoed %d bytes, want %d", len(got), len(payload))
+	}
+	// a larger one is cut at the maximum size
+	if got := roundTrip(append(payload, "overflow"...)); len(got) != len(payload) {
+		t.Errorf("echoed %d bytes of an oversized datagram, want %d", len(got), len(payload))
+	}
+}
+
+// userPassAuthenticator runs the username/password sub-negotiation of RFC 1929.
+type userPassAuthenticator struct{ user, password string }
+
+func (userPassAuthenticator) Method() byte { return 0x02 }
+
+func (a userPassAuthenticator) Authenticate(conn net.Conn) error {
+	if _, err := readByte(conn); err != nil {
+		return err
+	}
+	user, err := readBytes(conn)
+	if err != nil {
+		return err
+	}
+	password, err := readBytes(conn)
+	if err != nil {
+		return err
+	}
+	if string(user) != a.user || string(password) != a.password {
+		_, _ = conn.Write([]byte{1, 1})
+		return errors.New("invalid credentials")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+func TestUserPassSplitReads(t *testing.T) {
+	echo := echoServer(t)
+	_, proxy := serve(t, WithAuthenticators(userPassAuthenticator{"user", "secret"}))
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// every byte arrives in a read of its own
+	trickle := func(b []byte) {
+		t.Helper()
+		for i := range b {
+			if _, err := conn.Write(b[i : i+1]); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+	trickle([]byte{socks5Version, 1, 0x02})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != 0x02 {
+		t.Fatalf("method %x, %v", method, err)
+	}
+	trickle(append(append([]byte{1, 4}, "user"...), append([]byte{6}, "secret"...)...))
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil || status[1] != 0 {
+		t.Fatalf("auth status %x, %v", status, err)
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, byte(ConnectCommand), 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAddrWithStr(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAddr(conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code := reply(header[1]); code != successReply {
+		t.Fatalf("connect: %v", code)
+	}
+	assertEcho(t, conn)
+}
+
+func TestDeadlineMiddleware(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	echo := echoServer(t)
+	_, proxy := serve(t, WithConnMiddleware(statute.DeadlineMiddleware(timeout)))
+
+	conn, err := dial(t, proxy, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// traffic keeps pushing the deadline forward past the timeout
+	for i := 0; i < 5; i++ {
+		assertEcho(t, conn)
+		time.Sleep(timeout / 2)
+	}
+
+	// a silent tunnel is closed once the timeout passes
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var netErr net.Error
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("silent tunnel not closed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > timeout+500*time.Millisecond {
+		t.Errorf("silent tunnel closed after %v", elapsed)
+	}
+}
+
+func TestRequestInterceptorRewrite(t *testing.T) {
+	echo := echoServer(t)
+	unused := freeAddr(t)
+	_, proxy := serve(t, WithRequestInterceptors(
+		func(req *statute.ProxyRequest) error {
+			if req.Destination == "blocked.test:80" {
+				return errors.New("blocked")
+			}
+			return nil
+		},
+		func(req *statute.ProxyRequest) error {
+			if req.Destination == unused {
+				req.Destination = echo
+			}
+			return nil
+		},
+	))
+
+	// nothing listens on the requested address, the dial goes to the rewritten one
+	conn, err := dial(t, proxy, unused)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	if _, err := dial(t, proxy, "blocked.test:80"); err == nil {
+		t.Error("refused request succeeded")
+	}
+}
+
+func TestAllowedSourceCIDRs(t *testing.T) {
+	echo := echoServer(t)
+	_, allowed := serve(t, WithAllowedSourceCIDRs("10.0.0.0/8", "127.0.0.0/8"))
+	conn, err := dial(t, allowed, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	_, proxy := serve(t, WithAllowedSourceCIDRs("10.0.0.0/8"))
+	conn, err = net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 2)); !errors.Is(err, io.EOF) {
+		t.Errorf("read %d bytes, %v from a disallowed source, want EOF", n, err)
+	}
+}
+
+// hostsResolver resolves the names it maps to their addresses.
+type hostsResolver map[string]string
+
+func (r hostsResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range strings.Split(ips, ",") {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestUDPFQDNTarget(t *testing.T) {
+	echo := udpEchoServer(t)
+	_, proxy := serve(t, WithResolver(hostsResolver{"echo.test": "127.0.0.1"}))
+	client, relay := associate(t, proxy)
+
+	target := net.JoinHostPort("echo.test", strconv.Itoa(echo.Port))
+	if !udpRoundTrip(t, client, relay, target, []byte("ping")) {
+		t.Fatal("datagram to a name not relayed to its address")
+	}
+}
+
+func TestRejectWithRST(t *testing.T) {
+	_, proxy := serve(t, WithAllowedSourceCIDRs("10.0.0.0/8"), WithRejectWithRST(true))
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if errors.Is(err, syscall.ECONNRESET) {
+		// reset before connect returned
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("read from a rejected connection = %v, want a reset", err)
+	}
+}
+
+func TestServeConnReader(t *testing.T) {
+	echo := echoServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := NewServer(WithLogger(quietLogger{}))
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// the detector buffered the greeting and the whole request
+		reader := bufio.NewReader(conn)
+		if _, err := reader.Peek(3); err != nil {
+			_ = conn.Close()
+			return
+		}
+		_ = s.ServeConnReader(conn, reader)
+	}()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var request bytes.Buffer
+	request.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(ConnectCommand), 0})
+	if err := writeAddrWithStr(&request, echo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAddr(conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code := reply(header[1]); code != successReply {
+		t.Fatalf("connect: %v", code)
+	}
+	assertEcho(t, conn)
+}
+
+// countMetrics records the counts added and their latest labels, per name.
+type countMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	labels map[string][]string
+}
+
+func (m *countMetrics) ObserveDuration(string, time.Duration, ...string) {}
+
+func (m *countMetrics) AddCount(name string, delta int64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int64)
+		m.labels = make(map[string][]string)
+	}
+	m.counts[name] += delta
+	m.labels[name] = labels
+}
+
+func (m *countMetrics) count(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[name]
+}
+
+func (m *countMetrics) labelsOf(name string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.labels[name]
+}
+
+func TestUDPSessionCounters(t *testing.T) {
+	echo := udpEchoServer(t)
+	metrics := &countMetrics{}
+	_, proxy := serve(t, WithMetrics(metrics))
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	control, code, relay := sendAssociate(t, proxy, "0.0.0.0:0")
+	if code != successReply {
+		t.Fatalf("associate: %v", code)
+	}
+	for i := 0; i < 3; i++ {
+		if !udpRoundTrip(t, client, relay, echo.String(), []byte("ping")) {
+			t.Fatal("datagram not relayed")
+		}
+	}
+
+	// the totals are reported once the session ends, bytes down last
+	_ = control.Close()
+	want := map[string]int64{"udp_packets_up": 3, "udp_bytes_up": 12, "udp_packets_down": 3, "udp_bytes_down": 12}
+	for start := time.Now(); metrics.count("udp_bytes_down") == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("session counters not reported")
+		}
+	}
+	for name, n := range want {
+		if got := metrics.count(name); got != n {
+			t.Errorf("%s = %d, want %d", name, got, n)
+		}
+	}
+}
+
+// sizeRecorder records the largest reads and writes made on a connection.
+type sizeRecorder struct {
+	net.Conn
+	mu                sync.Mutex
+	maxRead, maxWrite int
+}
+
+func (c *sizeRecorder) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	c.maxRead = max(c.maxRead, len(p))
+	c.mu.Unlock()
+	return c.Conn.Read(p)
+}
+
+func (c *sizeRecorder) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.maxWrite = max(c.maxWrite, len(p))
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *sizeRecorder) sizes() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxRead, c.maxWrite
+}
+
+func TestBuffers(t *testing.T) {
+	const readSize, writeSize, total = 16, 64, 1000
+
+	// the destination sends its whole answer once the request is in
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, make([]byte, total)); err == nil {
+			_, _ = conn.Write(bytes.Repeat([]byte("d"), total))
+		}
+	}()
+
+	recorders := make(chan *sizeRecorder, 2)
+	_, proxy := serve(t,
+		WithBuffers(readSize, writeSize),
+		WithConnMiddleware(func(conn net.Conn) net.Conn {
+			recorder := &sizeRecorder{Conn: conn}
+			recorders <- recorder
+			return recorder
+		}),
+	)
+	// the first connection is serve's probe
+	<-recorders
+
+	conn, err := dial(t, proxy, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	recorder := <-recorders
+
+	if _, err := conn.Write(bytes.Repeat([]byte("u"), total)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, total)); err != nil {
+		t.Fatal(err)
+	}
+
+	maxRead, maxWrite := recorder.sizes()
+	if maxRead != readSize {
+		t.Errorf("largest read from the client is %d bytes, want %d", maxRead, readSize)
+	}
+	if maxWrite > writeSize {
+		t.Errorf("largest write to the client is %d bytes, want at most %d", maxWrite, writeSize)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	// a black-holed destination never answers the handshake
+	dialErrs := make(chan error, 1)
+	blackHole := func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		dialErrs <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	_, proxy := serve(t, WithProxyDial(blackHole), WithConnectTimeout(timeout))
+
+	start := time.Now()
+	if _, err := dial(t, proxy, "192.0.2.1:443"); err == nil {
+		t.Fatal("connect to a black-holed address succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("connect failed after %v, want about %v", elapsed, timeout)
+	}
+	if err := <-dialErrs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dial ended with %v, want the connect timeout", err)
+	}
+}
+
+func TestBindReplyAddr(t *testing.T) {
+	echo := echoServer(t)
+	public := net.IPv4(203, 0, 113, 7)
+	_, proxy := serve(t, WithBindReplyAddr(public))
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{socks5Version, byte(ConnectCommand), 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAddrWithStr(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	bind, err := readAddr(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := reply(header[1]); code != successReply {
+		t.Fatalf("connect: %v", code)
+	}
+	// the address is replaced, the real port is kept
+	if !bind.IP.Equal(public) || bind.Port == 0 {
+		t.Errorf("reply advertises %v:%d, want %v and the local port", bind.IP, bind.Port, public)
+	}
+	assertEcho(t, conn)
+}
+
+func TestUDPReplyHeaderFQDN(t *testing.T) {
+	echo := udpEchoServer(t)
+	_, proxy := serve(t, WithResolver(hostsResolver{"echo.test": "127.0.0.1"}))
+	client, relay := associate(t, proxy)
+
+	var datagram bytes.Buffer
+	datagram.Write([]byte{0, 0, 0})
+	if err := writeAddrWithStr(&datagram, net.JoinHostPort("echo.test", strconv.Itoa(echo.Port))); err != nil {
+		t.Fatal(err)
+	}
+	datagram.WriteString("ping")
+	if _, err := client.WriteTo(datagram.Bytes(), relay); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := bytes.NewReader(buf[3:n])
+	from, err := readAddr(rest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reply names the source as the client did, not by its resolved address
+	if from.Name != "echo.test" || from.Port != echo.Port {
+		t.Errorf("reply from %s:%d, want echo.test:%d", from.Name, from.Port, echo.Port)
+	}
+	if payload, _ := io.ReadAll(rest); string(payload) != "ping" {
+		t.Errorf("reply payload %q, want %q", payload, "ping")
+	}
+}
+
+func TestTargetListenPacket(t *testing.T) {
+	echo := udpEchoServer(t)
+	targets := make(chan string, 1)
+	_, proxy := serve(t, WithTargetListenPacket(func(ctx context.Context, network, target string) (net.PacketConn, error) {
+		targets <- target
+		var lc net.ListenConfig
+		return lc.ListenPacket(ctx, network, "127.0.0.1:0")
+	}))
+	client, relay := associate(t, proxy)
+
+	// the target gets its own socket, and the replies still come back
+	if !udpRoundTrip(t, client, relay, echo.String(), []byte("ping")) {
+		t.Fatal("datagram not relayed through the target's socket")
+	}
+	if target := <-targets; target != echo.String() {
+		t.Errorf("socket opened for %s, want %s", target, echo)
+	}
+	if !udpRoundTrip(t, client, relay, echo.String(), []byte("pong")) {
+		t.Fatal("second datagram not relayed")
+	}
+	select {
+	case target := <-targets:
+		t.Errorf("second socket opened for %s", target)
+	default:
+	}
+}
+
+func TestHandlerTeardownCause(t *testing.T) {
+	causes := make(chan error, 1)
+	_, proxy := serve(t, WithConnectHandle(func(req *statute.ProxyRequest) error {
+		defer req.Conn.Close()
+		// the client stays silent past the deadline
+		_ = req.Conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, _ = req.Conn.Read(make([]byte, 1))
+		select {
+		case <-req.Context.Done():
+			causes <- context.Cause(req.Context)
+		case <-time.After(2 * time.Second):
+			causes <- errors.New("context not cancelled")
+		}
+		return nil
+	}))
+
+	if _, err := dial(t, proxy, "127.0.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	if cause := <-causes; !errors.Is(cause, statute.ErrIdleTimeout) {
+		t.Errorf("handler saw cause %v, want %v", cause, statute.ErrIdleTimeout)
+	}
+}
+
+func TestHandlerErrorFilter(t *testing.T) {
+	logger := &errorLogger{}
+	errRefused := errors.New("refused by policy")
+	_, proxy := serve(t,
+		WithLogger(logger),
+		WithConnectHandle(func(req *statute.ProxyRequest) error {
+			_ = req.Conn.Close()
+			if req.DestPort == 1 {
+				return io.EOF
+			}
+			return errRefused
+		}),
+		WithHandlerErrorFilter(func(err error) bool {
+			return errors.Is(err, io.EOF)
+		}),
+	)
+	// forget the probe connection of serve
+	time.Sleep(50 * time.Millisecond)
+	logger.mu.Lock()
+	logger.errors = nil
+	logger.mu.Unlock()
+
+	for _, dest := range []string{"127.0.0.1:1", "127.0.0.1:2"} {
+		conn, err := dial(t, proxy, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the handler closes the connection once it has returned
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _ = conn.Read(make([]byte, 1))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	// the filtered EOF is left out, the other error is logged as the handler's
+	want := (&statute.HandlerError{Err: errRefused}).Error()
+	if len(logger.errors) != 1 || !strings.Contains(logger.errors[0], want) {
+		t.Errorf("logged %q, want only %q", logger.errors, want)
+	}
+}
+
+func TestVerboseReplies(t *testing.T) {
+	logger := &errorLogger{}
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	_, proxy := serve(t,
+		WithLogger(logger),
+		WithVerboseReplies(true),
+		WithResolver(hostsResolver{"multi.test": "127.0.0.2,127.0.0.3"}),
+	)
+	// forget the probe connection of serve
+	time.Sleep(50 * time.Millisecond)
+	logger.mu.Lock()
+	logger.errors = nil
+	logger.mu.Unlock()
+
+	if _, err := dial(t, proxy, net.JoinHostPort("multi.test", port)); err == nil {
+		t.Fatal("connect to a closed port succeeded")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	// every address tried is listed with its own error
+	var attempts []string
+	for _, entry := range logger.errors {
+		if strings.HasPrefix(entry, "connect attempt failed") {
+			attempts = append(attempts, entry)
+		}
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("logged %q, want an entry per address tried", logger.errors)
+	}
+	for i, address := range []string{"127.0.0.2:" + port, "127.0.0.3:" + port} {
+		if !strings.Contains(attempts[i], address) || !strings.Contains(attempts[i], "connection refused") {
+			t.Errorf("attempt %q, want %s refused", attempts[i], address)
+		}
+	}
+}
+
+func TestDestinationClassifier(t *testing.T) {
+	echo := echoServer(t)
+	metrics := &countMetrics{}
+	_, proxy := serve(t, WithMetrics(metrics), WithDestinationClassifier(func(host string) string {
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return "loopback"
+		}
+		return "other"
+	}))
+
+	conn, err := dial(t, proxy, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	_ = conn.Close()
+
+	// the byte counts are added once the tunnel ends
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if metrics.count("bytes_up") > 0 {
+			break
+		}
+	}
+	want := []string{"protocol", "socks5", "destination", "loopback"}
+	if got := metrics.labelsOf("bytes_up"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("bytes_up labels %q, want %q", got, want)
+	}
+}
+
+func TestEventChannel(t *testing.T) {
+	echo := echoServer(t)
+	events := make(chan statute.Event, 16)
+	_, proxy := serve(t, WithEventChannel(events))
+
+	conn, err := dial(t, proxy, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	client := conn.LocalAddr().String()
+	_ = conn.Close()
+
+	// the events of serve's probe connection come first
+	var got []statute.Event
+	timeout := time.After(2 * time.Second)
+	for len(got) == 0 || got[len(got)-1].Type != statute.EventConnClose {
+		select {
+		case event := <-events:
+			if event.ClientAddr == client {
+				got = append(got, event)
+			}
+		case <-timeout:
+			t.Fatalf("events %+v, want the connection to close", got)
+		}
+	}
+	if len(got) != 2 || got[0].Type != statute.EventConnOpen {
+		t.Fatalf("events %+v, want open and close", got)
+	}
+	closed := got[1]
+	if closed.Protocol != statute.ProtocolSOCKS5 || closed.Destination != echo {
+		t.Errorf("close event for %s to %s, want socks5 to %s", closed.Protocol, closed.Destination, echo)
+	}
+	if closed.BytesUp == 0 || closed.BytesDown == 0 || closed.Duration <= 0 {
+		t.Errorf("close event counts %d up and %d down in %v", closed.BytesUp, closed.BytesDown, closed.Duration)
+	}
+}
+
+// debugLogger records the debug messages logged.
+type debugLogger struct {
+	quietLogger
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *debugLogger) Debug(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintln(v...))
+}
+
+func TestAuthMethodLogged(t *testing.T) {
+	logger := &debugLogger{}
+	summaries := make(chan statute.ConnSummary, 4)
+	_, proxy := serve(t,
+		WithLogger(logger),
+		WithAuthenticators(userPassAuthenticator{"user", "secret"}),
+		WithConnLog(func(summary statute.ConnSummary) {
+			summaries <- summary
+		}),
+	)
+	// the probe connection of serve ends before any negotiation
+	<-summaries
+
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{socks5Version, 1, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(append([]byte{1, 4}, "user"...), append([]byte{6}, "secret"...)...)); err != nil {
+		t.Fatal(err)
+	}
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil || status[1] != 0 {
+		t.Fatalf("auth status %x, %v", status, err)
+	}
+	_ = conn.Close()
+
+	select {
+	case summary := <-summaries:
+		if summary.AuthMethod != "user/pass" {
+			t.Errorf("summary auth method %q, want %q", summary.AuthMethod, "user/pass")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no summary")
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, message := range logger.messages {
+		if strings.HasPrefix(message, "auth negotiated") && strings.Contains(message, "method user/pass") {
+			return
+		}
+	}
+	t.Errorf("logged %q, want the negotiated method", logger.messages)
+}
+
+func TestDatagramHandler(t *testing.T) {
+	echo := udpEchoServer(t)
+	_, proxy := serve(t, WithDatagramHandler(func(src, dst net.Addr, payload []byte) ([]byte, bool) {
+		if string(payload) == "drop" {
+			return nil, false
+		}
+		// only datagrams on their way to the target are rewritten
+		if dst.String() == echo.String() {
+			return bytes.ToUpper(payload), true
+		}
+		return payload, true
+	}))
+	client, relay := associate(t, proxy)
+
+	var datagram bytes.Buffer
+	datagram.Write([]byte{0, 0, 0})
+	if err := writeAddrWithStr(&datagram, echo.String()); err != nil {
+		t.Fatal(err)
+	}
+	datagram.WriteString("ping")
+	if _, err := client.WriteTo(datagram.Bytes(), relay); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the echo server returns the payload as rewritten on the way out
+	if !bytes.HasSuffix(buf[:n], []byte("PING")) {
+		t.Errorf("reply %q, want the rewritten payload", buf[:n])
+	}
+
+	if udpRoundTrip(t, client, relay, echo.String(), []byte("drop")) {
+		t.Error("dropped datagram relayed")
+	}
+}
+
+func TestListenPacketFailure(t *testing.T) {
+	_, proxy := serve(t, WithProxyListenPacket(func(context.Context, string, string) (net.PacketConn, error) {
+		return nil, errors.New("no UDP sockets left")
+	}))
+
+	conn, code, _ := sendAssociate(t, proxy, "0.0.0.0:0")
+	if code != serverFailure {
+		t.Fatalf("associate: %v, want %v", code, serverFailure)
+	}
+	// the control connection is closed rather than left for the client to wait on
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("read after the failure = %v, want EOF", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := NewServer().Validate(); err != nil {
+		t.Fatalf("default configuration: %v", err)
+	}
+
+	s := NewServer(
+		WithBind("127.0.0.1:99999"),
+		WithAllowedCommands(ConnectCommand),
+		WithDatagramHandler(func(_, _ net.Addr, payload []byte) ([]byte, bool) { return payload, true }),
+		WithBuffers(-1, 0),
+	)
+	err := s.Validate()
+	if err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	// every problem is reported at once
+	for _, want := range []string{
+		`socks5: Bind "127.0.0.1:99999": invalid port`,
+		"socks5: DatagramHandler is set but ASSOCIATE is not allowed",
+		"socks5: ReadBufferSize is negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to report %q", err, want)
+		}
+	}
+}
+
+func TestConnLogUserHandler(t *testing.T) {
+	echo := echoServer(t)
+	handler := WithConnectHandle(func(req *statute.ProxyRequest) error {
+		return req.Conn.Close()
+	})
+	for _, tt := range []struct {
+		name    string
+		options []ServerOption
+		want    bool
+	}{
+		{"embedded", nil, false},
+		{"user", []ServerOption{handler}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			summaries := make(chan statute.ConnSummary, 4)
+			options := append(tt.options, WithConnLog(func(summary statute.ConnSummary) {
+				summaries <- summary
+			}))
+			_, proxy := serve(t, options...)
+
+			conn, err := dial(t, proxy, echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+			for {
+				select {
+				case summary := <-summaries:
+					// skip the probe connection of serve
+					if summary.Destination == "" {
+						continue
+					}
+					if summary.UserHandler != tt.want {
+						t.Errorf("summary UserHandler %v, want %v", summary.UserHandler, tt.want)
+					}
+					return
+				case <-time.After(2 * time.Second):
+					t.Fatal("no summary")
+				}
+			}
+		})
+	}
+}
+
+func TestStrictProtocol(t *testing.T) {
+	echo := echoServer(t)
+	echoAddr, err := net.ResolveTCPAddr("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := []byte{byte(echoAddr.Port >> 8), byte(echoAddr.Port)}
+	reservedSet := append([]byte{socks5Version, byte(ConnectCommand), 1, 1, 127, 0, 0, 1}, port...)
+	badName := append([]byte{socks5Version, byte(ConnectCommand), 0, 3, 4, 'a', ' ', 'b', '!'}, port...)
+
+	_, lenient := serve(t)
+	_, strict := serve(t, WithStrictProtocol(true))
+
+	tests := []struct {
+		name    string
+		proxy   string
+		request []byte
+		want    reply
+	}{
+		{"lenient reserved byte", lenient, reservedSet, successReply},
+		{"strict reserved byte", strict, reservedSet, serverFailure},
+		{"strict invalid name", strict, badName, addrTypeNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.DialTimeout("tcp", tt.proxy, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(tt.request); err != nil {
+				t.Fatal(err)
+			}
+			header := make([]byte, 3)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				t.Fatal(err)
+			}
+			if got := reply(header[1]); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// udpStats counts the datagrams relayed by an ASSOCIATE session
+type udpStats struct {
+	packetsUp   atomic.Int64
+	bytesUp     atomic.Int64
+	packetsDown atomic.Int64
+	bytesDown   atomic.Int64
+}
+
+// up records a datagram of n payload bytes relayed from the client
+func (st *udpStats) up(n int) {
+	st.packetsUp.Add(1)
+	st.bytesUp.Add(int64(n))
+}
+
+// down records a datagram of n payload bytes relayed back to the client
+func (st *udpStats) down(n int) {
+	st.packetsDown.Add(1)
+	st.bytesDown.Add(int64(n))
+}
+
+func (st *udpStats) String() string {
+	return fmt.Sprintf("up %d packets/%d bytes, down %d packets/%d bytes",
+		st.packetsUp.Load(), st.bytesUp.Load(), st.packetsDown.Load(), st.bytesDown.Load())
+}
+
+// startUDPSession logs the setup of an ASSOCIATE session relaying on relay
+// for the client of req, and reports its counters every UDPLogInterval. The
+// returned function ends the session, logging the totals and adding them to
+// the metrics.
+func (s *Server) startUDPSession(req *request, relay string) (*udpStats, func()) {
+	st := &udpStats{}
+	client := req.Conn.RemoteAddr().String()
+	s.Logger.Debug("udp associate for " + client + " relaying on " + relay)
+
+	done := make(chan struct{})
+	if s.UDPLogInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(s.UDPLogInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.Logger.Debug("udp associate for " + client + ": " + st.String())
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return st, func() {
+		close(done)
+		s.Logger.Debug("udp associate for " + client + " closed: " + st.String())
+		s.Metrics.AddCount("udp_packets_up", st.packetsUp.Load(), "protocol", "socks5")
+		s.Metrics.AddCount("udp_bytes_up", st.bytesUp.Load(), "protocol", "socks5")
+		s.Metrics.AddCount("udp_packets_down", st.packetsDown.Load(), "protocol", "socks5")
+		s.Metrics.AddCount("udp_bytes_down", st.bytesDown.Load(), "protocol", "socks5")
+	}
+}
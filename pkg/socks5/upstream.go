@@ -0,0 +1,162 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// upstreamRelay is a UDP ASSOCIATE session established with an upstream SOCKS5 proxy.
+type upstreamRelay struct {
+	// conn is the TCP control connection that keeps the upstream association alive
+	conn net.Conn
+	// addr is the upstream UDP relay address datagrams are sent to
+	addr *net.UDPAddr
+}
+
+func (u *upstreamRelay) Close() error {
+	return u.conn.Close()
+}
+
+// dialUpstreamAssociate connects to the upstream SOCKS5 proxy at address and
+// performs a UDP ASSOCIATE request on it.
+func dialUpstreamAssociate(ctx context.Context, proxyDial statute.ProxyDialFunc, address string) (*upstreamRelay, error) {
+	conn, err := proxyDial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	relayAddr, err := associateHandshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// a relay bound to the unspecified address is reachable on the proxy's own address
+	if relayAddr.IP.IsUnspecified() {
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relayAddr.IP = remote.IP
+		}
+	}
+
+	return &upstreamRelay{conn: conn, addr: relayAddr}, nil
+}
+
+// associateHandshake negotiates no-auth and sends a UDP ASSOCIATE request over conn,
+// returning the relay address announced by the upstream proxy.
+func associateHandshake(conn net.Conn) (*net.UDPAddr, error) {
+	if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+		return nil, err
+	}
+
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		return nil, err
+	}
+	if method[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported upstream SOCKS version: %d", method[0])
+	}
+	if authMethod(method[1]) != noAuth {
+		return nil, errNoSupportedAuth
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, byte(AssociateCommand), 0}); err != nil {
+		return nil, err
+	}
+	if err := writeAddr(conn, nil, nil); err != nil {
+		return nil, err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	if reply(header[1]) != successReply {
+		return nil, fmt.Errorf("upstream associate failed: %v", reply(header[1]))
+	}
+
+	bind, err := readAddr(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", bind.Address())
+}
+
+// embedHandleUpstreamAssociate relays datagrams between the client and the upstream
+// relay. Both sides use the SOCKS UDP request header, so packets are validated and
+// forwarded as-is.
+func (s *Server) embedHandleUpstreamAssociate(req *request, udpConn net.PacketConn, upstream *upstreamRelay, stats *udpStats) error {
+	defer func() {
+		_ = udpConn.Close()
+	}()
+
+	// the association ends when either control connection goes away
+	for _, ctrl := range []net.Conn{req.Conn, upstream.conn} {
+		go func(ctrl net.Conn) {
+			var buf [1]byte
+			for {
+				_, err := ctrl.Read(buf[:])
+				if err != nil {
+					_ = udpConn.Close()
+					break
+				}
+			}
+		}(ctrl)
+	}
+
+	var (
+		sourceAddr net.Addr
+		wantSource string
+		wantRelay  = upstream.addr.String()
+		buf        = make([]byte, s.udpPacketSize())
+	)
+
+	for {
+		n, addr, err := udpConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		if n < 3 {
+			continue
+		}
+		if _, err := readAddr(bytes.NewBuffer(buf[3:n]), nil); err != nil {
+			s.Logger.Debug(err)
+			continue
+		}
+
+		gotAddr := addr.String()
+		if gotAddr == wantRelay {
+			if sourceAddr == nil {
+				continue
+			}
+			_, err = udpConn.WriteTo(buf[:n], sourceAddr)
+			if err != nil {
+				return err
+			}
+			stats.down(n)
+			continue
+		}
+
+		if sourceAddr == nil {
+			if !declaredSource(req.DestinationAddr, addr) {
+				s.Logger.Debug(fmt.Errorf("drop datagram from undeclared source %s", addr))
+				continue
+			}
+			sourceAddr = addr
+			wantSource = gotAddr
+		}
+		if gotAddr != wantSource {
+			continue
+		}
+		_, err = udpConn.WriteTo(buf[:n], upstream.addr)
+		if err != nil {
+			return err
+		}
+		stats.up(n)
+	}
+}
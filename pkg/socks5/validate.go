@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"slices"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Validate checks the assembled configuration of the server without serving,
+// returning every problem found joined in one error, or nil.
+func (s *Server) Validate() error {
+	c := statute.NewConfigCheck("socks5")
+	c.CheckAddr("Bind", s.Bind)
+	c.Check(s.ProxyDial != nil, "ProxyDial is nil")
+	c.Check(s.Logger != nil, "Logger is nil")
+	c.Check(s.Metrics != nil, "Metrics is nil")
+	c.Check(s.Context != nil, "Context is nil")
+	c.CheckDSCP(s.DSCP)
+
+	c.Check(len(s.AllowedCommands) > 0, "AllowedCommands is empty, every request would be refused")
+	associate := false
+	for _, cmd := range s.AllowedCommands {
+		c.Check(cmd == ConnectCommand || cmd == AssociateCommand, "AllowedCommands: unsupported %v", cmd)
+		associate = associate || cmd == AssociateCommand
+	}
+	if associate {
+		c.Check(s.ProxyListenPacket != nil, "ProxyListenPacket is nil while ASSOCIATE is allowed")
+		c.Check(s.PacketForwardAddress != nil, "PacketForwardAddress is nil while ASSOCIATE is allowed")
+	} else {
+		c.Check(s.UserAssociateHandle == nil, "UserAssociateHandle is set but ASSOCIATE is not allowed")
+		c.Check(s.UpstreamAssociate == "", "UpstreamAssociate is set but ASSOCIATE is not allowed")
+		c.Check(s.DatagramHandler == nil, "DatagramHandler is set but ASSOCIATE is not allowed")
+	}
+	if s.UpstreamAssociate != "" {
+		c.CheckAddr("UpstreamAssociate", s.UpstreamAssociate)
+		c.Check(s.UserAssociateHandle == nil, "UpstreamAssociate is ignored when UserAssociateHandle is set")
+		c.Check(s.DatagramHandler == nil, "DatagramHandler doesn't see datagrams relayed through UpstreamAssociate")
+	}
+	c.Check(s.MaxUDPPacketSize >= minUdpPacket && s.MaxUDPPacketSize <= maxUdpPacket,
+		"MaxUDPPacketSize %d is outside [%d, %d]", s.MaxUDPPacketSize, minUdpPacket, maxUdpPacket)
+	c.Check(s.MaxUDPSessions >= 0, "MaxUDPSessions is negative")
+	c.Check(s.UDPLogInterval >= 0, "UDPLogInterval is negative")
+
+	c.Check(len(s.Authenticators) > 0, "Authenticators is empty, every client would be refused")
+	methods := make(map[byte]bool, len(s.Authenticators))
+	for _, a := range s.Authenticators {
+		if a == nil {
+			c.Check(false, "Authenticators contains nil")
+			continue
+		}
+		method := a.Method()
+		c.Check(!methods[method], "Authenticators lists %v more than once", authMethod(method))
+		c.Check(authMethod(method) != noAcceptable, "Authenticators lists the reserved method 0xff")
+		methods[method] = true
+	}
+
+	// checked in order, so the problems are reported the same way every time
+	addrTypes := make([]byte, 0, len(s.AddressTypes))
+	for addrType := range s.AddressTypes {
+		addrTypes = append(addrTypes, addrType)
+	}
+	slices.Sort(addrTypes)
+	for _, addrType := range addrTypes {
+		custom := s.AddressTypes[addrType]
+		c.Check(addrType != 0 && addrType != ipv4Address && addrType != fqdnAddress && addrType != ipv6Address,
+			"AddressTypes: %#x is a standard address type", addrType)
+		c.Check(custom.Read != nil, "AddressTypes: %#x has no reader", addrType)
+	}
+
+	c.Check(s.ReadBufferSize >= 0, "ReadBufferSize is negative")
+	c.Check(s.WriteBufferSize >= 0, "WriteBufferSize is negative")
+	c.Check(s.SocketRecvBuffer >= 0, "SocketRecvBuffer is negative")
+	c.Check(s.SocketSendBuffer >= 0, "SocketSendBuffer is negative")
+	c.Check(s.TunnelKeepalive >= 0, "TunnelKeepalive is negative")
+	c.Check(s.MaxConnLifetime >= 0, "MaxConnLifetime is negative")
+	c.Check(s.ConnectTimeout >= 0, "ConnectTimeout is negative")
+	return c.Err()
+}
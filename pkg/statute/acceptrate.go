@@ -0,0 +1,81 @@
+package statute
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AcceptRateLimiter paces the connections accepted by a server with a token
+// bucket refilled at a fixed rate, smoothing bursts of new connections.
+type AcceptRateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	reject bool
+}
+
+// NewAcceptRateLimiter returns a limiter admitting perSec connections per
+// second on average and up to burst at once, at least one. Over the rate,
+// connections wait for their turn, or are rejected if reject is set. It
+// returns nil, which admits every connection, if perSec is not positive.
+func NewAcceptRateLimiter(perSec, burst int, reject bool) *AcceptRateLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &AcceptRateLimiter{
+		rate:   float64(perSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		reject: reject,
+	}
+}
+
+// Admit takes a token for an accepted connection, waiting for one if needed.
+// It reports false if the connection should be rejected: when the limiter
+// rejects over the rate and no token is left, or when ctx ends while
+// waiting. Accept loops calling it before serving each connection hold
+// further accepts back while waiting.
+func (l *AcceptRateLimiter) Admit(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+
+	for {
+		wait := l.take()
+		if wait == 0 {
+			return true
+		}
+		if l.reject {
+			return false
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// take takes a token if one is available, returning 0, or else the time
+// until the next one.
+func (l *AcceptRateLimiter) take() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return max(time.Duration((1-l.tokens)/l.rate*float64(time.Second)), time.Nanosecond)
+}
@@ -0,0 +1,59 @@
+package statute
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcceptRateLimiterReject(t *testing.T) {
+	l := NewAcceptRateLimiter(10, 2, true)
+	for i := 0; i < 2; i++ {
+		if !l.Admit(context.Background()) {
+			t.Fatalf("connection %d within the burst rejected", i)
+		}
+	}
+	start := time.Now()
+	if l.Admit(context.Background()) {
+		t.Fatal("connection over the burst admitted")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("rejection took %v, want no wait", elapsed)
+	}
+
+	// the bucket refills at the rate
+	time.Sleep(150 * time.Millisecond)
+	if !l.Admit(context.Background()) {
+		t.Fatal("connection rejected once a token was refilled")
+	}
+}
+
+func TestAcceptRateLimiterWait(t *testing.T) {
+	l := NewAcceptRateLimiter(10, 1, false)
+	if !l.Admit(context.Background()) {
+		t.Fatal("first connection rejected")
+	}
+	start := time.Now()
+	if !l.Admit(context.Background()) {
+		t.Fatal("connection over the rate rejected while waiting")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("connection over the rate admitted after %v, want about 100ms", elapsed)
+	}
+
+	// a waiting connection gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if l.Admit(ctx) {
+		t.Fatal("connection admitted after its context ended")
+	}
+}
+
+func TestAcceptRateLimiterNil(t *testing.T) {
+	l := NewAcceptRateLimiter(0, 0, true)
+	for i := 0; i < 100; i++ {
+		if !l.Admit(context.Background()) {
+			t.Fatal("unlimited limiter rejected a connection")
+		}
+	}
+}
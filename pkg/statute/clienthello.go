@@ -0,0 +1,286 @@
+package statute
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrNotClientHello is returned when the peeked bytes are not a TLS ClientHello.
+var ErrNotClientHello = errors.New("not a TLS client hello")
+
+const (
+	tlsRecordHandshake      = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsRecordHeaderLen      = 5
+	tlsMaxRecordLen         = 1 << 14
+
+	extServerName     = 0
+	extSupportedCurve = 10
+	extPointFormats   = 11
+	extALPN           = 16
+)
+
+// ClientHello holds the metadata parsed from a TLS ClientHello message.
+type ClientHello struct {
+	// ServerName is the SNI host name, empty if the client sent none
+	ServerName string
+	// Version is the legacy version field of the hello
+	Version uint16
+	// CipherSuites in the order offered by the client
+	CipherSuites []uint16
+	// Extensions types in the order sent by the client
+	Extensions []uint16
+	// SupportedCurves from the supported_groups extension
+	SupportedCurves []uint16
+	// SupportedPoints from the ec_point_formats extension
+	SupportedPoints []uint8
+	// ALPNProtocols offered by the client
+	ALPNProtocols []string
+}
+
+// JA3 returns the JA3 fingerprint string of the hello. GREASE values are
+// left out as the JA3 specification requires.
+func (h *ClientHello) JA3() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	b.WriteByte(',')
+	writeJA3List(&b, h.CipherSuites)
+	b.WriteByte(',')
+	writeJA3List(&b, h.Extensions)
+	b.WriteByte(',')
+	writeJA3List(&b, h.SupportedCurves)
+	b.WriteByte(',')
+	for i, p := range h.SupportedPoints {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(p)))
+	}
+	return b.String()
+}
+
+// JA3Hash returns the hex encoded MD5 digest of the JA3 string.
+func (h *ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJA3List(b *strings.Builder, values []uint16) {
+	first := true
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		first = false
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ClientHelloMaxSize is the most bytes PeekClientHello peeks, a TLS record
+// of the largest size, which the buffer of its reader must hold.
+const ClientHelloMaxSize = tlsRecordHeaderLen + tlsMaxRecordLen
+
+// PeekClientHello parses the TLS ClientHello at the head of reader without
+// consuming it, so the bytes can still be relayed to the destination. Hellos
+// larger than the buffer of reader fail with bufio.ErrBufferFull, see
+// ClientHelloMaxSize.
+func PeekClientHello(reader *bufio.Reader) (*ClientHello, error) {
+	header, err := reader.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != tlsRecordHandshake {
+		return nil, ErrNotClientHello
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > tlsMaxRecordLen {
+		return nil, ErrNotClientHello
+	}
+	record, err := reader.Peek(tlsRecordHeaderLen + length)
+	if err != nil {
+		return nil, err
+	}
+	return ParseClientHello(record[tlsRecordHeaderLen:])
+}
+
+// ParseClientHello parses a handshake message holding a ClientHello. The
+// whole message must be present in msg.
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	s := helloReader(msg)
+	typ, ok := s.uint8()
+	if !ok || typ != tlsHandshakeClientHello {
+		return nil, ErrNotClientHello
+	}
+	body, ok := s.bytes(24)
+	if !ok {
+		return nil, ErrNotClientHello
+	}
+	s = body
+
+	h := &ClientHello{}
+	var sessionID, suites, compression helloReader
+	if h.Version, ok = s.uint16(); !ok {
+		return nil, ErrNotClientHello
+	}
+	if _, ok = s.read(32); !ok { // random
+		return nil, ErrNotClientHello
+	}
+	if sessionID, ok = s.bytes(8); !ok || len(sessionID) > 32 {
+		return nil, ErrNotClientHello
+	}
+	if suites, ok = s.bytes(16); !ok || len(suites)%2 != 0 {
+		return nil, ErrNotClientHello
+	}
+	for len(suites) > 0 {
+		v, _ := suites.uint16()
+		h.CipherSuites = append(h.CipherSuites, v)
+	}
+	if compression, ok = s.bytes(8); !ok || len(compression) == 0 {
+		return nil, ErrNotClientHello
+	}
+	if len(s) == 0 {
+		// extensions are optional
+		return h, nil
+	}
+
+	extensions, ok := s.bytes(16)
+	if !ok {
+		return nil, ErrNotClientHello
+	}
+	for len(extensions) > 0 {
+		typ, ok := extensions.uint16()
+		if !ok {
+			return nil, ErrNotClientHello
+		}
+		data, ok := extensions.bytes(16)
+		if !ok {
+			return nil, ErrNotClientHello
+		}
+		h.Extensions = append(h.Extensions, typ)
+		if !h.parseExtension(typ, data) {
+			return nil, ErrNotClientHello
+		}
+	}
+	return h, nil
+}
+
+func (h *ClientHello) parseExtension(typ uint16, data helloReader) bool {
+	switch typ {
+	case extServerName:
+		names, ok := data.bytes(16)
+		if !ok {
+			return false
+		}
+		for len(names) > 0 {
+			nameType, ok := names.uint8()
+			if !ok {
+				return false
+			}
+			name, ok := names.bytes(16)
+			if !ok {
+				return false
+			}
+			if nameType == 0 && h.ServerName == "" {
+				h.ServerName = string(name)
+			}
+		}
+	case extSupportedCurve:
+		curves, ok := data.bytes(16)
+		if !ok || len(curves)%2 != 0 {
+			return false
+		}
+		for len(curves) > 0 {
+			v, _ := curves.uint16()
+			h.SupportedCurves = append(h.SupportedCurves, v)
+		}
+	case extPointFormats:
+		points, ok := data.bytes(8)
+		if !ok {
+			return false
+		}
+		h.SupportedPoints = append(h.SupportedPoints, points...)
+	case extALPN:
+		protocols, ok := data.bytes(16)
+		if !ok {
+			return false
+		}
+		for len(protocols) > 0 {
+			proto, ok := protocols.bytes(8)
+			if !ok {
+				return false
+			}
+			h.ALPNProtocols = append(h.ALPNProtocols, string(proto))
+		}
+	}
+	return true
+}
+
+// helloReader is a cursor over a handshake message.
+type helloReader []byte
+
+func (s *helloReader) read(n int) ([]byte, bool) {
+	if len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *helloReader) uint8() (uint8, bool) {
+	v, ok := s.read(1)
+	if !ok {
+		return 0, false
+	}
+	return v[0], true
+}
+
+func (s *helloReader) uint16() (uint16, bool) {
+	v, ok := s.read(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(v), true
+}
+
+// bytes reads a vector prefixed by a length of the given bit size.
+func (s *helloReader) bytes(bits int) (helloReader, bool) {
+	prefix, ok := s.read(bits / 8)
+	if !ok {
+		return nil, false
+	}
+	var n int
+	for _, b := range prefix {
+		n = n<<8 | int(b)
+	}
+	v, ok := s.read(n)
+	return v, ok
+}
+
+type clientHelloKey struct{}
+
+// ContextWithClientHello returns a copy of ctx carrying hello.
+func ContextWithClientHello(ctx context.Context, hello *ClientHello) context.Context {
+	return context.WithValue(ctx, clientHelloKey{}, hello)
+}
+
+// ClientHelloFromContext returns the ClientHello stored in ctx by a TLS
+// passthrough connection, if any.
+func ClientHelloFromContext(ctx context.Context) (*ClientHello, bool) {
+	hello, ok := ctx.Value(clientHelloKey{}).(*ClientHello)
+	return hello, ok
+}
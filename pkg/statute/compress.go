@@ -0,0 +1,121 @@
+package statute
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Compression is an algorithm compressing the streams of tunnels.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionDeflate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionDeflate:
+		return "deflate"
+	default:
+		return "compression " + strconv.Itoa(int(c))
+	}
+}
+
+// compressWriter is the writer of gzip and flate streams.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressConn wraps conn so that data written to it is compressed with algo,
+// flushed with every write so interactive traffic isn't held back, and data
+// read from it is decompressed. Both ends of the connection must be wrapped
+// with the same algorithm. CompressionNone and unknown algorithms return conn.
+func CompressConn(conn net.Conn, algo Compression) net.Conn {
+	var w compressWriter
+	switch algo {
+	case CompressionGzip:
+		w = gzip.NewWriter(conn)
+	case CompressionDeflate:
+		w, _ = flate.NewWriter(conn, flate.DefaultCompression)
+	default:
+		return conn
+	}
+	return &compressConn{Conn: conn, algo: algo, w: w}
+}
+
+type compressConn struct {
+	net.Conn
+	algo Compression
+
+	wmu sync.Mutex
+	w   compressWriter
+
+	// the reader is created on the first read, as gzip reads its header
+	// right away
+	rOnce sync.Once
+	r     io.Reader
+	rErr  error
+}
+
+func (c *compressConn) Read(b []byte) (int, error) {
+	c.rOnce.Do(func() {
+		switch c.algo {
+		case CompressionGzip:
+			c.r, c.rErr = gzip.NewReader(c.Conn)
+		case CompressionDeflate:
+			c.r = flate.NewReader(c.Conn)
+		}
+	})
+	if c.rErr != nil {
+		return 0, c.rErr
+	}
+	return c.r.Read(b)
+}
+
+func (c *compressConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// Close ends the compressed stream before closing the connection.
+func (c *compressConn) Close() error {
+	c.wmu.Lock()
+	_ = c.w.Close()
+	c.wmu.Unlock()
+	return c.Conn.Close()
+}
+
+// CloseWrite ends the compressed stream before half-closing the connection,
+// if it supports it.
+func (c *compressConn) CloseWrite() error {
+	c.wmu.Lock()
+	err := c.w.Close()
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	if cw, ok := findConn[closeWriter](c.Conn); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *compressConn) NetConn() net.Conn {
+	return c.Conn
+}
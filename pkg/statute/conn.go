@@ -0,0 +1,218 @@
+package statute
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BufferedConn is a net.Conn whose reads are served from a bufio.Reader, so
+// bytes already peeked from the connection are not lost when it is handed on.
+type BufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewBufferedConn creates a BufferedConn reading conn through reader.
+func NewBufferedConn(conn net.Conn, reader *bufio.Reader) *BufferedConn {
+	return &BufferedConn{Conn: conn, reader: reader}
+}
+
+// Read reads data from the buffered reader.
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// NetConn returns the wrapped connection.
+func (c *BufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CountingConn wraps a net.Conn and counts the bytes read from and written to it.
+// The counters are safe to read while the connection is in use.
+type CountingConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+// NewCountingConn creates a new CountingConn.
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+// Read reads data from the connection and counts the bytes read.
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// Write writes data to the connection and counts the bytes written.
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *CountingConn) BytesRead() int64 {
+	return c.read.Load()
+}
+
+// BytesWritten returns the number of bytes written to the connection.
+func (c *CountingConn) BytesWritten() int64 {
+	return c.written.Load()
+}
+
+// NetConn returns the wrapped connection.
+func (c *CountingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// FlushConn flushes the first connection that buffers writes in the chain of
+// wrappers around conn. Wrappers are unwrapped through a NetConn method, as
+// on *tls.Conn. Chains without a Flush method are left untouched.
+func FlushConn(conn net.Conn) error {
+	for conn != nil {
+		if f, ok := conn.(interface{ Flush() error }); ok {
+			return f.Flush()
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = u.NetConn()
+	}
+	return nil
+}
+
+// firstByteConn wraps a net.Conn and reports the time until its first successful read.
+type firstByteConn struct {
+	net.Conn
+	start       time.Time
+	once        sync.Once
+	onFirstByte func(time.Duration)
+}
+
+// NewFirstByteConn returns a net.Conn that calls onFirstByte with the time elapsed
+// since the wrapper was created once the first byte has been read from conn.
+func NewFirstByteConn(conn net.Conn, onFirstByte func(time.Duration)) net.Conn {
+	return &firstByteConn{
+		Conn:        conn,
+		start:       time.Now(),
+		onFirstByte: onFirstByte,
+	}
+}
+
+// Read reads data from the connection and records the first successful read.
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.once.Do(func() {
+			c.onFirstByte(time.Since(c.start))
+		})
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c *firstByteConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ConnMiddleware wraps an accepted connection before it is served.
+type ConnMiddleware func(net.Conn) net.Conn
+
+// ApplyConnMiddleware wraps conn with each middleware in order, so the last
+// middleware ends up outermost.
+func ApplyConnMiddleware(conn net.Conn, middleware []ConnMiddleware) net.Conn {
+	for _, m := range middleware {
+		conn = m(conn)
+	}
+	return conn
+}
+
+// LimitLifetime closes conn once lifetime has passed, whether or not it is
+// still transferring data. The returned function cancels the limit. A
+// lifetime of zero or less sets no limit.
+func LimitLifetime(conn net.Conn, lifetime time.Duration) (stop func()) {
+	if lifetime <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(lifetime, func() {
+		_ = conn.Close()
+	})
+	return func() {
+		timer.Stop()
+	}
+}
+
+// DeadlineConn wraps a net.Conn and pushes its read and write deadlines
+// forward by a fixed timeout after every successful read or write. A
+// connection that makes no progress for the timeout in either direction
+// fails its pending operations.
+type DeadlineConn struct {
+	net.Conn
+	timeout atomic.Int64
+}
+
+// NewDeadlineConn creates a new DeadlineConn and arms its first deadline.
+func NewDeadlineConn(conn net.Conn, timeout time.Duration) *DeadlineConn {
+	c := &DeadlineConn{Conn: conn}
+	c.timeout.Store(int64(timeout))
+	c.extend()
+	return c
+}
+
+// DeadlineMiddleware returns a ConnMiddleware wrapping connections in a
+// DeadlineConn with the given timeout.
+func DeadlineMiddleware(timeout time.Duration) ConnMiddleware {
+	return func(conn net.Conn) net.Conn {
+		return NewDeadlineConn(conn, timeout)
+	}
+}
+
+// Read reads data from the connection and extends the deadline on progress.
+func (c *DeadlineConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+// Write writes data to the connection and extends the deadline on progress.
+func (c *DeadlineConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c *DeadlineConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Disable clears the deadline and stops extending it, for connections that
+// may legitimately stay idle.
+func (c *DeadlineConn) Disable() {
+	c.timeout.Store(0)
+	_ = c.Conn.SetDeadline(time.Time{})
+}
+
+func (c *DeadlineConn) extend() {
+	timeout := time.Duration(c.timeout.Load())
+	if timeout <= 0 {
+		return
+	}
+	_ = c.Conn.SetDeadline(time.Now().Add(timeout))
+	if c.timeout.Load() <= 0 {
+		// Disable ran concurrently, don't leave the deadline behind
+		_ = c.Conn.SetDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,49 @@
+package statute
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCountingConnTunnel(t *testing.T) {
+	client, source := tcpPair(t)
+	destination, origin := tcpPair(t)
+	counted := NewCountingConn(source)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Tunnel(context.Background(), counted, destination, make([]byte, 1024), make([]byte, 1024))
+	}()
+
+	up := bytes.Repeat([]byte("u"), 10000)
+	down := bytes.Repeat([]byte("d"), 25000)
+	go func() {
+		_, _ = client.Write(up)
+	}()
+	if _, err := io.ReadFull(origin, make([]byte, len(up))); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = origin.Write(down)
+	}()
+	if _, err := io.ReadFull(client, make([]byte, len(down))); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.Close()
+	_ = origin.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel didn't return")
+	}
+	if got := counted.BytesRead(); got != int64(len(up)) {
+		t.Errorf("BytesRead = %d, want %d", got, len(up))
+	}
+	if got := counted.BytesWritten(); got != int64(len(down)) {
+		t.Errorf("BytesWritten = %d, want %d", got, len(down))
+	}
+}
@@ -0,0 +1,234 @@
+package statute
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnSummary describes a completed client connection.
+type ConnSummary struct {
+	Start       time.Time
+	Duration    time.Duration
+	Protocol    Protocol
+	ClientAddr  string
+	Destination string
+	// ClientHost is the reverse DNS name of the client IP, empty if reverse
+	// lookups are disabled or the name wasn't known by the end of the
+	// connection
+	ClientHost string
+	// AuthMethod is the authentication method negotiated with the client,
+	// empty for protocols without negotiation
+	AuthMethod string
+	// UserHandler is set if the request was served by a user-supplied handler
+	// rather than the embedded one
+	UserHandler bool
+	// BytesUp is the number of bytes read from the client
+	BytesUp int64
+	// BytesDown is the number of bytes written to the client
+	BytesDown int64
+	// DialLatency is the time it took to dial the destination, zero if no
+	// destination was dialed
+	DialLatency time.Duration
+	// TTFB is the time from the end of the dial to the first byte received
+	// from the destination, zero if none was received
+	TTFB time.Duration
+	// Err is the error the connection ended with, nil if it ended cleanly
+	Err error
+}
+
+// ConnLogFunc receives the summary of every completed connection.
+type ConnLogFunc func(ConnSummary)
+
+// ConnTracker assembles the ConnSummary of a connection while it is served.
+// Its setters do nothing on a nil tracker, so servers can call them whether
+// or not connection logging is enabled.
+type ConnTracker struct {
+	conn    *CountingConn
+	mu      sync.Mutex // guards summary, read by StatsCollector.Connections
+	summary ConnSummary
+	stats   *StatsCollector
+	events  *EventSink
+	rdns    *ReverseDNS
+}
+
+// NewConnTracker starts tracking conn, which arrived on protocol.
+func NewConnTracker(conn net.Conn, protocol Protocol) *ConnTracker {
+	return &ConnTracker{
+		conn: NewCountingConn(conn),
+		summary: ConnSummary{
+			Start:      time.Now(),
+			Protocol:   protocol,
+			ClientAddr: conn.RemoteAddr().String(),
+		},
+	}
+}
+
+// trackedConn is the connection served in place of a tracked one. It lets the
+// tracker be found again from the connection with ConnTrackerOf.
+type trackedConn struct {
+	*CountingConn
+	tracker *ConnTracker
+}
+
+// NetConn returns the wrapped connection.
+func (c *trackedConn) NetConn() net.Conn {
+	return c.CountingConn
+}
+
+// Conn returns the connection to serve in place of the tracked one, so that
+// the bytes exchanged with the client are counted.
+func (t *ConnTracker) Conn() net.Conn {
+	return &trackedConn{CountingConn: t.conn, tracker: t}
+}
+
+// ConnTrackerOf returns the tracker of conn, found in the chain of wrappers
+// around it, or nil if the connection isn't tracked.
+func ConnTrackerOf(conn net.Conn) *ConnTracker {
+	if tc, ok := findConn[*trackedConn](conn); ok {
+		return tc.tracker
+	}
+	return nil
+}
+
+// SetProtocol records the protocol once it is known more precisely.
+func (t *ConnTracker) SetProtocol(protocol Protocol) {
+	if t != nil {
+		t.mu.Lock()
+		t.summary.Protocol = protocol
+		t.mu.Unlock()
+	}
+}
+
+// SetDestination records the destination requested by the client.
+func (t *ConnTracker) SetDestination(destination string) {
+	if t != nil {
+		t.mu.Lock()
+		t.summary.Destination = destination
+		t.mu.Unlock()
+	}
+}
+
+// SetAuthMethod records the authentication method negotiated with the client.
+func (t *ConnTracker) SetAuthMethod(method string) {
+	if t != nil {
+		t.mu.Lock()
+		t.summary.AuthMethod = method
+		t.mu.Unlock()
+	}
+}
+
+// SetUserHandler records whether the request is served by a user-supplied
+// handler.
+func (t *ConnTracker) SetUserHandler(user bool) {
+	if t != nil {
+		t.mu.Lock()
+		t.summary.UserHandler = user
+		t.mu.Unlock()
+	}
+}
+
+// SetDialLatency records the time it took to dial the destination.
+func (t *ConnTracker) SetDialLatency(latency time.Duration) {
+	if t != nil {
+		t.mu.Lock()
+		t.summary.DialLatency = latency
+		t.mu.Unlock()
+	}
+}
+
+// SetTTFB records the time to the first byte received from the destination.
+func (t *ConnTracker) SetTTFB(ttfb time.Duration) {
+	if t != nil {
+		t.mu.Lock()
+		t.summary.TTFB = ttfb
+		t.mu.Unlock()
+	}
+}
+
+// ReverseLookup starts looking up the name of the client IP with rdns, to be
+// recorded in the summary if known by the time the connection is done. A nil
+// rdns looks up nothing.
+func (t *ConnTracker) ReverseLookup(rdns *ReverseDNS) {
+	if rdns == nil {
+		return
+	}
+	t.rdns = rdns
+	rdns.Start(t.clientIP())
+}
+
+// clientIP returns the IP part of the client address.
+func (t *ConnTracker) clientIP() string {
+	host, _, err := net.SplitHostPort(t.summary.ClientAddr)
+	if err != nil {
+		return t.summary.ClientAddr
+	}
+	return host
+}
+
+// Notify makes the tracker publish the events of the connection to events,
+// starting with its open event. A nil sink publishes nothing.
+func (t *ConnTracker) Notify(events *EventSink) {
+	if events == nil {
+		return
+	}
+	t.events = events
+	events.Publish(t.event(EventConnOpen, t.summary.Start))
+}
+
+// Done completes the summary with the outcome err and passes it to log, if
+// not nil, to the StatsCollector tracking the connection and, as error and
+// close events, to the EventSink set by Notify.
+func (t *ConnTracker) Done(err error, log ConnLogFunc) {
+	now := time.Now()
+	t.mu.Lock()
+	t.summary.Duration = now.Sub(t.summary.Start)
+	t.summary.BytesUp = t.conn.BytesRead()
+	t.summary.BytesDown = t.conn.BytesWritten()
+	t.summary.Err = err
+	if t.rdns != nil {
+		t.summary.ClientHost = t.rdns.Name(t.clientIP())
+	}
+	t.mu.Unlock()
+	if t.stats != nil {
+		t.stats.done(t, t.summary)
+	}
+	if log != nil {
+		log(t.summary)
+	}
+	if t.events != nil {
+		if err != nil {
+			t.events.Publish(t.event(EventError, now))
+		}
+		t.events.Publish(t.event(EventConnClose, now))
+	}
+}
+
+// info returns the details of the connection so far.
+func (t *ConnTracker) info() ConnInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ConnInfo{
+		Protocol:    t.summary.Protocol,
+		ClientAddr:  t.summary.ClientAddr,
+		Destination: t.summary.Destination,
+		Start:       t.summary.Start,
+		BytesUp:     t.conn.BytesRead(),
+		BytesDown:   t.conn.BytesWritten(),
+	}
+}
+
+// event returns an event of type typ about the tracked connection.
+func (t *ConnTracker) event(typ EventType, at time.Time) Event {
+	return Event{
+		Type:        typ,
+		Time:        at,
+		Protocol:    t.summary.Protocol,
+		ClientAddr:  t.summary.ClientAddr,
+		Destination: t.summary.Destination,
+		Duration:    t.summary.Duration,
+		BytesUp:     t.summary.BytesUp,
+		BytesDown:   t.summary.BytesDown,
+		Err:         t.summary.Err,
+	}
+}
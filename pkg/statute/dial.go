@@ -0,0 +1,18 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// TimeoutDial wraps dial so that establishing a connection fails after
+// timeout, even when the caller's context has no deadline. The timeout only
+// bounds the dial, not the lifetime of the returned connection.
+func TimeoutDial(dial ProxyDialFunc, timeout time.Duration) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, address)
+	}
+}
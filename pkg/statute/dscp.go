@@ -0,0 +1,31 @@
+package statute
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// DSCPDial wraps dial so that every established connection is marked with the
+// given DSCP value.
+func DSCPDial(dial ProxyDialFunc, dscp int) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := SetDSCP(conn, dscp); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// checkDSCP validates that dscp fits in the six DSCP bits.
+func checkDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP value %d", dscp)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package statute
+
+import (
+	"net"
+	"syscall"
+)
+
+// SetDSCP marks the traffic sent on conn with the given DSCP value by setting
+// IP_TOS, or IPV6_TCLASS for IPv6 sockets. Connections that don't expose a
+// socket are left untouched.
+func SetDSCP(conn net.Conn, dscp int) error {
+	if err := checkDSCP(dscp); err != nil {
+		return err
+	}
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	level, option := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, option, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
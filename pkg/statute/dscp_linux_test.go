@@ -0,0 +1,38 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestDSCPDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var d net.Dialer
+	dial := DSCPDial(d.DialContext, 46)
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the DSCP value takes the upper six bits of the TOS byte
+	if got := sockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS); got != 46<<2 {
+		t.Errorf("IP_TOS = %#x, want %#x", got, 46<<2)
+	}
+}
+
+func TestSetDSCPInvalid(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := SetDSCP(client, 64); err == nil {
+		t.Error("SetDSCP accepted 64")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package statute
+
+import "net"
+
+// SetDSCP is a no-op on platforms without DSCP support.
+func SetDSCP(_ net.Conn, dscp int) error {
+	return checkDSCP(dscp)
+}
@@ -0,0 +1,65 @@
+package statute
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	EventConnOpen  EventType = "conn_open"  // a connection was accepted
+	EventConnClose EventType = "conn_close" // a connection was closed
+	EventError     EventType = "error"      // a connection ended with an error
+)
+
+// Event describes something that happened to a client connection.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	Protocol   Protocol
+	ClientAddr string
+	// Destination is the destination requested by the client, once known
+	Destination string
+	// Duration, BytesUp and BytesDown are set on close and error events
+	Duration  time.Duration
+	BytesUp   int64
+	BytesDown int64
+	// Err is the error the connection ended with, set on error events
+	Err error
+}
+
+// EventSink publishes events on a channel. Sends never block: events that
+// don't fit in the channel are dropped and counted, so a slow consumer can't
+// stall the proxy.
+type EventSink struct {
+	ch      chan<- Event
+	dropped atomic.Int64
+}
+
+// NewEventSink creates an EventSink publishing on ch.
+func NewEventSink(ch chan<- Event) *EventSink {
+	return &EventSink{ch: ch}
+}
+
+// Publish sends event if the channel has room and counts it as dropped
+// otherwise. It does nothing on a nil sink.
+func (s *EventSink) Publish(event Event) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.ch <- event:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events dropped because the channel was full.
+func (s *EventSink) Dropped() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
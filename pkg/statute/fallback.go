@@ -0,0 +1,34 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// FallbackDial returns a ProxyDialFunc trying each of dials in order until one
+// connects, e.g. a direct dial, then an upstream SOCKS5 proxy, then an
+// upstream HTTP proxy. If all of them fail the errors are joined. No further
+// dial is attempted once ctx is done.
+func FallbackDial(dials ...ProxyDialFunc) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if len(dials) == 0 {
+			return nil, errors.New("fallback dial: no dial functions")
+		}
+
+		var errs []error
+		for i, dial := range dials {
+			if err := ctx.Err(); err != nil {
+				errs = append(errs, err)
+				break
+			}
+			conn, err := dial(ctx, network, address)
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, fmt.Errorf("dial %d: %w", i+1, err))
+		}
+		return nil, errors.Join(errs...)
+	}
+}
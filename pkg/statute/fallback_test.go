@@ -0,0 +1,51 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestFallbackDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errFirst := errors.New("first dial failed")
+	var calls []int
+	dial := FallbackDial(
+		func(context.Context, string, string) (net.Conn, error) {
+			calls = append(calls, 1)
+			return nil, errFirst
+		},
+		func(ctx context.Context, network, address string) (net.Conn, error) {
+			calls = append(calls, 2)
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+		func(context.Context, string, string) (net.Conn, error) {
+			calls = append(calls, 3)
+			return nil, errors.New("not reached")
+		},
+	)
+
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if len(calls) != 2 || calls[0] != 1 || calls[1] != 2 {
+		t.Errorf("dials tried %v, want [1 2]", calls)
+	}
+
+	// once every dial fails their errors are joined
+	failing := FallbackDial(func(context.Context, string, string) (net.Conn, error) {
+		return nil, errFirst
+	})
+	if _, err := failing(context.Background(), "tcp", ln.Addr().String()); !errors.Is(err, errFirst) {
+		t.Errorf("got %v, want the dial's error", err)
+	}
+}
@@ -0,0 +1,54 @@
+package statute
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrBlockedDestination is returned when a destination resolves to an address
+// the proxy is not allowed to connect to.
+var ErrBlockedDestination = errors.New("destination address is blocked")
+
+// IsPrivateIP reports whether ip is a loopback, link-local, private,
+// unique-local or unspecified address.
+func IsPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified()
+}
+
+// GuardDialedConn checks conn, a connection made by a hook rather than
+// through the proxy's dial chain, against the guards of the chain: if its
+// remote address is one of addrs, the proxy itself, or a private address
+// while blockPrivate is set, conn is closed and ErrBlockedDestination
+// returned.
+func GuardDialedConn(conn net.Conn, blockPrivate bool, addrs *ListenAddrs) (net.Conn, error) {
+	remote := conn.RemoteAddr()
+	if addrs.Contains(remote) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %s is the proxy's own listen address", ErrBlockedDestination, remote)
+	}
+	if tcp, ok := remote.(*net.TCPAddr); ok && blockPrivate && IsPrivateIP(tcp.IP) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: connected to %s", ErrBlockedDestination, tcp.IP)
+	}
+	return conn, nil
+}
+
+// BlockPrivateDial wraps dial so that the destination is resolved by the proxy
+// using resolver and connections to private ranges are refused with
+// ErrBlockedDestination. The resolved address is dialed directly so the name
+// can't be rebound to a private address between the check and the dial.
+func BlockPrivateDial(resolver Resolver, dial ProxyDialFunc) ProxyDialFunc {
+	return resolveDial(resolver, dial, func(host string, ips []net.IPAddr) error {
+		for _, ip := range ips {
+			if IsPrivateIP(ip.IP) {
+				return fmt.Errorf("%w: %s resolves to %s", ErrBlockedDestination, host, ip.IP)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,40 @@
+package statute
+
+import "errors"
+
+// HandlerError wraps an error returned by a user handler, so it can be told
+// apart from protocol and transport errors.
+type HandlerError struct {
+	Err error
+}
+
+// WrapHandlerError wraps err in a HandlerError, leaving nil as is.
+func WrapHandlerError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &HandlerError{Err: err}
+}
+
+func (e *HandlerError) Error() string {
+	return "user handler: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the user handler.
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// HandlerErrorFilter reports whether an error returned by a user handler is
+// expected, like a clean EOF, and should be left out of the logs.
+type HandlerErrorFilter func(err error) bool
+
+// LogConnError logs an error from serving a connection through logger,
+// unless it is a user handler error that filter suppresses.
+func LogConnError(logger Logger, err error, filter HandlerErrorFilter) {
+	var handlerErr *HandlerError
+	if filter != nil && errors.As(err, &handlerErr) && filter(handlerErr.Err) {
+		return
+	}
+	logger.Error(err)
+}
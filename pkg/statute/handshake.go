@@ -0,0 +1,93 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// HandshakeLimiter bounds how many connections are in their handshake phase
+// at once, from the first byte parsed until the tunnel starts or the
+// connection is rejected. Connections beyond the limit wait for a slot.
+type HandshakeLimiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+// NewHandshakeLimiter returns a limiter allowing n concurrent handshakes,
+// or nil, which doesn't limit, if n is not positive.
+func NewHandshakeLimiter(n int) *HandshakeLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &HandshakeLimiter{slots: make(chan struct{}, n)}
+}
+
+// Begin waits for a handshake slot for conn and returns conn wrapped so the
+// slot is freed by EndHandshake or when the connection is closed. A nil
+// limiter returns conn unchanged.
+func (l *HandshakeLimiter) Begin(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if l == nil {
+		return conn, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		l.waiting.Add(1)
+		defer l.waiting.Add(-1)
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &handshakeConn{Conn: conn, limiter: l}, nil
+}
+
+// Active returns the number of connections in their handshake phase.
+func (l *HandshakeLimiter) Active() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// Waiting returns the number of connections queued for a handshake slot.
+func (l *HandshakeLimiter) Waiting() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.waiting.Load())
+}
+
+// handshakeConn holds a handshake slot until the handshake ends.
+type handshakeConn struct {
+	net.Conn
+	limiter *HandshakeLimiter
+	once    sync.Once
+}
+
+func (c *handshakeConn) end() {
+	c.once.Do(func() {
+		<-c.limiter.slots
+	})
+}
+
+func (c *handshakeConn) Close() error {
+	c.end()
+	return c.Conn.Close()
+}
+
+func (c *handshakeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// EndHandshake frees the handshake slot held by conn, if any, once its
+// handshake is over. It is safe to call more than once.
+func EndHandshake(conn net.Conn) {
+	if hc, ok := findConn[*handshakeConn](conn); ok {
+		hc.end()
+	}
+}
@@ -0,0 +1,78 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	l := NewHandshakeLimiter(2)
+	var conns [3]net.Conn
+	for i := range conns {
+		conns[i], _ = net.Pipe()
+		defer conns[i].Close()
+	}
+
+	first, err := l.Begin(context.Background(), conns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.Begin(context.Background(), conns[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Active(); got != 2 {
+		t.Fatalf("Active = %d, want 2", got)
+	}
+
+	// a third handshake waits for a slot
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Begin(ctx, conns[2]); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Begin over the limit = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	began := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Begin(context.Background(), conns[2])
+		began <- conn
+	}()
+	for start := time.Now(); l.Waiting() != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("third handshake not queued")
+		}
+	}
+
+	// ending a handshake, even twice, frees exactly one slot
+	EndHandshake(first)
+	EndHandshake(first)
+	select {
+	case third := <-began:
+		defer third.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued handshake didn't start once a slot was freed")
+	}
+	if got := l.Active(); got != 2 {
+		t.Fatalf("Active = %d, want 2", got)
+	}
+
+	// closing a connection mid-handshake frees its slot
+	_ = second.Close()
+	if got := l.Active(); got != 1 {
+		t.Fatalf("Active after Close = %d, want 1", got)
+	}
+}
+
+func TestHandshakeLimiterNil(t *testing.T) {
+	var l *HandshakeLimiter
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	got, err := l.Begin(context.Background(), conn)
+	if err != nil || got != conn {
+		t.Fatalf("Begin = %v, %v, want the connection unchanged", got, err)
+	}
+	EndHandshake(got)
+}
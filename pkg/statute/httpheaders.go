@@ -0,0 +1,24 @@
+package statute
+
+import (
+	"context"
+	"net/http"
+)
+
+type httpHeadersKey struct{}
+
+// ContextWithHTTPHeaders returns a copy of ctx carrying header, the headers
+// of the HTTP request a destination is dialed for.
+func ContextWithHTTPHeaders(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, httpHeadersKey{}, header)
+}
+
+// HTTPHeadersFromContext returns the headers of the HTTP proxy request a
+// ProxyDialFunc is called for, if any, so that dialers can route on them.
+// The headers must not be modified. Pooled upstream connections are reused
+// for later requests to the same destination whatever their headers, unless
+// the HTTP server's UpstreamPoolKey tells them apart.
+func HTTPHeadersFromContext(ctx context.Context) (http.Header, bool) {
+	header, ok := ctx.Value(httpHeadersKey{}).(http.Header)
+	return header, ok
+}
@@ -0,0 +1,39 @@
+package statute
+
+import (
+	"net"
+	"strconv"
+)
+
+// RequestInterceptor inspects a proxy request after it has been parsed and
+// before its destination is dialed. It may rewrite the destination, or
+// return an error to refuse the request.
+type RequestInterceptor func(req *ProxyRequest) error
+
+// ApplyInterceptors runs interceptors on req in order, stopping at the first
+// error. After each interceptor Destination, DestHost and DestPort are made
+// consistent again; a changed Destination wins over changed DestHost/DestPort.
+func ApplyInterceptors(req *ProxyRequest, interceptors []RequestInterceptor) error {
+	for _, intercept := range interceptors {
+		destination, host, port := req.Destination, req.DestHost, req.DestPort
+		if err := intercept(req); err != nil {
+			return err
+		}
+
+		switch {
+		case req.Destination != destination:
+			host, portStr, err := net.SplitHostPort(req.Destination)
+			if err != nil {
+				return err
+			}
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				return err
+			}
+			req.DestHost, req.DestPort = host, int32(port)
+		case req.DestHost != host || req.DestPort != port:
+			req.Destination = net.JoinHostPort(req.DestHost, strconv.Itoa(int(req.DestPort)))
+		}
+	}
+	return nil
+}
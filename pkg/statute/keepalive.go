@@ -0,0 +1,49 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// keepAliveConn is implemented by connections supporting TCP keepalive, such as *net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// SetKeepAlive makes conn send TCP keepalive probes after interval of
+// idleness and every interval after that. Connections that don't support
+// keepalive are left untouched.
+func SetKeepAlive(conn net.Conn, interval time.Duration) error {
+	kc, ok := conn.(keepAliveConn)
+	if !ok {
+		return nil
+	}
+	if err := kc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	// depending on the Go release the period sets the idle time alone
+	if err := kc.SetKeepAlivePeriod(interval); err != nil {
+		return err
+	}
+	return setKeepAliveInterval(conn, interval)
+}
+
+// KeepAliveDial wraps dial so that every established connection sends TCP
+// keepalive probes at the given interval. Servers set it on both ends of
+// their tunnels so NAT devices and stateful firewalls don't drop flows that
+// stay idle longer than their timeouts.
+func KeepAliveDial(dial ProxyDialFunc, interval time.Duration) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := SetKeepAlive(conn, interval); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package statute
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// setKeepAliveInterval sets the time between keepalive probes of conn by
+// setting TCP_KEEPINTVL, rounded up to a second.
+func setKeepAliveInterval(conn net.Conn, interval time.Duration) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	secs := int((interval + time.Second - 1) / time.Second)
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,65 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt returns the integer socket option level/name of conn.
+func sockopt(t *testing.T, conn net.Conn, level, name int) int {
+	t.Helper()
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, name)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+func TestKeepAliveDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var d net.Dialer
+	d.KeepAlive = -1
+	dial := KeepAliveDial(d.DialContext, 7*time.Second)
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); got == 0 {
+		t.Error("keepalive not enabled")
+	}
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != 7 {
+		t.Errorf("TCP_KEEPIDLE = %d, want 7", got)
+	}
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); got != 7 {
+		t.Errorf("TCP_KEEPINTVL = %d, want 7", got)
+	}
+}
+
+func TestSetKeepAliveUnsupported(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := SetKeepAlive(client, time.Second); err != nil {
+		t.Fatalf("SetKeepAlive on a pipe = %v, want nil", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package statute
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAliveInterval leaves the probe interval to SetKeepAlivePeriod on
+// platforms other than Linux.
+func setKeepAliveInterval(_ net.Conn, _ time.Duration) error {
+	return nil
+}
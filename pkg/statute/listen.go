@@ -0,0 +1,20 @@
+package statute
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Listen announces on the local network address like net.Listen. When the
+// bind is refused for lack of privileges the error explains how to fix it;
+// the original error can still be matched with errors.Is.
+func Listen(network, address string) (net.Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil && (errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM)) {
+		return nil, fmt.Errorf("%w (binding to ports below 1024 requires running as root "+
+			"or granting the CAP_NET_BIND_SERVICE capability)", err)
+	}
+	return ln, err
+}
@@ -0,0 +1,30 @@
+package statute
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenPrivilegedPort(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root may bind privileged ports")
+	}
+	if start, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil && strings.TrimSpace(string(start)) == "0" {
+		t.Skip("privileged ports are open to everyone")
+	}
+
+	ln, err := Listen("tcp", "127.0.0.1:1")
+	if err == nil {
+		_ = ln.Close()
+		t.Skip("allowed to bind port 1")
+	}
+	if !errors.Is(err, syscall.EACCES) && !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("got %v, want a permission error", err)
+	}
+	if !strings.Contains(err.Error(), "CAP_NET_BIND_SERVICE") {
+		t.Errorf("error %q doesn't explain the fix", err)
+	}
+}
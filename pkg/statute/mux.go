@@ -0,0 +1,86 @@
+package statute
+
+import (
+	"net"
+	"sync"
+)
+
+// MuxSocketBuffer is the receive and send socket buffer size of both sides of
+// a tunnel carrying a multiplexed session.
+const MuxSocketBuffer = 1 << 20
+
+// MuxDetector reports whether first, the first bytes a client sends through a
+// tunnel, start a multiplexed session such as yamux or smux, for instance by
+// their magic prefix or by the ALPN protocol of a TLS ClientHello.
+type MuxDetector func(first []byte) bool
+
+// WatchMux wraps client, the client side of a tunnel to target, so that the
+// first bytes read from it are passed to detect. A multiplexed session may be
+// idle on the wire while logically active and carries several streams at
+// once, so once detected both connections are tuned for it: the idle
+// deadline of any DeadlineConn they are wrapped in is lifted and their socket
+// buffers are enlarged to MuxSocketBuffer. onMux, if not nil, is called
+// after. A nil detect returns client unchanged.
+func WatchMux(client, target net.Conn, detect MuxDetector, onMux func()) net.Conn {
+	if detect == nil {
+		return client
+	}
+	return &muxConn{
+		Conn: client,
+		first: func(b []byte) {
+			if !detect(b) {
+				return
+			}
+			for _, conn := range []net.Conn{client, target} {
+				if dc, ok := findConn[*DeadlineConn](conn); ok {
+					dc.Disable()
+				}
+				if tcp, ok := findConn[*net.TCPConn](conn); ok {
+					_ = SetSocketBuffers(tcp, MuxSocketBuffer, MuxSocketBuffer)
+				}
+			}
+			if onMux != nil {
+				onMux()
+			}
+		},
+	}
+}
+
+// muxConn passes the first bytes read from the connection to first.
+type muxConn struct {
+	net.Conn
+	once  sync.Once
+	first func(b []byte)
+}
+
+func (c *muxConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.once.Do(func() {
+			c.first(p[:n])
+		})
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c *muxConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// findConn returns the first connection of type T in the chain of wrappers
+// around conn, unwrapped through their NetConn method.
+func findConn[T net.Conn](conn net.Conn) (T, bool) {
+	for conn != nil {
+		if t, ok := conn.(T); ok {
+			return t, true
+		}
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = w.NetConn()
+	}
+	var zero T
+	return zero, false
+}
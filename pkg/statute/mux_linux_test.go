@@ -0,0 +1,62 @@
+package statute
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchMux(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	detect := func(first []byte) bool {
+		return bytes.HasPrefix(first, []byte("YAMUX"))
+	}
+
+	for _, tt := range []struct {
+		first string
+		mux   bool
+	}{
+		{"YAMUX session", true},
+		{"GET / HTTP/1.1", false},
+	} {
+		peer, accepted := tcpPair(t)
+		target, _ := tcpPair(t)
+		before := sockopt(t, accepted, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		detected := false
+		client := WatchMux(NewDeadlineConn(accepted, timeout), target, detect, func() { detected = true })
+
+		if _, err := peer.Write([]byte(tt.first)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Read(make([]byte, 64)); err != nil {
+			t.Fatal(err)
+		}
+		if detected != tt.mux {
+			t.Errorf("%q: detected %v, want %v", tt.first, detected, tt.mux)
+		}
+		// the socket buffers of both sides only grow for a multiplexed session
+		for _, conn := range []net.Conn{accepted, target} {
+			grown := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF) > before
+			if grown != tt.mux {
+				t.Errorf("%q: receive buffer of %v grown %v, want %v", tt.first, conn.LocalAddr(), grown, tt.mux)
+			}
+		}
+
+		// a multiplexed session may stay idle past the deadline
+		time.Sleep(2 * timeout)
+		_, err := peer.Write([]byte("more"))
+		if err == nil {
+			_, err = client.Read(make([]byte, 64))
+		}
+		if tt.mux && err != nil {
+			t.Errorf("%q: read after idling: %v", tt.first, err)
+		}
+		if !tt.mux && !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%q: read after idling = %v, want the deadline exceeded", tt.first, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package statute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// NetnsDial wraps dial so that connections are established from within the
+// network namespace at path, such as /var/run/netns/egress. Sockets keep the
+// namespace they were created in, so the established connection exits
+// through that namespace for its whole life. Switching namespaces requires
+// CAP_SYS_ADMIN.
+func NetnsDial(dial ProxyDialFunc, path string) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		done := make(chan result, 1)
+		// the namespace is switched on a dedicated thread, so the rest of
+		// the program keeps its own
+		go func() {
+			runtime.LockOSThread()
+			conn, restored, err := dialInNetns(ctx, dial, path, network, address)
+			if restored {
+				runtime.UnlockOSThread()
+			}
+			// a thread left in the wrong namespace is locked until the
+			// goroutine exits, which terminates it
+			done <- result{conn, err}
+		}()
+		res := <-done
+		return res.conn, res.err
+	}
+}
+
+// dialInNetns switches the calling thread to the namespace at path, dials,
+// and switches back. It reports whether the thread is back in its original
+// namespace.
+func dialInNetns(ctx context.Context, dial ProxyDialFunc, path, network, address string) (net.Conn, bool, error) {
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		return nil, true, err
+	}
+	defer origin.Close()
+
+	target, err := os.Open(path)
+	if err != nil {
+		return nil, true, err
+	}
+	defer target.Close()
+
+	if err := setns(target); err != nil {
+		return nil, true, fmt.Errorf("enter network namespace %s: %w", path, err)
+	}
+	conn, err := dial(ctx, network, address)
+	// the connection stays usable even if the thread can't switch back
+	restored := setns(origin) == nil
+	return conn, restored, err
+}
+
+// setnsTrap returns the number of the setns system call, which the syscall
+// package doesn't define.
+func setnsTrap() (uintptr, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 308, nil
+	case "arm64", "riscv64", "loong64":
+		return 268, nil
+	case "386":
+		return 346, nil
+	case "arm":
+		return 375, nil
+	case "ppc64", "ppc64le":
+		return 350, nil
+	case "s390x":
+		return 339, nil
+	}
+	return 0, fmt.Errorf("network namespaces are not supported on %s", runtime.GOARCH)
+}
+
+// setns moves the calling thread into the network namespace of ns.
+func setns(ns *os.File) error {
+	trap, err := setnsTrap()
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.RawSyscall(trap, ns.Fd(), syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// newNetns creates an empty network namespace, whose loopback interface is
+// down, and returns a path to it. It skips the test without CAP_SYS_ADMIN.
+func newNetns(t *testing.T) string {
+	t.Helper()
+	type result struct {
+		ns  *os.File
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- result{nil, err}
+			return
+		}
+		defer origin.Close()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			done <- result{nil, err}
+			return
+		}
+		ns, err := os.Open("/proc/thread-self/ns/net")
+		// the namespace lives on through ns, and a thread that can't go
+		// back is terminated as the goroutine exits
+		if setns(origin) == nil {
+			runtime.UnlockOSThread()
+		}
+		done <- result{ns, err}
+	}()
+	res := <-done
+	if errors.Is(res.err, syscall.EPERM) {
+		t.Skip("creating a network namespace requires CAP_SYS_ADMIN")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	t.Cleanup(func() { _ = res.ns.Close() })
+	return fmt.Sprintf("/proc/self/fd/%d", res.ns.Fd())
+}
+
+func TestNetnsDial(t *testing.T) {
+	ns := newNetns(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var d net.Dialer
+
+	// the listener is only reachable from the namespace of the test
+	conn, err := NetnsDial(d.DialContext, "/proc/self/ns/net")(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if conn, err := NetnsDial(d.DialContext, ns)(context.Background(), "tcp", ln.Addr().String()); err == nil {
+		_ = conn.Close()
+		t.Fatal("dial from an empty namespace reached the listener")
+	}
+
+	// the rest of the program stays in its namespace
+	conn, err = d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial after switching namespaces: %v", err)
+	}
+	_ = conn.Close()
+}
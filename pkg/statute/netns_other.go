@@ -0,0 +1,16 @@
+//go:build !linux
+
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// NetnsDial fails every dial on platforms without network namespaces.
+func NetnsDial(_ ProxyDialFunc, path string) ProxyDialFunc {
+	return func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("network namespace " + path + " is only supported on Linux")
+	}
+}
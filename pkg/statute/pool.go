@@ -0,0 +1,138 @@
+package statute
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultBufferSize is the buffer size handed out before any transfer sizes are known.
+const defaultBufferSize = 32 * 1024
+
+// adaptiveFillFactor is how many times a transfer should fill a buffer for
+// that buffer size to be picked.
+const adaptiveFillFactor = 8
+
+// BytesPoolHinter is implemented by BytesPools that size their buffers from
+// the amount of data recent connections transferred.
+type BytesPoolHinter interface {
+	Hint(bytes int64)
+}
+
+// HintBytesPool reports the bytes a connection transferred in one direction
+// to pool, if it accepts hints.
+func HintBytesPool(pool BytesPool, bytes int64) {
+	if hinter, ok := pool.(BytesPoolHinter); ok {
+		hinter.Hint(bytes)
+	}
+}
+
+// TunnelBuffers returns the two buffers handed to Tunnel. A buffer with a
+// positive size is allocated at that size, otherwise it comes from pool, or
+// is allocated at 32KB when pool is nil. release returns the pooled buffers.
+func TunnelBuffers(pool BytesPool, size1, size2 int) (buf1, buf2 []byte, release func()) {
+	var pooled [][]byte
+	get := func(size int) []byte {
+		switch {
+		case size > 0:
+			return make([]byte, size)
+		case pool != nil:
+			buf := pool.Get()
+			pooled = append(pooled, buf)
+			return buf
+		default:
+			return make([]byte, defaultBufferSize)
+		}
+	}
+	buf1, buf2 = get(size1), get(size2)
+	return buf1, buf2, func() {
+		for _, buf := range pooled {
+			pool.Put(buf)
+		}
+	}
+}
+
+// AdaptiveBytesPool is a BytesPool keeping buffers in several size classes.
+// Get picks the class from a moving average of recent transfer sizes, so
+// short control connections get small buffers and bulk transfers large ones.
+// Until the first hint it hands out 32KB buffers.
+type AdaptiveBytesPool struct {
+	sizes []int
+	pools []sync.Pool
+	// hint is the moving average of bytes per transfer, zero until hinted
+	hint atomic.Int64
+}
+
+// NewAdaptiveBytesPool creates an AdaptiveBytesPool with the given buffer
+// sizes, or 4KB, 32KB and 256KB if none are given.
+func NewAdaptiveBytesPool(sizes ...int) *AdaptiveBytesPool {
+	if len(sizes) == 0 {
+		sizes = []int{4 * 1024, 32 * 1024, 256 * 1024}
+	}
+	sizes = append([]int(nil), sizes...)
+	sort.Ints(sizes)
+
+	p := &AdaptiveBytesPool{
+		sizes: sizes,
+		pools: make([]sync.Pool, len(sizes)),
+	}
+	for i, size := range sizes {
+		size := size
+		p.pools[i].New = func() any {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+	return p
+}
+
+// Get returns a buffer of the size class suiting recent transfers.
+func (p *AdaptiveBytesPool) Get() []byte {
+	return *p.pools[p.class(p.hint.Load())].Get().(*[]byte)
+}
+
+// Put returns buf to the pool. Buffers that don't match a size class are dropped.
+func (p *AdaptiveBytesPool) Put(buf []byte) {
+	for i, size := range p.sizes {
+		if cap(buf) == size {
+			buf = buf[:size]
+			p.pools[i].Put(&buf)
+			return
+		}
+	}
+}
+
+// Hint records the bytes a connection transferred in one direction.
+func (p *AdaptiveBytesPool) Hint(bytes int64) {
+	for {
+		old := p.hint.Load()
+		next := bytes
+		if old != 0 {
+			next = old - old/adaptiveFillFactor + bytes/adaptiveFillFactor
+		}
+		if p.hint.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// class returns the index of the size class for the average transfer size
+// hint: the largest class such transfers fill adaptiveFillFactor times.
+func (p *AdaptiveBytesPool) class(hint int64) int {
+	if hint == 0 {
+		for i, size := range p.sizes {
+			if size >= defaultBufferSize {
+				return i
+			}
+		}
+		return len(p.sizes) - 1
+	}
+
+	class := 0
+	for i, size := range p.sizes {
+		if int64(size)*adaptiveFillFactor <= hint {
+			class = i
+		}
+	}
+	return class
+}
@@ -0,0 +1,99 @@
+package statute
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAdaptiveBytesPoolSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		hint int64
+		want int
+	}{
+		{"unhinted", 0, 32 * 1024},
+		{"small transfers", 1024, 4 * 1024},
+		{"bulk transfers", 16 * 1024 * 1024, 256 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewAdaptiveBytesPool()
+			if tt.hint != 0 {
+				pool.Hint(tt.hint)
+			}
+			if got := len(pool.Get()); got != tt.want {
+				t.Errorf("got a %d byte buffer, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// fixedBytesPool hands out buffers of a single size, as a plain sync.Pool
+// based BytesPool would.
+type fixedBytesPool struct {
+	pool sync.Pool
+}
+
+func newFixedBytesPool(size int) *fixedBytesPool {
+	p := &fixedBytesPool{}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+func (p *fixedBytesPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *fixedBytesPool) Put(buf []byte) {
+	p.pool.Put(&buf)
+}
+
+// onlyReader hides the WriterTo of a reader, so copies go through the buffer.
+type onlyReader struct {
+	io.Reader
+}
+
+// benchmarkMixedLoad copies transfers through buffers of pool, nine small
+// control exchanges of 1KB for every bulk transfer of 1MB, reporting the
+// buffer bytes handed out per transfer.
+func benchmarkMixedLoad(b *testing.B, pool BytesPool) {
+	small := strings.Repeat("s", 1024)
+	bulk := strings.Repeat("b", 1024*1024)
+	var handedOut, transfers atomic.Int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			data := small
+			if i%10 == 9 {
+				data = bulk
+			}
+			buf := pool.Get()
+			n, err := io.CopyBuffer(io.Discard, onlyReader{strings.NewReader(data)}, buf)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			handedOut.Add(int64(len(buf)))
+			transfers.Add(1)
+			HintBytesPool(pool, n)
+			pool.Put(buf)
+		}
+	})
+	b.ReportMetric(float64(handedOut.Load())/float64(transfers.Load()), "bufB/op")
+}
+
+func BenchmarkAdaptiveBytesPool(b *testing.B) {
+	benchmarkMixedLoad(b, NewAdaptiveBytesPool())
+}
+
+func BenchmarkFixedBytesPool(b *testing.B) {
+	benchmarkMixedLoad(b, newFixedBytesPool(defaultBufferSize))
+}
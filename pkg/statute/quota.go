@@ -0,0 +1,159 @@
+package statute
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// quotaBuckets is the number of time buckets a quota window is split into
+	quotaBuckets = 10
+	// quotaFlushBytes is how many bytes a connection counts locally before
+	// adding them to the shared accumulator
+	quotaFlushBytes = 64 * 1024
+)
+
+// ByteQuota limits how many bytes each source IP may transfer within a
+// sliding window. Usage is kept in time buckets of a tenth of the window, so
+// old traffic expires in steps as the window rolls.
+type ByteQuota struct {
+	limit     int64
+	bucket    time.Duration
+	mu        sync.Mutex
+	usage     map[string]*quotaUsage
+	lastSweep int64
+}
+
+// quotaUsage holds the bytes of one source IP per time bucket.
+type quotaUsage struct {
+	epochs [quotaBuckets]int64 // bucket number each slot currently holds
+	bytes  [quotaBuckets]int64
+}
+
+// NewByteQuota creates a ByteQuota allowing limit bytes per source IP within window.
+func NewByteQuota(limit int64, window time.Duration) *ByteQuota {
+	bucket := window / quotaBuckets
+	if bucket <= 0 {
+		bucket = 1
+	}
+	return &ByteQuota{
+		limit:  limit,
+		bucket: bucket,
+		usage:  make(map[string]*quotaUsage),
+	}
+}
+
+// epoch returns the number of the current time bucket.
+func (q *ByteQuota) epoch() int64 {
+	return time.Now().UnixNano() / int64(q.bucket)
+}
+
+// total sums the bytes of the buckets still within the window.
+func (u *quotaUsage) total(epoch int64) int64 {
+	var total int64
+	for i, e := range u.epochs {
+		if e > epoch-quotaBuckets {
+			total += u.bytes[i]
+		}
+	}
+	return total
+}
+
+// Allow reports whether ip is still within its quota.
+func (q *ByteQuota) Allow(ip string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage, ok := q.usage[ip]
+	return !ok || usage.total(q.epoch()) < q.limit
+}
+
+// Add records n bytes transferred by ip.
+func (q *ByteQuota) Add(ip string, n int64) {
+	if n <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	epoch := q.epoch()
+	usage, ok := q.usage[ip]
+	if !ok {
+		usage = &quotaUsage{}
+		q.usage[ip] = usage
+	}
+	slot := epoch % quotaBuckets
+	if usage.epochs[slot] != epoch {
+		usage.epochs[slot] = epoch
+		usage.bytes[slot] = 0
+	}
+	usage.bytes[slot] += n
+
+	// forget idle sources once per window
+	if epoch-q.lastSweep >= quotaBuckets {
+		q.lastSweep = epoch
+		for key, u := range q.usage {
+			if u.total(epoch) == 0 {
+				delete(q.usage, key)
+			}
+		}
+	}
+}
+
+// Conn wraps conn so the bytes it transfers count against the quota of its
+// remote IP.
+func (q *ByteQuota) Conn(conn net.Conn) net.Conn {
+	return &quotaConn{Conn: conn, quota: q, ip: RemoteIP(conn.RemoteAddr())}
+}
+
+// quotaConn counts the bytes read from and written to a connection against a ByteQuota.
+type quotaConn struct {
+	net.Conn
+	quota   *ByteQuota
+	ip      string
+	pending atomic.Int64
+}
+
+// Read reads data from the connection and counts it.
+func (c *quotaConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.count(n)
+	return n, err
+}
+
+// Write writes data to the connection and counts it.
+func (c *quotaConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.count(n)
+	return n, err
+}
+
+// Close adds the remaining count to the quota and closes the connection.
+func (c *quotaConn) Close() error {
+	c.quota.Add(c.ip, c.pending.Swap(0))
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *quotaConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *quotaConn) count(n int) {
+	if n > 0 && c.pending.Add(int64(n)) >= quotaFlushBytes {
+		c.quota.Add(c.ip, c.pending.Swap(0))
+	}
+}
+
+// RemoteIP returns the IP of a TCP or UDP address as a string, or the whole
+// address for other kinds.
+func RemoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return addr.String()
+}
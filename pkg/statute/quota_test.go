@@ -0,0 +1,73 @@
+package statute
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestByteQuotaLimit(t *testing.T) {
+	q := NewByteQuota(100, time.Hour)
+	q.Add("192.0.2.1", 99)
+	if !q.Allow("192.0.2.1") {
+		t.Fatal("source refused below its limit")
+	}
+	q.Add("192.0.2.1", 1)
+	if q.Allow("192.0.2.1") {
+		t.Fatal("source allowed at its limit")
+	}
+	if !q.Allow("192.0.2.2") {
+		t.Fatal("another source refused")
+	}
+}
+
+func TestByteQuotaWindowResets(t *testing.T) {
+	q := NewByteQuota(100, 200*time.Millisecond)
+	q.Add("192.0.2.1", 100)
+	if q.Allow("192.0.2.1") {
+		t.Fatal("source allowed at its limit")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if !q.Allow("192.0.2.1") {
+		t.Fatal("source still refused once the window passed")
+	}
+}
+
+func TestByteQuotaSharedAcrossConns(t *testing.T) {
+	q := NewByteQuota(100, time.Hour)
+	_, first := tcpPair(t)
+	_, second := tcpPair(t)
+
+	// both connections come from 127.0.0.1 and draw on the same quota
+	for i, conn := range []net.Conn{q.Conn(first), q.Conn(second)} {
+		if !q.Allow("127.0.0.1") {
+			t.Fatalf("source refused before connection %d", i)
+		}
+		if _, err := conn.Write(make([]byte, 60)); err != nil {
+			t.Fatal(err)
+		}
+		// the count is added to the quota when the connection closes
+		_ = conn.Close()
+	}
+	if q.Allow("127.0.0.1") {
+		t.Fatal("source allowed after both connections used up its quota")
+	}
+}
+
+func TestByteQuotaFlushesLongConns(t *testing.T) {
+	q := NewByteQuota(quotaFlushBytes, time.Hour)
+	client, server := tcpPair(t)
+	conn := q.Conn(server)
+
+	go func() {
+		_, _ = io.Copy(io.Discard, client)
+	}()
+	if _, err := conn.Write(make([]byte, quotaFlushBytes)); err != nil {
+		t.Fatal(err)
+	}
+	// an open connection counts once it has transferred enough to flush
+	if q.Allow("127.0.0.1") {
+		t.Fatal("source allowed while an open connection used up its quota")
+	}
+}
@@ -0,0 +1,134 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reverseDNSTimeout bounds each PTR lookup.
+const reverseDNSTimeout = 2 * time.Second
+
+// reverseDNSTTL is how long a name found is cached, reverseDNSNegativeTTL how
+// long a failed lookup is.
+const (
+	reverseDNSTTL         = 10 * time.Minute
+	reverseDNSNegativeTTL = time.Minute
+)
+
+// reverseDNSCacheSize caps the number of cached names; once it is full,
+// expired names are dropped and then the one expiring soonest.
+const reverseDNSCacheSize = 4096
+
+// ReverseLookupFunc looks up the names of addr, like net.Resolver.LookupAddr.
+type ReverseLookupFunc func(ctx context.Context, addr string) ([]string, error)
+
+// ReverseDNS resolves client IPs to host names for logging. Lookups run in
+// the background and their results are cached for a while, failures
+// included, so asking for a name never waits on DNS.
+type ReverseDNS struct {
+	lookup      ReverseLookupFunc
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+
+	mu      sync.Mutex
+	names   map[string]reverseName
+	pending map[string]struct{}
+}
+
+// reverseName is a cached lookup result, name is "" if none was found.
+type reverseName struct {
+	name    string
+	expires time.Time
+}
+
+// NewReverseDNS creates a ReverseDNS resolving names with lookup, or with
+// net.DefaultResolver if lookup is nil.
+func NewReverseDNS(lookup ReverseLookupFunc) *ReverseDNS {
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupAddr
+	}
+	return &ReverseDNS{
+		lookup:      lookup,
+		ttl:         reverseDNSTTL,
+		negativeTTL: reverseDNSNegativeTTL,
+		size:        reverseDNSCacheSize,
+		names:       make(map[string]reverseName),
+		pending:     make(map[string]struct{}),
+	}
+}
+
+// Start looks up the name of ip in the background unless it is cached or
+// already being looked up. It does nothing on a nil ReverseDNS.
+func (r *ReverseDNS) Start(ip string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cached, ok := r.names[ip]; ok && time.Now().Before(cached.expires) {
+		return
+	}
+	if _, ok := r.pending[ip]; ok {
+		return
+	}
+	r.pending[ip] = struct{}{}
+	go r.resolve(ip)
+}
+
+// Name returns the cached name of ip, or "" if it is unknown, expired or
+// still being looked up.
+func (r *ReverseDNS) Name(ip string) string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cached, ok := r.names[ip]
+	if !ok || !time.Now().Before(cached.expires) {
+		return ""
+	}
+	return cached.name
+}
+
+// resolve looks up ip and caches the first name found, "" if there is none.
+func (r *ReverseDNS) resolve(ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), reverseDNSTimeout)
+	defer cancel()
+
+	var name string
+	if names, err := r.lookup(ctx, ip); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	ttl := r.ttl
+	if name == "" {
+		ttl = r.negativeTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, ip)
+	if _, ok := r.names[ip]; !ok && len(r.names) >= r.size {
+		r.evict()
+	}
+	r.names[ip] = reverseName{name: name, expires: time.Now().Add(ttl)}
+}
+
+// evict drops the expired names, or the one expiring soonest if none has.
+func (r *ReverseDNS) evict() {
+	now := time.Now()
+	var soonest string
+	for ip, cached := range r.names {
+		if !now.Before(cached.expires) {
+			delete(r.names, ip)
+		} else if soonest == "" || cached.expires.Before(r.names[soonest].expires) {
+			soonest = ip
+		}
+	}
+	if len(r.names) >= r.size {
+		delete(r.names, soonest)
+	}
+}
@@ -0,0 +1,107 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingLookup answers lookups with the names in its map, failing for the
+// others, and counts the lookups of each address.
+type countingLookup struct {
+	mu    sync.Mutex
+	names map[string]string
+	calls map[string]int
+}
+
+func (l *countingLookup) lookup(_ context.Context, addr string) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls[addr]++
+	if name, ok := l.names[addr]; ok {
+		return []string{name + "."}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (l *countingLookup) count(addr string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.calls[addr]
+}
+
+// resolved starts a lookup of ip and waits for it to finish.
+func resolved(t *testing.T, r *ReverseDNS, ip string) {
+	t.Helper()
+	r.Start(ip)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		_, pending := r.pending[ip]
+		r.mu.Unlock()
+		if !pending {
+			return
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("lookup of %s didn't finish", ip)
+		}
+	}
+}
+
+func TestReverseDNSCache(t *testing.T) {
+	l := &countingLookup{names: map[string]string{"192.0.2.1": "client.example"}, calls: map[string]int{}}
+	r := NewReverseDNS(l.lookup)
+	r.ttl = 100 * time.Millisecond
+	r.negativeTTL = 50 * time.Millisecond
+
+	resolved(t, r, "192.0.2.1")
+	resolved(t, r, "192.0.2.2")
+	if got := r.Name("192.0.2.1"); got != "client.example" {
+		t.Fatalf("Name = %q, want %q", got, "client.example")
+	}
+	if got := r.Name("192.0.2.2"); got != "" {
+		t.Fatalf("Name of a failed lookup = %q, want none", got)
+	}
+
+	// cached names and failures aren't looked up again
+	resolved(t, r, "192.0.2.1")
+	resolved(t, r, "192.0.2.2")
+	if l.count("192.0.2.1") != 1 || l.count("192.0.2.2") != 1 {
+		t.Fatalf("lookups = %v, want one each", l.calls)
+	}
+
+	// failures expire first, then names
+	time.Sleep(60 * time.Millisecond)
+	resolved(t, r, "192.0.2.1")
+	resolved(t, r, "192.0.2.2")
+	if l.count("192.0.2.1") != 1 || l.count("192.0.2.2") != 2 {
+		t.Fatalf("lookups after the negative TTL = %v", l.calls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := r.Name("192.0.2.1"); got != "" {
+		t.Fatalf("Name after the TTL = %q, want none", got)
+	}
+	resolved(t, r, "192.0.2.1")
+	if l.count("192.0.2.1") != 2 {
+		t.Fatalf("lookups after the TTL = %v", l.calls)
+	}
+}
+
+func TestReverseDNSCacheBounded(t *testing.T) {
+	l := &countingLookup{names: map[string]string{}, calls: map[string]int{}}
+	r := NewReverseDNS(l.lookup)
+	r.size = 2
+
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	for _, ip := range ips {
+		resolved(t, r, ip)
+	}
+	if len(r.names) != 2 {
+		t.Fatalf("%d names cached, want 2", len(r.names))
+	}
+	// the entry expiring soonest, the first cached, made room
+	if _, ok := r.names[ips[0]]; ok {
+		t.Fatalf("oldest entry %s still cached", ips[0])
+	}
+}
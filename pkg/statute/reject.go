@@ -0,0 +1,69 @@
+package statute
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// rejectDrainTimeout bounds how long RejectConn waits for the client to finish sending
+	rejectDrainTimeout = 500 * time.Millisecond
+	// rejectDrainLimit bounds how much client data RejectConn discards
+	rejectDrainLimit = 64 * 1024
+)
+
+// RejectConn writes a protocol-appropriate rejection to conn and closes it
+// gracefully. The write side is shut down first and pending client data is
+// drained for a short while, so the close isn't turned into a reset by unread
+// data. For HTTP the reason is sent as the response body, SOCKS replies carry
+// no text.
+func RejectConn(conn net.Conn, protocol Protocol, reason string) error {
+	var err error
+	switch protocol {
+	case ProtocolSOCKS5:
+		// connection not allowed by ruleset, with an empty IPv4 bind address
+		_, err = conn.Write([]byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	case ProtocolSOCKS4:
+		// request rejected or failed
+		_, err = conn.Write([]byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0})
+	case ProtocolHTTP, ProtocolHTTPConnect:
+		body := reason + "\n"
+		_, err = fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Connection: close\r\n\r\n%s", len(body), body)
+	}
+
+	closeErr := DrainAndClose(conn)
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// DrainAndClose half-closes conn, discards what the peer still sends until it
+// closes or the drain timeout passes, then closes conn. Closing right after
+// an error response would otherwise reset the connection if the client is
+// still sending, losing the response.
+func DrainAndClose(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(rejectDrainTimeout))
+	_, _ = io.Copy(io.Discard, io.LimitReader(conn, rejectDrainLimit))
+	return conn.Close()
+}
+
+// CloseRejected closes a connection refused before any protocol exchange.
+// With reset set the linger time is set to zero first, so the peer receives
+// an RST instead of an orderly FIN.
+func CloseRejected(conn net.Conn, reset bool) error {
+	if reset {
+		if lc, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+			_ = lc.SetLinger(0)
+		}
+	}
+	return conn.Close()
+}
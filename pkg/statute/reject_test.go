@@ -0,0 +1,48 @@
+package statute
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectConn(t *testing.T) {
+	tests := []struct {
+		protocol Protocol
+		want     string
+	}{
+		{ProtocolSOCKS5, "\x05\x02\x00\x01\x00\x00\x00\x00\x00\x00"},
+		{ProtocolSOCKS4, "\x00\x5b\x00\x00\x00\x00\x00\x00"},
+		{ProtocolHTTP, "HTTP/1.1 403 Forbidden\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.protocol), func(t *testing.T) {
+			client, server := tcpPair(t)
+			// data the server never reads must not turn the close into a reset
+			if _, err := client.Write(bytes.Repeat([]byte("x"), 4096)); err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				_ = client.(interface{ CloseWrite() error }).CloseWrite()
+			}()
+			if err := RejectConn(server, tt.protocol, "not allowed"); err != nil {
+				t.Fatalf("RejectConn = %v", err)
+			}
+
+			_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			got, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatalf("read = %v, want the rejection and EOF", err)
+			}
+			if !strings.HasPrefix(string(got), tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.protocol == ProtocolHTTP && !strings.HasSuffix(string(got), "not allowed\n") {
+				t.Errorf("response %q lacks the reason", got)
+			}
+		})
+	}
+}
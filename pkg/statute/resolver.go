@@ -0,0 +1,249 @@
+package statute
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver is the interface for looking up the addresses of a host.
+// *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DefaultResolver returns the default implementation of Resolver.
+func DefaultResolver() Resolver {
+	return net.DefaultResolver
+}
+
+// ResolveDial wraps dial so that the destination is resolved with resolver
+// before dialing. The resolved addresses are tried in order until one connects.
+func ResolveDial(resolver Resolver, dial ProxyDialFunc) ProxyDialFunc {
+	return resolveDial(resolver, dial, nil)
+}
+
+// resolveDial resolves the destination host, lets check veto the result and
+// dials the resolved addresses in order.
+func resolveDial(resolver Resolver, dial ProxyDialFunc, check func(host string, ips []net.IPAddr) error) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		pins, _ := ctx.Value(pinsKey{}).(*resolutionPins)
+		ips, pinned := pins.get(host)
+		if !pinned {
+			ips, err = resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("no addresses found for %s", host)
+			}
+
+			if check != nil {
+				if err := check(host, ips); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		dialErr := &DialError{Host: host}
+		for _, ip := range ips {
+			ipAddress := net.JoinHostPort(ip.IP.String(), port)
+			conn, err := dial(ctx, network, ipAddress)
+			if err == nil {
+				pins.set(host, ip)
+				return conn, nil
+			}
+			dialErr.Attempts = append(dialErr.Attempts, DialAttempt{Address: ipAddress, Err: err})
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, dialErr
+	}
+}
+
+// pinsKey is the context key of the resolutionPins of a session.
+type pinsKey struct{}
+
+// resolutionPins holds the address each host of a session is pinned to.
+type resolutionPins struct {
+	mu  sync.Mutex
+	ips map[string]net.IPAddr
+}
+
+// ContextWithPinnedResolution returns a context for a session, such as the
+// requests of one client connection, in which dials through ResolveDial or
+// BlockPrivateDial pin each host to the first address they connected to.
+// Later dials of the host within the session reuse that address rather than
+// resolving the host again.
+func ContextWithPinnedResolution(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pinsKey{}, &resolutionPins{ips: make(map[string]net.IPAddr)})
+}
+
+// get returns the address host is pinned to, if any. It finds nothing on
+// nil pins.
+func (p *resolutionPins) get(host string) ([]net.IPAddr, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ip, ok := p.ips[host]
+	if !ok {
+		return nil, false
+	}
+	return []net.IPAddr{ip}, true
+}
+
+// set pins host to ip unless it is pinned already. It does nothing on nil pins.
+func (p *resolutionPins) set(host string, ip net.IPAddr) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.ips[host]; !ok {
+		p.ips[host] = ip
+	}
+}
+
+// DialAttempt is the failed dial of one resolved address of a destination.
+type DialAttempt struct {
+	Address string
+	Err     error
+}
+
+// DialError is returned when none of the resolved addresses of a destination
+// could be dialed. It reads and unwraps as the error of the first attempt.
+type DialError struct {
+	Host     string
+	Attempts []DialAttempt
+}
+
+func (e *DialError) Error() string {
+	return e.Attempts[0].Err.Error()
+}
+
+// Unwrap returns the error of the first attempt.
+func (e *DialError) Unwrap() error {
+	return e.Attempts[0].Err
+}
+
+// CachingResolver is a Resolver that caches the results of another Resolver.
+// Successful lookups are kept for ttl and failed lookups for the separate, usually
+// shorter negativeTTL; either being zero leaves those results uncached. Once
+// the cache holds maxSize hosts the least recently used entry is evicted.
+type CachingResolver struct {
+	resolver    Resolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxSize     int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// cacheEntry is a cached lookup result.
+type cacheEntry struct {
+	host    string
+	ips     []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver creates a new CachingResolver wrapping resolver.
+func NewCachingResolver(resolver Resolver, ttl, negativeTTL time.Duration, maxSize int) *CachingResolver {
+	return &CachingResolver{
+		resolver:    resolver,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxSize:     maxSize,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// LookupIPAddr looks up host, answering from the cache when possible.
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	// literal addresses resolve to themselves, there's nothing worth caching
+	if net.ParseIP(host) != nil {
+		return r.resolver.LookupIPAddr(ctx, host)
+	}
+
+	if entry, ok := r.lookupCache(host); ok {
+		return entry.ips, entry.err
+	}
+
+	ips, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil && ctx.Err() != nil {
+		// a cancelled lookup says nothing about the host
+		return ips, err
+	}
+
+	ttl := r.ttl
+	if err != nil {
+		ttl = r.negativeTTL
+	}
+	if ttl > 0 && r.maxSize > 0 {
+		r.store(host, ips, err, ttl)
+	}
+	return ips, err
+}
+
+// lookupCache returns the cached result for host if it hasn't expired yet.
+func (r *CachingResolver) lookupCache(host string) (cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.entries[host]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		r.lru.Remove(el)
+		delete(r.entries, host)
+		return cacheEntry{}, false
+	}
+
+	r.lru.MoveToFront(el)
+	result := *entry
+	result.ips = append([]net.IPAddr(nil), entry.ips...)
+	return result, true
+}
+
+// store adds a lookup result to the cache, evicting the least recently used entries when full.
+func (r *CachingResolver) store(host string, ips []net.IPAddr, err error, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := &cacheEntry{
+		host:    host,
+		ips:     append([]net.IPAddr(nil), ips...),
+		err:     err,
+		expires: time.Now().Add(ttl),
+	}
+
+	if el, ok := r.entries[host]; ok {
+		el.Value = entry
+		r.lru.MoveToFront(el)
+		return
+	}
+
+	for r.lru.Len() >= r.maxSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).host)
+	}
+	r.entries[host] = r.lru.PushFront(entry)
+}
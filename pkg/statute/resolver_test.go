@@ -0,0 +1,157 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingResolver resolves the hosts in its map, failing for the others,
+// and counts the lookups of each host.
+type countingResolver struct {
+	mu    sync.Mutex
+	hosts map[string]net.IP
+	calls map[string]int
+}
+
+func newCountingResolver(hosts map[string]net.IP) *countingResolver {
+	return &countingResolver{hosts: hosts, calls: make(map[string]int)}
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[host]++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if ip, ok := r.hosts[host]; ok {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r *countingResolver) count(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[host]
+}
+
+func TestCachingResolverHit(t *testing.T) {
+	upstream := newCountingResolver(map[string]net.IP{"example.com": net.IPv4(192, 0, 2, 1)})
+	r := NewCachingResolver(upstream, time.Minute, time.Minute, 16)
+
+	for i := 0; i < 3; i++ {
+		ips, err := r.LookupIPAddr(context.Background(), "example.com")
+		if err != nil || len(ips) != 1 || !ips[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatalf("lookup %d: %v, %v", i, ips, err)
+		}
+	}
+	if n := upstream.count("example.com"); n != 1 {
+		t.Errorf("resolved %d times, want the cache to answer after the first", n)
+	}
+
+	// the cached addresses can't be changed through a result
+	ips, _ := r.LookupIPAddr(context.Background(), "example.com")
+	ips[0].IP = net.IPv4(198, 51, 100, 1)
+	if ips, _ := r.LookupIPAddr(context.Background(), "example.com"); !ips[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("cache entry modified to %v", ips[0].IP)
+	}
+}
+
+func TestCachingResolverMiss(t *testing.T) {
+	upstream := newCountingResolver(map[string]net.IP{
+		"a.example": net.IPv4(192, 0, 2, 1),
+		"b.example": net.IPv4(192, 0, 2, 2),
+	})
+	r := NewCachingResolver(upstream, time.Minute, time.Minute, 16)
+
+	for _, host := range []string{"a.example", "b.example", "192.0.2.3", "192.0.2.3"} {
+		if _, err := r.LookupIPAddr(context.Background(), host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for host, want := range map[string]int{"a.example": 1, "b.example": 1, "192.0.2.3": 2} {
+		if n := upstream.count(host); n != want {
+			t.Errorf("%s resolved %d times, want %d", host, n, want)
+		}
+	}
+
+	// a cancelled lookup says nothing about the host and isn't cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.LookupIPAddr(ctx, "c.example"); err == nil {
+		t.Fatal("cancelled lookup succeeded")
+	}
+	_, _ = r.LookupIPAddr(context.Background(), "c.example")
+	if n := upstream.count("c.example"); n != 2 {
+		t.Errorf("c.example resolved %d times, want 2", n)
+	}
+}
+
+func TestCachingResolverNegative(t *testing.T) {
+	upstream := newCountingResolver(nil)
+	r := NewCachingResolver(upstream, time.Minute, 50*time.Millisecond, 16)
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIPAddr(context.Background(), "missing.example"); err == nil {
+			t.Fatal("lookup of a missing host succeeded")
+		}
+	}
+	if n := upstream.count("missing.example"); n != 1 {
+		t.Errorf("resolved %d times, want the failure cached", n)
+	}
+
+	// failures are kept for the negative TTL only
+	time.Sleep(100 * time.Millisecond)
+	_, _ = r.LookupIPAddr(context.Background(), "missing.example")
+	if n := upstream.count("missing.example"); n != 2 {
+		t.Errorf("resolved %d times, want the failure to have expired", n)
+	}
+
+	// a zero negative TTL doesn't cache failures at all
+	r = NewCachingResolver(upstream, time.Minute, 0, 16)
+	_, _ = r.LookupIPAddr(context.Background(), "other.example")
+	_, _ = r.LookupIPAddr(context.Background(), "other.example")
+	if n := upstream.count("other.example"); n != 2 {
+		t.Errorf("resolved %d times without negative caching, want 2", n)
+	}
+}
+
+func TestCachingResolverExpiry(t *testing.T) {
+	upstream := newCountingResolver(map[string]net.IP{"example.com": net.IPv4(192, 0, 2, 1)})
+	r := NewCachingResolver(upstream, 50*time.Millisecond, time.Minute, 16)
+
+	_, _ = r.LookupIPAddr(context.Background(), "example.com")
+	_, _ = r.LookupIPAddr(context.Background(), "example.com")
+	time.Sleep(100 * time.Millisecond)
+	_, _ = r.LookupIPAddr(context.Background(), "example.com")
+	if n := upstream.count("example.com"); n != 2 {
+		t.Errorf("resolved %d times, want once more after expiry", n)
+	}
+}
+
+func TestCachingResolverEviction(t *testing.T) {
+	upstream := newCountingResolver(map[string]net.IP{
+		"a.example": net.IPv4(192, 0, 2, 1),
+		"b.example": net.IPv4(192, 0, 2, 2),
+		"c.example": net.IPv4(192, 0, 2, 3),
+	})
+	r := NewCachingResolver(upstream, time.Minute, time.Minute, 2)
+
+	// a is used after b, so b is the least recently used when c comes in
+	for _, host := range []string{"a.example", "b.example", "a.example", "c.example", "a.example", "b.example"} {
+		_, _ = r.LookupIPAddr(context.Background(), host)
+	}
+	for host, want := range map[string]int{"a.example": 1, "b.example": 2, "c.example": 1} {
+		if n := upstream.count(host); n != want {
+			t.Errorf("%s resolved %d times, want %d", host, n, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package statute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ListenAddrs records the addresses a proxy listens on, so connections it
+// dials back to itself can be refused. A nil *ListenAddrs records nothing.
+type ListenAddrs struct {
+	mu    sync.RWMutex
+	addrs []*net.TCPAddr
+}
+
+// NewListenAddrs returns an empty set of listen addresses.
+func NewListenAddrs() *ListenAddrs {
+	return &ListenAddrs{}
+}
+
+// Add records addr, the address of a listener.
+func (l *ListenAddrs) Add(addr net.Addr) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if l == nil || !ok {
+		return
+	}
+	l.mu.Lock()
+	l.addrs = append(l.addrs, tcp)
+	l.mu.Unlock()
+}
+
+// Remove forgets addr once its listener is closed.
+func (l *ListenAddrs) Remove(addr net.Addr) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if l == nil || !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, a := range l.addrs {
+		if a.Port == tcp.Port && a.IP.Equal(tcp.IP) {
+			l.addrs = append(l.addrs[:i], l.addrs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Contains reports whether addr is one of the recorded listen addresses.
+// Listeners on the unspecified address match every local IP.
+func (l *ListenAddrs) Contains(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if l == nil || !ok {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, a := range l.addrs {
+		if a.Port != tcp.Port {
+			continue
+		}
+		if a.IP.Equal(tcp.IP) || (a.IP.IsUnspecified() && isLocalIP(tcp.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip is a loopback address or one of the host's
+// interface addresses.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SelfDialGuard wraps dial so that connections reaching one of addrs, the
+// proxy itself, are closed and refused with ErrBlockedDestination, rather
+// than letting a misconfigured client loop the proxy into itself. The check
+// uses the address actually connected to, after any resolution.
+func SelfDialGuard(dial ProxyDialFunc, addrs *ListenAddrs) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if addrs.Contains(conn.RemoteAddr()) {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%w: %s is the proxy's own listen address", ErrBlockedDestination, address)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,49 @@
+package statute
+
+import (
+	"context"
+	"net"
+)
+
+// bufferConn is implemented by connections with tunable socket buffers, such as *net.TCPConn.
+type bufferConn interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// SetSocketBuffers sets the receive (SO_RCVBUF) and send (SO_SNDBUF) buffer
+// sizes of conn. A size of zero leaves the OS default. Connections without
+// tunable buffers are left untouched.
+func SetSocketBuffers(conn net.Conn, recv, send int) error {
+	bc, ok := conn.(bufferConn)
+	if !ok {
+		return nil
+	}
+	if recv > 0 {
+		if err := bc.SetReadBuffer(recv); err != nil {
+			return err
+		}
+	}
+	if send > 0 {
+		if err := bc.SetWriteBuffer(send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SocketBuffersDial wraps dial so that every established connection gets the
+// given socket buffer sizes, see SetSocketBuffers.
+func SocketBuffersDial(dial ProxyDialFunc, recv, send int) ProxyDialFunc {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := SetSocketBuffers(conn, recv, send); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
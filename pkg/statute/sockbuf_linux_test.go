@@ -0,0 +1,32 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketBuffersDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var d net.Dialer
+	dial := SocketBuffersDial(d.DialContext, 64*1024, 32*1024)
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Linux doubles the sizes set to make room for its bookkeeping
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got != 2*64*1024 {
+		t.Errorf("SO_RCVBUF = %d, want %d", got, 2*64*1024)
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got != 2*32*1024 {
+		t.Errorf("SO_SNDBUF = %d, want %d", got, 2*32*1024)
+	}
+}
@@ -0,0 +1,123 @@
+package statute
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the connections served by one or more servers.
+type Stats struct {
+	// TotalConns is the number of connections accepted so far
+	TotalConns int64
+	// ActiveConns is the number of connections being served
+	ActiveConns int64
+	// BytesUp is the number of bytes read from clients of completed connections
+	BytesUp int64
+	// BytesDown is the number of bytes written to clients of completed connections
+	BytesDown int64
+	// Protocols counts the completed connections by protocol
+	Protocols map[Protocol]int64
+}
+
+// ConnInfo describes a connection being served.
+type ConnInfo struct {
+	Protocol    Protocol
+	ClientAddr  string
+	Destination string
+	Start       time.Time
+	// BytesUp is the number of bytes read from the client so far
+	BytesUp int64
+	// BytesDown is the number of bytes written to the client so far
+	BytesDown int64
+}
+
+// StatsCollector maintains Stats from the connections it tracks. It is safe
+// for concurrent use and may be shared by several servers.
+type StatsCollector struct {
+	total     atomic.Int64
+	active    atomic.Int64
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+
+	mu        sync.Mutex
+	protocols map[Protocol]int64
+	live      map[*ConnTracker]struct{}
+}
+
+// NewStatsCollector creates an empty StatsCollector.
+func NewStatsCollector() *StatsCollector {
+	return &StatsCollector{
+		protocols: make(map[Protocol]int64),
+		live:      make(map[*ConnTracker]struct{}),
+	}
+}
+
+// Track starts tracking conn, which arrived on protocol, and counts it as
+// active until the tracker is done. On a nil collector it only returns a new
+// ConnTracker.
+func (c *StatsCollector) Track(conn net.Conn, protocol Protocol) *ConnTracker {
+	t := NewConnTracker(conn, protocol)
+	if c != nil {
+		c.total.Add(1)
+		c.active.Add(1)
+		t.stats = c
+
+		c.mu.Lock()
+		c.live[t] = struct{}{}
+		c.mu.Unlock()
+	}
+	return t
+}
+
+// done accounts for the completed connection of t.
+func (c *StatsCollector) done(t *ConnTracker, summary ConnSummary) {
+	c.active.Add(-1)
+	c.bytesUp.Add(summary.BytesUp)
+	c.bytesDown.Add(summary.BytesDown)
+
+	c.mu.Lock()
+	c.protocols[summary.Protocol]++
+	delete(c.live, t)
+	c.mu.Unlock()
+}
+
+// Connections returns the connections being served, oldest first. A nil
+// collector returns none.
+func (c *StatsCollector) Connections() []ConnInfo {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	infos := make([]ConnInfo, 0, len(c.live))
+	for t := range c.live {
+		infos = append(infos, t.info())
+	}
+	c.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Start.Before(infos[j].Start)
+	})
+	return infos
+}
+
+// Snapshot returns the current Stats.
+func (c *StatsCollector) Snapshot() Stats {
+	c.mu.Lock()
+	protocols := make(map[Protocol]int64, len(c.protocols))
+	for protocol, n := range c.protocols {
+		protocols[protocol] = n
+	}
+	c.mu.Unlock()
+
+	return Stats{
+		TotalConns:  c.total.Load(),
+		ActiveConns: c.active.Load(),
+		BytesUp:     c.bytesUp.Load(),
+		BytesDown:   c.bytesDown.Load(),
+		Protocols:   protocols,
+	}
+}
@@ -2,9 +2,12 @@ package statute
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"time"
 )
 
 // Logger is the interface for logging messages.
@@ -26,6 +29,107 @@ func (l DefaultLogger) Error(v ...interface{}) {
 	fmt.Println(v...)
 }
 
+// Warn prints warnings to the standard output.
+func (l DefaultLogger) Warn(v ...interface{}) {
+	fmt.Println(append([]interface{}{"warning:"}, v...)...)
+}
+
+// WarnLogger is implemented by loggers with a level for warnings, which are
+// worth noticing but no errors.
+type WarnLogger interface {
+	Warn(v ...interface{})
+}
+
+// Warn logs a warning with logger, at the Debug level if it has no Warn method.
+func Warn(logger Logger, v ...interface{}) {
+	if w, ok := logger.(WarnLogger); ok {
+		w.Warn(v...)
+		return
+	}
+	logger.Debug(v...)
+}
+
+// Metrics is the interface for reporting connection measurements.
+// Labels are passed as alternating key/value pairs.
+type Metrics interface {
+	ObserveDuration(name string, d time.Duration, labels ...string)
+	AddCount(name string, delta int64, labels ...string)
+}
+
+// DestinationClassifier maps the host of a destination to one of a bounded
+// set of labels, such as its TLD, keeping per-destination metrics from
+// exploding in cardinality.
+type DestinationClassifier func(host string) string
+
+// MetricLabels returns the labels of a metric about a connection of protocol
+// to destination, a host:port or a bare host. The destination is only
+// labelled, by its class, when classify is set.
+func MetricLabels(protocol string, destination string, classify DestinationClassifier) []string {
+	labels := []string{"protocol", protocol}
+	if classify != nil {
+		host := destination
+		if h, _, err := net.SplitHostPort(destination); err == nil {
+			host = h
+		}
+		labels = append(labels, "destination", classify(host))
+	}
+	return labels
+}
+
+// DefaultMetrics is a Metrics implementation that discards all measurements.
+type DefaultMetrics struct{}
+
+// ObserveDuration discards the duration.
+func (m DefaultMetrics) ObserveDuration(string, time.Duration, ...string) {}
+
+// AddCount discards the count.
+func (m DefaultMetrics) AddCount(string, int64, ...string) {}
+
+// Protocol identifies the proxy protocol a connection arrived on.
+type Protocol string
+
+const (
+	ProtocolSOCKS5      Protocol = "socks5"
+	ProtocolSOCKS4      Protocol = "socks4"
+	ProtocolHTTP        Protocol = "http"         // plain HTTP forward proxy request
+	ProtocolHTTPConnect Protocol = "http-connect" // HTTP CONNECT tunnel
+	ProtocolTransparent Protocol = "transparent"  // connection redirected by the kernel
+	ProtocolTLS         Protocol = "tls"          // raw TLS passthrough by SNI
+	ProtocolH2C         Protocol = "h2c"          // prior-knowledge cleartext HTTP/2
+)
+
+// ErrDraining is returned for requests refused because the server is
+// shutting down.
+var ErrDraining = errors.New("server is draining")
+
+var (
+	// ErrShutdown is returned by ListenAndServe when it stops because its
+	// context was cancelled, wrapping the cause.
+	ErrShutdown = errors.New("server shut down")
+	// ErrBindFailed is returned by ListenAndServe when it can't listen on
+	// its address, wrapping the cause.
+	ErrBindFailed = errors.New("bind failed")
+	// ErrAcceptFailed is returned by ListenAndServe when its listener stops
+	// accepting connections unexpectedly, wrapping the cause.
+	ErrAcceptFailed = errors.New("accept failed")
+)
+
+// ShutdownError returns ErrShutdown wrapping the cause of ctx's cancellation,
+// so errors.Is still matches context.Canceled and the like.
+func ShutdownError(ctx context.Context) error {
+	return fmt.Errorf("%w: %w", ErrShutdown, context.Cause(ctx))
+}
+
+// BindError returns ErrBindFailed wrapping err, an error of Listen.
+func BindError(err error) error {
+	return fmt.Errorf("%w: %w", ErrBindFailed, err)
+}
+
+// AcceptError returns ErrAcceptFailed wrapping err, an error of Accept.
+func AcceptError(err error) error {
+	return fmt.Errorf("%w: %w", ErrAcceptFailed, err)
+}
+
 // ProxyRequest contains information about a proxy request.
 type ProxyRequest struct {
 	Conn        net.Conn
@@ -35,6 +139,13 @@ type ProxyRequest struct {
 	Destination string
 	DestHost    string
 	DestPort    int32
+	// Protocol is the proxy protocol the request arrived on
+	Protocol Protocol
+	// HTTPRequest is the parsed request for HTTP proxy requests, nil otherwise
+	HTTPRequest *http.Request
+	// Context is cancelled once the client connection is torn down, with the
+	// reason reported by context.Cause
+	Context context.Context
 }
 
 // UserConnectHandler is a function type for handling CONNECT requests.
@@ -43,6 +154,15 @@ type UserConnectHandler func(request *ProxyRequest) error
 // UserAssociateHandler is a function type for handling UDP ASSOCIATE requests.
 type UserAssociateHandler func(request *ProxyRequest) error
 
+// UserBindHandler opens the listener for a SOCKS BIND request, on which the
+// server accepts the inbound connection from the request's destination.
+type UserBindHandler func(request *ProxyRequest) (net.Listener, error)
+
+// DatagramHandler inspects a datagram of a UDP associate session on its way
+// from src to dst. It returns the payload to relay in its place, or false to
+// drop the datagram.
+type DatagramHandler func(src net.Addr, dst net.Addr, payload []byte) ([]byte, bool)
+
 // ProxyDialFunc is a function type for establishing transport connections.
 type ProxyDialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
 
@@ -61,6 +181,10 @@ func DefaultProxyListenPacket() ProxyListenPacket {
 	return listener.ListenPacket
 }
 
+// TargetListenPacket is a function type for opening the packet connection
+// used to reach a specific UDP target.
+type TargetListenPacket func(ctx context.Context, network string, target string) (net.PacketConn, error)
+
 // PacketForwardAddress is a function type for forwarding packets and obtaining the local address.
 type PacketForwardAddress func(ctx context.Context, destinationAddr string,
 	packet net.PacketConn, conn net.Conn) (net.IP, int, error)
@@ -0,0 +1,84 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+var (
+	// ErrIdleTimeout is the cause of a request context cancelled because the
+	// client connection made no progress before its deadline.
+	ErrIdleTimeout = errors.New("connection idle timeout")
+	// ErrConnClosed is the cause of a request context cancelled because the
+	// client connection was closed.
+	ErrConnClosed = errors.New("connection closed")
+)
+
+// WatchTeardown sets the Context of req, derived from ctx, and wraps its
+// connection so the context is cancelled once the connection is torn down.
+// context.Cause then reports ErrIdleTimeout, ErrConnClosed, the failed read
+// or write, or the cause of ctx ending. The returned function cancels the
+// context once the request has been handled.
+func WatchTeardown(ctx context.Context, req *ProxyRequest) context.CancelFunc {
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	conn := &teardownConn{Conn: req.Conn, cancel: cancel}
+	if req.Reader == io.Reader(req.Conn) {
+		req.Reader = conn
+	}
+	if req.Writer == io.Writer(req.Conn) {
+		req.Writer = conn
+	}
+	req.Conn = conn
+	req.Context = reqCtx
+	return func() {
+		cancel(nil)
+	}
+}
+
+// teardownConn cancels a request context when its connection fails or closes.
+type teardownConn struct {
+	net.Conn
+	cancel context.CancelCauseFunc
+}
+
+// Read reads data from the connection, cancelling the context on failure.
+func (c *teardownConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.check(err)
+	return n, err
+}
+
+// Write writes data to the connection, cancelling the context on failure.
+func (c *teardownConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.check(err)
+	return n, err
+}
+
+// Close closes the connection and cancels the context.
+func (c *teardownConn) Close() error {
+	c.cancel(ErrConnClosed)
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *teardownConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// check cancels the context for errors that end the connection. EOF only
+// ends the client's side, so the handler may still write its response.
+func (c *teardownConn) check(err error) {
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		c.cancel(ErrIdleTimeout)
+	case errors.Is(err, net.ErrClosed):
+		c.cancel(ErrConnClosed)
+	default:
+		c.cancel(err)
+	}
+}
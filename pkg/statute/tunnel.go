@@ -2,12 +2,15 @@ package statute
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"os"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 )
 
 // isClosedConnError reports whether err is an error from the use of a closed
@@ -44,52 +47,205 @@ func errno(v error) uintptr {
 	return 0
 }
 
+type joinTunnelErrorsKey struct{}
+
+// ContextWithJoinedTunnelErrors returns a copy of ctx making Tunnel report
+// the errors of both directions and of closing them joined with errors.Join,
+// rather than only the first to occur, once both directions have ended. Set
+// as the Context of a server, it applies to all its tunnels.
+func ContextWithJoinedTunnelErrors(ctx context.Context) context.Context {
+	return context.WithValue(ctx, joinTunnelErrorsKey{}, true)
+}
+
+type closeGraceKey struct{}
+
+// ContextWithCloseGrace returns a copy of ctx making Tunnel flush in-flight
+// data for up to grace when ctx is cancelled: rather than closing both ends
+// at once, it finishes relaying what it has read, half-closes the ends
+// supporting CloseWrite so their peers see EOF after it, and drains what the
+// peers still send until they close or grace has passed, so no unread data
+// resets the connections. Zero or less closes at once.
+func ContextWithCloseGrace(ctx context.Context, grace time.Duration) context.Context {
+	if grace <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, closeGraceKey{}, grace)
+}
+
+// closeGraceFromContext returns the grace set by ContextWithCloseGrace, or 0.
+func closeGraceFromContext(ctx context.Context) time.Duration {
+	grace, _ := ctx.Value(closeGraceKey{}).(time.Duration)
+	return grace
+}
+
 // Tunnel creates bidirectional tunnels between two io.ReadWriteCloser instances.
+// If ctx carries a grace set by ContextWithCloseGrace, its cancellation lets
+// in-flight data flush before both ends are closed. The error returned is
+// the first to occur in either direction, unless ctx was made by
+// ContextWithJoinedTunnelErrors.
 func Tunnel(ctx context.Context, source, destination io.ReadWriteCloser, sourceBuffer, destinationBuffer []byte) error {
 	var errs tunnelErr
 
+	// the handshake is over once data flows both ways
+	for _, c := range []io.ReadWriteCloser{source, destination} {
+		if conn, ok := c.(net.Conn); ok {
+			EndHandshake(conn)
+		}
+	}
+
 	// Use the provided context directly
+	parent := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	var copies sync.WaitGroup
+	copies.Add(2)
 	go func() {
-		_, errs[0] = io.CopyBuffer(source, destination, sourceBuffer)
+		defer copies.Done()
+		_, err := io.CopyBuffer(source, destination, sourceBuffer)
+		errs.add(err)
 		cancel()
 	}()
 
 	go func() {
-		_, errs[1] = io.CopyBuffer(destination, source, destinationBuffer)
+		defer copies.Done()
+		_, err := io.CopyBuffer(destination, source, destinationBuffer)
+		errs.add(err)
 		cancel()
 	}()
 
 	<-ctx.Done()
 
+	if grace := closeGraceFromContext(parent); grace > 0 && parent.Err() != nil {
+		// the copies fail as the ends are half-closed, which is no error
+		errs.ignoreDrain()
+		drainTunnel(&copies, source, destination, grace)
+	}
+
 	// Close both source and destination, and check for errors
-	errs[2] = source.Close()
-	errs[3] = destination.Close()
-	errs[4] = ctx.Err()
+	errs.add(source.Close())
+	errs.add(destination.Close())
+	// closing both ends makes the other direction end, and the buffers are
+	// only free to reuse once it has
+	copies.Wait()
 
-	// If the context was canceled, set it to nil in the error slice
-	if errs[4] == context.Canceled {
-		errs[4] = nil
+	// If the context was canceled, it is no error
+	if err := ctx.Err(); err != context.Canceled {
+		errs.add(err)
 	}
 
-	// Return the first non-nil error, ignoring closed connection errors
+	if join, _ := parent.Value(joinTunnelErrorsKey{}).(bool); join {
+		return errs.Joined()
+	}
+	// Return the first error to occur, ignoring closed connection errors
 	return errs.FirstError()
 }
 
-// tunnelErr is a type that aggregates multiple errors.
-type tunnelErr [5]error
+// closeWriter is a connection that can be half-closed.
+type closeWriter interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// drainTunnel flushes a cancelled tunnel for up to grace: the copies stop
+// reading but finish writing what they have read, then both ends are
+// half-closed where they support it and what their peers still send is read
+// and discarded until they close. It returns when both ends are drained or
+// grace has passed, whichever is first.
+func drainTunnel(copies *sync.WaitGroup, source, destination io.ReadWriteCloser, grace time.Duration) {
+	ends := []io.ReadWriteCloser{source, destination}
+	deadline := time.Now().Add(grace)
+	for _, c := range ends {
+		conn, ok := c.(net.Conn)
+		if !ok {
+			continue
+		}
+		// an idle timeout would push the deadlines further with every read
+		if dc, ok := findConn[*DeadlineConn](conn); ok {
+			dc.Disable()
+		}
+		_ = conn.SetReadDeadline(time.Now())
+		_ = conn.SetWriteDeadline(deadline)
+	}
 
-// FirstError returns the first non-nil error, ignoring closed connection errors.
-func (t tunnelErr) FirstError() error {
-	for _, err := range t {
-		if err != nil {
-			if isClosedConnError(err) {
-				return nil
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		copies.Wait()
+		for _, c := range ends {
+			conn, ok := c.(net.Conn)
+			if !ok {
+				continue
+			}
+			if cw, ok := findConn[closeWriter](conn); ok {
+				_ = cw.CloseWrite()
 			}
-			return err
+			_ = conn.SetReadDeadline(deadline)
 		}
+		var drains sync.WaitGroup
+		for _, c := range ends {
+			drains.Add(1)
+			go func(c io.ReadWriteCloser) {
+				defer drains.Done()
+				_, _ = io.Copy(io.Discard, c)
+			}(c)
+		}
+		drains.Wait()
+	}()
+
+	// ends without deadlines are only stopped by closing them
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
 	}
-	return nil
+}
+
+// tunnelErr collects the errors of a tunnel in the order they occurred, so
+// the direction that failed first isn't masked by the other one failing as
+// the tunnel is torn down.
+type tunnelErr struct {
+	mu       sync.Mutex
+	errs     []error
+	draining bool // ignore the errors of draining the tunnel
+}
+
+// add records err, if any. Closed connection errors follow from the tunnel
+// being closed and are left out.
+func (t *tunnelErr) add(err error) {
+	if err == nil || isClosedConnError(err) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return
+	}
+	t.errs = append(t.errs, err)
+}
+
+// ignoreDrain leaves out the errors recorded from now on, which follow from
+// the tunnel being half-closed and drained.
+func (t *tunnelErr) ignoreDrain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+}
+
+// FirstError returns the first error to occur, or nil.
+func (t *tunnelErr) FirstError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.errs) == 0 {
+		return nil
+	}
+	return t.errs[0]
+}
+
+// Joined returns the errors joined in the order they occurred, or nil.
+func (t *tunnelErr) Joined() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return errors.Join(t.errs...)
 }
@@ -0,0 +1,215 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = dialed.Close()
+		_ = conn.Close()
+	})
+	return dialed, conn
+}
+
+func TestTunnelCloseGraceFlushes(t *testing.T) {
+	client, source := tcpPair(t)
+	destination, origin := tcpPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Tunnel(ContextWithCloseGrace(ctx, 5*time.Second), source, destination, make([]byte, 1024), make([]byte, 1024))
+	}()
+
+	if _, err := origin.Write([]byte("final")); err != nil {
+		t.Fatal(err)
+	}
+	// let the tunnel relay the data before it is cancelled
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	// both peers see the data relayed followed by EOF, not a reset
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if string(got) != "final" {
+		t.Fatalf("client got %q, want %q", got, "final")
+	}
+	_ = origin.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(origin); err != nil {
+		t.Fatalf("origin read: %v", err)
+	}
+
+	// the tunnel returns once both peers have closed, before the grace ends
+	start := time.Now()
+	_ = client.Close()
+	_ = origin.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Tunnel returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel didn't return once drained")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Tunnel returned after %v", elapsed)
+	}
+}
+
+func TestTunnelCloseGraceBounded(t *testing.T) {
+	_, source := tcpPair(t)
+	destination, _ := tcpPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Tunnel(ContextWithCloseGrace(ctx, 100*time.Millisecond), source, destination, make([]byte, 1024), make([]byte, 1024))
+	}()
+	cancel()
+
+	// peers that never close are cut off once the grace has passed
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel outlived its close grace")
+	}
+}
+
+// lingeringEnd is a tunnel end whose reads only fail once it's closed, and
+// still fill the buffer shortly after, as a read completing at close does.
+type lingeringEnd struct {
+	once     sync.Once
+	closed   chan struct{}
+	returned atomic.Bool
+}
+
+func (e *lingeringEnd) Read(p []byte) (int, error) {
+	<-e.closed
+	time.Sleep(20 * time.Millisecond)
+	p[0] = 1
+	e.returned.Store(true)
+	return 0, net.ErrClosed
+}
+
+func (e *lingeringEnd) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (e *lingeringEnd) Close() error {
+	e.once.Do(func() {
+		close(e.closed)
+	})
+	return nil
+}
+
+func TestTunnelWaitsForCopies(t *testing.T) {
+	pool := NewAdaptiveBytesPool()
+	buf1, buf2, release := TunnelBuffers(pool, 0, 0)
+
+	// pipes don't copy through their own buffers as TCP connections do
+	client, source := net.Pipe()
+	destination := &lingeringEnd{closed: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- Tunnel(context.Background(), source, destination, buf1, buf2)
+	}()
+	_ = client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Tunnel didn't return")
+	}
+	if !destination.returned.Load() {
+		t.Error("Tunnel returned while a copy was still using its buffer")
+	}
+
+	// the next tunnel reuses the buffers, which the race detector checks
+	clear(buf1)
+	clear(buf2)
+	release()
+}
+
+// failingEnd is a tunnel end whose reads fail with err, at once or, if wait
+// is set, only once it is closed.
+type failingEnd struct {
+	err    error
+	wait   bool
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newFailingEnd(err error, wait bool) *failingEnd {
+	return &failingEnd{err: err, wait: wait, closed: make(chan struct{})}
+}
+
+func (e *failingEnd) Read([]byte) (int, error) {
+	if e.wait {
+		<-e.closed
+	}
+	return 0, e.err
+}
+
+func (e *failingEnd) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (e *failingEnd) Close() error {
+	e.once.Do(func() {
+		close(e.closed)
+	})
+	return nil
+}
+
+func TestTunnelBothDirectionsFail(t *testing.T) {
+	errReset := errors.New("client reset the connection")
+	errTeardown := errors.New("read after teardown")
+	tunnel := func(ctx context.Context) error {
+		// the client fails first, the destination only as the tunnel is torn down
+		source := newFailingEnd(errReset, false)
+		destination := newFailingEnd(errTeardown, true)
+		return Tunnel(ctx, source, destination, make([]byte, 64), make([]byte, 64))
+	}
+
+	// the failure that ended the tunnel isn't masked by the one that followed
+	if err := tunnel(context.Background()); err != errReset {
+		t.Errorf("Tunnel() = %v, want %v", err, errReset)
+	}
+
+	err := tunnel(ContextWithJoinedTunnelErrors(context.Background()))
+	if !errors.Is(err, errReset) || !errors.Is(err, errTeardown) {
+		t.Errorf("Tunnel() = %v, want both errors joined", err)
+	}
+}
@@ -0,0 +1,63 @@
+package statute
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ConfigCheck collects the problems found while validating the configuration
+// of a server, so that all of them are reported at once.
+type ConfigCheck struct {
+	prefix string
+	errs   []error
+}
+
+// NewConfigCheck creates a ConfigCheck prefixing its errors with prefix,
+// usually the name of the package being validated.
+func NewConfigCheck(prefix string) *ConfigCheck {
+	return &ConfigCheck{prefix: prefix}
+}
+
+// Check records a problem described by format and args unless ok.
+func (c *ConfigCheck) Check(ok bool, format string, args ...any) {
+	if !ok {
+		c.errs = append(c.errs, fmt.Errorf(c.prefix+": "+format, args...))
+	}
+}
+
+// CheckAddr records a problem unless addr, the value of the setting name, is
+// a host:port address with a valid port. An empty address or host is allowed,
+// as net.Listen takes it for any address.
+func (c *ConfigCheck) CheckAddr(name, addr string) {
+	if addr == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		c.Check(false, "%s %q: %v", name, addr, err)
+		return
+	}
+	n, err := strconv.Atoi(port)
+	c.Check(err == nil && n >= 0 && n <= 65535, "%s %q: invalid port", name, addr)
+}
+
+// CheckDSCP records a problem unless dscp fits in the six DSCP bits.
+func (c *ConfigCheck) CheckDSCP(dscp int) {
+	if err := checkDSCP(dscp); err != nil {
+		c.Check(false, "%v", err)
+	}
+}
+
+// Add records err, which may wrap several problems, unless it is nil.
+func (c *ConfigCheck) Add(err error) {
+	if err != nil {
+		c.errs = append(c.errs, err)
+	}
+}
+
+// Err returns the problems recorded, joined, or nil if there are none.
+func (c *ConfigCheck) Err() error {
+	return errors.Join(c.errs...)
+}
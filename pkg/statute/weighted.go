@@ -0,0 +1,108 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// weightedFailureBackoff is how long an upstream that failed to dial is
+// skipped by WeightedDial while others are available.
+const weightedFailureBackoff = 30 * time.Second
+
+// WeightedDialer is an upstream of WeightedDial.
+type WeightedDialer struct {
+	Dial   ProxyDialFunc
+	Weight int
+}
+
+// WeightedDial returns a ProxyDialFunc spreading dials across entries by
+// smooth weighted round-robin, so each gets a share proportional to its
+// weight, e.g. to balance egress over several upstream proxies. Entries that
+// failed in the last 30 seconds are skipped while others are available, and a
+// failed dial moves on to the next entry. Entries with no positive weight are
+// never used. If all of them fail the errors are joined.
+func WeightedDial(entries []WeightedDialer) ProxyDialFunc {
+	w := &weightedDial{
+		entries:  entries,
+		current:  make([]int, len(entries)),
+		failedAt: make([]time.Time, len(entries)),
+	}
+	return w.dial
+}
+
+type weightedDial struct {
+	mu       sync.Mutex
+	entries  []WeightedDialer
+	current  []int
+	failedAt []time.Time
+}
+
+func (w *weightedDial) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	tried := make([]bool, len(w.entries))
+	var errs []error
+	for {
+		i := w.pick(tried)
+		if i < 0 {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		tried[i] = true
+		conn, err := w.entries[i].Dial(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		w.fail(i)
+		errs = append(errs, fmt.Errorf("dial %d: %w", i+1, err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("weighted dial: no dial functions")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// pick returns the next entry not tried yet, preferring the ones that didn't
+// fail recently, or -1 if none is left.
+func (w *weightedDial) pick(tried []bool) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if i := w.next(tried, func(i int) bool { return now.Sub(w.failedAt[i]) >= weightedFailureBackoff }); i >= 0 {
+		return i
+	}
+	// every upstream left failed recently, try them anyway
+	return w.next(tried, func(int) bool { return true })
+}
+
+// next advances the smooth weighted round-robin over the untried entries
+// accepted by usable.
+func (w *weightedDial) next(tried []bool, usable func(i int) bool) int {
+	best, total := -1, 0
+	for i, entry := range w.entries {
+		if tried[i] || entry.Weight <= 0 || entry.Dial == nil || !usable(i) {
+			continue
+		}
+		w.current[i] += entry.Weight
+		total += entry.Weight
+		if best < 0 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		w.current[best] -= total
+	}
+	return best
+}
+
+func (w *weightedDial) fail(i int) {
+	w.mu.Lock()
+	w.failedAt[i] = time.Now()
+	w.mu.Unlock()
+}
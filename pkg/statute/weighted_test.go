@@ -0,0 +1,41 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestWeightedDial(t *testing.T) {
+	counts := make([]int, 4)
+	counting := func(i int) ProxyDialFunc {
+		return func(context.Context, string, string) (net.Conn, error) {
+			counts[i]++
+			return nil, nil
+		}
+	}
+	failing := func(context.Context, string, string) (net.Conn, error) {
+		counts[3]++
+		return nil, errors.New("upstream down")
+	}
+	dial := WeightedDial([]WeightedDialer{
+		{Dial: counting(0), Weight: 3},
+		{Dial: counting(1), Weight: 1},
+		{Dial: counting(2), Weight: 0},
+		{Dial: failing, Weight: 4},
+	})
+
+	for i := 0; i < 40; i++ {
+		if _, err := dial(context.Background(), "tcp", "example.com:443"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the failed upstream is skipped once it failed, the rest share by weight
+	if counts[3] != 1 {
+		t.Errorf("failed upstream dialed %d times, want once", counts[3])
+	}
+	if counts[0] != 30 || counts[1] != 10 || counts[2] != 0 {
+		t.Errorf("dials spread %v over weights 3, 1 and 0, want 30, 10 and 0", counts[:3])
+	}
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package transparent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which shares
+// its value with IP6T_SO_ORIGINAL_DST.
+const soOriginalDst = 80
+
+// OriginalDestination returns the destination a connection was addressed to
+// before netfilter redirected it to the proxy.
+func OriginalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("original destination: connection exposes no socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := false
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			addr, sockErr = originalDestination6(int(fd))
+		} else {
+			addr, sockErr = originalDestination4(int(fd))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(sockErr, syscall.ENOENT) {
+		// no conntrack entry, the connection wasn't NATed to us
+		return nil, ErrNotRedirected
+	}
+	return addr, sockErr
+}
+
+// originalDestination4 reads the sockaddr_in returned by SO_ORIGINAL_DST. The
+// IPv6Mreq getter is only used because its buffer fits a sockaddr_in.
+func originalDestination4(fd int) (*net.TCPAddr, error) {
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	sa := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+		Port: int(sa[2])<<8 | int(sa[3]),
+	}, nil
+}
+
+// originalDestination6 reads the sockaddr_in6 returned by IP6T_SO_ORIGINAL_DST.
+func originalDestination6(fd int) (*net.TCPAddr, error) {
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	// Port holds the network byte order bytes as read from memory
+	var port [2]byte
+	binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+		Port: int(binary.BigEndian.Uint16(port[:])),
+	}, nil
+}
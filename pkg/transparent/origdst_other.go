@@ -0,0 +1,13 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDestination is only supported on Linux.
+func OriginalDestination(net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("original destination: not supported on this platform")
+}
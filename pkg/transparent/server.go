@@ -0,0 +1,566 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// ErrNotRedirected is returned when a connection's original destination is
+// the listener itself, i.e. it was not redirected to the proxy.
+var ErrNotRedirected = errors.New("connection was not redirected")
+
+// Server accepts connections redirected to it by the kernel (for example by
+// an iptables REDIRECT rule) and tunnels them to their original destination.
+type Server struct {
+	Bind              string
+	ProxyDial         statute.ProxyDialFunc
+	UserConnectHandle statute.UserConnectHandler
+	Logger            statute.Logger
+	Metrics           statute.Metrics
+	Context           context.Context
+	BytesPool         statute.BytesPool
+	// BlockPrivateRanges rejects destinations resolving to private addresses.
+	BlockPrivateRanges bool
+	// Resolver resolves destination names before dialing, nil passes names to ProxyDial.
+	Resolver statute.Resolver
+	// DSCP marks proxied traffic with the given DSCP value, zero leaves it unmarked.
+	DSCP int
+	// RequestInterceptors run on requests before the destination is dialed.
+	RequestInterceptors []statute.RequestInterceptor
+	// ConnLog receives a summary of every connection served.
+	ConnLog statute.ConnLogFunc
+	// HandlerErrorFilter reports user handler errors to leave out of the logs.
+	HandlerErrorFilter statute.HandlerErrorFilter
+	// Events receives connection open, close and error events, nil for none.
+	Events *statute.EventSink
+	// Stats counts the connections served, nil disables counting.
+	Stats *statute.StatsCollector
+	// ReadBufferSize and WriteBufferSize size the buffers for data read from and
+	// written to the client, zero takes them from BytesPool.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// TunnelKeepalive is the TCP keepalive interval of client and destination connections, zero leaves the default.
+	TunnelKeepalive time.Duration
+	// SocketRecvBuffer and SocketSendBuffer are the SO_RCVBUF and SO_SNDBUF
+	// sizes of client and destination connections, zero leaves the OS default.
+	SocketRecvBuffer int
+	SocketSendBuffer int
+	// MaxConnLifetime closes client connections this long after they were accepted, zero for no limit.
+	MaxConnLifetime time.Duration
+	// MuxHint detects multiplexed sessions from the first bytes of tunnels, to tune them, see statute.WatchMux.
+	MuxHint statute.MuxDetector
+	// CloseGrace bounds flushing tunnels once Context is cancelled before they are closed, zero closes them at once.
+	CloseGrace time.Duration
+	// AcceptRate and AcceptBurst pace the connections accepted by ListenAndServe to AcceptRate per
+	// second, in bursts of up to AcceptBurst, zero for no limit.
+	AcceptRate  int
+	AcceptBurst int
+	// RejectOverAcceptRate closes connections over AcceptRate rather than holding them back.
+	RejectOverAcceptRate bool
+	// Handshakes bounds the connections accepted by ListenAndServe that are negotiating at once, nil doesn't limit them.
+	Handshakes *statute.HandshakeLimiter
+	// ListenAddrs holds the addresses the server listens on, destinations reaching them are refused.
+	ListenAddrs *statute.ListenAddrs
+	// ReverseDNS looks up the names of client IPs for ConnLog, nil disables lookups.
+	ReverseDNS *statute.ReverseDNS
+	// ConnectTimeout bounds establishing connections to destinations, zero leaves them to the context.
+	ConnectTimeout time.Duration
+	// Netns is the path of the network namespace destinations are dialed from, empty for the current one.
+	Netns string
+	// DestinationClassifier labels metrics with the class of their destination.
+	DestinationClassifier statute.DestinationClassifier
+
+	draining atomic.Bool
+}
+
+// NewServer creates a new transparent proxy server with the provided options.
+func NewServer(options ...ServerOption) *Server {
+	s := &Server{
+		Bind:        statute.DefaultBindAddress,
+		ProxyDial:   statute.DefaultProxyDial(),
+		Logger:      statute.DefaultLogger{},
+		Metrics:     statute.DefaultMetrics{},
+		Context:     statute.DefaultContext(),
+		ListenAddrs: statute.NewListenAddrs(),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+// ServerOption is a functional option for configuring the Server.
+type ServerOption func(*Server)
+
+// WithBind sets the address the server listens on.
+func WithBind(bindAddress string) ServerOption {
+	return func(s *Server) {
+		s.Bind = bindAddress
+	}
+}
+
+// WithConnectHandle sets the handler for redirected connections.
+func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
+	return func(s *Server) {
+		s.UserConnectHandle = handler
+	}
+}
+
+// WithProxyDial sets the dial function used to reach original destinations.
+func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
+	return func(s *Server) {
+		s.ProxyDial = proxyDial
+	}
+}
+
+// WithLogger sets the logger.
+func WithLogger(logger statute.Logger) ServerOption {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+// WithMetrics sets the metrics sink.
+func WithMetrics(metrics statute.Metrics) ServerOption {
+	return func(s *Server) {
+		s.Metrics = metrics
+	}
+}
+
+// WithContext sets the default context.
+func WithContext(ctx context.Context) ServerOption {
+	return func(s *Server) {
+		s.Context = ctx
+	}
+}
+
+// WithBytesPool sets the bytes pool used by the tunnel.
+func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
+	return func(s *Server) {
+		s.BytesPool = bytesPool
+	}
+}
+
+// WithBlockPrivateRanges rejects destinations that resolve to loopback,
+// link-local, private or unique-local addresses.
+func WithBlockPrivateRanges(block bool) ServerOption {
+	return func(s *Server) {
+		s.BlockPrivateRanges = block
+	}
+}
+
+// WithResolver sets the resolver used to resolve destination names before dialing.
+func WithResolver(resolver statute.Resolver) ServerOption {
+	return func(s *Server) {
+		s.Resolver = resolver
+	}
+}
+
+// WithDSCP marks outbound and accepted sockets with the given DSCP value.
+func WithDSCP(value int) ServerOption {
+	return func(s *Server) {
+		s.DSCP = value
+	}
+}
+
+// WithRequestInterceptors adds interceptors run on requests before the destination is dialed.
+func WithRequestInterceptors(interceptors ...statute.RequestInterceptor) ServerOption {
+	return func(s *Server) {
+		s.RequestInterceptors = append(s.RequestInterceptors, interceptors...)
+	}
+}
+
+// WithReverseDNS records the reverse DNS name of client IPs in ConnLog summaries, see statute.ReverseDNS.
+func WithReverseDNS(enable bool) ServerOption {
+	return func(s *Server) {
+		s.ReverseDNS = nil
+		if enable {
+			s.ReverseDNS = statute.NewReverseDNS(nil)
+		}
+	}
+}
+
+// WithMuxHint detects tunnels carrying a multiplexed session, such as yamux
+// or smux, from the first bytes the client sends and tunes them with larger
+// socket buffers and no idle deadline, see statute.WatchMux.
+func WithMuxHint(detector statute.MuxDetector) ServerOption {
+	return func(s *Server) {
+		s.MuxHint = detector
+	}
+}
+
+// WithCloseGrace lets tunnels flush in-flight data for up to grace when the
+// server's context is cancelled: both ends are half-closed, so peers see EOF
+// after the data already relayed, and only closed once their peers have
+// closed too or after grace. Zero closes them at once.
+func WithCloseGrace(grace time.Duration) ServerOption {
+	return func(s *Server) {
+		s.CloseGrace = grace
+	}
+}
+
+// WithAcceptRateLimit paces accepted connections to perSec per second, in
+// bursts of up to burst.
+func WithAcceptRateLimit(perSec int, burst int) ServerOption {
+	return func(s *Server) {
+		s.AcceptRate = perSec
+		s.AcceptBurst = burst
+	}
+}
+
+// WithRejectOverAcceptRate closes connections over the rate set by
+// WithAcceptRateLimit at once rather than making them wait.
+func WithRejectOverAcceptRate(reject bool) ServerOption {
+	return func(s *Server) {
+		s.RejectOverAcceptRate = reject
+	}
+}
+
+// WithMaxConcurrentHandshakes bounds how many accepted connections are in
+// their handshake phase at once, from parsing the first bytes until the
+// tunnel starts or the connection is rejected. Connections beyond the limit
+// wait for a slot, protecting the server against handshake floods. Zero or
+// less doesn't limit them.
+func WithMaxConcurrentHandshakes(n int) ServerOption {
+	return func(s *Server) {
+		s.Handshakes = statute.NewHandshakeLimiter(n)
+	}
+}
+
+// WithMaxConnLifetime closes client connections lifetime after they were
+// accepted, even while they are actively transferring data.
+func WithMaxConnLifetime(lifetime time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxConnLifetime = lifetime
+	}
+}
+
+// WithSocketBuffers sets the receive and send socket buffer sizes of client
+// and destination connections. Zero leaves the OS default.
+func WithSocketBuffers(recv, send int) ServerOption {
+	return func(s *Server) {
+		s.SocketRecvBuffer = recv
+		s.SocketSendBuffer = send
+	}
+}
+
+// WithTunnelKeepalive enables TCP keepalive probes at the given interval on tunnels, see statute.KeepAliveDial.
+func WithTunnelKeepalive(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.TunnelKeepalive = interval
+	}
+}
+
+// WithNetns dials destinations from within the Linux network namespace at
+// path, such as /var/run/netns/egress, so proxied traffic exits through it
+// rather than the listener's namespace.
+func WithNetns(path string) ServerOption {
+	return func(s *Server) {
+		s.Netns = path
+	}
+}
+
+// WithDestinationClassifier labels connection metrics with the class
+// classify maps their destination host to. Without it metrics carry no
+// destination label.
+func WithDestinationClassifier(classify statute.DestinationClassifier) ServerOption {
+	return func(s *Server) {
+		s.DestinationClassifier = classify
+	}
+}
+
+// WithConnectTimeout bounds how long establishing a connection to a
+// destination may take, regardless of the deadline of the server context.
+func WithConnectTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ConnectTimeout = timeout
+	}
+}
+
+// WithBuffers sets the sizes of the buffers for data read from the client
+// (upload) and written to it (download), overriding BytesPool for that
+// direction. Zero keeps the default for a direction.
+func WithBuffers(readSize, writeSize int) ServerOption {
+	return func(s *Server) {
+		s.ReadBufferSize = readSize
+		s.WriteBufferSize = writeSize
+	}
+}
+
+// WithStats counts the connections served in stats, which may be shared
+// with other servers.
+func WithStats(stats *statute.StatsCollector) ServerOption {
+	return func(s *Server) {
+		s.Stats = stats
+	}
+}
+
+// WithEventChannel publishes connection open, close and error events on ch.
+// Events are dropped rather than blocking when ch is full.
+func WithEventChannel(ch chan<- statute.Event) ServerOption {
+	return func(s *Server) {
+		s.Events = statute.NewEventSink(ch)
+	}
+}
+
+// WithHandlerErrorFilter leaves errors returned by the user handler out of
+// the logs when filter reports them as expected.
+func WithHandlerErrorFilter(filter statute.HandlerErrorFilter) ServerOption {
+	return func(s *Server) {
+		s.HandlerErrorFilter = filter
+	}
+}
+
+// WithConnLog sets the callback receiving a summary of every connection served.
+func WithConnLog(connLog statute.ConnLogFunc) ServerOption {
+	return func(s *Server) {
+		s.ConnLog = connLog
+	}
+}
+
+// ListenAndServe starts accepting connections on the specified address.
+// It returns an error wrapping statute.ErrBindFailed if it can't listen, or
+// statute.ErrShutdown once the server's context is cancelled.
+func (s *Server) ListenAndServe() error {
+	s.Logger.Debug("Serving on " + s.Bind + " ...")
+
+	ln, err := statute.Listen("tcp", s.Bind)
+	if err != nil {
+		s.Logger.Error("Error listening on " + s.Bind + ", " + err.Error())
+		return statute.BindError(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	s.ListenAddrs.Add(ln.Addr())
+	defer s.ListenAddrs.Remove(ln.Addr())
+
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel()
+
+	// close the listener on cancellation so a blocked Accept returns
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	acceptRate := statute.NewAcceptRateLimiter(s.AcceptRate, s.AcceptBurst, s.RejectOverAcceptRate)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return statute.ShutdownError(ctx)
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return statute.AcceptError(err)
+			}
+			s.Logger.Error(err)
+			continue
+		}
+		if !acceptRate.Admit(ctx) {
+			s.Logger.Debug("accept rate exceeded, rejected connection from " + conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+		if s.DSCP != 0 {
+			if err := statute.SetDSCP(conn, s.DSCP); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.TunnelKeepalive > 0 {
+			if err := statute.SetKeepAlive(conn, s.TunnelKeepalive); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+		if s.SocketRecvBuffer > 0 || s.SocketSendBuffer > 0 {
+			if err := statute.SetSocketBuffers(conn, s.SocketRecvBuffer, s.SocketSendBuffer); err != nil {
+				s.Logger.Debug(err)
+			}
+		}
+
+		go func() {
+			limited, err := s.Handshakes.Begin(s.Context, conn)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			defer statute.EndHandshake(limited)
+
+			err = s.ServeConn(limited)
+			if err != nil {
+				statute.LogConnError(s.Logger, err, s.HandlerErrorFilter)
+			}
+		}()
+	}
+}
+
+// ActiveConnections returns the connections being served, as tracked by
+// Stats, or none if Stats is nil.
+func (s *Server) ActiveConnections() []statute.ConnInfo {
+	return s.Stats.Connections()
+}
+
+// SetDraining makes the server refuse new connections while it shuts down.
+func (s *Server) SetDraining(draining bool) {
+	s.draining.Store(draining)
+}
+
+// ServeConn tunnels a single redirected connection to its original
+// destination. conn must be the accepted connection itself, as the
+// destination is read from its socket.
+func (s *Server) ServeConn(conn net.Conn) error {
+	dest, err := OriginalDestination(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return s.ServeRedirected(conn, dest)
+}
+
+// ServeRedirected tunnels conn to dest, its original destination as returned
+// by OriginalDestination.
+func (s *Server) ServeRedirected(conn net.Conn, dest *net.TCPAddr) error {
+	stop := statute.LimitLifetime(conn, s.MaxConnLifetime)
+	defer stop()
+
+	if s.ConnLog == nil && s.Stats == nil && s.Events == nil {
+		return s.serveRedirected(conn, dest, nil)
+	}
+
+	tracker := s.Stats.Track(conn, statute.ProtocolTransparent)
+	tracker.Notify(s.Events)
+	tracker.ReverseLookup(s.ReverseDNS)
+	tracker.SetDestination(dest.String())
+	tracker.SetUserHandler(s.UserConnectHandle != nil)
+	err := s.serveRedirected(tracker.Conn(), dest, tracker)
+	tracker.Done(err, s.ConnLog)
+	return err
+}
+
+func (s *Server) serveRedirected(conn net.Conn, dest *net.TCPAddr, tracker *statute.ConnTracker) error {
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(dest.IP) && local.Port == dest.Port {
+		_ = conn.Close()
+		return ErrNotRedirected
+	}
+	// there is no reply to refuse a redirected connection with
+	if s.draining.Load() {
+		_ = conn.Close()
+		return statute.ErrDraining
+	}
+
+	proxyReq := &statute.ProxyRequest{
+		Conn:        conn,
+		Reader:      io.Reader(conn),
+		Writer:      io.Writer(conn),
+		Network:     "tcp",
+		Destination: dest.String(),
+		DestHost:    dest.IP.String(),
+		DestPort:    int32(dest.Port),
+		Protocol:    statute.ProtocolTransparent,
+	}
+
+	if len(s.RequestInterceptors) > 0 {
+		if err := statute.ApplyInterceptors(proxyReq, s.RequestInterceptors); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("request to %v rejected: %w", dest, err)
+		}
+		tracker.SetDestination(proxyReq.Destination)
+	}
+
+	if s.UserConnectHandle == nil {
+		return s.embedHandleConnect(conn, net.JoinHostPort(proxyReq.DestHost, strconv.Itoa(int(proxyReq.DestPort))))
+	}
+
+	// the handler may return without closing the client connection
+	defer func() {
+		_ = conn.Close()
+	}()
+	statute.EndHandshake(proxyReq.Conn)
+	cancel := statute.WatchTeardown(s.Context, proxyReq)
+	defer cancel()
+	return statute.WrapHandlerError(s.UserConnectHandle(proxyReq))
+}
+
+// embedHandleConnect is the default handler if UserConnectHandle is not set.
+func (s *Server) embedHandleConnect(conn net.Conn, destination string) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	dialStart := time.Now()
+	target, err := s.proxyDial()(s.Context, "tcp", destination)
+	if err != nil {
+		return fmt.Errorf("connect to %v failed: %w", destination, err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+
+	dialLatency := time.Since(dialStart)
+	labels := statute.MetricLabels("transparent", destination, s.DestinationClassifier)
+	s.Logger.Debug("dial", "protocol", "transparent", "destination", destination, "latency", dialLatency)
+	s.Metrics.ObserveDuration("dial_latency", dialLatency, labels...)
+	tracker := statute.ConnTrackerOf(conn)
+	tracker.SetDialLatency(dialLatency)
+	target = statute.NewFirstByteConn(target, func(ttfb time.Duration) {
+		s.Logger.Debug("first byte", "protocol", "transparent", "destination", destination, "ttfb", ttfb)
+		s.Metrics.ObserveDuration("ttfb", ttfb, labels...)
+		tracker.SetTTFB(ttfb)
+	})
+
+	buf1, buf2, release := statute.TunnelBuffers(s.BytesPool, s.ReadBufferSize, s.WriteBufferSize)
+	defer release()
+
+	clientConn := statute.WatchMux(conn, target, s.MuxHint, func() {
+		s.Logger.Debug("mux session detected", "protocol", "transparent", "destination", destination)
+	})
+	client := statute.NewCountingConn(clientConn)
+	defer func() {
+		s.Metrics.AddCount("bytes_up", client.BytesRead(), labels...)
+		s.Metrics.AddCount("bytes_down", client.BytesWritten(), labels...)
+		statute.HintBytesPool(s.BytesPool, max(client.BytesRead(), client.BytesWritten()))
+	}()
+	return statute.Tunnel(statute.ContextWithCloseGrace(s.Context, s.CloseGrace), target, client, buf1, buf2)
+}
+
+// proxyDial returns the dial function used by the embedded handler.
+func (s *Server) proxyDial() statute.ProxyDialFunc {
+	dial := statute.SelfDialGuard(s.ProxyDial, s.ListenAddrs)
+	if s.Netns != "" {
+		dial = statute.NetnsDial(dial, s.Netns)
+	}
+	if s.DSCP != 0 {
+		dial = statute.DSCPDial(dial, s.DSCP)
+	}
+	if s.TunnelKeepalive > 0 {
+		dial = statute.KeepAliveDial(dial, s.TunnelKeepalive)
+	}
+	if s.SocketRecvBuffer > 0 || s.SocketSendBuffer > 0 {
+		dial = statute.SocketBuffersDial(dial, s.SocketRecvBuffer, s.SocketSendBuffer)
+	}
+
+	resolver := s.Resolver
+	if s.BlockPrivateRanges {
+		if resolver == nil {
+			resolver = statute.DefaultResolver()
+		}
+		dial = statute.BlockPrivateDial(resolver, dial)
+	} else if resolver != nil {
+		dial = statute.ResolveDial(resolver, dial)
+	}
+
+	if s.ConnectTimeout > 0 {
+		dial = statute.TimeoutDial(dial, s.ConnectTimeout)
+	}
+	return dial
+}
@@ -0,0 +1,77 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+type quietLogger struct{}
+
+func (quietLogger) Debug(...interface{}) {}
+func (quietLogger) Error(...interface{}) {}
+
+// redirected returns both ends of a loopback connection to serve as if it
+// had been redirected.
+func redirected(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestServeRedirectedGuards(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	dest := target.Addr().(*net.TCPAddr)
+
+	tests := []struct {
+		name    string
+		options []ServerOption
+		want    error
+	}{
+		{"block private", []ServerOption{WithBlockPrivateRanges(true)}, statute.ErrBlockedDestination},
+		{"interceptor", []ServerOption{WithRequestInterceptors(func(*statute.ProxyRequest) error {
+			return statute.ErrBlockedDestination
+		})}, statute.ErrBlockedDestination},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(quietLogger{}), WithContext(context.Background())}, tt.options...)...)
+			_, conn := redirected(t)
+			if err := s.ServeRedirected(conn, dest); !errors.Is(err, tt.want) {
+				t.Fatalf("ServeRedirected = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("draining", func(t *testing.T) {
+		s := NewServer(WithLogger(quietLogger{}))
+		s.SetDraining(true)
+		_, conn := redirected(t)
+		if err := s.ServeRedirected(conn, dest); !errors.Is(err, statute.ErrDraining) {
+			t.Fatalf("ServeRedirected = %v, want %v", err, statute.ErrDraining)
+		}
+	})
+}
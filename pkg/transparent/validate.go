@@ -0,0 +1,24 @@
+package transparent
+
+import (
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Validate checks the assembled configuration of the server without serving,
+// returning every problem found joined in one error, or nil.
+func (s *Server) Validate() error {
+	c := statute.NewConfigCheck("transparent")
+	c.CheckAddr("Bind", s.Bind)
+	c.Check(s.ProxyDial != nil, "ProxyDial is nil")
+	c.Check(s.Logger != nil, "Logger is nil")
+	c.Check(s.Metrics != nil, "Metrics is nil")
+	c.Check(s.Context != nil, "Context is nil")
+	c.Check(s.ReadBufferSize >= 0, "ReadBufferSize is negative")
+	c.Check(s.WriteBufferSize >= 0, "WriteBufferSize is negative")
+	c.Check(s.SocketRecvBuffer >= 0, "SocketRecvBuffer is negative")
+	c.Check(s.SocketSendBuffer >= 0, "SocketSendBuffer is negative")
+	c.Check(s.TunnelKeepalive >= 0, "TunnelKeepalive is negative")
+	c.Check(s.MaxConnLifetime >= 0, "MaxConnLifetime is negative")
+	c.Check(s.ConnectTimeout >= 0, "ConnectTimeout is negative")
+	return c.Err()
+}